@@ -14,8 +14,9 @@
 
 /*
 nftdump dumps netfilter tables with their chains, rules, and down to the level
-of expressions. The netfilter dump can be reduced to specific table families and
-table names only.
+of expressions. Rules are annotated with their decoded statements, such as
+counters, logging, NAT, and verdicts. The netfilter dump can be reduced to
+specific table families and table names only.
 */
 package main
 
@@ -29,6 +30,7 @@ import (
 	"github.com/spf13/cobra"
 	"github.com/thediveo/enumflag/v2"
 	"github.com/thediveo/nufftables"
+	"github.com/thediveo/nufftables/dsl"
 	"golang.org/x/exp/maps"
 	"golang.org/x/exp/slices"
 )
@@ -118,6 +120,9 @@ func dumpTables(cmd *cobra.Command, _ []string) error {
 			fmt.Println(s)
 			for _, rule := range chain.Rules {
 				fmt.Printf("    RULE HANDLE %d POS %d \n", rule.Handle, rule.Position)
+				for _, stmt := range dsl.DecodeStatements(table.Family, rule.Expressions()) {
+					fmt.Printf("      STMT %s\n", stmt)
+				}
 				for _, expr := range rule.Exprs {
 					fmt.Println(indentLines(strings.TrimRight(fmt.Sprintf("EXPR %s", exprForm.Sdump(expr)), "\n"), 6))
 				}
@@ -13,10 +13,30 @@
 // under the License.
 
 /*
-portfinder lists forwarded ports found in "nat" netfilter tables for the IPv4
-and IPv6 families. Forwarded ports are detected only in form of rules with port
-range and target DNAT expressions, as well as an optional IP address compare
-expression.
+portfinder lists forwarded ports found in the “nat” type base chains hooked at
+prerouting or output, as well as in the chains reachable from these base
+chains, regardless of table names. Only forwarded ports actually reachable
+are listed, unless dead forwarded ports are requested too. By default, the
+tables of the IPv4, IPv6, and inet families are scanned; the scan can be
+restricted to specific table families and table names.
+
+Forwarded ports are detected in form of rules with port range and target DNAT
+expressions, as well as an optional IP address compare expression, as created
+by iptables-nft. Additionally, native nft rules with a destination port match
+and a dnat statement are detected. Load-balanced forwarded ports, using
+statistic matches or number generator and hash maps, are listed once with all
+their endpoints and their shares of the traffic. Forwarded ports managed by
+Docker, the CNI portmap plugin, netavark, or libvirt are attributed to their
+tools, including network names and container IDs where available.
+
+Optionally, redirections to local ports using REDIRECT and TPROXY targets or
+redir and tproxy statements are listed too, together with the exclusions of
+earlier rules, such as the socket owner exclusions of service mesh sidecars.
+Egress NAT, that is, masquerading and SNAT in postrouting chains, can be listed
+as well, telling which source networks get translated to which addresses on
+which output interfaces. Finally, forwarded ports can be checked against the
+forward filter chains, telling whether the forwarded traffic is open, blocked,
+or conditional, together with the deciding rule.
 */
 package main
 
@@ -29,20 +49,22 @@ import (
 	"github.com/thediveo/enumflag/v2"
 	"github.com/thediveo/nufftables"
 	"github.com/thediveo/nufftables/portfinder"
+	"golang.org/x/exp/maps"
 	"golang.org/x/exp/slices"
 )
 
 // TableFamilies maps netfilter table families (or more precise: the IP protocol
 // families) to their textual representations.
 var TableFamilies = map[nufftables.TableFamily][]string{
+	nufftables.TableFamilyINet: {"inet"},
 	nufftables.TableFamilyIPv4: {"IPv4", "v4"},
 	nufftables.TableFamilyIPv6: {"IPv6", "v6"},
 }
 
-// dumpTableFamilies receives the table families to scan for "nat" table port
-// forwarding expressions.
+// dumpTableFamilies receives the table families to scan for port forwarding
+// expressions.
 var dumpTableFamilies = []nufftables.TableFamily{
-	nufftables.TableFamilyIPv4, nufftables.TableFamilyIPv6,
+	nufftables.TableFamilyIPv4, nufftables.TableFamilyIPv6, nufftables.TableFamilyINet,
 }
 
 func dumpForwardedPorts(cmd *cobra.Command, _ []string) error {
@@ -52,30 +74,43 @@ func dumpForwardedPorts(cmd *cobra.Command, _ []string) error {
 	}
 	defer func() { _ = conn.CloseLasting() }()
 
-	fps := []*portfinder.ForwardedPortRange{}
+	tables := nufftables.TableMap{}
 	for _, fam := range dumpTableFamilies {
-		iptables, err := nufftables.GetFamilyTables(conn, fam)
+		famTables, err := nufftables.GetFamilyTables(conn, fam)
 		if err != nil {
-			panic(err)
+			return fmt.Errorf("cannot query netfilter tables, reason: %w", err)
+		}
+		maps.Copy(tables, famTables)
+	}
+	if tablenames, _ := cmd.PersistentFlags().GetStringSlice("table"); len(tablenames) != 0 {
+		maps.DeleteFunc(tables, func(key nufftables.TableKey, _ *nufftables.Table) bool {
+			return !slices.Contains(tablenames, key.Name)
+		})
+	}
+
+	if redirects, _ := cmd.PersistentFlags().GetBool("redirects"); redirects {
+		for _, r := range portfinder.Redirections(tables) {
+			fmt.Printf("%s\n", r.String())
 		}
-		table := iptables.Table("nat", fam)
-		if table == nil {
-			continue
+	}
+	if egress, _ := cmd.PersistentFlags().GetBool("egress"); egress {
+		for _, e := range portfinder.EgressNATs(tables) {
+			fmt.Printf("%s\n", e.String())
 		}
-		for _, chain := range table.ChainsByName {
-			for _, rule := range chain.Rules {
-				fp := portfinder.ForwardedPort(rule)
-				if fp == nil {
-					continue
-				}
-				fps = append(fps, fp)
-			}
+	}
+	if all, _ := cmd.PersistentFlags().GetBool("all"); all {
+		for _, fwd := range portfinder.AnalyzeForwards(tables) {
+			fmt.Printf("%s\n", fwd.String())
 		}
+		return nil
 	}
-
-	slices.SortFunc(fps, portfinder.ForwardedPortOrder)
-
-	for _, fp := range fps {
+	if check, _ := cmd.PersistentFlags().GetBool("check"); check {
+		for _, c := range portfinder.CheckForwards(tables) {
+			fmt.Printf("%s\n", c.String())
+		}
+		return nil
+	}
+	for _, fp := range portfinder.ForwardedPorts(tables) {
 		fmt.Printf("%s\n", fp.String())
 	}
 	return nil
@@ -84,7 +119,7 @@ func dumpForwardedPorts(cmd *cobra.Command, _ []string) error {
 func newRootCmd() (rootCmd *cobra.Command) {
 	rootCmd = &cobra.Command{
 		Use:     "forwardedports",
-		Short:   "forwardedports lists forwarded ports from the \"nat\" netfilter tables",
+		Short:   "forwardedports lists forwarded ports from the netfilter NAT chains",
 		Version: "omicron",
 		Args:    cobra.NoArgs,
 		RunE:    dumpForwardedPorts,
@@ -93,8 +128,20 @@ func newRootCmd() (rootCmd *cobra.Command) {
 	rootCmd.PersistentFlags().VarP(
 		enumflag.NewSlice(&dumpTableFamilies, "TableFamily",
 			TableFamilies, enumflag.EnumCaseInsensitive),
-		"family", "f", "table family, any combination of 'v4' and 'v6'")
-	rootCmd.PersistentFlags().Lookup("family").DefValue = "v4,v6"
+		"family", "f", "table family, any combination of 'inet', 'v4' and 'v6'")
+	rootCmd.PersistentFlags().Lookup("family").DefValue = "v4,v6,inet"
+	rootCmd.PersistentFlags().StringSliceP("table", "t", []string{},
+		"list of table names to restrict scan to")
+	rootCmd.PersistentFlags().BoolP("all", "a", false,
+		"also list dead forwarded ports that are shadowed or unreachable")
+	rootCmd.PersistentFlags().BoolP("redirects", "r", false,
+		"also list redirections and transparent proxying to local ports")
+	rootCmd.PersistentFlags().BoolP("egress", "e", false,
+		"also list masquerading and source NAT of outgoing traffic")
+	rootCmd.PersistentFlags().BoolP("check", "c", false,
+		"check forwarded ports against the forward filter chains")
+	// Dead forwarded ports never pass the forward filter chains anyway.
+	rootCmd.MarkFlagsMutuallyExclusive("all", "check")
 	return
 }
 
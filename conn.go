@@ -0,0 +1,43 @@
+// Copyright 2023 Harald Albrecht.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy
+// of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package nufftables
+
+import (
+	"github.com/google/nftables"
+)
+
+// Conn represents the listing operations nufftables needs in order to retrieve
+// netfilter tables, chains, rules, and sets. [*nftables.Conn] satisfies this
+// interface, as does the in-memory [MemConn].
+type Conn interface {
+	// ListTables returns all tables, regardless of their family.
+	ListTables() ([]*nftables.Table, error)
+	// ListChains returns all chains in all tables, regardless of their table
+	// family.
+	ListChains() ([]*nftables.Chain, error)
+	// ListChainsOfTableFamily returns all chains in tables of the specified
+	// family; it returns all chains if the family is
+	// [nftables.TableFamilyUnspecified].
+	ListChainsOfTableFamily(family nftables.TableFamily) ([]*nftables.Chain, error)
+	// GetRules returns the rules of the specified table and chain.
+	GetRules(table *nftables.Table, chain *nftables.Chain) ([]*nftables.Rule, error)
+	// GetSets returns the named and anonymous sets (including maps) of the
+	// specified table.
+	GetSets(table *nftables.Table) ([]*nftables.Set, error)
+	// GetSetElements returns the elements of the specified set.
+	GetSetElements(set *nftables.Set) ([]nftables.SetElement, error)
+}
+
+var _ Conn = (*nftables.Conn)(nil)
@@ -10,13 +10,23 @@ nufftables' information model is basically that of netfilter and Google's
 nftables information model in particular, but with the hierarchy added in
 explicitly.
 
-  - [Table] wraps [nftables.Table] and references all [Chain] objects belonging
-    to this table by name.
+  - [Table] wraps [nftables.Table] and references all [Chain] and [Set] objects
+    belonging to this table by name.
   - [Chain] wraps [nftables.Chain] and contains all [Rule] objects for a
     particular chain, sorted by their [nftables.Rule.Position]. It also
     references its containing table.
   - [Rule] wraps [nftables.Rule] with its [Expressions]. Rules reference the
     [Chain] they are contained in.
+  - [Set] wraps [nftables.Set] with its elements, including anonymous sets and
+    maps. Sets reference the [Table] they are contained in.
+
+# Connections
+
+[GetAllTables] and [GetFamilyTables] retrieve tables, chains, and rules using
+any [Conn]. Usually, this will be a [*nftables.Conn] talking to the kernel.
+For unit testing without root privileges, network namespaces, or a kernel, a
+[MemConn] can be populated programmatically with tables, chains, rules, and
+sets instead.
 
 # Reasoning About Expressions
 
@@ -52,7 +62,11 @@ remaining expressions, or simply a nil match with nil expressions.
 
 These basic building blocks allow to assemble a DSL for netfilter table
 expression reasoning, and to finally build high-level functions on top of this
-all. Please see the [github.com/thediveo/nufftables/dsl] and
+all. Instead of hand-chaining these building blocks, the
+[github.com/thediveo/nufftables/pattern] package allows to declaratively
+describe whole sequences of expressions, including optional, alternative,
+repeated, and absent expressions, returning all named captures in one go.
+Please see the [github.com/thediveo/nufftables/dsl] and
 [github.com/thediveo/nufftables/portfinder] packages for more details.
 
 [google/nftables]: https://github.com/google/nftables
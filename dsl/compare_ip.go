@@ -25,6 +25,9 @@ import (
 // nil. It either returns the remaining expressions or the original expressions
 // if no IP compare expression could be found. IP here refers to both IPv4 and
 // IPv6.
+//
+// OptionalCompareIP doesn't check which address has been loaded for comparison;
+// please use [OptionalMatchAddr] to tell source from destination addresses.
 func OptionalCompareIP(exprs nufftables.Expressions) (nufftables.Expressions, net.IP) {
 	remexprs, cmp := nufftables.OptionalOfTypeFunc(exprs, isCompareIPExpression)
 	if cmp == nil {
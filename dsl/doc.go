@@ -1,4 +1,63 @@
 /*
 Package dsl helps with reasoning about rule expressions.
+
+Rule expressions are basically register machine code: expressions load packet
+data, meta and conntrack information, et cetera, into registers, transform the
+register contents, and finally compare the register contents. [Lift] follows
+the register dataflow through the expressions of a rule and lifts them into
+typed [Predicate] match conditions and [Statement] objects, similar to what nft
+does when listing rules. This way, predicates know which field they are
+actually matching, so a source address can be told apart from a destination
+address.
+
+[PayloadField] and [FieldByName] map between payload expressions and named
+protocol header fields, such as “ip saddr” and “tcp dport”, and
+[Field.Decode] decodes field values into typed values, such as [netip.Addr].
+[LiftedRule.PredicatesOf] then finds the predicates of a lifted rule matching
+a particular field by its name, resolving payload dependencies on the network
+and transport protocols the same way nft does.
+
+Building on lifted rules, [MatchAddr] and [MatchPort] decode address and port
+matches into [AddrMatch] and [PortMatch] descriptions, regardless of whether
+they have been expressed natively or using xt match extensions.
+
+For rules created by iptables-nft, [DecodeXtMatch] decodes the commonly used
+xt match extensions into structured information, such as [ConntrackMatch],
+[AddrTypeMatch], [MarkMatch], [LimitMatch], [PhysdevMatch], [IPSetMatch],
+[StatisticMatch], and [OwnerMatch]. Specific functions such as [MatchConntrack] and [MatchComment]
+return the information of the first such match extension, together with the
+remaining expressions. [RuleComment] returns the comment of a rule, regardless
+of whether it is stored in the rule's user data or an xt “comment” match.
+
+[TargetNAT] decodes the xt NAT targets as well as native nat, masq, and redir
+statements into a common [NAT] description, and [TargetTProxy] the xt
+“TPROXY” target and native tproxy statements into a [TProxy] description,
+while [TerminalVerdict] and [RuleVerdict] return the [Verdict] of a rule, such
+as accept, drop, reject, jump, or a verdict map lookup.
+
+[MatchIface], [MatchMeta], and [MatchCt] decode interface (wildcard) matches,
+as well as meta and conntrack matches including their bit masks.
+[OwnerMatches] returns the socket owner matches, regardless of whether they
+are expressed using the xt “owner” match or “meta skuid” and “meta skgid”.
+
+For the arp, bridge, and netdev families, [MatchField] and [FieldMatches]
+decode matches of arbitrary protocol header fields, such as Ethernet
+addresses, VLAN IDs, and ARP operations ([ArpOp]) and addresses. The ebtables
+extensions emitted by ebtables-nft are decoded into [Ether8023Match],
+[EtherMarkMatch], and [AmongMatch], as well as [EtherNAT] for the “snat”,
+“dnat”, and “redirect” targets.
+
+Finally, [DecodeStatements] returns typed descriptions of all statements of a
+rule, such as [CounterStatement], [LogStatement], [LimitStatement],
+[QuotaStatement], [SetUpdateStatement], and [MarkStatement], as well as NAT
+and verdicts.
+
+For verdict maps, such as “ip daddr . tcp dport vmap @service-ips”,
+[RuleDispatchTable] resolves the map in the loaded model into a
+[DispatchTable], splitting concatenated keys into their individual fields and
+resolving the jump and goto target chains. [ResolveSpread] resolves map
+lookups keyed by number generators and hashes, such as “dnat to numgen inc mod
+2 map { 0 : 10.0.0.1, 1 : 10.0.0.2 }”, into the map data with their share of
+the traffic.
 */
 package dsl
@@ -0,0 +1,466 @@
+// Copyright 2023 Harald Albrecht.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy
+// of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package dsl
+
+import (
+	"bytes"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"golang.org/x/sys/unix"
+)
+
+// FieldType specifies how to decode the value of a protocol header [Field].
+type FieldType int
+
+// Types of protocol header fields.
+const (
+	FieldInteger   FieldType = iota // big-endian unsigned integer, decoded as uint64.
+	FieldIPv4Addr                   // IPv4 address, decoded as netip.Addr.
+	FieldIPv6Addr                   // IPv6 address, decoded as netip.Addr.
+	FieldEtherAddr                  // Ethernet MAC address, decoded as net.HardwareAddr.
+	FieldPort                       // transport port, decoded as uint16.
+	FieldProtocol                   // IP protocol number, decoded as uint8.
+	FieldEtherType                  // Ethernet type, decoded as uint16.
+	FieldDSCP                       // differentiated services code point, decoded as uint8.
+	FieldTCPFlags                   // TCP flags, decoded as TCPFlags.
+	FieldArpOp                      // ARP operation, decoded as ArpOp.
+)
+
+// Field describes a named protocol header field, such as “ip saddr” or “tcp
+// dport”, in terms of the payload base, offset, and length used by
+// [*expr.Payload] expressions to load the field into a register.
+type Field struct {
+	Protocol string // protocol name, such as "ip", "ip6", "tcp", "ether", et cetera.
+	Name     string // field name, such as "saddr", "dport", et cetera.
+	Base     expr.PayloadBase
+	Offset   uint32 // in bytes.
+	Len      uint32 // in bytes.
+	// Mask is non-nil for fields that don't start or end at byte boundaries
+	// and thus need to be masked using [*expr.Bitwise]; Shift is the number of
+	// bits to shift the masked value to the right.
+	Mask  []byte
+	Shift uint
+	Type  FieldType
+}
+
+// String returns the field name in nft notation, such as “ip saddr”.
+func (f *Field) String() string {
+	return f.Protocol + " " + f.Name
+}
+
+// Decode returns the typed value of the specified field data, or nil if the
+// data doesn't fit this field.
+func (f *Field) Decode(data []byte) any {
+	if len(data) < int(f.Len) {
+		return nil
+	}
+	data = data[:f.Len]
+	switch f.Type {
+	case FieldIPv4Addr, FieldIPv6Addr:
+		addr, ok := netip.AddrFromSlice(data)
+		if !ok {
+			return nil
+		}
+		return addr
+	case FieldEtherAddr:
+		return net.HardwareAddr(append([]byte(nil), data...))
+	}
+	val := f.value(data)
+	switch f.Type {
+	case FieldPort, FieldEtherType:
+		return uint16(val)
+	case FieldProtocol, FieldDSCP:
+		return uint8(val)
+	case FieldTCPFlags:
+		return TCPFlags(val)
+	case FieldArpOp:
+		return ArpOp(val)
+	}
+	return val
+}
+
+// value returns the big-endian unsigned integer value of the specified data,
+// masked and shifted as required by this field.
+func (f *Field) value(data []byte) uint64 {
+	var val uint64
+	for idx, b := range data {
+		if f.Mask != nil && idx < len(f.Mask) {
+			b &= f.Mask[idx]
+		}
+		val = val<<8 | uint64(b)
+	}
+	return val >> f.Shift
+}
+
+// TCPFlags are the flags of a TCP header.
+type TCPFlags uint8
+
+// TCP header flags.
+const (
+	TCPFlagFIN TCPFlags = 1 << iota
+	TCPFlagSYN
+	TCPFlagRST
+	TCPFlagPSH
+	TCPFlagACK
+	TCPFlagURG
+	TCPFlagECE
+	TCPFlagCWR
+)
+
+var tcpFlagNames = []string{"fin", "syn", "rst", "psh", "ack", "urg", "ecn", "cwr"}
+
+// String returns the TCP flags in nft notation, such as “syn|ack”.
+func (f TCPFlags) String() string {
+	names := []string{}
+	for bit, name := range tcpFlagNames {
+		if f&(1<<bit) != 0 {
+			names = append(names, name)
+		}
+	}
+	return strings.Join(names, "|")
+}
+
+// ArpOp is the operation of an ARP (or RARP, InARP) packet.
+type ArpOp uint16
+
+// ARP operations.
+const (
+	ArpOpRequest   ArpOp = 1
+	ArpOpReply     ArpOp = 2
+	ArpOpRRequest  ArpOp = 3
+	ArpOpRReply    ArpOp = 4
+	ArpOpInRequest ArpOp = 8
+	ArpOpInReply   ArpOp = 9
+	ArpOpNAK       ArpOp = 10
+)
+
+var arpOpNames = map[ArpOp]string{
+	ArpOpRequest:   "request",
+	ArpOpReply:     "reply",
+	ArpOpRRequest:  "rrequest",
+	ArpOpRReply:    "rreply",
+	ArpOpInRequest: "inrequest",
+	ArpOpInReply:   "inreply",
+	ArpOpNAK:       "nak",
+}
+
+// String returns the ARP operation in nft notation, such as “request”, or
+// its number if unknown.
+func (op ArpOp) String() string {
+	if name, ok := arpOpNames[op]; ok {
+		return name
+	}
+	return strconv.FormatUint(uint64(op), 10)
+}
+
+// Protocol header fields, organized by payload base and by the protocol (or
+// address family) a particular payload base refers to.
+var (
+	linkFields = []Field{
+		{Protocol: "ether", Name: "daddr", Base: expr.PayloadBaseLLHeader, Offset: 0, Len: 6, Type: FieldEtherAddr},
+		{Protocol: "ether", Name: "saddr", Base: expr.PayloadBaseLLHeader, Offset: 6, Len: 6, Type: FieldEtherAddr},
+		{Protocol: "ether", Name: "type", Base: expr.PayloadBaseLLHeader, Offset: 12, Len: 2, Type: FieldEtherType},
+		{Protocol: "vlan", Name: "pcp", Base: expr.PayloadBaseLLHeader, Offset: 14, Len: 1, Mask: []byte{0xe0}, Shift: 5},
+		{Protocol: "vlan", Name: "dei", Base: expr.PayloadBaseLLHeader, Offset: 14, Len: 1, Mask: []byte{0x10}, Shift: 4},
+		{Protocol: "vlan", Name: "id", Base: expr.PayloadBaseLLHeader, Offset: 14, Len: 2, Mask: []byte{0x0f, 0xff}},
+		{Protocol: "vlan", Name: "type", Base: expr.PayloadBaseLLHeader, Offset: 16, Len: 2, Type: FieldEtherType},
+	}
+
+	ipFields = []Field{
+		{Protocol: "ip", Name: "dscp", Base: expr.PayloadBaseNetworkHeader, Offset: 1, Len: 1, Mask: []byte{0xfc}, Shift: 2, Type: FieldDSCP},
+		{Protocol: "ip", Name: "ecn", Base: expr.PayloadBaseNetworkHeader, Offset: 1, Len: 1, Mask: []byte{0x03}},
+		{Protocol: "ip", Name: "length", Base: expr.PayloadBaseNetworkHeader, Offset: 2, Len: 2},
+		{Protocol: "ip", Name: "id", Base: expr.PayloadBaseNetworkHeader, Offset: 4, Len: 2},
+		{Protocol: "ip", Name: "ttl", Base: expr.PayloadBaseNetworkHeader, Offset: 8, Len: 1},
+		{Protocol: "ip", Name: "protocol", Base: expr.PayloadBaseNetworkHeader, Offset: 9, Len: 1, Type: FieldProtocol},
+		{Protocol: "ip", Name: "checksum", Base: expr.PayloadBaseNetworkHeader, Offset: 10, Len: 2},
+		{Protocol: "ip", Name: "saddr", Base: expr.PayloadBaseNetworkHeader, Offset: 12, Len: 4, Type: FieldIPv4Addr},
+		{Protocol: "ip", Name: "daddr", Base: expr.PayloadBaseNetworkHeader, Offset: 16, Len: 4, Type: FieldIPv4Addr},
+	}
+
+	ip6Fields = []Field{
+		{Protocol: "ip6", Name: "dscp", Base: expr.PayloadBaseNetworkHeader, Offset: 0, Len: 2, Mask: []byte{0x0f, 0xc0}, Shift: 6, Type: FieldDSCP},
+		{Protocol: "ip6", Name: "flowlabel", Base: expr.PayloadBaseNetworkHeader, Offset: 1, Len: 3, Mask: []byte{0x0f, 0xff, 0xff}},
+		{Protocol: "ip6", Name: "length", Base: expr.PayloadBaseNetworkHeader, Offset: 4, Len: 2},
+		{Protocol: "ip6", Name: "nexthdr", Base: expr.PayloadBaseNetworkHeader, Offset: 6, Len: 1, Type: FieldProtocol},
+		{Protocol: "ip6", Name: "hoplimit", Base: expr.PayloadBaseNetworkHeader, Offset: 7, Len: 1},
+		{Protocol: "ip6", Name: "saddr", Base: expr.PayloadBaseNetworkHeader, Offset: 8, Len: 16, Type: FieldIPv6Addr},
+		{Protocol: "ip6", Name: "daddr", Base: expr.PayloadBaseNetworkHeader, Offset: 24, Len: 16, Type: FieldIPv6Addr},
+	}
+
+	arpFields = []Field{
+		{Protocol: "arp", Name: "htype", Base: expr.PayloadBaseNetworkHeader, Offset: 0, Len: 2},
+		{Protocol: "arp", Name: "ptype", Base: expr.PayloadBaseNetworkHeader, Offset: 2, Len: 2, Type: FieldEtherType},
+		{Protocol: "arp", Name: "hlen", Base: expr.PayloadBaseNetworkHeader, Offset: 4, Len: 1},
+		{Protocol: "arp", Name: "plen", Base: expr.PayloadBaseNetworkHeader, Offset: 5, Len: 1},
+		{Protocol: "arp", Name: "operation", Base: expr.PayloadBaseNetworkHeader, Offset: 6, Len: 2, Type: FieldArpOp},
+		{Protocol: "arp", Name: "saddr ether", Base: expr.PayloadBaseNetworkHeader, Offset: 8, Len: 6, Type: FieldEtherAddr},
+		{Protocol: "arp", Name: "saddr ip", Base: expr.PayloadBaseNetworkHeader, Offset: 14, Len: 4, Type: FieldIPv4Addr},
+		{Protocol: "arp", Name: "daddr ether", Base: expr.PayloadBaseNetworkHeader, Offset: 18, Len: 6, Type: FieldEtherAddr},
+		{Protocol: "arp", Name: "daddr ip", Base: expr.PayloadBaseNetworkHeader, Offset: 24, Len: 4, Type: FieldIPv4Addr},
+	}
+
+	transportFields = map[uint8][]Field{
+		unix.IPPROTO_TCP: {
+			{Protocol: "tcp", Name: "sport", Base: expr.PayloadBaseTransportHeader, Offset: 0, Len: 2, Type: FieldPort},
+			{Protocol: "tcp", Name: "dport", Base: expr.PayloadBaseTransportHeader, Offset: 2, Len: 2, Type: FieldPort},
+			{Protocol: "tcp", Name: "sequence", Base: expr.PayloadBaseTransportHeader, Offset: 4, Len: 4},
+			{Protocol: "tcp", Name: "ackseq", Base: expr.PayloadBaseTransportHeader, Offset: 8, Len: 4},
+			{Protocol: "tcp", Name: "flags", Base: expr.PayloadBaseTransportHeader, Offset: 13, Len: 1, Type: FieldTCPFlags},
+			{Protocol: "tcp", Name: "window", Base: expr.PayloadBaseTransportHeader, Offset: 14, Len: 2},
+		},
+		unix.IPPROTO_UDP: {
+			{Protocol: "udp", Name: "sport", Base: expr.PayloadBaseTransportHeader, Offset: 0, Len: 2, Type: FieldPort},
+			{Protocol: "udp", Name: "dport", Base: expr.PayloadBaseTransportHeader, Offset: 2, Len: 2, Type: FieldPort},
+			{Protocol: "udp", Name: "length", Base: expr.PayloadBaseTransportHeader, Offset: 4, Len: 2},
+			{Protocol: "udp", Name: "checksum", Base: expr.PayloadBaseTransportHeader, Offset: 6, Len: 2},
+		},
+		unix.IPPROTO_SCTP: {
+			{Protocol: "sctp", Name: "sport", Base: expr.PayloadBaseTransportHeader, Offset: 0, Len: 2, Type: FieldPort},
+			{Protocol: "sctp", Name: "dport", Base: expr.PayloadBaseTransportHeader, Offset: 2, Len: 2, Type: FieldPort},
+			{Protocol: "sctp", Name: "vtag", Base: expr.PayloadBaseTransportHeader, Offset: 4, Len: 4},
+			{Protocol: "sctp", Name: "checksum", Base: expr.PayloadBaseTransportHeader, Offset: 8, Len: 4},
+		},
+		unix.IPPROTO_ICMP: {
+			{Protocol: "icmp", Name: "type", Base: expr.PayloadBaseTransportHeader, Offset: 0, Len: 1},
+			{Protocol: "icmp", Name: "code", Base: expr.PayloadBaseTransportHeader, Offset: 1, Len: 1},
+			{Protocol: "icmp", Name: "checksum", Base: expr.PayloadBaseTransportHeader, Offset: 2, Len: 2},
+			{Protocol: "icmp", Name: "id", Base: expr.PayloadBaseTransportHeader, Offset: 4, Len: 2},
+			{Protocol: "icmp", Name: "sequence", Base: expr.PayloadBaseTransportHeader, Offset: 6, Len: 2},
+		},
+		unix.IPPROTO_ICMPV6: {
+			{Protocol: "icmpv6", Name: "type", Base: expr.PayloadBaseTransportHeader, Offset: 0, Len: 1},
+			{Protocol: "icmpv6", Name: "code", Base: expr.PayloadBaseTransportHeader, Offset: 1, Len: 1},
+			{Protocol: "icmpv6", Name: "checksum", Base: expr.PayloadBaseTransportHeader, Offset: 2, Len: 2},
+			{Protocol: "icmpv6", Name: "id", Base: expr.PayloadBaseTransportHeader, Offset: 4, Len: 2},
+			{Protocol: "icmpv6", Name: "sequence", Base: expr.PayloadBaseTransportHeader, Offset: 6, Len: 2},
+		},
+	}
+
+	// thFields are the generic transport header fields when the transport
+	// protocol isn't known.
+	thFields = []Field{
+		{Protocol: "th", Name: "sport", Base: expr.PayloadBaseTransportHeader, Offset: 0, Len: 2, Type: FieldPort},
+		{Protocol: "th", Name: "dport", Base: expr.PayloadBaseTransportHeader, Offset: 2, Len: 2, Type: FieldPort},
+	}
+)
+
+// PayloadField returns the protocol header field loaded by the specified
+// payload expression, or nil if unknown. The table family, which needs to be
+// refined to [nftables.TableFamilyIPv4], [nftables.TableFamilyIPv6], or
+// [nftables.TableFamilyARP] where known, determines the network header
+// protocol, while l4proto determines the transport header protocol; an
+// unknown l4proto (zero) only returns generic “th” fields. The mask is the
+// mask applied to the loaded payload, if any, and is used to tell apart
+// fields sharing the same bytes, such as “ip dscp” and “ip ecn”.
+//
+// For the inet, bridge, and netdev families the network header protocol is
+// ambiguous, so PayloadField returns a network header field only if it is
+// unambiguous in both IPv4 and IPv6.
+func PayloadField(family nftables.TableFamily, l4proto uint8, payload *expr.Payload, mask []byte) *Field {
+	var fields [][]Field
+	switch payload.Base {
+	case expr.PayloadBaseLLHeader:
+		fields = [][]Field{linkFields}
+	case expr.PayloadBaseNetworkHeader:
+		switch family {
+		case nftables.TableFamilyIPv4:
+			fields = [][]Field{ipFields}
+		case nftables.TableFamilyIPv6:
+			fields = [][]Field{ip6Fields}
+		case nftables.TableFamilyARP:
+			fields = [][]Field{arpFields}
+		default:
+			ip := lookupField(ipFields, payload, mask)
+			ip6 := lookupField(ip6Fields, payload, mask)
+			if ip != nil && ip6 == nil {
+				return ip
+			}
+			if ip6 != nil && ip == nil {
+				return ip6
+			}
+			return nil
+		}
+	case expr.PayloadBaseTransportHeader:
+		if tf, ok := transportFields[l4proto]; ok {
+			fields = [][]Field{tf}
+		} else {
+			fields = [][]Field{thFields}
+		}
+	}
+	for _, fs := range fields {
+		if f := lookupField(fs, payload, mask); f != nil {
+			return f
+		}
+	}
+	return nil
+}
+
+// lookupField returns the field matching the specified payload expression and
+// mask, or nil. If multiple fields share the same payload bytes, the field with
+// the same mask is preferred, otherwise the field without any mask.
+func lookupField(fields []Field, payload *expr.Payload, mask []byte) *Field {
+	var unmasked *Field
+	for idx := range fields {
+		f := &fields[idx]
+		if f.Base != payload.Base || f.Offset != payload.Offset || f.Len != payload.Len {
+			continue
+		}
+		if f.Mask == nil {
+			unmasked = f
+			continue
+		}
+		if bytes.Equal(f.Mask, mask) {
+			return f
+		}
+	}
+	return unmasked
+}
+
+// FieldByName returns the protocol header field with the specified name in nft
+// notation, such as “ip saddr” or “tcp dport”, or nil if unknown.
+func FieldByName(name string) *Field {
+	for _, fs := range allFields() {
+		for idx := range fs {
+			if fs[idx].String() == name {
+				return &fs[idx]
+			}
+		}
+	}
+	return nil
+}
+
+// allFields returns all known protocol header fields.
+func allFields() [][]Field {
+	all := [][]Field{linkFields, ipFields, ip6Fields, arpFields, thFields}
+	for _, l4proto := range []uint8{
+		unix.IPPROTO_TCP, unix.IPPROTO_UDP, unix.IPPROTO_SCTP,
+		unix.IPPROTO_ICMP, unix.IPPROTO_ICMPV6,
+	} {
+		all = append(all, transportFields[l4proto])
+	}
+	return all
+}
+
+// Field returns the protocol header field of the specified operand, or nil if
+// the operand isn't a (known) payload field. Field refines the specified
+// table family and determines the transport protocol from the predicates of
+// this lifted rule, such as “meta nfproto ipv4” and “meta l4proto tcp”,
+// similar to how nft resolves payload dependencies.
+func (r *LiftedRule) Field(family nftables.TableFamily, op Operand) *Field {
+	payload, ok := op.Field.(*expr.Payload)
+	if !ok {
+		return nil
+	}
+	return PayloadField(r.L3Family(family), r.L4Proto(family), payload, op.Mask)
+}
+
+// L3Family returns the network protocol family of this lifted rule. For the
+// ip, ip6, and arp families this is the table family itself. For the inet,
+// bridge, and netdev families the network protocol is determined from “meta
+// nfproto”, “meta protocol”, and “ether type” predicates, if present;
+// otherwise the specified table family is returned unchanged.
+func (r *LiftedRule) L3Family(family nftables.TableFamily) nftables.TableFamily {
+	switch family {
+	case nftables.TableFamilyIPv4, nftables.TableFamilyIPv6, nftables.TableFamilyARP:
+		return family
+	}
+	for _, p := range r.Predicates {
+		if p.Op != OpEq {
+			continue
+		}
+		switch f := p.Operand.Field.(type) {
+		case *expr.Meta:
+			switch {
+			case f.Key == expr.MetaKeyNFPROTO && len(p.Value) == 1:
+				switch p.Value[0] {
+				case unix.NFPROTO_IPV4:
+					return nftables.TableFamilyIPv4
+				case unix.NFPROTO_IPV6:
+					return nftables.TableFamilyIPv6
+				}
+			case f.Key == expr.MetaKeyPROTOCOL:
+				if fam, ok := etherTypeFamily(p.Value); ok {
+					return fam
+				}
+			}
+		case *expr.Payload:
+			if f.Base == expr.PayloadBaseLLHeader && f.Offset == 12 && f.Len == 2 {
+				if fam, ok := etherTypeFamily(p.Value); ok {
+					return fam
+				}
+			}
+		}
+	}
+	return family
+}
+
+// etherTypeFamily returns the table family corresponding with the specified
+// (big-endian) Ethernet type.
+func etherTypeFamily(ethertype []byte) (nftables.TableFamily, bool) {
+	if len(ethertype) != 2 {
+		return 0, false
+	}
+	switch uint16(ethertype[0])<<8 | uint16(ethertype[1]) {
+	case unix.ETH_P_IP:
+		return nftables.TableFamilyIPv4, true
+	case unix.ETH_P_IPV6:
+		return nftables.TableFamilyIPv6, true
+	case unix.ETH_P_ARP:
+		return nftables.TableFamilyARP, true
+	}
+	return 0, false
+}
+
+// L4Proto returns the transport protocol of this lifted rule, as determined
+// from “meta l4proto”, “ip protocol”, or “ip6 nexthdr” equality predicates.
+// Otherwise, L4Proto returns zero.
+func (r *LiftedRule) L4Proto(family nftables.TableFamily) uint8 {
+	l3family := r.L3Family(family)
+	for _, p := range r.Predicates {
+		if p.Op != OpEq || len(p.Value) != 1 {
+			continue
+		}
+		switch f := p.Operand.Field.(type) {
+		case *expr.Meta:
+			if f.Key == expr.MetaKeyL4PROTO {
+				return p.Value[0]
+			}
+		case *expr.Payload:
+			if f := PayloadField(l3family, 0, f, p.Operand.Mask); f != nil && f.Type == FieldProtocol {
+				return p.Value[0]
+			}
+		}
+	}
+	return 0
+}
+
+// PredicatesOf returns the predicates of this lifted rule matching the
+// protocol header field with the specified name in nft notation, such as “ip
+// saddr” or “tcp dport”.
+func (r *LiftedRule) PredicatesOf(family nftables.TableFamily, name string) []Predicate {
+	var preds []Predicate
+	for _, p := range r.Predicates {
+		if f := r.Field(family, p.Operand); f != nil && f.String() == name {
+			preds = append(preds, p)
+		}
+	}
+	return preds
+}
@@ -0,0 +1,126 @@
+// Copyright 2023 Harald Albrecht.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy
+// of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package dsl
+
+import (
+	"net"
+	"net/netip"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"github.com/thediveo/nufftables"
+	"golang.org/x/sys/unix"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+func payload(base expr.PayloadBase, offset, len uint32) *expr.Payload {
+	return &expr.Payload{DestRegister: 1, Base: base, Offset: offset, Len: len}
+}
+
+var _ = Describe("protocol header fields", func() {
+
+	DescribeTable("looks up payload fields",
+		func(family nftables.TableFamily, l4proto uint8, p *expr.Payload, mask []byte, name string) {
+			f := PayloadField(family, l4proto, p, mask)
+			if name == "" {
+				Expect(f).To(BeNil())
+				return
+			}
+			Expect(f).NotTo(BeNil())
+			Expect(f.String()).To(Equal(name))
+		},
+		Entry(nil, nftables.TableFamilyIPv4, uint8(0), payload(expr.PayloadBaseNetworkHeader, 12, 4), nil, "ip saddr"),
+		Entry(nil, nftables.TableFamilyIPv4, uint8(0), payload(expr.PayloadBaseNetworkHeader, 12, 4), []byte{0xff, 0, 0, 0}, "ip saddr"),
+		Entry(nil, nftables.TableFamilyIPv4, uint8(0), payload(expr.PayloadBaseNetworkHeader, 1, 1), []byte{0xfc}, "ip dscp"),
+		Entry(nil, nftables.TableFamilyIPv4, uint8(0), payload(expr.PayloadBaseNetworkHeader, 1, 1), []byte{0x03}, "ip ecn"),
+		Entry(nil, nftables.TableFamilyIPv4, uint8(0), payload(expr.PayloadBaseNetworkHeader, 1, 1), nil, ""),
+		Entry(nil, nftables.TableFamilyIPv6, uint8(0), payload(expr.PayloadBaseNetworkHeader, 24, 16), nil, "ip6 daddr"),
+		Entry(nil, nftables.TableFamilyINet, uint8(0), payload(expr.PayloadBaseNetworkHeader, 16, 4), nil, "ip daddr"),
+		Entry(nil, nftables.TableFamilyINet, uint8(0), payload(expr.PayloadBaseNetworkHeader, 4, 2), nil, ""),
+		Entry(nil, nftables.TableFamilyARP, uint8(0), payload(expr.PayloadBaseNetworkHeader, 14, 4), nil, "arp saddr ip"),
+		Entry(nil, nftables.TableFamilyBridge, uint8(0), payload(expr.PayloadBaseLLHeader, 6, 6), nil, "ether saddr"),
+		Entry(nil, nftables.TableFamilyBridge, uint8(0), payload(expr.PayloadBaseLLHeader, 14, 2), []byte{0x0f, 0xff}, "vlan id"),
+		Entry(nil, nftables.TableFamilyIPv4, uint8(unix.IPPROTO_TCP), payload(expr.PayloadBaseTransportHeader, 2, 2), nil, "tcp dport"),
+		Entry(nil, nftables.TableFamilyIPv4, uint8(unix.IPPROTO_UDP), payload(expr.PayloadBaseTransportHeader, 0, 2), nil, "udp sport"),
+		Entry(nil, nftables.TableFamilyIPv4, uint8(unix.IPPROTO_SCTP), payload(expr.PayloadBaseTransportHeader, 2, 2), nil, "sctp dport"),
+		Entry(nil, nftables.TableFamilyIPv4, uint8(unix.IPPROTO_ICMP), payload(expr.PayloadBaseTransportHeader, 0, 1), nil, "icmp type"),
+		Entry(nil, nftables.TableFamilyIPv6, uint8(unix.IPPROTO_ICMPV6), payload(expr.PayloadBaseTransportHeader, 1, 1), nil, "icmpv6 code"),
+		Entry(nil, nftables.TableFamilyIPv4, uint8(0), payload(expr.PayloadBaseTransportHeader, 2, 2), nil, "th dport"),
+		Entry(nil, nftables.TableFamilyIPv4, uint8(0), payload(expr.PayloadBaseTransportHeader, 0, 1), nil, ""),
+	)
+
+	It("finds fields by name", func() {
+		f := FieldByName("tcp dport")
+		Expect(f).NotTo(BeNil())
+		Expect(f.Offset).To(Equal(uint32(2)))
+		Expect(FieldByName("arp daddr ether").Len).To(Equal(uint32(6)))
+		Expect(FieldByName("foo bar")).To(BeNil())
+	})
+
+	It("decodes field values", func() {
+		Expect(FieldByName("ip saddr").Decode(ip("10.1.2.3"))).To(Equal(netip.MustParseAddr("10.1.2.3")))
+		Expect(FieldByName("ip6 saddr").Decode(ip("fe80::1"))).To(Equal(netip.MustParseAddr("fe80::1")))
+		Expect(FieldByName("ip saddr").Decode([]byte{1})).To(BeNil())
+		Expect(FieldByName("ether daddr").Decode([]byte{1, 2, 3, 4, 5, 6})).To(
+			Equal(net.HardwareAddr{1, 2, 3, 4, 5, 6}))
+		Expect(FieldByName("tcp dport").Decode([]byte{0x1f, 0x90})).To(Equal(uint16(8080)))
+		Expect(FieldByName("ip protocol").Decode([]byte{unix.IPPROTO_UDP})).To(Equal(uint8(unix.IPPROTO_UDP)))
+		Expect(FieldByName("ip dscp").Decode([]byte{0xb8})).To(Equal(uint8(46)))
+		Expect(FieldByName("ip6 dscp").Decode([]byte{0x6b, 0x80})).To(Equal(uint8(46)))
+		Expect(FieldByName("vlan id").Decode([]byte{0xe0, 0x2a})).To(Equal(uint64(42)))
+		flags := FieldByName("tcp flags").Decode([]byte{0x12})
+		Expect(flags).To(Equal(TCPFlagSYN | TCPFlagACK))
+		Expect(flags.(TCPFlags).String()).To(Equal("syn|ack"))
+	})
+
+	It("resolves payload dependencies of lifted rules", func() {
+		r := Lift(nufftables.Expressions{
+			&expr.Meta{Key: expr.MetaKeyNFPROTO, Register: 1},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{unix.NFPROTO_IPV6}},
+			&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{unix.IPPROTO_UDP}},
+			payload(expr.PayloadBaseNetworkHeader, 8, 16),
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: ip("fe80::1")},
+			payload(expr.PayloadBaseTransportHeader, 2, 2),
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{0, 53}},
+		})
+		Expect(r.L3Family(nftables.TableFamilyINet)).To(Equal(nftables.TableFamilyIPv6))
+		Expect(r.L3Family(nftables.TableFamilyIPv4)).To(Equal(nftables.TableFamilyIPv4))
+		Expect(r.L4Proto(nftables.TableFamilyINet)).To(Equal(uint8(unix.IPPROTO_UDP)))
+		Expect(r.PredicatesOf(nftables.TableFamilyINet, "ip6 saddr")).To(HaveLen(1))
+		dport := r.PredicatesOf(nftables.TableFamilyINet, "udp dport")
+		Expect(dport).To(HaveLen(1))
+		Expect(dport[0].Value).To(Equal([]byte{0, 53}))
+		Expect(r.PredicatesOf(nftables.TableFamilyINet, "tcp dport")).To(BeEmpty())
+
+		r = Lift(nufftables.Expressions{
+			payload(expr.PayloadBaseNetworkHeader, 9, 1),
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{unix.IPPROTO_TCP}},
+			payload(expr.PayloadBaseTransportHeader, 2, 2),
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{0, 80}},
+		})
+		Expect(r.L4Proto(nftables.TableFamilyIPv4)).To(Equal(uint8(unix.IPPROTO_TCP)))
+		Expect(r.PredicatesOf(nftables.TableFamilyIPv4, "tcp dport")).To(HaveLen(1))
+
+		r = Lift(nufftables.Expressions{
+			payload(expr.PayloadBaseLLHeader, 12, 2),
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{0x08, 0x06}},
+		})
+		Expect(r.L3Family(nftables.TableFamilyBridge)).To(Equal(nftables.TableFamilyARP))
+	})
+
+})
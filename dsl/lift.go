@@ -0,0 +1,472 @@
+// Copyright 2023 Harald Albrecht.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy
+// of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package dsl
+
+import (
+	"math/bits"
+
+	"github.com/google/nftables/expr"
+	"github.com/thediveo/nufftables"
+	"golang.org/x/sys/unix"
+)
+
+// LiftedRule is the high-level representation of a rule's expressions, as
+// returned by [Lift]. Instead of the low-level register machine code of
+// individual expressions, a LiftedRule consists of typed match predicates
+// (such as “the IPv4 source address is in 10.0.0.0/8”) and statements (such as
+// counters, NAT, and verdicts), together with the resolved contents of the
+// registers the statements read.
+type LiftedRule struct {
+	Predicates []Predicate
+	XtMatches  []*expr.Match // iptables-nft xt match extensions.
+	Statements []Statement
+}
+
+// Operand describes the contents of a register, that is, what has been loaded
+// into a register and how it has been transformed.
+type Operand struct {
+	// Field is the expression that loaded the data from a packet, conntrack
+	// or meta information, et cetera, such as [*expr.Payload], [*expr.Meta],
+	// [*expr.Ct], [*expr.Exthdr], [*expr.Fib], [*expr.Rt], [*expr.Numgen] and
+	// [*expr.Hash]; nil for immediate data, concatenations, and map lookup
+	// results.
+	Field expr.Any
+	// Data is the immediate data loaded into a register.
+	Data []byte
+	// Mask and Xor are non-nil if the loaded data has been transformed
+	// using an [*expr.Bitwise] operation.
+	Mask, Xor []byte
+	// Concat lists the individual operands of a concatenation, such as
+	// “ip daddr . tcp dport”.
+	Concat []Operand
+	// Map is the name of a map and MapKey the key used in a map lookup when
+	// the register contents are the result of a map lookup.
+	Map    string
+	MapKey *Operand
+	// Len is the length of the register contents in bytes, if known, otherwise
+	// zero.
+	Len int
+}
+
+// IsZero returns true if nothing is known about the register contents.
+func (o Operand) IsZero() bool {
+	return o.Field == nil && o.Data == nil && o.Concat == nil && o.Map == ""
+}
+
+// PredicateOp is the operation of a [Predicate].
+type PredicateOp int
+
+// Operations of predicates.
+const (
+	OpEq         PredicateOp = iota // operand equals value
+	OpNeq                           // operand does not equal value
+	OpLt                            // operand is less than value
+	OpLte                           // operand is less than or equal to value
+	OpGt                            // operand is greater than value
+	OpGte                           // operand is greater than or equal to value
+	OpInRange                       // operand is inside the range [Value..ValueTo]
+	OpNotInRange                    // operand is outside the range [Value..ValueTo]
+	OpInSet                         // operand is an element of Set
+	OpNotInSet                      // operand is not an element of Set
+)
+
+// String returns the nft operator for this predicate operation.
+func (op PredicateOp) String() string {
+	switch op {
+	case OpEq, OpInRange, OpInSet:
+		return "=="
+	case OpNeq, OpNotInRange, OpNotInSet:
+		return "!="
+	case OpLt:
+		return "<"
+	case OpLte:
+		return "<="
+	case OpGt:
+		return ">"
+	case OpGte:
+		return ">="
+	}
+	return "?"
+}
+
+// Predicate is a match condition of a rule, comparing a register operand with
+// a value, a range of values, or the elements of a set.
+type Predicate struct {
+	Operand Operand
+	Op      PredicateOp
+	Value   []byte // value compared with, or lower bound of a range.
+	ValueTo []byte // upper bound of a range.
+	Set     string // set name for set lookups.
+	// Exprs are the expressions this predicate has been lifted from, that is,
+	// the loading, transforming, and finally comparing expressions.
+	Exprs nufftables.Expressions
+}
+
+// Prefix returns the prefix length in bits if the predicate's operand has
+// been masked with a prefix mask, such as when matching IP addresses against a
+// CIDR prefix. If the operand has not been masked at all, Prefix returns the
+// length of the compared value in bits. Otherwise, Prefix returns false.
+func (p *Predicate) Prefix() (int, bool) {
+	if p.Operand.Mask == nil {
+		return len(p.Value) * 8, true
+	}
+	ones := 0
+	zeros := false
+	for _, b := range p.Operand.Mask {
+		if zeros {
+			if b != 0 {
+				return 0, false
+			}
+			continue
+		}
+		n := bits.LeadingZeros8(^b)
+		ones += n
+		if n < 8 {
+			if b<<n != 0 {
+				return 0, false
+			}
+			zeros = true
+		}
+	}
+	return ones, true
+}
+
+// Statement is a rule statement, such as a counter, log, NAT, or verdict,
+// together with the resolved contents of the registers the statement reads.
+type Statement struct {
+	Expr     expr.Any
+	Operands map[uint32]Operand // register contents read, indexed by register.
+}
+
+// Lift lifts the specified (rule) expressions into a [LiftedRule], tracking
+// the register contents through payload, meta, ct, bitwise, lookup, et cetera
+// expressions, similar to what nft does when listing rules.
+func Lift(exprs nufftables.Expressions) *LiftedRule {
+	l := lifter{
+		regs: map[int]*regSlot{},
+		srcs: map[*Operand]nufftables.Expressions{},
+	}
+	rule := &LiftedRule{}
+	for _, e := range exprs {
+		switch e := e.(type) {
+		case *expr.Payload:
+			if e.OperationType == expr.PayloadWrite {
+				rule.Statements = append(rule.Statements, l.statement(e, e.SourceRegister))
+				continue
+			}
+			l.load(e.DestRegister, &Operand{Field: e, Len: int(e.Len)}, e)
+		case *expr.Meta:
+			if e.SourceRegister {
+				rule.Statements = append(rule.Statements, l.statement(e, e.Register))
+				continue
+			}
+			l.load(e.Register, &Operand{Field: e, Len: metaKeyLen(e.Key)}, e)
+		case *expr.Ct:
+			if e.SourceRegister {
+				rule.Statements = append(rule.Statements, l.statement(e, e.Register))
+				continue
+			}
+			l.load(e.Register, &Operand{Field: e, Len: ctKeyLen(e.Key)}, e)
+		case *expr.Exthdr:
+			if e.SourceRegister != 0 {
+				rule.Statements = append(rule.Statements, l.statement(e, e.SourceRegister))
+				continue
+			}
+			l.load(e.DestRegister, &Operand{Field: e, Len: int(e.Len)}, e)
+		case *expr.Fib:
+			l.load(e.Register, &Operand{Field: e, Len: 4}, e)
+		case *expr.Rt:
+			l.load(e.Register, &Operand{Field: e, Len: 4}, e)
+		case *expr.Socket:
+			l.load(e.Register, &Operand{Field: e, Len: socketKeyLen(e.Key)}, e)
+		case *expr.Numgen:
+			l.load(e.Register, &Operand{Field: e, Len: 4}, e)
+		case *expr.Hash:
+			l.load(e.DestRegister, &Operand{Field: e, Len: 4}, e)
+		case *expr.Immediate:
+			l.load(e.Register, &Operand{Data: e.Data, Len: len(e.Data)}, e)
+		case *expr.Bitwise:
+			src, srcexprs := l.read(e.SourceRegister, int(e.Len))
+			op := src
+			op.Mask, op.Xor = e.Mask, e.Xor
+			if src.Mask != nil && len(src.Mask) == len(e.Mask) {
+				op.Mask = make([]byte, len(e.Mask))
+				for idx := range e.Mask {
+					op.Mask[idx] = src.Mask[idx] & e.Mask[idx]
+				}
+			}
+			op.Len = int(e.Len)
+			l.load(e.DestRegister, &op, append(srcexprs, e)...)
+		case *expr.Byteorder:
+			src, srcexprs := l.read(e.SourceRegister, int(e.Len))
+			l.load(e.DestRegister, &src, append(srcexprs, e)...)
+		case *expr.Cmp:
+			op, srcexprs := l.read(e.Register, len(e.Data))
+			rule.Predicates = append(rule.Predicates, Predicate{
+				Operand: op,
+				Op:      cmpPredicateOp(e.Op),
+				Value:   e.Data,
+				Exprs:   append(srcexprs, e),
+			})
+		case *expr.Range:
+			op, srcexprs := l.read(e.Register, len(e.FromData))
+			pop := OpInRange
+			if e.Op == expr.CmpOpNeq {
+				pop = OpNotInRange
+			}
+			rule.Predicates = append(rule.Predicates, Predicate{
+				Operand: op,
+				Op:      pop,
+				Value:   e.FromData,
+				ValueTo: e.ToData,
+				Exprs:   append(srcexprs, e),
+			})
+		case *expr.Lookup:
+			key, srcexprs := l.read(e.SourceRegister, 0)
+			if e.IsDestRegSet {
+				if e.DestRegister == unix.NFT_REG_VERDICT {
+					// verdict map lookup, thus a statement
+					rule.Statements = append(rule.Statements, Statement{
+						Expr:     e,
+						Operands: map[uint32]Operand{e.SourceRegister: key},
+					})
+					continue
+				}
+				l.load(e.DestRegister, &Operand{Map: e.SetName, MapKey: &key},
+					append(srcexprs, e)...)
+				continue
+			}
+			pop := OpInSet
+			if e.Invert {
+				pop = OpNotInSet
+			}
+			rule.Predicates = append(rule.Predicates, Predicate{
+				Operand: key,
+				Op:      pop,
+				Set:     e.SetName,
+				Exprs:   append(srcexprs, e),
+			})
+		case *expr.Match:
+			rule.XtMatches = append(rule.XtMatches, e)
+		case *expr.NAT:
+			rule.Statements = append(rule.Statements, l.statement(e,
+				e.RegAddrMin, e.RegAddrMax, e.RegProtoMin, e.RegProtoMax))
+		case *expr.Masq:
+			rule.Statements = append(rule.Statements, l.statement(e,
+				e.RegProtoMin, e.RegProtoMax))
+		case *expr.Redir:
+			rule.Statements = append(rule.Statements, l.statement(e,
+				e.RegisterProtoMin, e.RegisterProtoMax))
+		case *expr.TProxy:
+			rule.Statements = append(rule.Statements, l.statement(e, e.RegAddr, e.RegPort))
+		case *expr.Dynset:
+			stmt := l.statement(e, e.SrcRegData)
+			if stmt.Operands == nil {
+				stmt.Operands = map[uint32]Operand{}
+			}
+			stmt.Operands[e.SrcRegKey], _ = l.read(e.SrcRegKey, 0)
+			rule.Statements = append(rule.Statements, stmt)
+		case *expr.Dup:
+			rule.Statements = append(rule.Statements, l.statement(e,
+				e.RegAddr, e.RegDev))
+		default:
+			// counter, log, limit, quota, reject, queue, verdict, target, ...
+			rule.Statements = append(rule.Statements, Statement{Expr: e})
+		}
+	}
+	return rule
+}
+
+// after returns the expressions following the last of the specified lifted
+// expressions, or nil if the lifted expressions aren't part of exprs.
+func after(exprs nufftables.Expressions, lifted nufftables.Expressions) nufftables.Expressions {
+	if len(lifted) == 0 {
+		return nil
+	}
+	last := lifted[len(lifted)-1]
+	for idx, e := range exprs {
+		if e == last {
+			return exprs[idx+1:]
+		}
+	}
+	return nil
+}
+
+// lifter tracks the register contents while lifting expressions. Registers
+// are tracked at the granularity of 32bit registers, so that the 128bit
+// registers NFT_REG_1 to NFT_REG_4 alias the 32bit registers NFT_REG32_00 to
+// NFT_REG32_15 the same way the kernel does.
+type lifter struct {
+	regs map[int]*regSlot                    // indexed by 32bit register slot.
+	srcs map[*Operand]nufftables.Expressions // expressions producing an operand.
+	seq  int                                 // load sequence number.
+}
+
+// regSlot references the operand stored in a particular 32bit register slot.
+type regSlot struct {
+	op     *Operand
+	start  int // first slot occupied by the operand.
+	nslots int // number of slots occupied by the operand.
+	seq    int // load sequence number, used to detect concatenations.
+}
+
+// slot returns the 32bit register slot for the specified register, or -1 for
+// the verdict register and invalid registers.
+func slot(reg uint32) int {
+	switch {
+	case reg >= unix.NFT_REG_1 && reg <= unix.NFT_REG_4:
+		return int(reg-unix.NFT_REG_1) * 4
+	case reg >= unix.NFT_REG32_00 && reg <= unix.NFT_REG32_00+15:
+		return int(reg - unix.NFT_REG32_00)
+	}
+	return -1
+}
+
+// slots returns the number of 32bit register slots required to store the
+// specified number of bytes.
+func slots(length int) int {
+	if length <= 0 {
+		return 1
+	}
+	return (length + 3) / 4
+}
+
+// load stores the operand in the specified register, remembering the
+// expressions producing the operand.
+func (l *lifter) load(reg uint32, op *Operand, exprs ...expr.Any) {
+	start := slot(reg)
+	if start < 0 {
+		return
+	}
+	l.seq++
+	l.srcs[op] = exprs
+	n := slots(op.Len)
+	for idx := start; idx < start+n; idx++ {
+		l.regs[idx] = &regSlot{op: op, start: start, nslots: n, seq: l.seq}
+	}
+}
+
+// read returns the operand stored in the specified register, together with
+// the expressions producing the operand. If the length is unknown (zero),
+// then read returns a concatenation of all operands loaded in sequence into
+// consecutive registers. If there is nothing known about the register
+// contents, then a zero operand is returned.
+func (l *lifter) read(reg uint32, length int) (Operand, nufftables.Expressions) {
+	start := slot(reg)
+	s, ok := l.regs[start]
+	if start < 0 || !ok || s.start != start {
+		return Operand{}, nufftables.Expressions{}
+	}
+	ops := []*regSlot{s}
+	covered := s.nslots
+	for length <= 0 || covered < slots(length) {
+		next, ok := l.regs[start+covered]
+		if !ok || next.start != start+covered || next.seq != ops[len(ops)-1].seq+1 {
+			break
+		}
+		ops = append(ops, next)
+		covered += next.nslots
+	}
+	if len(ops) == 1 {
+		return *s.op, append(nufftables.Expressions{}, l.srcs[s.op]...)
+	}
+	concat := Operand{}
+	exprs := nufftables.Expressions{}
+	for _, s := range ops {
+		concat.Concat = append(concat.Concat, *s.op)
+		concat.Len += s.nslots * 4
+		exprs = append(exprs, l.srcs[s.op]...)
+	}
+	return concat, exprs
+}
+
+// statement returns a statement for the specified expression, together with
+// the operands read from the specified registers; unused (zero) registers are
+// skipped. As statements might read multiple adjacent registers individually,
+// such as NAT addresses and ports, no concatenations are considered.
+func (l *lifter) statement(e expr.Any, regs ...uint32) Statement {
+	stmt := Statement{Expr: e}
+	for _, reg := range regs {
+		if reg == 0 {
+			continue
+		}
+		if stmt.Operands == nil {
+			stmt.Operands = map[uint32]Operand{}
+		}
+		stmt.Operands[reg], _ = l.read(reg, 1)
+	}
+	return stmt
+}
+
+// cmpPredicateOp returns the predicate operation corresponding with the
+// specified compare operation.
+func cmpPredicateOp(op expr.CmpOp) PredicateOp {
+	switch op {
+	case expr.CmpOpNeq:
+		return OpNeq
+	case expr.CmpOpLt:
+		return OpLt
+	case expr.CmpOpLte:
+		return OpLte
+	case expr.CmpOpGt:
+		return OpGt
+	case expr.CmpOpGte:
+		return OpGte
+	}
+	return OpEq
+}
+
+// metaKeyLen returns the length in bytes of the specified meta key's data.
+func metaKeyLen(key expr.MetaKey) int {
+	switch key {
+	case expr.MetaKeyIIFNAME, expr.MetaKeyOIFNAME,
+		expr.MetaKeyBRIIIFNAME, expr.MetaKeyBRIOIFNAME:
+		return unix.IFNAMSIZ
+	case expr.MetaKeyL4PROTO, expr.MetaKeyNFPROTO, expr.MetaKeyPKTTYPE:
+		return 1
+	case expr.MetaKeyPROTOCOL, expr.MetaKeyIIFTYPE, expr.MetaKeyOIFTYPE:
+		return 2
+	}
+	return 4
+}
+
+// socketKeyLen returns the length in bytes of the specified socket key's
+// data.
+func socketKeyLen(key expr.SocketKey) int {
+	switch key {
+	case expr.SocketKeyTransparent, expr.SocketKeyWildcard:
+		return 1
+	case expr.SocketKeyCgroupv2:
+		return 8
+	}
+	return 4
+}
+
+// ctKeyLen returns the length in bytes of the specified conntrack key's data.
+// As the length of conntrack addresses depends on the address family, the
+// IPv6 address length is returned for them.
+func ctKeyLen(key expr.CtKey) int {
+	switch key {
+	case expr.CtKeyL3PROTOCOL, expr.CtKeyPROTOCOL, expr.CtKeyDIRECTION:
+		return 1
+	case expr.CtKeyPROTOSRC, expr.CtKeyPROTODST, expr.CtKeyZONE:
+		return 2
+	case expr.CtKeySRC, expr.CtKeyDST, expr.CtKeyLABELS, expr.CtKeyHELPER:
+		return 16
+	case expr.CtKeyPKTS, expr.CtKeyBYTES, expr.CtKeyAVGPKT:
+		return 8
+	}
+	return 4
+}
@@ -0,0 +1,266 @@
+// Copyright 2023 Harald Albrecht.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy
+// of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package dsl
+
+import (
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"github.com/thediveo/nufftables"
+	"github.com/thediveo/nufftables/nufftablestest"
+	"golang.org/x/sys/unix"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("lifting expressions", func() {
+
+	It("tells source from destination addresses", func() {
+		saddr := &expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: 12, Len: 4}
+		daddr := &expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: 16, Len: 4}
+		cmpsaddr := &expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: ip("10.0.0.1")}
+		cmpdaddr := &expr.Cmp{Op: expr.CmpOpNeq, Register: 1, Data: ip("10.0.0.2")}
+		r := Lift(nufftables.Expressions{saddr, cmpsaddr, daddr, cmpdaddr})
+		Expect(r.Predicates).To(HaveLen(2))
+		Expect(r.Predicates[0].Operand.Field).To(BeIdenticalTo(saddr))
+		Expect(r.Predicates[0].Op).To(Equal(OpEq))
+		Expect(r.Predicates[0].Value).To(Equal([]byte(ip("10.0.0.1"))))
+		Expect(r.Predicates[0].Exprs).To(Equal(nufftables.Expressions{saddr, cmpsaddr}))
+		Expect(r.Predicates[1].Operand.Field).To(BeIdenticalTo(daddr))
+		Expect(r.Predicates[1].Op).To(Equal(OpNeq))
+		Expect(r.Predicates[1].Op.String()).To(Equal("!="))
+		Expect(r.Statements).To(BeEmpty())
+	})
+
+	It("lifts prefixes", func() {
+		r := Lift(nufftables.Expressions{
+			&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: 12, Len: 4},
+			&expr.Bitwise{SourceRegister: 1, DestRegister: 1, Len: 4,
+				Mask: []byte{0xff, 0xff, 0xf0, 0x00}, Xor: []byte{0, 0, 0, 0}},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: ip("10.0.0.0")},
+		})
+		Expect(r.Predicates).To(HaveLen(1))
+		p := r.Predicates[0]
+		Expect(p.Operand.Field).To(BeAssignableToTypeOf(&expr.Payload{}))
+		Expect(p.Exprs).To(HaveLen(3))
+		bits, ok := p.Prefix()
+		Expect(ok).To(BeTrue())
+		Expect(bits).To(Equal(20))
+
+		p.Operand.Mask = []byte{0xff, 0x0f, 0, 0}
+		_, ok = p.Prefix()
+		Expect(ok).To(BeFalse())
+		p.Operand.Mask = []byte{0xff, 0, 0xff, 0}
+		_, ok = p.Prefix()
+		Expect(ok).To(BeFalse())
+		p.Operand.Mask = nil
+		bits, ok = p.Prefix()
+		Expect(ok).To(BeTrue())
+		Expect(bits).To(Equal(32))
+	})
+
+	It("lifts ranges and set lookups", func() {
+		r := Lift(nufftables.Expressions{
+			&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{unix.IPPROTO_TCP}},
+			&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseTransportHeader, Offset: 2, Len: 2},
+			&expr.Range{Op: expr.CmpOpNeq, Register: 1, FromData: []byte{0, 80}, ToData: []byte{0, 90}},
+			&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: 12, Len: 4},
+			&expr.Lookup{SourceRegister: 1, SetName: "blocked", Invert: true},
+		})
+		Expect(r.Predicates).To(HaveLen(3))
+		Expect(r.Predicates[0].Operand.Field).To(BeAssignableToTypeOf(&expr.Meta{}))
+		Expect(r.Predicates[0].Operand.Len).To(Equal(1))
+		Expect(r.Predicates[1].Op).To(Equal(OpNotInRange))
+		Expect(r.Predicates[1].ValueTo).To(Equal([]byte{0, 90}))
+		Expect(r.Predicates[2].Op).To(Equal(OpNotInSet))
+		Expect(r.Predicates[2].Set).To(Equal("blocked"))
+		Expect(r.Predicates[2].Operand.Concat).To(BeNil())
+	})
+
+	It("lifts concatenations", func() {
+		daddr := &expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: 16, Len: 4}
+		dport := &expr.Payload{DestRegister: 9, Base: expr.PayloadBaseTransportHeader, Offset: 2, Len: 2}
+		r := Lift(nufftables.Expressions{
+			daddr, dport,
+			&expr.Lookup{SourceRegister: 1, SetName: "services"},
+		})
+		Expect(r.Predicates).To(HaveLen(1))
+		op := r.Predicates[0].Operand
+		Expect(op.Field).To(BeNil())
+		Expect(op.Concat).To(HaveLen(2))
+		Expect(op.Concat[0].Field).To(BeIdenticalTo(daddr))
+		Expect(op.Concat[1].Field).To(BeIdenticalTo(dport))
+		Expect(op.Len).To(Equal(8))
+	})
+
+	It("lifts map lookups and statements with their operands", func() {
+		r := Lift(nufftables.Expressions{
+			&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseTransportHeader, Offset: 2, Len: 2},
+			&expr.Lookup{SourceRegister: 1, DestRegister: 1, IsDestRegSet: true, SetName: "marks"},
+			&expr.Meta{Key: expr.MetaKeyMARK, Register: 1, SourceRegister: true},
+			&expr.Counter{},
+			&expr.Immediate{Register: 1, Data: ip("fe80::1")},
+			&expr.Immediate{Register: 2, Data: []byte{0x1f, 0x90}},
+			&expr.NAT{Type: expr.NATTypeDestNAT, Family: unix.NFPROTO_IPV6,
+				RegAddrMin: 1, RegProtoMin: 2},
+			&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseTransportHeader, Offset: 2, Len: 2},
+			&expr.Lookup{SourceRegister: 1, DestRegister: unix.NFT_REG_VERDICT, IsDestRegSet: true, SetName: "vmap"},
+			&expr.Verdict{Kind: expr.VerdictAccept},
+		})
+		Expect(r.Predicates).To(BeEmpty())
+		Expect(r.Statements).To(HaveLen(5))
+
+		mark := r.Statements[0]
+		Expect(mark.Expr).To(BeAssignableToTypeOf(&expr.Meta{}))
+		Expect(mark.Operands[1].Map).To(Equal("marks"))
+		Expect(mark.Operands[1].MapKey.Field).To(BeAssignableToTypeOf(&expr.Payload{}))
+
+		Expect(r.Statements[1].Expr).To(BeAssignableToTypeOf(&expr.Counter{}))
+		Expect(r.Statements[1].Operands).To(BeNil())
+
+		nat := r.Statements[2]
+		Expect(nat.Operands).To(HaveLen(2))
+		Expect(nat.Operands[1].Data).To(Equal([]byte(ip("fe80::1"))))
+		Expect(nat.Operands[2].Data).To(Equal([]byte{0x1f, 0x90}))
+
+		vmap := r.Statements[3]
+		Expect(vmap.Expr).To(BeAssignableToTypeOf(&expr.Lookup{}))
+		Expect(vmap.Operands[1].Field).To(BeAssignableToTypeOf(&expr.Payload{}))
+
+		Expect(r.Statements[4].Expr).To(BeAssignableToTypeOf(&expr.Verdict{}))
+	})
+
+	It("collects xt matches and handles unknown register contents", func() {
+		m := &expr.Match{Name: "conntrack"}
+		r := Lift(nufftables.Expressions{
+			m,
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 3, Data: []byte{42}},
+		})
+		Expect(r.XtMatches).To(ConsistOf(m))
+		Expect(r.Predicates).To(HaveLen(1))
+		Expect(r.Predicates[0].Operand.IsZero()).To(BeTrue())
+	})
+
+	It("decodes rules read from the kernel", func() {
+		tcp := []expr.Any{
+			&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{unix.IPPROTO_TCP}},
+		}
+		dport := &expr.Payload{DestRegister: 1, Base: expr.PayloadBaseTransportHeader, Offset: 2, Len: 2}
+		conn := nufftablestest.NewConn(nufftablestest.Ruleset{
+			{
+				Name:   "fw",
+				Family: nftables.TableFamilyINet,
+				Sets: []nufftablestest.Set{{
+					Name:     "ports",
+					KeyType:  nftables.TypeInetService,
+					DataType: nftables.TypeVerdict,
+					IsMap:    true,
+					Elements: []nftables.SetElement{{
+						Key:         []byte{0, 80},
+						VerdictData: &expr.Verdict{Kind: expr.VerdictJump, Chain: "web"},
+					}},
+				}},
+				Chains: []nufftablestest.Chain{
+					{
+						Name:     "forward",
+						Type:     nftables.ChainTypeFilter,
+						Hook:     nftables.ChainHookForward,
+						Priority: nftables.ChainPriorityFilter,
+						Rules: []nufftablestest.Rule{
+							// iifname "eth0" ip saddr 10.0.0.0/8 tcp dport 8000-8010
+							// ct state established,related fib daddr type local
+							// counter accept comment "web"
+							append(append(append([]expr.Any{
+								&expr.Meta{Key: expr.MetaKeyIIFNAME, Register: 1},
+								&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte("eth0\x00")},
+								&expr.Meta{Key: expr.MetaKeyNFPROTO, Register: 1},
+								&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{unix.NFPROTO_IPV4}},
+							}, nufftablestest.SAddr4("10.0.0.0/8")...), tcp...),
+								dport,
+								&expr.Range{Op: expr.CmpOpEq, Register: 1,
+									FromData: []byte{0x1f, 0x40}, ToData: []byte{0x1f, 0x4a}},
+								&expr.Ct{Key: expr.CtKeySTATE, Register: 1},
+								&expr.Bitwise{SourceRegister: 1, DestRegister: 1, Len: 4,
+									Mask: hostUint32(uint32(CtStateRelated | CtStateEstablished)), Xor: []byte{0, 0, 0, 0}},
+								&expr.Cmp{Op: expr.CmpOpNeq, Register: 1, Data: []byte{0, 0, 0, 0}},
+								&expr.Fib{Register: 1, FlagDADDR: true, ResultADDRTYPE: true},
+								&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: hostUint32(unix.RTN_LOCAL)},
+								&expr.Counter{},
+								&expr.Verdict{Kind: expr.VerdictAccept}),
+							// tcp dport vmap @ports
+							append(tcp, dport,
+								&expr.Lookup{SourceRegister: 1, DestRegister: 0, IsDestRegSet: true, SetName: "ports"}),
+						},
+					},
+					{Name: "web"},
+				},
+			},
+			{
+				Name:   "nat",
+				Family: nftables.TableFamilyIPv4,
+				Chains: []nufftablestest.Chain{{
+					Name:     "prerouting",
+					Type:     nftables.ChainTypeNAT,
+					Hook:     nftables.ChainHookPrerouting,
+					Priority: nftables.ChainPriorityNATDest,
+					Rules: []nufftablestest.Rule{
+						// tcp dport 80 dnat to 10.0.0.1:8080
+						append(tcp, dport,
+							&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{0, 80}},
+							&expr.Immediate{Register: 1, Data: []byte{10, 0, 0, 1}},
+							&expr.Immediate{Register: 2, Data: []byte{0x1f, 0x90}},
+							&expr.NAT{Type: expr.NATTypeDestNAT, Family: unix.NFPROTO_IPV4,
+								RegAddrMin: 1, RegProtoMin: 2}),
+					},
+				}},
+			},
+		})
+		tables, err := nufftables.GetAllTables(conn)
+		Expect(err).NotTo(HaveOccurred())
+
+		fw := tables.Table("fw", nufftables.TableFamilyINet)
+		Expect(fw).NotTo(BeNil())
+		forward := fw.ChainsByName["forward"]
+		Expect(forward.Rules).To(HaveLen(2))
+
+		rule := &forward.Rules[0]
+		exprs := rule.Expressions()
+		Expect(IfaceMatches(exprs)).To(ConsistOf(HaveField("Name", "eth0")))
+		Expect(RuleAddrMatches(rule)).To(ConsistOf(HaveField("Prefix.String()", "10.0.0.0/8")))
+		Expect(RulePortMatches(rule)).To(ConsistOf(And(
+			HaveField("Protocol", "tcp"),
+			HaveField("Ranges", ConsistOf(PortRange{Min: 8000, Max: 8010})))))
+		_, ct := MatchCt(exprs, expr.CtKeySTATE)
+		Expect(ct).NotTo(BeNil())
+		Expect(ct.States()).To(Equal(CtStateRelated | CtStateEstablished))
+		Expect(Lift(exprs).Predicates).To(ContainElement(
+			HaveField("Operand.Field", BeAssignableToTypeOf(&expr.Fib{}))))
+		Expect(RuleVerdict(rule).Kind).To(Equal(VerdictAccept))
+
+		vmap := RuleDispatchTable(&forward.Rules[1])
+		Expect(vmap).NotTo(BeNil())
+		Expect(vmap.Names()).To(ConsistOf("tcp dport"))
+		Expect(vmap.Entries).To(ConsistOf(HaveField("Verdict.Target", fw.ChainsByName["web"])))
+
+		nat := tables.Table("nat", nufftables.TableFamilyIPv4)
+		Expect(nat).NotTo(BeNil())
+		_, dnat := TargetNAT(nat.ChainsByName["prerouting"].Rules[0].Expressions(), DNAT)
+		Expect(dnat).NotTo(BeNil())
+		Expect(dnat.String()).To(Equal("dnat to 10.0.0.1:8080"))
+	})
+
+})
@@ -0,0 +1,277 @@
+// Copyright 2023 Harald Albrecht.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy
+// of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package dsl
+
+import (
+	"net/netip"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"github.com/thediveo/nufftables"
+)
+
+// AddrDirection tells whether a packet's source or destination address is
+// being matched.
+type AddrDirection int
+
+// Address match directions.
+const (
+	SourceAddr      AddrDirection = iota // matches the source address (saddr)
+	DestinationAddr                      // matches the destination address (daddr)
+)
+
+// String returns the nft name of the address direction, that is, either
+// “saddr” or “daddr”.
+func (d AddrDirection) String() string {
+	if d == DestinationAddr {
+		return "daddr"
+	}
+	return "saddr"
+}
+
+// AddrMatch describes matching an IPv4 or IPv6 source or destination address
+// against a single address, a CIDR prefix, an address range, or the elements
+// of a named set.
+type AddrMatch struct {
+	Direction AddrDirection
+	// Op is either OpEq, OpNeq, OpInRange, OpNotInRange, OpInSet, or
+	// OpNotInSet.
+	Op PredicateOp
+	// Prefix is the address prefix matched for OpEq and OpNeq; single
+	// addresses are represented as /32 or /128 prefixes.
+	Prefix netip.Prefix
+	// From and To are the inclusive address range for OpInRange and
+	// OpNotInRange.
+	From, To netip.Addr
+	// Set is the name of the set looked up for OpInSet and OpNotInSet.
+	Set string
+
+	is6 bool
+}
+
+// Is6 returns true if this is an IPv6 address match.
+func (m *AddrMatch) Is6() bool {
+	return m.is6
+}
+
+// Inverted returns true if this address match is inverted (“!=”).
+func (m *AddrMatch) Inverted() bool {
+	switch m.Op {
+	case OpNeq, OpNotInRange, OpNotInSet:
+		return true
+	}
+	return false
+}
+
+// String returns the address match in nft notation, such as “ip saddr
+// 10.0.0.0/8”, “ip6 daddr != fe80::1”, or “ip saddr @allowed”.
+func (m *AddrMatch) String() string {
+	proto := "ip"
+	if m.is6 {
+		proto = "ip6"
+	}
+	op := ""
+	if m.Inverted() {
+		op = "!= "
+	}
+	s := proto + " " + m.Direction.String() + " " + op
+	switch m.Op {
+	case OpInRange, OpNotInRange:
+		return s + m.From.String() + "-" + m.To.String()
+	case OpInSet, OpNotInSet:
+		return s + "@" + m.Set
+	}
+	if m.Prefix.IsSingleIP() {
+		return s + m.Prefix.Addr().String()
+	}
+	return s + m.Prefix.String()
+}
+
+// Overlaps returns true if some addresses from the specified prefix might be
+// matched. As set elements aren't known, Overlaps always returns true for set
+// lookups of the same IP family. Overlaps returns false if the prefix is of a
+// different IP family than this address match.
+func (m *AddrMatch) Overlaps(prefix netip.Prefix) bool {
+	prefix = prefix.Masked()
+	if m.is6 != prefix.Addr().Is6() {
+		return false
+	}
+	switch m.Op {
+	case OpEq:
+		return m.Prefix.Overlaps(prefix)
+	case OpNeq:
+		return !(prefix.Bits() >= m.Prefix.Bits() && m.Prefix.Contains(prefix.Addr()))
+	case OpInRange, OpNotInRange:
+		first, last := prefix.Addr(), lastAddr(prefix)
+		if m.Op == OpInRange {
+			return first.Compare(m.To) <= 0 && last.Compare(m.From) >= 0
+		}
+		return first.Compare(m.From) < 0 || last.Compare(m.To) > 0
+	}
+	return true
+}
+
+// lastAddr returns the last address of the specified prefix.
+func lastAddr(prefix netip.Prefix) netip.Addr {
+	addr := prefix.Addr().AsSlice()
+	for bit := prefix.Bits(); bit < len(addr)*8; bit++ {
+		addr[bit/8] |= 0x80 >> (bit % 8)
+	}
+	last, _ := netip.AddrFromSlice(addr)
+	return last
+}
+
+// MatchAddr returns the first IPv4 or IPv6 source or destination address
+// match, as well as the remaining expressions after the match. If no address
+// match was found, then the remaining expressions are returned as nil,
+// together with a nil address match.
+//
+// MatchAddr tracks the register dataflow (see also [Lift]), so it correctly
+// tells source from destination addresses, and also handles CIDR prefixes,
+// inverted matches, address ranges, and set lookups. As the table family isn't
+// known, MatchAddr determines the network protocol only from “meta nfproto”,
+// “meta protocol”, and “ether type” predicates, if present; see also
+// [RuleAddrMatches].
+func MatchAddr(exprs nufftables.Expressions) (nufftables.Expressions, *AddrMatch) {
+	rule := Lift(exprs)
+	l3family := rule.L3Family(nftables.TableFamilyUnspecified)
+	for _, pred := range rule.Predicates {
+		if match := addrMatch(l3family, &pred); match != nil {
+			return after(exprs, pred.Exprs), match
+		}
+	}
+	return nil, nil
+}
+
+// OptionalMatchAddr returns the next IPv4 or IPv6 source or destination
+// address match, if any, or nil. It either returns the remaining expressions or
+// the original expressions if no address match could be found.
+func OptionalMatchAddr(exprs nufftables.Expressions) (nufftables.Expressions, *AddrMatch) {
+	remexprs, match := MatchAddr(exprs)
+	if match == nil {
+		return exprs, nil
+	}
+	return remexprs, match
+}
+
+// AddrMatches returns all IPv4 and IPv6 source and destination address
+// matches of the specified expressions. Similar to [MatchAddr], the network
+// protocol is determined only from the predicates of the expressions; use
+// [RuleAddrMatches] when the rule and thus its table family are known.
+func AddrMatches(exprs nufftables.Expressions) []AddrMatch {
+	return FamilyAddrMatches(nftables.TableFamilyUnspecified, exprs)
+}
+
+// FamilyAddrMatches returns all IPv4 and IPv6 source and destination address
+// matches of the specified expressions belonging to a rule in a table of the
+// specified family. For the arp family, as well as for bridge and netdev rules
+// matching non-IP traffic, FamilyAddrMatches returns nil.
+func FamilyAddrMatches(family nftables.TableFamily, exprs nufftables.Expressions) []AddrMatch {
+	var matches []AddrMatch
+	rule := Lift(exprs)
+	l3family := rule.L3Family(family)
+	for _, pred := range rule.Predicates {
+		if match := addrMatch(l3family, &pred); match != nil {
+			matches = append(matches, *match)
+		}
+	}
+	return matches
+}
+
+// RuleAddrMatches returns all IPv4 and IPv6 source and destination address
+// matches of the specified rule, taking the family of the rule's table into
+// account.
+func RuleAddrMatches(rule *nufftables.Rule) []AddrMatch {
+	family := nftables.TableFamilyUnspecified
+	if rule.Chain != nil && rule.Chain.Table != nil {
+		family = rule.Chain.Table.Family
+	}
+	return FamilyAddrMatches(family, rule.Expressions())
+}
+
+// addrMatch returns the address match for the specified predicate, or nil if
+// the predicate doesn't match an IPv4 or IPv6 address. The network protocol
+// family l3family restricts the address matches to either IPv4 or IPv6, if
+// known, while it rules out any address matches for ARP.
+func addrMatch(l3family nftables.TableFamily, pred *Predicate) *AddrMatch {
+	payload, ok := pred.Operand.Field.(*expr.Payload)
+	if !ok || payload.Base != expr.PayloadBaseNetworkHeader {
+		return nil
+	}
+	if l3family == nftables.TableFamilyARP {
+		return nil
+	}
+	// Please note that byte-aligned prefixes are matched by loading only the
+	// prefix bytes of an address, such as “payload load 1b @ network header +
+	// 12” for “ip saddr 10.0.0.0/8”.
+	var dir AddrDirection
+	addrlen := 4
+	switch {
+	case payload.Offset == 12 && payload.Len <= 4:
+		dir = SourceAddr
+	case payload.Offset == 16 && payload.Len <= 4:
+		dir = DestinationAddr
+	case payload.Offset == 8 && payload.Len >= 2 && payload.Len <= 16:
+		// a single byte at offset 8 is the IPv4 TTL instead.
+		dir, addrlen = SourceAddr, 16
+	case payload.Offset == 24 && payload.Len <= 16:
+		dir, addrlen = DestinationAddr, 16
+	default:
+		return nil
+	}
+	switch l3family {
+	case nftables.TableFamilyIPv4:
+		if addrlen != 4 {
+			return nil
+		}
+	case nftables.TableFamilyIPv6:
+		if addrlen != 16 {
+			return nil
+		}
+	}
+	match := &AddrMatch{Direction: dir, Op: pred.Op, is6: addrlen == 16}
+	switch pred.Op {
+	case OpEq, OpNeq:
+		if len(pred.Value) != int(payload.Len) {
+			return nil
+		}
+		data := make([]byte, addrlen)
+		copy(data, pred.Value)
+		addr, _ := netip.AddrFromSlice(data)
+		bits, ok := pred.Prefix()
+		if !ok {
+			return nil
+		}
+		match.Prefix = netip.PrefixFrom(addr, bits).Masked()
+	case OpInRange, OpNotInRange:
+		from, ok := netip.AddrFromSlice(pred.Value)
+		if !ok || len(pred.Value) != addrlen || pred.Operand.Mask != nil {
+			return nil
+		}
+		to, ok := netip.AddrFromSlice(pred.ValueTo)
+		if !ok || len(pred.ValueTo) != addrlen {
+			return nil
+		}
+		match.From, match.To = from, to
+	case OpInSet, OpNotInSet:
+		if pred.Operand.Concat != nil || int(payload.Len) != addrlen {
+			return nil
+		}
+		match.Set = pred.Set
+	default:
+		return nil
+	}
+	return match
+}
@@ -0,0 +1,154 @@
+// Copyright 2023 Harald Albrecht.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy
+// of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package dsl
+
+import (
+	"net/netip"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"github.com/thediveo/nufftables"
+	"golang.org/x/sys/unix"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("matching addresses", func() {
+
+	It("tells source from destination and returns the remaining expressions", func() {
+		counter := &expr.Counter{}
+		exprs := nufftables.Expressions{
+			payload(expr.PayloadBaseNetworkHeader, 16, 4),
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: ip("10.0.0.1")},
+			counter,
+		}
+		remexprs, match := MatchAddr(exprs)
+		Expect(match).NotTo(BeNil())
+		Expect(remexprs).To(ConsistOf(counter))
+		Expect(match.Direction).To(Equal(DestinationAddr))
+		Expect(match.Direction.String()).To(Equal("daddr"))
+		Expect(match.Op).To(Equal(OpEq))
+		Expect(match.Prefix).To(Equal(netip.MustParsePrefix("10.0.0.1/32")))
+		Expect(match.Is6()).To(BeFalse())
+		Expect(match.Inverted()).To(BeFalse())
+		Expect(match.String()).To(Equal("ip daddr 10.0.0.1"))
+
+		remexprs, match = MatchAddr(nufftables.Expressions{counter})
+		Expect(remexprs).To(BeNil())
+		Expect(match).To(BeNil())
+
+		remexprs, match = OptionalMatchAddr(nufftables.Expressions{counter})
+		Expect(remexprs).To(ConsistOf(counter))
+		Expect(match).To(BeNil())
+	})
+
+	It("does not mistake the IPv4 TTL for an IPv6 source address", func() {
+		Expect(AddrMatches(nufftables.Expressions{
+			payload(expr.PayloadBaseNetworkHeader, 8, 1),
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{64}},
+		})).To(BeEmpty())
+	})
+
+	It("matches prefixes, inequalities, ranges, and sets", func() {
+		matches := AddrMatches(nufftables.Expressions{
+			// ip saddr 10.0.0.0/8
+			payload(expr.PayloadBaseNetworkHeader, 12, 1),
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{10}},
+			// ip daddr != 192.168.0.0/20
+			payload(expr.PayloadBaseNetworkHeader, 16, 3),
+			&expr.Bitwise{SourceRegister: 1, DestRegister: 1, Len: 3,
+				Mask: []byte{0xff, 0xff, 0xf0}, Xor: []byte{0, 0, 0}},
+			&expr.Cmp{Op: expr.CmpOpNeq, Register: 1, Data: []byte{192, 168, 0}},
+			// ip6 saddr fe80::1-fe80::ff
+			payload(expr.PayloadBaseNetworkHeader, 8, 16),
+			&expr.Range{Op: expr.CmpOpEq, Register: 1, FromData: ip("fe80::1"), ToData: ip("fe80::ff")},
+			// ip6 daddr != @blocked
+			payload(expr.PayloadBaseNetworkHeader, 24, 16),
+			&expr.Lookup{SourceRegister: 1, SetName: "blocked", Invert: true},
+		})
+		Expect(matches).To(HaveLen(4))
+
+		Expect(matches[0].Direction).To(Equal(SourceAddr))
+		Expect(matches[0].Prefix).To(Equal(netip.MustParsePrefix("10.0.0.0/8")))
+		Expect(matches[0].Overlaps(netip.MustParsePrefix("10.1.0.0/16"))).To(BeTrue())
+		Expect(matches[0].Overlaps(netip.MustParsePrefix("0.0.0.0/0"))).To(BeTrue())
+		Expect(matches[0].Overlaps(netip.MustParsePrefix("11.0.0.0/8"))).To(BeFalse())
+		Expect(matches[0].Overlaps(netip.MustParsePrefix("fe80::/64"))).To(BeFalse())
+		Expect(matches[0].String()).To(Equal("ip saddr 10.0.0.0/8"))
+
+		Expect(matches[1].Direction).To(Equal(DestinationAddr))
+		Expect(matches[1].Op).To(Equal(OpNeq))
+		Expect(matches[1].Inverted()).To(BeTrue())
+		Expect(matches[1].Prefix).To(Equal(netip.MustParsePrefix("192.168.0.0/20")))
+		Expect(matches[1].Overlaps(netip.MustParsePrefix("192.168.1.0/24"))).To(BeFalse())
+		Expect(matches[1].Overlaps(netip.MustParsePrefix("192.168.0.0/16"))).To(BeTrue())
+		Expect(matches[1].String()).To(Equal("ip daddr != 192.168.0.0/20"))
+
+		Expect(matches[2].Op).To(Equal(OpInRange))
+		Expect(matches[2].Is6()).To(BeTrue())
+		Expect(matches[2].From).To(Equal(netip.MustParseAddr("fe80::1")))
+		Expect(matches[2].To).To(Equal(netip.MustParseAddr("fe80::ff")))
+		Expect(matches[2].Overlaps(netip.MustParsePrefix("fe80::/120"))).To(BeTrue())
+		Expect(matches[2].Overlaps(netip.MustParsePrefix("fe80::100/120"))).To(BeFalse())
+		Expect(matches[2].String()).To(HaveSuffix(" fe80::1-fe80::ff"))
+
+		Expect(matches[3].Direction).To(Equal(DestinationAddr))
+		Expect(matches[3].Op).To(Equal(OpNotInSet))
+		Expect(matches[3].Set).To(Equal("blocked"))
+		Expect(matches[3].Is6()).To(BeTrue())
+		Expect(matches[3].Overlaps(netip.MustParsePrefix("::/0"))).To(BeTrue())
+		Expect(matches[3].String()).To(Equal("ip6 daddr != @blocked"))
+	})
+
+	It("doesn't mistake ARP addresses for IP addresses", func() {
+		arpdaddr := nufftables.Expressions{
+			// arp daddr ip 10.0.0.1
+			payload(expr.PayloadBaseNetworkHeader, 24, 4),
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: ip("10.0.0.1")},
+		}
+		Expect(FamilyAddrMatches(nftables.TableFamilyARP, arpdaddr)).To(BeEmpty())
+		Expect(FamilyAddrMatches(nftables.TableFamilyIPv4, arpdaddr)).To(BeEmpty())
+
+		bridged := append(nufftables.Expressions{
+			payload(expr.PayloadBaseLLHeader, 12, 2),
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{unix.ETH_P_ARP >> 8, unix.ETH_P_ARP & 0xff}},
+		}, arpdaddr...)
+		Expect(FamilyAddrMatches(nftables.TableFamilyBridge, bridged)).To(BeEmpty())
+		Expect(AddrMatches(bridged)).To(BeEmpty())
+
+		rule := &nufftables.Rule{
+			Rule: &nftables.Rule{Exprs: arpdaddr},
+			Chain: &nufftables.Chain{Table: &nufftables.Table{
+				Table: &nftables.Table{Family: nftables.TableFamilyARP},
+			}},
+		}
+		Expect(RuleAddrMatches(rule)).To(BeEmpty())
+		rule.Chain.Table.Family = nftables.TableFamilyIPv6
+		Expect(RuleAddrMatches(rule)).To(ConsistOf(
+			HaveField("Prefix", netip.MustParsePrefix("a00:1::/32"))))
+	})
+
+	It("restricts address matches to the table family", func() {
+		exprs := nufftables.Expressions{
+			payload(expr.PayloadBaseNetworkHeader, 12, 4),
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: ip("10.0.0.1")},
+		}
+		Expect(FamilyAddrMatches(nftables.TableFamilyIPv6, exprs)).To(BeEmpty())
+		Expect(FamilyAddrMatches(nftables.TableFamilyINet, exprs)).To(ConsistOf(
+			HaveField("Prefix", netip.MustParsePrefix("10.0.0.1/32"))))
+	})
+
+})
@@ -0,0 +1,139 @@
+// Copyright 2023 Harald Albrecht.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy
+// of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package dsl
+
+import (
+	"strings"
+
+	"github.com/google/nftables/expr"
+	"github.com/google/nftables/xt"
+	"github.com/thediveo/nufftables"
+)
+
+// AddrTypes is a set of address (route) types, such as LOCAL, UNICAST, et
+// cetera, as matched by the xt “addrtype” match extension and by “fib daddr
+// type”.
+type AddrTypes uint16
+
+// Address types; these correspond with the [xt.AddrTypeFlags] bits.
+const (
+	AddrTypeUnspec      = AddrTypes(xt.AddrTypeUnspec)
+	AddrTypeUnicast     = AddrTypes(xt.AddrTypeUnicast)
+	AddrTypeLocal       = AddrTypes(xt.AddrTypeLocal)
+	AddrTypeBroadcast   = AddrTypes(xt.AddrTypeBroadcast)
+	AddrTypeAnycast     = AddrTypes(xt.AddrTypeAnycast)
+	AddrTypeMulticast   = AddrTypes(xt.AddrTypeMulticast)
+	AddrTypeBlackhole   = AddrTypes(xt.AddrTypeBlackhole)
+	AddrTypeUnreachable = AddrTypes(xt.AddrTypeUnreachable)
+	AddrTypeProhibit    = AddrTypes(xt.AddrTypeProhibit)
+	AddrTypeThrow       = AddrTypes(xt.AddrTypeThrow)
+	AddrTypeNat         = AddrTypes(xt.AddrTypeNat)
+	AddrTypeXresolve    = AddrTypes(xt.AddrTypeXresolve)
+)
+
+var addrTypeNames = []string{
+	"UNSPEC", "UNICAST", "LOCAL", "BROADCAST", "ANYCAST", "MULTICAST",
+	"BLACKHOLE", "UNREACHABLE", "PROHIBIT", "THROW", "NAT", "XRESOLVE",
+}
+
+// String returns the address types in iptables notation, such as
+// “LOCAL,BROADCAST”.
+func (t AddrTypes) String() string {
+	names := []string{}
+	for bit, name := range addrTypeNames {
+		if t&(1<<bit) != 0 {
+			names = append(names, name)
+		}
+	}
+	return strings.Join(names, ",")
+}
+
+// AddrTypeMatch describes an xt “addrtype” match. A zero Source or Dest means
+// that the source or destination address type isn't matched.
+type AddrTypeMatch struct {
+	Source, Dest             AddrTypes
+	InvertSource, InvertDest bool
+	// LimitIfaceIn and LimitIfaceOut limit address type lookups to the
+	// incoming or outgoing interface.
+	LimitIfaceIn, LimitIfaceOut bool
+}
+
+// String returns the address type match in iptables notation, such as
+// “addrtype --dst-type LOCAL” or “addrtype ! --src-type LOCAL
+// --limit-iface-in”.
+func (m *AddrTypeMatch) String() string {
+	var b strings.Builder
+	b.WriteString("addrtype")
+	if m.Source != 0 {
+		if m.InvertSource {
+			b.WriteString(" !")
+		}
+		b.WriteString(" --src-type " + m.Source.String())
+	}
+	if m.Dest != 0 {
+		if m.InvertDest {
+			b.WriteString(" !")
+		}
+		b.WriteString(" --dst-type " + m.Dest.String())
+	}
+	if m.LimitIfaceIn {
+		b.WriteString(" --limit-iface-in")
+	}
+	if m.LimitIfaceOut {
+		b.WriteString(" --limit-iface-out")
+	}
+	return b.String()
+}
+
+// Flags of the xt “addrtype” match extension revision 1.
+const (
+	xtAddrTypeInvertSource  = 0x1
+	xtAddrTypeInvertDest    = 0x2
+	xtAddrTypeLimitIfaceIn  = 0x4
+	xtAddrTypeLimitIfaceOut = 0x8
+)
+
+// MatchAddrType returns the information from the first xt “addrtype” match
+// extension, together with the remaining expressions after the match. If no
+// match is found, then nil is returned for the remaining expressions.
+func MatchAddrType(exprs nufftables.Expressions) (nufftables.Expressions, *AddrTypeMatch) {
+	return matchXt(exprs, decodeAddrType)
+}
+
+// decodeAddrType decodes the xt “addrtype” match extension.
+func decodeAddrType(match *expr.Match) (*AddrTypeMatch, bool) {
+	if match.Name != "addrtype" {
+		return nil, false
+	}
+	switch info := match.Info.(type) {
+	case *xt.AddrType:
+		return &AddrTypeMatch{
+			Source:       AddrTypes(info.Source),
+			Dest:         AddrTypes(info.Dest),
+			InvertSource: info.InvertSource,
+			InvertDest:   info.InvertDest,
+		}, true
+	case *xt.AddrTypeV1:
+		return &AddrTypeMatch{
+			Source:        AddrTypes(info.Source),
+			Dest:          AddrTypes(info.Dest),
+			InvertSource:  info.Flags&xtAddrTypeInvertSource != 0,
+			InvertDest:    info.Flags&xtAddrTypeInvertDest != 0,
+			LimitIfaceIn:  info.Flags&xtAddrTypeLimitIfaceIn != 0,
+			LimitIfaceOut: info.Flags&xtAddrTypeLimitIfaceOut != 0,
+		}, true
+	}
+	return nil, false
+}
@@ -0,0 +1,64 @@
+// Copyright 2023 Harald Albrecht.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy
+// of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package dsl
+
+import (
+	"github.com/google/nftables/expr"
+	"github.com/thediveo/nufftables"
+)
+
+// MatchComment returns the comment from the first xt “comment” match
+// extension, together with the remaining expressions after the match. If no
+// match is found, then nil is returned for the remaining expressions.
+func MatchComment(exprs nufftables.Expressions) (nufftables.Expressions, string) {
+	return matchXt(exprs, decodeComment)
+}
+
+// decodeComment decodes the xt “comment” match extension.
+func decodeComment(match *expr.Match) (string, bool) {
+	info, ok := unknownInfo(match, "comment", 0)
+	if !ok {
+		return "", false
+	}
+	return cString(info), true
+}
+
+// udataRuleComment is the type of the comment in the user data of a rule, as
+// stored by nft, iptables-nft, and knftables (NFTNL_UDATA_RULE_COMMENT).
+const udataRuleComment = 0
+
+// RuleComment returns the comment of the specified rule, or "" if the rule has
+// no comment. Rule comments are either stored in the user data of a rule, as
+// nft and iptables-nft do, or otherwise in an xt “comment” match extension.
+func RuleComment(rule *nufftables.Rule) string {
+	if rule.Rule == nil {
+		return ""
+	}
+	// The user data are type-length-value attributes with 8bit types and
+	// lengths.
+	udata := rule.UserData
+	for len(udata) >= 2 {
+		typ, l := udata[0], int(udata[1])
+		if len(udata) < 2+l {
+			break
+		}
+		if typ == udataRuleComment {
+			return cString(udata[2 : 2+l])
+		}
+		udata = udata[2+l:]
+	}
+	_, comment := MatchComment(rule.Expressions())
+	return comment
+}
@@ -0,0 +1,199 @@
+// Copyright 2023 Harald Albrecht.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy
+// of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package dsl
+
+import (
+	"net"
+	"net/netip"
+	"strings"
+
+	"github.com/google/nftables/expr"
+	"github.com/google/nftables/xt"
+	"github.com/thediveo/nufftables"
+)
+
+// CtStates is a set of conntrack states, as matched by the xt “conntrack” and
+// “state” match extensions, as well as by “ct state”.
+type CtStates uint16
+
+// Conntrack states; please note that the SNAT and DNAT virtual states are only
+// supported by the xt “conntrack” match extension.
+const (
+	CtStateInvalid     CtStates = 1 << 0
+	CtStateEstablished CtStates = 1 << 1
+	CtStateRelated     CtStates = 1 << 2
+	CtStateNew         CtStates = 1 << 3
+	CtStateSNAT        CtStates = 1 << 6
+	CtStateDNAT        CtStates = 1 << 7
+	CtStateUntracked   CtStates = 1 << 8
+)
+
+var ctStateNames = []struct {
+	state CtStates
+	name  string
+}{
+	{CtStateInvalid, "invalid"},
+	{CtStateEstablished, "established"},
+	{CtStateRelated, "related"},
+	{CtStateNew, "new"},
+	{CtStateSNAT, "snat"},
+	{CtStateDNAT, "dnat"},
+	{CtStateUntracked, "untracked"},
+}
+
+// String returns the conntrack states in nft notation, such as
+// “established,related”.
+func (s CtStates) String() string {
+	names := []string{}
+	for _, state := range ctStateNames {
+		if s&state.state != 0 {
+			names = append(names, state.name)
+		}
+	}
+	return strings.Join(names, ",")
+}
+
+// CtStatus is a set of conntrack status bits.
+type CtStatus uint16
+
+// Conntrack status bits.
+const (
+	CtStatusExpected  CtStatus = 1 << 0
+	CtStatusSeenReply CtStatus = 1 << 1
+	CtStatusAssured   CtStatus = 1 << 2
+	CtStatusConfirmed CtStatus = 1 << 3
+	CtStatusSNAT      CtStatus = 1 << 4
+	CtStatusDNAT      CtStatus = 1 << 5
+)
+
+// ConntrackMatch describes an xt “conntrack” or “state” match. Flags tells
+// which conditions are actually matched, and Invert which of them are
+// inverted. Only the fields of matched conditions are valid.
+type ConntrackMatch struct {
+	Flags  xt.ConntrackFlags
+	Invert xt.ConntrackFlags
+
+	States                 CtStates
+	Status                 CtStatus
+	L4Proto                uint16
+	OrigSrc, OrigDst       netip.Prefix
+	ReplSrc, ReplDst       netip.Prefix
+	OrigSrcPorts           PortRange
+	OrigDstPorts           PortRange
+	ReplSrcPorts           PortRange
+	ReplDstPorts           PortRange
+	ExpiresMin, ExpiresMax uint32
+}
+
+// Matches returns true if the specified condition is matched.
+func (m *ConntrackMatch) Matches(flag xt.ConntrackFlags) bool {
+	return m.Flags&flag != 0
+}
+
+// Inverted returns true if the specified condition is inverted.
+func (m *ConntrackMatch) Inverted(flag xt.ConntrackFlags) bool {
+	return m.Invert&flag != 0
+}
+
+// MatchConntrack returns the information from the first xt “conntrack” or
+// “state” match extension, together with the remaining expressions after the
+// match. If no match is found, then nil is returned for the remaining
+// expressions.
+func MatchConntrack(exprs nufftables.Expressions) (nufftables.Expressions, *ConntrackMatch) {
+	return matchXt(exprs, decodeConntrack)
+}
+
+// decodeConntrack decodes the xt “conntrack” and “state” match extensions.
+func decodeConntrack(match *expr.Match) (*ConntrackMatch, bool) {
+	if match.Name == "state" {
+		info, ok := unknownInfo(match, "state", 4)
+		if !ok {
+			return nil, false
+		}
+		states := CtStates(hostOrder.Uint32(info))
+		if states&(1<<6) != 0 {
+			// the state match uses a different bit for untracked.
+			states = states&^(1<<6) | CtStateUntracked
+		}
+		return &ConntrackMatch{Flags: xt.ConntrackState, States: states}, true
+	}
+	if match.Name != "conntrack" {
+		return nil, false
+	}
+	var base *xt.ConntrackMtinfoBase
+	m := &ConntrackMatch{}
+	switch info := match.Info.(type) {
+	case *xt.ConntrackMtinfo1:
+		base = &info.ConntrackMtinfoBase
+		m.States, m.Status = CtStates(info.StateMask), CtStatus(info.StatusMask)
+	case *xt.ConntrackMtinfo2:
+		base = &info.ConntrackMtinfoBase
+		m.States, m.Status = CtStates(info.StateMask), CtStatus(info.StatusMask)
+	case *xt.ConntrackMtinfo3:
+		base = &info.ConntrackMtinfoBase
+		m.States, m.Status = CtStates(info.StateMask), CtStatus(info.StatusMask)
+		m.OrigSrcPorts.Max = info.OrigSrcPortHigh
+		m.OrigDstPorts.Max = info.OrigDstPortHigh
+		m.ReplSrcPorts.Max = info.ReplSrcPortHigh
+		m.ReplDstPorts.Max = info.ReplDstPortHigh
+	default:
+		return nil, false
+	}
+	m.Flags = xt.ConntrackFlags(base.MatchFlags)
+	m.Invert = xt.ConntrackFlags(base.InvertFlags)
+	m.L4Proto = base.L4Proto
+	m.OrigSrc = prefixOf(base.OrigSrcAddr, base.OrigSrcMask)
+	m.OrigDst = prefixOf(base.OrigDstAddr, base.OrigDstMask)
+	m.ReplSrc = prefixOf(base.ReplSrcAddr, base.ReplSrcMask)
+	m.ReplDst = prefixOf(base.ReplDstAddr, base.ReplDstMask)
+	// Ports are in network byte order, but have been read in host byte order.
+	m.OrigSrcPorts = portRangeOf(ntohs(base.OrigSrcPort), ntohs(m.OrigSrcPorts.Max))
+	m.OrigDstPorts = portRangeOf(ntohs(base.OrigDstPort), ntohs(m.OrigDstPorts.Max))
+	m.ReplSrcPorts = portRangeOf(ntohs(base.ReplSrcPort), ntohs(m.ReplSrcPorts.Max))
+	m.ReplDstPorts = portRangeOf(ntohs(base.ReplDstPort), ntohs(m.ReplDstPorts.Max))
+	m.ExpiresMin, m.ExpiresMax = base.ExpiresMin, base.ExpiresMax
+	return m, true
+}
+
+// prefixOf returns the prefix for the specified address and mask, or the
+// zero prefix if invalid.
+func prefixOf(ip net.IP, mask net.IPMask) netip.Prefix {
+	addr, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return netip.Prefix{}
+	}
+	bits, size := mask.Size()
+	if size == 0 {
+		bits = addr.BitLen() // non-canonical mask, so play it safe.
+	}
+	return netip.PrefixFrom(addr, bits)
+}
+
+// portRangeOf returns the port range [min..max], where a max of zero
+// indicates a single port.
+func portRangeOf(min, max uint16) PortRange {
+	if max < min {
+		max = min
+	}
+	return PortRange{Min: min, Max: max}
+}
+
+// ntohs converts a 16bit value read in host byte order, but being in network
+// byte order, into host byte order.
+func ntohs(v uint16) uint16 {
+	var b [2]byte
+	hostOrder.PutUint16(b[:], v)
+	return uint16(b[0])<<8 | uint16(b[1])
+}
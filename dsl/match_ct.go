@@ -0,0 +1,127 @@
+// Copyright 2023 Harald Albrecht.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy
+// of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package dsl
+
+import (
+	"strconv"
+
+	"github.com/google/nftables/expr"
+	"github.com/thediveo/nufftables"
+)
+
+// CtMatch describes matching conntrack information, such as “ct state
+// established,related”, “ct mark 0x42”, “ct zone 1”, or “ct status dnat”.
+type CtMatch struct {
+	Key expr.CtKey
+	ValueMatch
+}
+
+// States returns the conntrack states matched by a “ct state” match, such as
+// “ct state established,related” or “ct state new”. States returns zero for
+// other conntrack keys and for set lookups.
+func (m *CtMatch) States() CtStates {
+	if m.Key != expr.CtKeySTATE {
+		return 0
+	}
+	return CtStates(m.flags())
+}
+
+// Status returns the conntrack status bits matched by a “ct status” match.
+// Status returns zero for other conntrack keys and for set lookups.
+func (m *CtMatch) Status() CtStatus {
+	if m.Key != expr.CtKeySTATUS {
+		return 0
+	}
+	return CtStatus(m.flags())
+}
+
+// flags returns the flag bits matched by a bit mask match; nft expresses
+// “ct state established,related” as “(ct state & 0x06) != 0”, and “ct state
+// new” as “ct state == 0x08”.
+func (m *CtMatch) flags() uint32 {
+	switch {
+	case m.Op == OpNeq && m.Value == 0 && m.Mask != ^uint32(0):
+		return m.Mask
+	case m.Op == OpEq:
+		return m.Value & m.Mask
+	}
+	return 0
+}
+
+// MatchCt returns the first conntrack match with any of the specified keys –
+// or any key if none are specified – as well as the remaining expressions
+// after the match. If no conntrack match was found, then the remaining
+// expressions are returned as nil, together with a nil conntrack match.
+//
+// Please note that the xt “conntrack” and “state” match extensions of
+// iptables-nft are decoded by [MatchConntrack] instead.
+func MatchCt(exprs nufftables.Expressions, keys ...expr.CtKey) (nufftables.Expressions, *CtMatch) {
+	for _, pred := range Lift(exprs).Predicates {
+		if match := ctMatch(&pred, keys); match != nil {
+			return after(exprs, pred.Exprs), match
+		}
+	}
+	return nil, nil
+}
+
+// ctMatch returns the conntrack match for the specified predicate if it
+// matches any of the specified conntrack keys, or nil. Only conntrack keys
+// with scalar values of up to 32 bits are supported.
+func ctMatch(pred *Predicate, keys []expr.CtKey) *CtMatch {
+	ct, ok := pred.Operand.Field.(*expr.Ct)
+	if !ok || ctKeyLen(ct.Key) > 4 {
+		return nil
+	}
+	if len(keys) != 0 && !containsKey(keys, ct.Key) {
+		return nil
+	}
+	// transport protocol ports are in network byte order, all other conntrack
+	// information in host byte order.
+	vm, ok := valueMatch(pred, ct.Key == expr.CtKeyPROTOSRC || ct.Key == expr.CtKeyPROTODST)
+	if !ok {
+		return nil
+	}
+	return &CtMatch{Key: ct.Key, ValueMatch: vm}
+}
+
+var ctKeyNames = map[expr.CtKey]string{
+	expr.CtKeySTATE:      "ct state",
+	expr.CtKeyDIRECTION:  "ct direction",
+	expr.CtKeySTATUS:     "ct status",
+	expr.CtKeyMARK:       "ct mark",
+	expr.CtKeySECMARK:    "ct secmark",
+	expr.CtKeyEXPIRATION: "ct expiration",
+	expr.CtKeyHELPER:     "ct helper",
+	expr.CtKeyL3PROTOCOL: "ct l3proto",
+	expr.CtKeySRC:        "ct saddr",
+	expr.CtKeyDST:        "ct daddr",
+	expr.CtKeyPROTOCOL:   "ct protocol",
+	expr.CtKeyPROTOSRC:   "ct proto-src",
+	expr.CtKeyPROTODST:   "ct proto-dst",
+	expr.CtKeyLABELS:     "ct label",
+	expr.CtKeyPKTS:       "ct packets",
+	expr.CtKeyBYTES:      "ct bytes",
+	expr.CtKeyAVGPKT:     "ct avgpkt",
+	expr.CtKeyZONE:       "ct zone",
+	expr.CtKeyEVENTMASK:  "ct event",
+}
+
+// ctKeyName returns the nft name of the specified conntrack key.
+func ctKeyName(key expr.CtKey) string {
+	if name, ok := ctKeyNames[key]; ok {
+		return name
+	}
+	return "ct " + strconv.FormatUint(uint64(key), 10)
+}
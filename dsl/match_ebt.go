@@ -0,0 +1,222 @@
+// Copyright 2023 Harald Albrecht.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy
+// of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package dsl
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+
+	"github.com/google/nftables/expr"
+	"github.com/thediveo/nufftables"
+)
+
+// Ether8023Match describes an ebtables “802_3” match of IEEE 802.3 frames,
+// matching the DSAP/SSAP and/or the SNAP type.
+type Ether8023Match struct {
+	SAP    uint8  // DSAP and SSAP, if MatchSAP is set.
+	Type   uint16 // SNAP type, if MatchType is set.
+	Flags  Ether8023Flags
+	Invert Ether8023Flags
+}
+
+// Ether8023Flags tells which parts of 802.3 frames are matched.
+type Ether8023Flags uint8
+
+// Parts of 802.3 frames to be matched.
+const (
+	Ether8023SAP  Ether8023Flags = 0x01
+	Ether8023Type Ether8023Flags = 0x02
+)
+
+// Match802_3 returns the information from the first ebtables “802_3” match
+// extension, together with the remaining expressions after the match. If no
+// match is found, then nil is returned for the remaining expressions.
+func Match802_3(exprs nufftables.Expressions) (nufftables.Expressions, *Ether8023Match) {
+	return matchXt(exprs, decode802_3)
+}
+
+// decode802_3 decodes the ebtables “802_3” match extension; struct
+// ebt_802_3_info: sap u8, pad u8, type be16, bitmask u8, invflags u8.
+func decode802_3(match *expr.Match) (*Ether8023Match, bool) {
+	info, ok := unknownInfo(match, "802_3", 6)
+	if !ok {
+		return nil, false
+	}
+	return &Ether8023Match{
+		SAP:    info[0],
+		Type:   binary.BigEndian.Uint16(info[2:]),
+		Flags:  Ether8023Flags(info[4]),
+		Invert: Ether8023Flags(info[5]),
+	}, true
+}
+
+// EtherMarkMatch describes an ebtables “mark_m” match. Unless Any is set, it
+// matches packets with (mark & Mask) == Mark, otherwise packets with (mark &
+// Mask) != 0.
+type EtherMarkMatch struct {
+	Mark, Mask uint32
+	Any        bool
+	Invert     bool
+}
+
+// ebtables “mark_m” match operations.
+const (
+	ebtMarkAnd = 0x01
+	ebtMarkOr  = 0x02
+)
+
+// MatchEtherMark returns the information from the first ebtables “mark_m”
+// match extension, together with the remaining expressions after the match.
+// If no match is found, then nil is returned for the remaining expressions.
+func MatchEtherMark(exprs nufftables.Expressions) (nufftables.Expressions, *EtherMarkMatch) {
+	return matchXt(exprs, decodeEtherMark)
+}
+
+// decodeEtherMark decodes the ebtables “mark_m” match extension; struct
+// ebt_mark_m_info: mark (64bit) long, mask (64bit) long, invert u8, bitmask
+// u8.
+func decodeEtherMark(match *expr.Match) (*EtherMarkMatch, bool) {
+	info, ok := unknownInfo(match, "mark_m", 18)
+	if !ok {
+		return nil, false
+	}
+	return &EtherMarkMatch{
+		Mark:   uint32(hostOrder.Uint64(info[0:])),
+		Mask:   uint32(hostOrder.Uint64(info[8:])),
+		Invert: info[16] != 0,
+		Any:    info[17]&ebtMarkOr != 0,
+	}, true
+}
+
+// AmongMatch describes an ebtables “among” match, matching the source and/or
+// destination MAC addresses, optionally together with IPv4 addresses,
+// against lists of entries.
+type AmongMatch struct {
+	// Dst and Src are the entries the destination and source MAC (and IPv4)
+	// addresses are matched against; nil if not matched at all.
+	Dst, Src             []AmongEntry
+	InvertDst, InvertSrc bool
+}
+
+// AmongEntry is an entry of an ebtables “among” match: a MAC address and an
+// optional IPv4 address, which is invalid if any IPv4 address matches.
+type AmongEntry struct {
+	MAC net.HardwareAddr
+	IP  netip.Addr
+}
+
+// String returns the among entry in ebtables notation, such as
+// “52:54:00:12:34:56=10.0.0.1”.
+func (e AmongEntry) String() string {
+	if !e.IP.IsValid() {
+		return e.MAC.String()
+	}
+	return e.MAC.String() + "=" + e.IP.String()
+}
+
+// String returns the among match in ebtables notation.
+func (m *AmongMatch) String() string {
+	var parts []string
+	list := func(name string, invert bool, entries []AmongEntry) {
+		if entries == nil {
+			return
+		}
+		elems := make([]string, 0, len(entries))
+		for _, e := range entries {
+			elems = append(elems, e.String())
+		}
+		neg := ""
+		if invert {
+			neg = "! "
+		}
+		parts = append(parts, fmt.Sprintf("--among-%s %s%s", name, neg, strings.Join(elems, ",")))
+	}
+	list("dst", m.InvertDst, m.Dst)
+	list("src", m.InvertSrc, m.Src)
+	return strings.Join(parts, " ")
+}
+
+// ebtables “among” match inversion flags.
+const (
+	ebtAmongDstNeg = 0x01
+	ebtAmongSrcNeg = 0x02
+)
+
+// MatchAmong returns the information from the first ebtables “among” match
+// extension, together with the remaining expressions after the match. If no
+// match is found, then nil is returned for the remaining expressions.
+func MatchAmong(exprs nufftables.Expressions) (nufftables.Expressions, *AmongMatch) {
+	return matchXt(exprs, decodeAmong)
+}
+
+// decodeAmong decodes the ebtables “among” match extension; struct
+// ebt_among_info: wh_dst_ofs int, wh_src_ofs int, bitmask int, followed by the
+// “wormhashes” at the specified offsets (relative to the start of the info).
+func decodeAmong(match *expr.Match) (*AmongMatch, bool) {
+	info, ok := unknownInfo(match, "among", 12)
+	if !ok {
+		return nil, false
+	}
+	m := &AmongMatch{}
+	bitmask := hostOrder.Uint32(info[8:])
+	m.InvertDst = bitmask&ebtAmongDstNeg != 0
+	m.InvertSrc = bitmask&ebtAmongSrcNeg != 0
+	if m.Dst, ok = amongWormhash(info, int32(hostOrder.Uint32(info[0:]))); !ok {
+		return nil, false
+	}
+	if m.Src, ok = amongWormhash(info, int32(hostOrder.Uint32(info[4:]))); !ok {
+		return nil, false
+	}
+	return m, true
+}
+
+// Layout of struct ebt_mac_wormhash: table int[257], poolsize int, followed
+// by the pool tuples of cmp u32[2], ip be32, with the MAC address stored in
+// the cmp bytes 2 to 7.
+const (
+	amongPoolsizeOffset = 257 * 4
+	amongPoolOffset     = amongPoolsizeOffset + 4
+	amongTupleSize      = 12
+)
+
+// amongWormhash returns the entries of the wormhash at the specified offset
+// into the info, or nil if the offset is zero. It returns false if the
+// wormhash is truncated.
+func amongWormhash(info []byte, ofs int32) ([]AmongEntry, bool) {
+	if ofs == 0 {
+		return nil, true
+	}
+	if ofs < 0 || int(ofs)+amongPoolOffset > len(info) {
+		return nil, false
+	}
+	wh := info[ofs:]
+	poolsize := int(int32(hostOrder.Uint32(wh[amongPoolsizeOffset:])))
+	if poolsize < 0 || amongPoolOffset+poolsize*amongTupleSize > len(wh) {
+		return nil, false
+	}
+	entries := make([]AmongEntry, 0, poolsize)
+	for idx := 0; idx < poolsize; idx++ {
+		tuple := wh[amongPoolOffset+idx*amongTupleSize:]
+		entry := AmongEntry{MAC: net.HardwareAddr(append([]byte(nil), tuple[2:8]...))}
+		if ip := netip.AddrFrom4(*(*[4]byte)(tuple[8:12])); !ip.IsUnspecified() {
+			entry.IP = ip
+		}
+		entries = append(entries, entry)
+	}
+	return entries, true
+}
@@ -0,0 +1,117 @@
+// Copyright 2023 Harald Albrecht.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy
+// of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package dsl
+
+import (
+	"net"
+	"net/netip"
+
+	"github.com/google/nftables/expr"
+	"github.com/google/nftables/xt"
+	"github.com/thediveo/nufftables"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+// amongInfo returns the info payload of an ebtables “among” match with the
+// specified destination and source entries; nil entries are not matched.
+func amongInfo(dst, src []AmongEntry, bitmask uint32) func([]byte) {
+	return func(info []byte) {
+		hostOrder.PutUint32(info[8:], bitmask)
+		ofs := 12
+		for idx, entries := range [][]AmongEntry{dst, src} {
+			if entries == nil {
+				continue
+			}
+			hostOrder.PutUint32(info[idx*4:], uint32(ofs))
+			hostOrder.PutUint32(info[ofs+amongPoolsizeOffset:], uint32(len(entries)))
+			for eidx, entry := range entries {
+				tuple := info[ofs+amongPoolOffset+eidx*amongTupleSize:]
+				copy(tuple[2:8], entry.MAC)
+				if entry.IP.IsValid() {
+					ip := entry.IP.As4()
+					copy(tuple[8:12], ip[:])
+				}
+			}
+			ofs += amongPoolOffset + len(entries)*amongTupleSize
+		}
+	}
+}
+
+var _ = Describe("ebtables match extensions", func() {
+
+	It("decodes 802_3 matches", func() {
+		counter := &expr.Counter{}
+		remexprs, m := Match802_3(nufftables.Expressions{
+			xtMatch("802_3", 0, 8, func(info []byte) {
+				info[0] = 0xaa
+				info[2], info[3] = 0x08, 0x00
+				info[4] = byte(Ether8023SAP | Ether8023Type)
+				info[5] = byte(Ether8023Type)
+			}),
+			counter,
+		})
+		Expect(remexprs).To(ConsistOf(counter))
+		Expect(*m).To(Equal(Ether8023Match{
+			SAP:    0xaa,
+			Type:   0x0800,
+			Flags:  Ether8023SAP | Ether8023Type,
+			Invert: Ether8023Type,
+		}))
+		Expect(DecodeXtMatch(xtMatch("802_3", 0, 4, nil))).To(BeNil())
+	})
+
+	It("decodes mark_m matches", func() {
+		m := DecodeXtMatch(xtMatch("mark_m", 0, 24, func(info []byte) {
+			hostOrder.PutUint64(info[0:], 0x42)
+			hostOrder.PutUint64(info[8:], 0xff)
+			info[16] = 1
+			info[17] = ebtMarkOr
+		}))
+		Expect(m).To(Equal(&EtherMarkMatch{Mark: 0x42, Mask: 0xff, Any: true, Invert: true}))
+		remexprs, mark := MatchEtherMark(nufftables.Expressions{&expr.Counter{}})
+		Expect(remexprs).To(BeNil())
+		Expect(mark).To(BeNil())
+	})
+
+	It("decodes among matches", func() {
+		dst := []AmongEntry{
+			{MAC: net.HardwareAddr{0x52, 0x54, 0, 0, 0, 1}},
+			{MAC: net.HardwareAddr{0x52, 0x54, 0, 0, 0, 2}, IP: netip.MustParseAddr("10.0.0.2")},
+		}
+		src := []AmongEntry{}
+		size := 12 + 2*amongPoolOffset + 2*amongTupleSize
+		remexprs, m := MatchAmong(nufftables.Expressions{
+			xtMatch("among", 0, size, amongInfo(dst, src, ebtAmongSrcNeg)),
+		})
+		Expect(remexprs).To(BeEmpty())
+		Expect(remexprs).NotTo(BeNil())
+		Expect(m.Dst).To(Equal(dst))
+		Expect(m.Src).To(BeEmpty())
+		Expect(m.Src).NotTo(BeNil())
+		Expect(m.InvertDst).To(BeFalse())
+		Expect(m.InvertSrc).To(BeTrue())
+		Expect(m.String()).To(Equal(
+			"--among-dst 52:54:00:00:00:01,52:54:00:00:00:02=10.0.0.2 --among-src ! "))
+
+		match := xtMatch("among", 0, size, amongInfo(nil, dst, 0))
+		Expect(DecodeXtMatch(match)).To(HaveField("Src", HaveLen(2)))
+		truncated := (*match.Info.(*xt.Unknown))[:12+amongPoolOffset+2*amongTupleSize-1]
+		match.Info = &truncated
+		Expect(DecodeXtMatch(match)).To(BeNil())
+	})
+
+})
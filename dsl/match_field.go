@@ -0,0 +1,120 @@
+// Copyright 2023 Harald Albrecht.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy
+// of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package dsl
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/google/nftables"
+	"github.com/thediveo/nufftables"
+)
+
+// FieldMatch describes matching a protocol header field, such as “ether
+// saddr”, “vlan id”, or “arp operation”, against a value, a range of values,
+// or the elements of a named set. FieldMatch is especially useful for the
+// arp, bridge, and netdev families, where the IP-specific matches don't apply.
+type FieldMatch struct {
+	Field *Field
+	// Op is the predicate operation, such as OpEq, OpInRange, or OpInSet.
+	Op PredicateOp
+	// Value is the decoded value compared with, or the lower bound of a range;
+	// see [Field.Decode] for the value types. ValueTo is the decoded upper
+	// bound of a range.
+	Value, ValueTo any
+	// Set is the name of the set looked up for OpInSet and OpNotInSet.
+	Set string
+}
+
+// String returns the field match in nft notation, such as “ether saddr
+// 52:54:00:12:34:56” or “arp operation != reply”.
+func (m *FieldMatch) String() string {
+	var op string
+	switch m.Op {
+	case OpEq, OpInRange, OpInSet:
+	default:
+		op = m.Op.String() + " "
+	}
+	switch m.Op {
+	case OpInRange, OpNotInRange:
+		return fmt.Sprintf("%s %s%v-%v", m.Field, op, m.Value, m.ValueTo)
+	case OpInSet, OpNotInSet:
+		return fmt.Sprintf("%s %s@%s", m.Field, op, m.Set)
+	}
+	return fmt.Sprintf("%s %s%v", m.Field, op, m.Value)
+}
+
+// MatchField returns the first match of a protocol header field with one of
+// the specified names in nft notation, such as “ether saddr” or “arp
+// operation”, together with the remaining expressions after the match. If no
+// names are specified, then any known protocol header field matches. If no
+// field match was found, then the remaining expressions are returned as nil,
+// together with a nil field match.
+//
+// The table family is refined from “meta protocol” and “ether type”
+// predicates for the bridge and netdev families, so that “arp” fields are
+// correctly decoded in bridge tables.
+func MatchField(family nftables.TableFamily, exprs nufftables.Expressions, names ...string) (nufftables.Expressions, *FieldMatch) {
+	lifted := Lift(exprs)
+	for _, pred := range lifted.Predicates {
+		match := fieldMatch(family, lifted, &pred)
+		if match == nil {
+			continue
+		}
+		if len(names) != 0 && !containsKey(names, match.Field.String()) {
+			continue
+		}
+		return after(exprs, pred.Exprs), match
+	}
+	return nil, nil
+}
+
+// FieldMatches returns all protocol header field matches of the specified
+// expressions.
+func FieldMatches(family nftables.TableFamily, exprs nufftables.Expressions) []FieldMatch {
+	var matches []FieldMatch
+	lifted := Lift(exprs)
+	for _, pred := range lifted.Predicates {
+		if match := fieldMatch(family, lifted, &pred); match != nil {
+			matches = append(matches, *match)
+		}
+	}
+	return matches
+}
+
+// fieldMatch returns the field match for the specified predicate, or nil if
+// the predicate doesn't match a known protocol header field. Fields masked
+// differently than defined by the field itself, such as prefix matches on
+// Ethernet addresses, are ignored.
+func fieldMatch(family nftables.TableFamily, lifted *LiftedRule, pred *Predicate) *FieldMatch {
+	f := lifted.Field(family, pred.Operand)
+	if f == nil || pred.Operand.Concat != nil || !bytes.Equal(f.Mask, pred.Operand.Mask) {
+		return nil
+	}
+	match := &FieldMatch{Field: f, Op: pred.Op}
+	switch pred.Op {
+	case OpInSet, OpNotInSet:
+		match.Set = pred.Set
+		return match
+	case OpInRange, OpNotInRange:
+		if match.ValueTo = f.Decode(pred.ValueTo); match.ValueTo == nil {
+			return nil
+		}
+	}
+	if match.Value = f.Decode(pred.Value); match.Value == nil {
+		return nil
+	}
+	return match
+}
@@ -0,0 +1,87 @@
+// Copyright 2023 Harald Albrecht.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy
+// of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package dsl
+
+import (
+	"net"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"github.com/thediveo/nufftables"
+	"golang.org/x/sys/unix"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("protocol header field matches", func() {
+
+	It("names ARP operations", func() {
+		Expect(ArpOpRequest.String()).To(Equal("request"))
+		Expect(ArpOpNAK.String()).To(Equal("nak"))
+		Expect(ArpOp(42).String()).To(Equal("42"))
+	})
+
+	It("matches Ethernet addresses and VLAN IDs", func() {
+		mac := net.HardwareAddr{0x52, 0x54, 0, 0x12, 0x34, 0x56}
+		counter := &expr.Counter{}
+		exprs := nufftables.Expressions{
+			payload(expr.PayloadBaseLLHeader, 6, 6),
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: mac},
+			payload(expr.PayloadBaseLLHeader, 14, 2),
+			&expr.Bitwise{SourceRegister: 1, DestRegister: 1, Len: 2,
+				Mask: []byte{0x0f, 0xff}, Xor: []byte{0, 0}},
+			&expr.Cmp{Op: expr.CmpOpNeq, Register: 1, Data: []byte{0, 42}},
+			counter,
+		}
+		remexprs, match := MatchField(nftables.TableFamilyBridge, exprs, "vlan id")
+		Expect(remexprs).To(ConsistOf(counter))
+		Expect(match.Value).To(Equal(uint64(42)))
+		Expect(match.String()).To(Equal("vlan id != 42"))
+
+		matches := FieldMatches(nftables.TableFamilyBridge, exprs)
+		Expect(matches).To(HaveLen(2))
+		Expect(matches[0].Value).To(Equal(mac))
+		Expect(matches[0].String()).To(Equal("ether saddr 52:54:00:12:34:56"))
+
+		remexprs, match = MatchField(nftables.TableFamilyBridge, exprs, "arp operation")
+		Expect(remexprs).To(BeNil())
+		Expect(match).To(BeNil())
+	})
+
+	It("matches ARP fields in bridge tables", func() {
+		exprs := nufftables.Expressions{
+			payload(expr.PayloadBaseLLHeader, 12, 2),
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{unix.ETH_P_ARP >> 8, unix.ETH_P_ARP & 0xff}},
+			payload(expr.PayloadBaseNetworkHeader, 6, 2),
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{0, 1}},
+			payload(expr.PayloadBaseNetworkHeader, 24, 4),
+			&expr.Range{Op: expr.CmpOpEq, Register: 1, FromData: ip("10.0.0.1"), ToData: ip("10.0.0.9")},
+			payload(expr.PayloadBaseNetworkHeader, 8, 6),
+			&expr.Lookup{SourceRegister: 1, SetName: "hosts"},
+		}
+		_, match := MatchField(nftables.TableFamilyBridge, exprs, "arp operation")
+		Expect(match).NotTo(BeNil())
+		Expect(match.Value).To(Equal(ArpOpRequest))
+		Expect(match.String()).To(Equal("arp operation request"))
+
+		matches := FieldMatches(nftables.TableFamilyBridge, exprs)
+		Expect(matches).To(HaveLen(4))
+		Expect(matches[0].String()).To(Equal("ether type 2054"))
+		Expect(matches[2].String()).To(Equal("arp daddr ip 10.0.0.1-10.0.0.9"))
+		Expect(matches[3].String()).To(Equal("arp saddr ether @hosts"))
+	})
+
+})
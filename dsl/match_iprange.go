@@ -0,0 +1,90 @@
+// Copyright 2023 Harald Albrecht.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy
+// of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package dsl
+
+import (
+	"net/netip"
+
+	"github.com/google/nftables/expr"
+	"github.com/thediveo/nufftables"
+)
+
+// Flags of the xt “iprange” match extension.
+const (
+	iprangeSrc    = 0x01
+	iprangeDst    = 0x02
+	iprangeSrcInv = 0x10
+	iprangeDstInv = 0x20
+)
+
+// MatchIPRange returns the source and/or destination address ranges from the
+// first xt “iprange” match extension as [AddrMatch] values with OpInRange or
+// OpNotInRange operations, together with the remaining expressions after the
+// match. If no match is found, then nil is returned for the remaining
+// expressions.
+//
+// As the xt “iprange” match information doesn't tell the IP family, ranges
+// with all addresses having only zero bytes after the first four bytes are
+// considered to be IPv4 address ranges.
+func MatchIPRange(exprs nufftables.Expressions) (nufftables.Expressions, []AddrMatch) {
+	return matchXt(exprs, decodeIPRange)
+}
+
+// decodeIPRange decodes the xt “iprange” match extension revision 1.
+func decodeIPRange(match *expr.Match) ([]AddrMatch, bool) {
+	if match.Rev != 1 {
+		return nil, false
+	}
+	info, ok := unknownInfo(match, "iprange", 65)
+	if !ok {
+		return nil, false
+	}
+	addrlen := 4
+	for _, addr := range [][]byte{info[0:16], info[16:32], info[32:48], info[48:64]} {
+		for _, b := range addr[4:] {
+			if b != 0 {
+				addrlen = 16
+			}
+		}
+	}
+	flags := info[64]
+	matches := []AddrMatch{}
+	for _, r := range []struct {
+		dir       AddrDirection
+		from, to  []byte
+		flag, inv byte
+	}{
+		{SourceAddr, info[0:16], info[16:32], iprangeSrc, iprangeSrcInv},
+		{DestinationAddr, info[32:48], info[48:64], iprangeDst, iprangeDstInv},
+	} {
+		if flags&r.flag == 0 {
+			continue
+		}
+		from, _ := netip.AddrFromSlice(r.from[:addrlen])
+		to, _ := netip.AddrFromSlice(r.to[:addrlen])
+		op := OpInRange
+		if flags&r.inv != 0 {
+			op = OpNotInRange
+		}
+		matches = append(matches, AddrMatch{
+			Direction: r.dir,
+			Op:        op,
+			From:      from,
+			To:        to,
+			is6:       addrlen == 16,
+		})
+	}
+	return matches, true
+}
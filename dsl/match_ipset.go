@@ -0,0 +1,68 @@
+// Copyright 2023 Harald Albrecht.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy
+// of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package dsl
+
+import (
+	"github.com/google/nftables/expr"
+	"github.com/thediveo/nufftables"
+)
+
+// IPSetMatch describes an xt “set” match on an ipset. As xt “set” matches
+// reference ipsets only by their kernel index, the ipset name isn't
+// available. Directions tells for each dimension of the ipset whether the
+// source or destination address (or port) is looked up.
+type IPSetMatch struct {
+	Index      uint16
+	Directions []AddrDirection
+	Invert     bool
+}
+
+// ipsetInvMatch is the flag of the xt “set” match extension inverting the
+// match; the other flag bits i tell whether dimension i is a source or
+// destination lookup.
+const ipsetInvMatch = 1 << 0
+
+// MatchIPSet returns the information from the first xt “set” match extension,
+// together with the remaining expressions after the match. If no match is
+// found, then nil is returned for the remaining expressions.
+func MatchIPSet(exprs nufftables.Expressions) (nufftables.Expressions, *IPSetMatch) {
+	return matchXt(exprs, decodeIPSet)
+}
+
+// decodeIPSet decodes the xt “set” match extension revisions 1 and later;
+// they all start with the same set information.
+func decodeIPSet(match *expr.Match) (*IPSetMatch, bool) {
+	if match.Rev < 1 {
+		return nil, false
+	}
+	info, ok := unknownInfo(match, "set", 4)
+	if !ok {
+		return nil, false
+	}
+	dim, flags := int(info[2]), info[3]
+	m := &IPSetMatch{
+		Index:      hostOrder.Uint16(info[0:]),
+		Directions: make([]AddrDirection, 0, dim),
+		Invert:     flags&ipsetInvMatch != 0,
+	}
+	for d := 1; d <= dim; d++ {
+		dir := DestinationAddr
+		if flags&(1<<d) != 0 {
+			dir = SourceAddr
+		}
+		m.Directions = append(m.Directions, dir)
+	}
+	return m, true
+}
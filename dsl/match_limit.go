@@ -0,0 +1,84 @@
+// Copyright 2023 Harald Albrecht.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy
+// of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package dsl
+
+import (
+	"fmt"
+
+	"github.com/google/nftables/expr"
+	"github.com/thediveo/nufftables"
+)
+
+// LimitMatch describes an xt “limit” match. Avg is the average time between
+// packets in units of 1/10000 seconds, and Burst the maximum initial number of
+// packets to match.
+type LimitMatch struct {
+	Avg, Burst uint32
+}
+
+// xtLimitScale is the scale of LimitMatch.Avg.
+const xtLimitScale = 10000
+
+var limitUnits = []struct {
+	name string
+	mult uint32
+}{
+	{"day", xtLimitScale * 24 * 60 * 60},
+	{"hour", xtLimitScale * 60 * 60},
+	{"min", xtLimitScale * 60},
+	{"sec", xtLimitScale},
+}
+
+// Rate returns the average rate as a number of packets per time unit, with
+// units being either “sec”, “min”, “hour”, or “day”, the same way iptables
+// shows the average rate.
+func (m *LimitMatch) Rate() (uint32, string) {
+	if m.Avg == 0 {
+		return 0, "sec"
+	}
+	idx := 1
+	for ; idx < len(limitUnits); idx++ {
+		if m.Avg > limitUnits[idx].mult ||
+			limitUnits[idx].mult/m.Avg < limitUnits[idx].mult%m.Avg {
+			break
+		}
+	}
+	return limitUnits[idx-1].mult / m.Avg, limitUnits[idx-1].name
+}
+
+// String returns the limit in iptables notation, such as “3/min burst 5”.
+func (m *LimitMatch) String() string {
+	rate, unit := m.Rate()
+	return fmt.Sprintf("%d/%s burst %d", rate, unit, m.Burst)
+}
+
+// MatchLimit returns the information from the first xt “limit” match
+// extension, together with the remaining expressions after the match. If no
+// match is found, then nil is returned for the remaining expressions.
+func MatchLimit(exprs nufftables.Expressions) (nufftables.Expressions, *LimitMatch) {
+	return matchXt(exprs, decodeLimit)
+}
+
+// decodeLimit decodes the xt “limit” match extension.
+func decodeLimit(match *expr.Match) (*LimitMatch, bool) {
+	info, ok := unknownInfo(match, "limit", 8)
+	if !ok {
+		return nil, false
+	}
+	return &LimitMatch{
+		Avg:   hostOrder.Uint32(info[0:]),
+		Burst: hostOrder.Uint32(info[4:]),
+	}, true
+}
@@ -0,0 +1,59 @@
+// Copyright 2023 Harald Albrecht.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy
+// of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package dsl
+
+import (
+	"github.com/google/nftables/expr"
+	"github.com/thediveo/nufftables"
+)
+
+// MarkMatch describes an xt “mark” match, matching packets with (mark & Mask)
+// == Mark, or != Mark if inverted.
+type MarkMatch struct {
+	Mark, Mask uint32
+	Invert     bool
+}
+
+// MatchMark returns the information from the first xt “mark” match extension,
+// together with the remaining expressions after the match. If no match is
+// found, then nil is returned for the remaining expressions.
+func MatchMark(exprs nufftables.Expressions) (nufftables.Expressions, *MarkMatch) {
+	return matchXt(exprs, decodeMark)
+}
+
+// decodeMark decodes the xt “mark” match extension. Revision 0 uses (64bit)
+// longs, while revision 1 uses 32bit marks and masks.
+func decodeMark(match *expr.Match) (*MarkMatch, bool) {
+	if match.Rev == 0 {
+		info, ok := unknownInfo(match, "mark", 17)
+		if !ok {
+			return nil, false
+		}
+		return &MarkMatch{
+			Mark:   uint32(hostOrder.Uint64(info[0:])),
+			Mask:   uint32(hostOrder.Uint64(info[8:])),
+			Invert: info[16] != 0,
+		}, true
+	}
+	info, ok := unknownInfo(match, "mark", 9)
+	if !ok {
+		return nil, false
+	}
+	return &MarkMatch{
+		Mark:   hostOrder.Uint32(info[0:]),
+		Mask:   hostOrder.Uint32(info[4:]),
+		Invert: info[8] != 0,
+	}, true
+}
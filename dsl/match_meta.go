@@ -0,0 +1,350 @@
+// Copyright 2023 Harald Albrecht.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy
+// of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package dsl
+
+import (
+	"encoding/binary"
+	"strconv"
+	"strings"
+
+	"github.com/google/nftables/expr"
+	"github.com/thediveo/nufftables"
+)
+
+// IfaceMatch describes matching the input or output network interface,
+// either by name or by index, as in “iifname "eth0"”, “oifname != "veth*"”,
+// “iif 42”, or “meta ibrname "br0"”.
+type IfaceMatch struct {
+	// Key is the meta key of the interface matched, such as
+	// [expr.MetaKeyIIFNAME], [expr.MetaKeyOIFNAME], [expr.MetaKeyIIF],
+	// [expr.MetaKeyOIF], [expr.MetaKeyBRIIIFNAME], or [expr.MetaKeyBRIOIFNAME].
+	Key expr.MetaKey
+	// Name is the interface name matched; if Wildcard is true, then all
+	// interface names starting with Name are matched.
+	Name     string
+	Wildcard bool
+	// Index is the interface index matched when matching by index instead of
+	// name.
+	Index uint32
+	// Set is the name of the set of interface names or indices looked up, if
+	// any.
+	Set    string
+	Invert bool
+}
+
+// Input returns true if the input interface is matched.
+func (m *IfaceMatch) Input() bool {
+	switch m.Key {
+	case expr.MetaKeyIIFNAME, expr.MetaKeyIIF, expr.MetaKeyBRIIIFNAME:
+		return true
+	}
+	return false
+}
+
+// Matches returns true if the specified interface name is matched, taking
+// wildcards and inverted matches into account. Matches always returns false
+// for interface index matches and set lookups.
+func (m *IfaceMatch) Matches(name string) bool {
+	if m.Set != "" || !isIfnameKey(m.Key) {
+		return false
+	}
+	matches := name == m.Name
+	if m.Wildcard {
+		matches = strings.HasPrefix(name, m.Name)
+	}
+	return matches != m.Invert
+}
+
+// String returns the interface match in nft notation, such as “iifname
+// "eth*"”.
+func (m *IfaceMatch) String() string {
+	var b strings.Builder
+	b.WriteString(metaKeyName(m.Key))
+	if m.Invert {
+		b.WriteString(" !=")
+	}
+	switch {
+	case m.Set != "":
+		b.WriteString(" @" + m.Set)
+	case isIfnameKey(m.Key):
+		b.WriteString(` "` + m.Name)
+		if m.Wildcard {
+			b.WriteString("*")
+		}
+		b.WriteString(`"`)
+	default:
+		b.WriteString(" " + strconv.FormatUint(uint64(m.Index), 10))
+	}
+	return b.String()
+}
+
+// MatchIface returns the first input or output interface match, as well as
+// the remaining expressions after the match. If no interface match was found,
+// then the remaining expressions are returned as nil, together with a nil
+// interface match.
+//
+// Interface name matches without a terminating zero are wildcard matches, such
+// as “iifname "eth*"” in nft or “-i eth+” in iptables.
+func MatchIface(exprs nufftables.Expressions) (nufftables.Expressions, *IfaceMatch) {
+	for _, pred := range Lift(exprs).Predicates {
+		if match := ifaceMatch(&pred); match != nil {
+			return after(exprs, pred.Exprs), match
+		}
+	}
+	return nil, nil
+}
+
+// IfaceMatches returns all input and output interface matches of the
+// specified expressions.
+func IfaceMatches(exprs nufftables.Expressions) []IfaceMatch {
+	var matches []IfaceMatch
+	for _, pred := range Lift(exprs).Predicates {
+		if match := ifaceMatch(&pred); match != nil {
+			matches = append(matches, *match)
+		}
+	}
+	return matches
+}
+
+// ifaceMatch returns the interface match for the specified predicate, or nil
+// if the predicate doesn't match a network interface.
+func ifaceMatch(pred *Predicate) *IfaceMatch {
+	meta, ok := pred.Operand.Field.(*expr.Meta)
+	if !ok || pred.Operand.Mask != nil {
+		return nil
+	}
+	match := &IfaceMatch{Key: meta.Key}
+	switch meta.Key {
+	case expr.MetaKeyIIFNAME, expr.MetaKeyOIFNAME,
+		expr.MetaKeyBRIIIFNAME, expr.MetaKeyBRIOIFNAME:
+		switch pred.Op {
+		case OpEq, OpNeq:
+			match.Name = cString(pred.Value)
+			match.Wildcard = len(match.Name) == len(pred.Value)
+		}
+	case expr.MetaKeyIIF, expr.MetaKeyOIF:
+		switch pred.Op {
+		case OpEq, OpNeq:
+			if len(pred.Value) != 4 {
+				return nil
+			}
+			match.Index = hostOrder.Uint32(pred.Value)
+		}
+	default:
+		return nil
+	}
+	switch pred.Op {
+	case OpEq:
+	case OpNeq:
+		match.Invert = true
+	case OpInSet, OpNotInSet:
+		if pred.Operand.Concat != nil {
+			return nil
+		}
+		match.Set = pred.Set
+		match.Invert = pred.Op == OpNotInSet
+	default:
+		return nil
+	}
+	return match
+}
+
+// isIfnameKey returns true if the meta key is an interface name.
+func isIfnameKey(key expr.MetaKey) bool {
+	switch key {
+	case expr.MetaKeyIIFNAME, expr.MetaKeyOIFNAME,
+		expr.MetaKeyBRIIIFNAME, expr.MetaKeyBRIOIFNAME:
+		return true
+	}
+	return false
+}
+
+// ValueMatch describes matching a scalar value, such as a packet mark or
+// conntrack state, optionally masked. Values are decoded into host byte
+// order integers.
+type ValueMatch struct {
+	Op PredicateOp
+	// Value is the value compared with, or the lower bound of a range, and
+	// ValueTo the upper bound of a range.
+	Value, ValueTo uint32
+	// Mask is the mask applied to the value before comparing; it has all bits
+	// set if the value isn't masked.
+	Mask uint32
+	// Set is the name of the set looked up, if any.
+	Set string
+}
+
+// Matches returns true if the specified value is matched. Matches always
+// returns false for set lookups.
+func (m *ValueMatch) Matches(v uint32) bool {
+	v &= m.Mask
+	switch m.Op {
+	case OpEq:
+		return v == m.Value
+	case OpNeq:
+		return v != m.Value
+	case OpLt:
+		return v < m.Value
+	case OpLte:
+		return v <= m.Value
+	case OpGt:
+		return v > m.Value
+	case OpGte:
+		return v >= m.Value
+	case OpInRange:
+		return v >= m.Value && v <= m.ValueTo
+	case OpNotInRange:
+		return v < m.Value || v > m.ValueTo
+	}
+	return false
+}
+
+// valueMatch returns the value match for the specified predicate, decoding
+// values either in host or in network byte order, or false if the predicate's
+// operand has been transformed other than by masking.
+func valueMatch(pred *Predicate, bigEndian bool) (ValueMatch, bool) {
+	if pred.Operand.Xor != nil && !allZero(pred.Operand.Xor) {
+		return ValueMatch{}, false
+	}
+	m := ValueMatch{Op: pred.Op, Mask: ^uint32(0), Set: pred.Set}
+	if pred.Operand.Mask != nil {
+		m.Mask = scalar(pred.Operand.Mask, bigEndian)
+	}
+	switch pred.Op {
+	case OpInSet, OpNotInSet:
+		if pred.Operand.Concat != nil {
+			return ValueMatch{}, false
+		}
+	default:
+		m.Value = scalar(pred.Value, bigEndian)
+		m.ValueTo = scalar(pred.ValueTo, bigEndian)
+	}
+	return m, true
+}
+
+// scalar returns the value of 1, 2, or 4 bytes of data as an unsigned 32bit
+// integer, using either host or network byte order.
+func scalar(data []byte, bigEndian bool) uint32 {
+	var order binary.ByteOrder = binary.BigEndian
+	if !bigEndian {
+		order = hostOrder
+	}
+	switch {
+	case len(data) >= 4:
+		return order.Uint32(data)
+	case len(data) >= 2:
+		return uint32(order.Uint16(data))
+	case len(data) == 1:
+		return uint32(data[0])
+	}
+	return 0
+}
+
+// allZero returns true if all bytes are zero.
+func allZero(data []byte) bool {
+	for _, b := range data {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// MetaMatch describes matching meta information other than interfaces, such
+// as “meta l4proto tcp”, “meta mark & 0xff == 0x42”, or “meta skuid 1000”.
+type MetaMatch struct {
+	Key expr.MetaKey
+	ValueMatch
+}
+
+// MatchMeta returns the first meta match with any of the specified keys – or
+// any key if none are specified – as well as the remaining expressions after
+// the match. If no meta match was found, then the remaining expressions are
+// returned as nil, together with a nil meta match. Please use [MatchIface] for
+// interface matches.
+func MatchMeta(exprs nufftables.Expressions, keys ...expr.MetaKey) (nufftables.Expressions, *MetaMatch) {
+	for _, pred := range Lift(exprs).Predicates {
+		if match := metaMatch(&pred, keys); match != nil {
+			return after(exprs, pred.Exprs), match
+		}
+	}
+	return nil, nil
+}
+
+// metaMatch returns the meta match for the specified predicate if it matches
+// any of the specified meta keys, or nil.
+func metaMatch(pred *Predicate, keys []expr.MetaKey) *MetaMatch {
+	meta, ok := pred.Operand.Field.(*expr.Meta)
+	if !ok || isIfnameKey(meta.Key) ||
+		meta.Key == expr.MetaKeyIIF || meta.Key == expr.MetaKeyOIF {
+		return nil
+	}
+	if len(keys) != 0 && !containsKey(keys, meta.Key) {
+		return nil
+	}
+	// the packet's (ethernet) protocol is in network byte order, all other
+	// meta information in host byte order.
+	vm, ok := valueMatch(pred, meta.Key == expr.MetaKeyPROTOCOL)
+	if !ok {
+		return nil
+	}
+	return &MetaMatch{Key: meta.Key, ValueMatch: vm}
+}
+
+// containsKey returns true if the key is in keys.
+func containsKey[K comparable](keys []K, key K) bool {
+	for _, k := range keys {
+		if k == key {
+			return true
+		}
+	}
+	return false
+}
+
+var metaKeyNames = map[expr.MetaKey]string{
+	expr.MetaKeyLEN:        "meta length",
+	expr.MetaKeyPROTOCOL:   "meta protocol",
+	expr.MetaKeyPRIORITY:   "meta priority",
+	expr.MetaKeyMARK:       "meta mark",
+	expr.MetaKeyIIF:        "iif",
+	expr.MetaKeyOIF:        "oif",
+	expr.MetaKeyIIFNAME:    "iifname",
+	expr.MetaKeyOIFNAME:    "oifname",
+	expr.MetaKeyIIFTYPE:    "iiftype",
+	expr.MetaKeyOIFTYPE:    "oiftype",
+	expr.MetaKeySKUID:      "meta skuid",
+	expr.MetaKeySKGID:      "meta skgid",
+	expr.MetaKeyNFTRACE:    "meta nftrace",
+	expr.MetaKeyRTCLASSID:  "meta rtclassid",
+	expr.MetaKeySECMARK:    "meta secmark",
+	expr.MetaKeyNFPROTO:    "meta nfproto",
+	expr.MetaKeyL4PROTO:    "meta l4proto",
+	expr.MetaKeyBRIIIFNAME: "meta ibrname",
+	expr.MetaKeyBRIOIFNAME: "meta obrname",
+	expr.MetaKeyPKTTYPE:    "meta pkttype",
+	expr.MetaKeyCPU:        "meta cpu",
+	expr.MetaKeyIIFGROUP:   "meta iifgroup",
+	expr.MetaKeyOIFGROUP:   "meta oifgroup",
+	expr.MetaKeyCGROUP:     "meta cgroup",
+	expr.MetaKeyPRANDOM:    "meta random",
+}
+
+// metaKeyName returns the nft name of the specified meta key.
+func metaKeyName(key expr.MetaKey) string {
+	if name, ok := metaKeyNames[key]; ok {
+		return name
+	}
+	return "meta " + strconv.FormatUint(uint64(key), 10)
+}
@@ -0,0 +1,192 @@
+// Copyright 2023 Harald Albrecht.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy
+// of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package dsl
+
+import (
+	"github.com/google/nftables/expr"
+	"github.com/thediveo/nufftables"
+	"golang.org/x/sys/unix"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+func ifnameData(name string) []byte {
+	b := make([]byte, unix.IFNAMSIZ)
+	copy(b, name)
+	return b
+}
+
+var _ = Describe("meta matches", func() {
+
+	It("matches interface names", func() {
+		counter := &expr.Counter{}
+		remexprs, match := MatchIface(nufftables.Expressions{
+			&expr.Meta{Key: expr.MetaKeyIIFNAME, Register: 1},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: ifnameData("eth0")},
+			counter,
+		})
+		Expect(remexprs).To(ConsistOf(counter))
+		Expect(*match).To(Equal(IfaceMatch{Key: expr.MetaKeyIIFNAME, Name: "eth0"}))
+		Expect(match.Input()).To(BeTrue())
+		Expect(match.Matches("eth0")).To(BeTrue())
+		Expect(match.Matches("eth01")).To(BeFalse())
+		Expect(match.String()).To(Equal(`iifname "eth0"`))
+
+		remexprs, match = MatchIface(nufftables.Expressions{counter})
+		Expect(remexprs).To(BeNil())
+		Expect(match).To(BeNil())
+	})
+
+	It("matches inverted wildcard interface names, indices and sets", func() {
+		matches := IfaceMatches(nufftables.Expressions{
+			&expr.Meta{Key: expr.MetaKeyOIFNAME, Register: 1},
+			&expr.Cmp{Op: expr.CmpOpNeq, Register: 1, Data: []byte("veth")},
+			&expr.Meta{Key: expr.MetaKeyIIF, Register: 1},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{42, 0, 0, 0}},
+			&expr.Meta{Key: expr.MetaKeyIIFNAME, Register: 1},
+			&expr.Lookup{SourceRegister: 1, SetName: "lan"},
+		})
+		Expect(matches).To(HaveLen(3))
+		Expect(matches[0].Wildcard).To(BeTrue())
+		Expect(matches[0].Input()).To(BeFalse())
+		Expect(matches[0].Matches("veth123")).To(BeFalse())
+		Expect(matches[0].Matches("eth0")).To(BeTrue())
+		Expect(matches[0].String()).To(Equal(`oifname != "veth*"`))
+		Expect(matches[1].Index).To(Equal(hostOrder.Uint32([]byte{42, 0, 0, 0})))
+		Expect(matches[2].Set).To(Equal("lan"))
+		Expect(matches[2].String()).To(Equal(`iifname @lan`))
+	})
+
+	It("matches masked meta marks and transport protocols", func() {
+		mask := make([]byte, 4)
+		hostOrder.PutUint32(mask, 0xff00)
+		value := make([]byte, 4)
+		hostOrder.PutUint32(value, 0x4200)
+		exprs := append(l4proto(unix.IPPROTO_TCP),
+			&expr.Meta{Key: expr.MetaKeyMARK, Register: 1},
+			&expr.Bitwise{SourceRegister: 1, DestRegister: 1, Len: 4, Mask: mask, Xor: []byte{0, 0, 0, 0}},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: value})
+		_, match := MatchMeta(exprs, expr.MetaKeyMARK)
+		Expect(match).NotTo(BeNil())
+		Expect(match.Value).To(Equal(uint32(0x4200)))
+		Expect(match.Mask).To(Equal(uint32(0xff00)))
+		Expect(match.Matches(0x4212)).To(BeTrue())
+		Expect(match.Matches(0x4300)).To(BeFalse())
+
+		remexprs, match := MatchMeta(exprs)
+		Expect(remexprs).To(HaveLen(3))
+		Expect(match.Key).To(Equal(expr.MetaKeyL4PROTO))
+		Expect(match.Matches(unix.IPPROTO_TCP)).To(BeTrue())
+	})
+
+	It("matches conntrack states", func() {
+		mask := make([]byte, 4)
+		hostOrder.PutUint32(mask, uint32(CtStateEstablished|CtStateRelated))
+		_, match := MatchCt(nufftables.Expressions{
+			&expr.Ct{Key: expr.CtKeySTATE, Register: 1},
+			&expr.Bitwise{SourceRegister: 1, DestRegister: 1, Len: 4, Mask: mask, Xor: []byte{0, 0, 0, 0}},
+			&expr.Cmp{Op: expr.CmpOpNeq, Register: 1, Data: []byte{0, 0, 0, 0}},
+		}, expr.CtKeySTATE)
+		Expect(match).NotTo(BeNil())
+		Expect(match.States()).To(Equal(CtStateEstablished | CtStateRelated))
+		Expect(match.Status()).To(BeZero())
+		Expect(match.Matches(uint32(CtStateRelated))).To(BeTrue())
+		Expect(match.Matches(uint32(CtStateNew))).To(BeFalse())
+	})
+
+	It("matches conntrack zones and ignores addresses", func() {
+		remexprs, match := MatchCt(nufftables.Expressions{
+			&expr.Ct{Key: expr.CtKeySRC, Register: 1},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{10, 0, 0, 1}},
+		})
+		Expect(remexprs).To(BeNil())
+		Expect(match).To(BeNil())
+
+		zone := make([]byte, 2)
+		hostOrder.PutUint16(zone, 42)
+		_, match = MatchCt(nufftables.Expressions{
+			&expr.Ct{Key: expr.CtKeyZONE, Register: 1},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: zone},
+		})
+		Expect(match.Value).To(Equal(uint32(42)))
+	})
+
+	It("decodes xt socket matches", func() {
+		_, socket := MatchSocket(nufftables.Expressions{
+			xtMatch("socket", 3, 4, func(info []byte) { info[0] = xtSocketTransparent }),
+		})
+		Expect(socket).To(Equal(&SocketMatch{Transparent: true}))
+	})
+
+	It("decodes native socket matches", func() {
+		// socket transparent 1 accept
+		verdict := &expr.Verdict{Kind: expr.VerdictAccept}
+		remexprs, socket := MatchSocket(nufftables.Expressions{
+			&expr.Socket{Key: expr.SocketKeyTransparent, Register: 1},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{1}},
+			verdict,
+		})
+		Expect(remexprs).To(HaveExactElements(verdict))
+		Expect(socket.Transparent).To(BeTrue())
+		Expect(socket.NoWildcard).To(BeFalse())
+		Expect(socket.Native).To(Equal(&SocketKeyMatch{Key: expr.SocketKeyTransparent,
+			ValueMatch: ValueMatch{Op: OpEq, Value: 1, Mask: ^uint32(0)}}))
+
+		// socket wildcard 0
+		_, socket = MatchSocket(nufftables.Expressions{
+			&expr.Socket{Key: expr.SocketKeyWildcard, Register: 1},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{0}},
+		})
+		Expect(socket.NoWildcard).To(BeTrue())
+		Expect(socket.Transparent).To(BeFalse())
+
+		// socket transparent 0
+		_, socket = MatchSocket(nufftables.Expressions{
+			&expr.Socket{Key: expr.SocketKeyTransparent, Register: 1},
+			&expr.Cmp{Op: expr.CmpOpNeq, Register: 1, Data: []byte{1}},
+		})
+		Expect(socket.Transparent).To(BeFalse())
+
+		// socket mark 0x2a
+		_, socket = MatchSocket(nufftables.Expressions{
+			&expr.Socket{Key: expr.SocketKeyMark, Register: 1},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{42, 0, 0, 0}},
+		})
+		Expect(socket.Native.Key).To(Equal(expr.SocketKeyMark))
+		Expect(socket.Native.Matches(42)).To(BeTrue())
+	})
+
+	It("returns the first socket match", func() {
+		native := nufftables.Expressions{
+			&expr.Socket{Key: expr.SocketKeyTransparent, Register: 1},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{1}},
+		}
+		xt := xtMatch("socket", 3, 4, func(info []byte) { info[0] = xtSocketNoWildcard })
+
+		remexprs, socket := MatchSocket(append(nufftables.Expressions{xt}, native...))
+		Expect(remexprs).To(HaveLen(2))
+		Expect(socket).To(Equal(&SocketMatch{NoWildcard: true}))
+
+		remexprs, socket = MatchSocket(append(native, xt))
+		Expect(remexprs).To(HaveExactElements(xt))
+		Expect(socket.Native).NotTo(BeNil())
+
+		Expect(MatchSocket(nufftables.Expressions{
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{1}},
+		})).Error().To(BeNil())
+	})
+
+})
@@ -0,0 +1,167 @@
+// Copyright 2023 Harald Albrecht.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy
+// of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package dsl
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/google/nftables/expr"
+	"github.com/thediveo/nufftables"
+)
+
+// OwnerFlags are the socket owner properties matched by an xt “owner” match.
+type OwnerFlags uint8
+
+// Socket owner properties.
+const (
+	OwnerUID          OwnerFlags = 1 << iota // matches the socket's user ID
+	OwnerGID                                 // matches the socket's group ID
+	OwnerSocketExists                        // matches packets with a local socket
+	OwnerSupplGroups                         // also matches supplementary groups
+)
+
+// OwnerMatch describes matching the owner of the local socket of locally
+// generated packets, regardless of whether the match is expressed using the
+// xt “owner” match of iptables-nft, such as “-m owner --uid-owner 1337”, or
+// natively using “meta skuid 1337” and “meta skgid 1337”.
+type OwnerMatch struct {
+	// UIDMin and UIDMax are the (inclusive) range of user IDs matched, and
+	// GIDMin and GIDMax the range of group IDs matched.
+	UIDMin, UIDMax uint32
+	GIDMin, GIDMax uint32
+	// Match tells the socket owner properties matched, and Invert which of
+	// them are inverted.
+	Match, Invert OwnerFlags
+}
+
+// MatchesUID returns true if the specified user ID is matched; the group ID
+// isn't taken into account. MatchesUID always returns true if the user ID
+// isn't matched at all.
+func (m *OwnerMatch) MatchesUID(uid uint32) bool {
+	if m.Match&OwnerUID == 0 {
+		return true
+	}
+	return (uid >= m.UIDMin && uid <= m.UIDMax) != (m.Invert&OwnerUID != 0)
+}
+
+// String returns the owner match in iptables notation, such as “owner !
+// --uid-owner 1337”.
+func (m *OwnerMatch) String() string {
+	var b strings.Builder
+	b.WriteString("owner")
+	not := func(flag OwnerFlags) {
+		if m.Invert&flag != 0 {
+			b.WriteString(" !")
+		}
+	}
+	if m.Match&OwnerSocketExists != 0 {
+		not(OwnerSocketExists)
+		b.WriteString(" --socket-exists")
+	}
+	if m.Match&OwnerUID != 0 {
+		not(OwnerUID)
+		b.WriteString(" --uid-owner " + idRangeString(m.UIDMin, m.UIDMax))
+	}
+	if m.Match&OwnerGID != 0 {
+		not(OwnerGID)
+		b.WriteString(" --gid-owner " + idRangeString(m.GIDMin, m.GIDMax))
+		if m.Match&OwnerSupplGroups != 0 {
+			b.WriteString(" --suppl-groups")
+		}
+	}
+	return b.String()
+}
+
+// idRangeString returns the specified user or group ID range in textual
+// format, collapsing single IDs.
+func idRangeString(min, max uint32) string {
+	if min == max {
+		return fmt.Sprint(min)
+	}
+	return fmt.Sprintf("%d-%d", min, max)
+}
+
+// MatchOwner returns the information from the first xt “owner” match
+// extension, together with the remaining expressions after the match. If no
+// match is found, then nil is returned for the remaining expressions.
+func MatchOwner(exprs nufftables.Expressions) (nufftables.Expressions, *OwnerMatch) {
+	return matchXt(exprs, decodeOwner)
+}
+
+// OwnerMatches returns all socket owner matches of the specified expressions,
+// that is, the xt “owner” matches, followed by the native “meta skuid” and
+// “meta skgid” matches of single IDs or ID ranges.
+func OwnerMatches(exprs nufftables.Expressions) []OwnerMatch {
+	var matches []OwnerMatch
+	rule := Lift(exprs)
+	for _, match := range rule.XtMatches {
+		if m, ok := decodeOwner(match); ok {
+			matches = append(matches, *m)
+		}
+	}
+	for _, pred := range rule.Predicates {
+		meta := metaMatch(&pred, []expr.MetaKey{expr.MetaKeySKUID, expr.MetaKeySKGID})
+		if meta == nil || meta.Mask != ^uint32(0) {
+			continue
+		}
+		flag := OwnerUID
+		if meta.Key == expr.MetaKeySKGID {
+			flag = OwnerGID
+		}
+		m := OwnerMatch{Match: flag}
+		min, max := meta.Value, meta.Value
+		switch meta.Op {
+		case OpEq:
+		case OpNeq:
+			m.Invert = flag
+		case OpInRange:
+			max = meta.ValueTo
+		case OpNotInRange:
+			max = meta.ValueTo
+			m.Invert = flag
+		default:
+			continue
+		}
+		if flag == OwnerUID {
+			m.UIDMin, m.UIDMax = min, max
+		} else {
+			m.GIDMin, m.GIDMax = min, max
+		}
+		matches = append(matches, m)
+	}
+	return matches
+}
+
+// decodeOwner decodes the xt “owner” match extension revision 1: struct
+// xt_owner_match_info with uid_min, uid_max, gid_min, and gid_max u32,
+// followed by match and invert u8.
+func decodeOwner(match *expr.Match) (*OwnerMatch, bool) {
+	if match.Rev != 1 {
+		return nil, false
+	}
+	info, ok := unknownInfo(match, "owner", 18)
+	if !ok {
+		return nil, false
+	}
+	return &OwnerMatch{
+		UIDMin: hostOrder.Uint32(info[0:]),
+		UIDMax: hostOrder.Uint32(info[4:]),
+		GIDMin: hostOrder.Uint32(info[8:]),
+		GIDMax: hostOrder.Uint32(info[12:]),
+		Match:  OwnerFlags(info[16]),
+		Invert: OwnerFlags(info[17]),
+	}, true
+}
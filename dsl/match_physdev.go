@@ -0,0 +1,76 @@
+// Copyright 2023 Harald Albrecht.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy
+// of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package dsl
+
+import (
+	"github.com/google/nftables/expr"
+	"github.com/thediveo/nufftables"
+	"golang.org/x/sys/unix"
+)
+
+// PhysdevMatch describes an xt “physdev” match on bridge ports. Interface
+// names ending in “+” are wildcards matching all interface names with the same
+// prefix. Flags tells which conditions are actually matched, and Invert which
+// of them are inverted.
+type PhysdevMatch struct {
+	InDev, OutDev string
+	Flags, Invert PhysdevFlags
+}
+
+// PhysdevFlags are the conditions of an xt “physdev” match.
+type PhysdevFlags uint8
+
+// Conditions of xt “physdev” matches.
+const (
+	PhysdevIn      PhysdevFlags = 1 << iota // match the bridge input port
+	PhysdevOut                              // match the bridge output port
+	PhysdevBridged                          // match bridged packets
+	PhysdevIsIn                             // match packets entering a bridge port
+	PhysdevIsOut                            // match packets leaving a bridge port
+)
+
+// MatchPhysdev returns the information from the first xt “physdev” match
+// extension, together with the remaining expressions after the match. If no
+// match is found, then nil is returned for the remaining expressions.
+func MatchPhysdev(exprs nufftables.Expressions) (nufftables.Expressions, *PhysdevMatch) {
+	return matchXt(exprs, decodePhysdev)
+}
+
+// decodePhysdev decodes the xt “physdev” match extension.
+func decodePhysdev(match *expr.Match) (*PhysdevMatch, bool) {
+	info, ok := unknownInfo(match, "physdev", 4*unix.IFNAMSIZ+2)
+	if !ok {
+		return nil, false
+	}
+	return &PhysdevMatch{
+		InDev:  ifname(info[0:unix.IFNAMSIZ], info[unix.IFNAMSIZ:2*unix.IFNAMSIZ]),
+		OutDev: ifname(info[2*unix.IFNAMSIZ:3*unix.IFNAMSIZ], info[3*unix.IFNAMSIZ:4*unix.IFNAMSIZ]),
+		Invert: PhysdevFlags(info[4*unix.IFNAMSIZ]),
+		Flags:  PhysdevFlags(info[4*unix.IFNAMSIZ+1]),
+	}, true
+}
+
+// ifname returns the interface name with the specified mask, where a mask
+// not covering the terminating zero indicates a wildcard interface name.
+func ifname(name, mask []byte) string {
+	n := cString(name)
+	if n == "" {
+		return ""
+	}
+	if len(n) < len(mask) && mask[len(n)] == 0 {
+		return n + "+"
+	}
+	return n
+}
@@ -0,0 +1,446 @@
+// Copyright 2023 Harald Albrecht.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy
+// of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package dsl
+
+import (
+	"encoding/binary"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"github.com/google/nftables/xt"
+	"github.com/thediveo/nufftables"
+	"golang.org/x/sys/unix"
+)
+
+// PortDirection tells whether a packet's source or destination port is being
+// matched.
+type PortDirection int
+
+// Port match directions.
+const (
+	DestinationPort PortDirection = iota // matches the destination port (dport)
+	SourcePort                           // matches the source port (sport)
+	EitherPort                           // matches either the source or destination port
+)
+
+// String returns the nft name of the port direction, that is, either “dport”
+// or “sport”, or “port” for matching either port.
+func (d PortDirection) String() string {
+	switch d {
+	case SourcePort:
+		return "sport"
+	case EitherPort:
+		return "port"
+	}
+	return "dport"
+}
+
+// PortRange is an inclusive range of ports [Min..Max]. A single port is
+// represented by a port range with Min and Max being the same.
+type PortRange struct {
+	Min, Max uint16
+}
+
+// Contains returns true if the specified port is inside this port range.
+func (r PortRange) Contains(port uint16) bool {
+	return port >= r.Min && port <= r.Max
+}
+
+// String returns the port range in nft notation, such as “80” or “8000-8100”.
+func (r PortRange) String() string {
+	if r.Min == r.Max {
+		return strconv.FormatUint(uint64(r.Min), 10)
+	}
+	return strconv.FormatUint(uint64(r.Min), 10) + "-" + strconv.FormatUint(uint64(r.Max), 10)
+}
+
+// PortMatch describes matching a transport source or destination port,
+// regardless of whether the match is expressed using the xt “tcp” and “udp”
+// match extensions of iptables-nft, or natively using payload compare, range,
+// and set lookup expressions.
+type PortMatch struct {
+	// Protocol is the name of the transport protocol, such as "tcp", "udp",
+	// "sctp", et cetera, or empty if unknown.
+	Protocol  string
+	Direction PortDirection
+	// Ranges are the port ranges matched, sorted in ascending order. Ranges is
+	// nil in case of a set lookup with the set elements (yet) unknown.
+	Ranges []PortRange
+	// Set is the name of the set looked up, if any; anonymous sets have names
+	// in the form of “__set%d”.
+	Set string
+	// Invert is true for inverted port matches, that is, for matching ports
+	// not in Ranges.
+	Invert bool
+}
+
+// Matches returns true if the specified port is matched, taking inverted
+// matches into account. Matches always returns false if the port ranges are
+// unknown.
+func (m *PortMatch) Matches(port uint16) bool {
+	if m.Ranges == nil {
+		return false
+	}
+	for _, r := range m.Ranges {
+		if r.Contains(port) {
+			return !m.Invert
+		}
+	}
+	return m.Invert
+}
+
+// String returns the port match in nft notation, such as “tcp dport 80”,
+// “udp sport != 1024-65535”, “tcp dport { 80, 443 }”, or “tcp dport
+// @ports”. Anonymous sets are rendered with their ports, if known. If the
+// transport protocol is unknown, then “th” is used instead.
+func (m *PortMatch) String() string {
+	var b strings.Builder
+	if m.Protocol != "" {
+		b.WriteString(m.Protocol)
+	} else {
+		b.WriteString("th")
+	}
+	b.WriteString(" " + m.Direction.String())
+	if m.Invert {
+		b.WriteString(" !=")
+	}
+	switch {
+	case m.Set != "" && (m.Ranges == nil || !strings.HasPrefix(m.Set, "__set")):
+		b.WriteString(" @" + m.Set)
+	case len(m.Ranges) == 1 && m.Set == "":
+		b.WriteString(" " + m.Ranges[0].String())
+	default:
+		ranges := make([]string, 0, len(m.Ranges))
+		for _, r := range m.Ranges {
+			ranges = append(ranges, r.String())
+		}
+		b.WriteString(" { " + strings.Join(ranges, ", ") + " }")
+	}
+	return b.String()
+}
+
+// Resolve resolves the port ranges of a set lookup port match using the sets
+// of the specified table, returning true if successful. Resolve returns true
+// without changing the port match if it isn't a set lookup.
+func (m *PortMatch) Resolve(table *nufftables.Table) bool {
+	if m.Set == "" {
+		return true
+	}
+	if table == nil {
+		return false
+	}
+	set, ok := table.SetsByName[m.Set]
+	if !ok || set.IsMap || set.Concatenation {
+		return false
+	}
+	ranges := []PortRange{}
+	for _, r := range set.Ranges() {
+		if len(r.From) < 2 || len(r.To) < 2 {
+			return false
+		}
+		ranges = append(ranges, PortRange{
+			Min: binary.BigEndian.Uint16(r.From),
+			Max: binary.BigEndian.Uint16(r.To),
+		})
+	}
+	m.Ranges = ranges
+	return true
+}
+
+// MatchPort returns the first transport port match, as well as the remaining
+// expressions after the match. If no port match was found, then the remaining
+// expressions are returned as nil, together with a nil port match.
+//
+// MatchPort understands the xt “tcp”, “udp”, and “multiport” match extensions, as well as
+// native port matches, such as “tcp dport 80”, “udp sport != 53”, “tcp dport
+// 8000-8100”, “th dport >= 1024”, and “tcp dport { 80, 443 }”. Set lookups are
+// returned unresolved, see also [PortMatch.Resolve].
+func MatchPort(exprs nufftables.Expressions) (nufftables.Expressions, *PortMatch) {
+	matches := portMatches(exprs)
+	if len(matches) == 0 {
+		return nil, nil
+	}
+	return exprs[matches[0].next:], &matches[0].PortMatch
+}
+
+// OptionalMatchPort returns the next transport port match, if any, or nil. It
+// either returns the remaining expressions or the original expressions if no
+// port match could be found.
+func OptionalMatchPort(exprs nufftables.Expressions) (nufftables.Expressions, *PortMatch) {
+	remexprs, match := MatchPort(exprs)
+	if match == nil {
+		return exprs, nil
+	}
+	return remexprs, match
+}
+
+// PortMatches returns all transport port matches of the specified expressions,
+// in the order of the expressions. Set lookups are returned unresolved, see
+// also [PortMatch.Resolve] and [RulePortMatches].
+func PortMatches(exprs nufftables.Expressions) []PortMatch {
+	var matches []PortMatch
+	for _, m := range portMatches(exprs) {
+		matches = append(matches, m.PortMatch)
+	}
+	return matches
+}
+
+// RulePortMatches returns all transport port matches of the specified rule,
+// resolving anonymous as well as named set lookups using the sets of the
+// rule's table.
+func RulePortMatches(rule *nufftables.Rule) []PortMatch {
+	matches := PortMatches(rule.Expressions())
+	if rule.Chain == nil {
+		return matches
+	}
+	for idx := range matches {
+		matches[idx].Resolve(rule.Chain.Table)
+	}
+	return matches
+}
+
+// portMatch is a port match together with the index of the expression
+// following the expressions of the port match.
+type portMatch struct {
+	PortMatch
+	next int
+}
+
+// portProtocols maps the transport protocol numbers having source and
+// destination ports to their names.
+var portProtocols = map[uint8]string{
+	unix.IPPROTO_TCP:     "tcp",
+	unix.IPPROTO_UDP:     "udp",
+	unix.IPPROTO_SCTP:    "sctp",
+	unix.IPPROTO_DCCP:    "dccp",
+	unix.IPPROTO_UDPLITE: "udplite",
+}
+
+// portMatches returns the port matches of the specified expressions, sorted
+// by the position of the expressions.
+func portMatches(exprs nufftables.Expressions) []portMatch {
+	index := map[expr.Any]int{}
+	for idx, e := range exprs {
+		index[e] = idx
+	}
+	rule := Lift(exprs)
+	l4proto := rule.L4Proto(nftables.TableFamilyUnspecified)
+	protocol, ok := portProtocols[l4proto]
+	if !ok && l4proto != 0 {
+		// transport protocol without ports, such as ICMP.
+		return xtPortMatches(rule.XtMatches, index, protocol)
+	}
+	matches := xtPortMatches(rule.XtMatches, index, protocol)
+	for idx := 0; idx < len(rule.Predicates); idx++ {
+		pred := &rule.Predicates[idx]
+		dir, ok := portDirection(pred)
+		if !ok {
+			continue
+		}
+		match := portMatch{
+			PortMatch: PortMatch{Protocol: protocol, Direction: dir},
+			next:      index[pred.Exprs[len(pred.Exprs)-1]] + 1,
+		}
+		switch pred.Op {
+		case OpEq, OpNeq:
+			port := portValue(pred, pred.Value)
+			match.Ranges = []PortRange{{Min: port, Max: port}}
+			match.Invert = pred.Op == OpNeq
+		case OpInRange, OpNotInRange:
+			match.Ranges = []PortRange{{Min: portValue(pred, pred.Value), Max: portValue(pred, pred.ValueTo)}}
+			match.Invert = pred.Op == OpNotInRange
+		case OpLt, OpLte, OpGt, OpGte:
+			r, ok := portBound(pred)
+			if !ok {
+				continue
+			}
+			// iptables-nft expresses port ranges as “>= min” followed by
+			// “<= max”, so we merge them into a single range.
+			if idx+1 < len(rule.Predicates) {
+				next := &rule.Predicates[idx+1]
+				if nextdir, ok := portDirection(next); ok && nextdir == dir {
+					if nextr, ok := portBound(next); ok && (r.Min == 0) != (nextr.Min == 0) {
+						if nextr.Min > r.Min {
+							r.Min = nextr.Min
+						}
+						if nextr.Max < r.Max {
+							r.Max = nextr.Max
+						}
+						match.next = index[next.Exprs[len(next.Exprs)-1]] + 1
+						idx++
+					}
+				}
+			}
+			match.Ranges = []PortRange{r}
+		case OpInSet, OpNotInSet:
+			if pred.Operand.Concat != nil {
+				continue
+			}
+			match.Set = pred.Set
+			match.Invert = pred.Op == OpNotInSet
+		}
+		matches = append(matches, match)
+	}
+	sort.SliceStable(matches, func(a, b int) bool { return matches[a].next < matches[b].next })
+	return matches
+}
+
+// portDirection returns the port direction if the specified predicate matches
+// a transport port.
+func portDirection(pred *Predicate) (PortDirection, bool) {
+	payload, ok := pred.Operand.Field.(*expr.Payload)
+	if !ok || payload.Base != expr.PayloadBaseTransportHeader ||
+		payload.Len != 2 || pred.Operand.Mask != nil {
+		return 0, false
+	}
+	switch payload.Offset {
+	case 0:
+		return SourcePort, true
+	case 2:
+		return DestinationPort, true
+	}
+	return 0, false
+}
+
+// portValue returns the port value compared with, taking into account that
+// the port might have been converted into host byte order.
+func portValue(pred *Predicate, data []byte) uint16 {
+	if len(data) < 2 {
+		return 0
+	}
+	for _, e := range pred.Exprs {
+		if bo, ok := e.(*expr.Byteorder); ok && bo.Op == expr.ByteorderNtoh {
+			return hostOrder.Uint16(data)
+		}
+	}
+	return binary.BigEndian.Uint16(data)
+}
+
+// portBound returns the port range for a “<”, “<=”, “>”, or “>=” port
+// predicate.
+func portBound(pred *Predicate) (PortRange, bool) {
+	port := portValue(pred, pred.Value)
+	switch pred.Op {
+	case OpLt:
+		if port == 0 {
+			return PortRange{}, false
+		}
+		return PortRange{Min: 0, Max: port - 1}, true
+	case OpLte:
+		return PortRange{Min: 0, Max: port}, true
+	case OpGt:
+		if port == 0xffff {
+			return PortRange{}, false
+		}
+		return PortRange{Min: port + 1, Max: 0xffff}, true
+	case OpGte:
+		return PortRange{Min: port, Max: 0xffff}, true
+	}
+	return PortRange{}, false
+}
+
+// xtPortMatches returns the port matches of the xt “tcp”, “udp”, and
+// “multiport” match extensions. As the “tcp” and “udp” match extensions always
+// specify both source and destination port ranges, unrestricted non-inverted
+// port ranges are skipped. As the “multiport” match extension doesn't tell the
+// transport protocol itself, the specified protocol is used instead.
+func xtPortMatches(matches []*expr.Match, index map[expr.Any]int, protocol string) []portMatch {
+	var ports []portMatch
+	add := func(m *expr.Match, dir PortDirection, r [2]uint16, invert bool) {
+		if r[0] == 0 && r[1] == 0xffff && !invert {
+			return
+		}
+		ports = append(ports, portMatch{
+			PortMatch: PortMatch{
+				Protocol:  m.Name,
+				Direction: dir,
+				Ranges:    []PortRange{{Min: r[0], Max: r[1]}},
+				Invert:    invert,
+			},
+			next: index[m] + 1,
+		})
+	}
+	for _, m := range matches {
+		switch info := m.Info.(type) {
+		case *xt.Tcp:
+			add(m, SourcePort, info.SrcPorts, info.InvFlags&xt.TcpInvSrcPorts != 0)
+			add(m, DestinationPort, info.DstPorts, info.InvFlags&xt.TcpInvDestPorts != 0)
+		case *xt.Udp:
+			add(m, SourcePort, info.SrcPorts, info.InvFlags&xt.UdpInvSrcPorts != 0)
+			add(m, DestinationPort, info.DstPorts, info.InvFlags&xt.UdpInvDestPorts != 0)
+		default:
+			if match, ok := decodeMultiport(m); ok {
+				match.Protocol = protocol
+				ports = append(ports, portMatch{PortMatch: *match, next: index[m] + 1})
+			}
+		}
+	}
+	return ports
+}
+
+// Flags and sizes of the xt “multiport” match extension.
+const (
+	multiportSource      = 0
+	multiportDestination = 1
+	multiportEither      = 2
+
+	multiportMaxPorts = 15
+)
+
+// decodeMultiport decodes the xt “multiport” match extension. Revision 0 only
+// supports individual ports, while revision 1 additionally supports port
+// ranges as well as inversion. The ports are in host byte order.
+func decodeMultiport(match *expr.Match) (*PortMatch, bool) {
+	size := 2 + 2*multiportMaxPorts
+	if match.Rev >= 1 {
+		size += multiportMaxPorts + 1
+	}
+	info, ok := unknownInfo(match, "multiport", size)
+	if !ok {
+		return nil, false
+	}
+	m := &PortMatch{Ranges: []PortRange{}}
+	switch info[0] {
+	case multiportSource:
+		m.Direction = SourcePort
+	case multiportDestination:
+		m.Direction = DestinationPort
+	case multiportEither:
+		m.Direction = EitherPort
+	default:
+		return nil, false
+	}
+	count := int(info[1])
+	if count > multiportMaxPorts {
+		return nil, false
+	}
+	port := func(idx int) uint16 { return hostOrder.Uint16(info[2+2*idx:]) }
+	for idx := 0; idx < count; idx++ {
+		r := PortRange{Min: port(idx), Max: port(idx)}
+		if match.Rev >= 1 && info[2+2*multiportMaxPorts+idx] != 0 && idx+1 < count {
+			idx++
+			r.Max = port(idx)
+		}
+		m.Ranges = append(m.Ranges, r)
+	}
+	if match.Rev >= 1 {
+		m.Invert = info[2+3*multiportMaxPorts] != 0
+	}
+	sort.Slice(m.Ranges, func(a, b int) bool { return m.Ranges[a].Min < m.Ranges[b].Min })
+	return m, true
+}
@@ -25,6 +25,9 @@ import (
 // expressions. Protocol names returned are either "tcp" or "udp". If no
 // suitable Match expression was found, then the remaining expressions are
 // returned as nil, together with an empty protocol name.
+//
+// MatchPortRange only understands the xt “tcp” and “udp” match extensions; please
+// use [MatchPort] to also match native nftables port matches.
 func MatchPortRange(exprs nufftables.Expressions) (e nufftables.Expressions, protocol string, minport, maxport uint16) {
 	exprs, match := nufftables.OfTypeFunc(exprs, isTCPUDPPortRange)
 	if exprs == nil {
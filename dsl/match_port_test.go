@@ -0,0 +1,186 @@
+// Copyright 2023 Harald Albrecht.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy
+// of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package dsl
+
+import (
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"github.com/google/nftables/xt"
+	"github.com/thediveo/nufftables"
+	"golang.org/x/sys/unix"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+func l4proto(proto uint8) nufftables.Expressions {
+	return nufftables.Expressions{
+		&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{proto}},
+	}
+}
+
+func dport() *expr.Payload {
+	return payload(expr.PayloadBaseTransportHeader, 2, 2)
+}
+
+var _ = Describe("matching ports", func() {
+
+	It("formats port ranges", func() {
+		Expect(PortRange{Min: 80, Max: 80}.String()).To(Equal("80"))
+		Expect(PortRange{Min: 8000, Max: 8100}.String()).To(Equal("8000-8100"))
+		Expect(SourcePort.String()).To(Equal("sport"))
+		Expect(DestinationPort.String()).To(Equal("dport"))
+	})
+
+	It("formats port matches", func() {
+		Expect((&PortMatch{Protocol: "tcp", Ranges: []PortRange{{Min: 80, Max: 80}}}).String()).
+			To(Equal("tcp dport 80"))
+		Expect((&PortMatch{Protocol: "udp", Direction: SourcePort, Invert: true,
+			Ranges: []PortRange{{Min: 1024, Max: 65535}}}).String()).
+			To(Equal("udp sport != 1024-65535"))
+		Expect((&PortMatch{Direction: EitherPort, Set: "__set0",
+			Ranges: []PortRange{{Min: 80, Max: 80}, {Min: 443, Max: 443}}}).String()).
+			To(Equal("th port { 80, 443 }"))
+		Expect((&PortMatch{Protocol: "tcp", Set: "ports"}).String()).
+			To(Equal("tcp dport @ports"))
+	})
+
+	It("matches single native ports and returns the remaining expressions", func() {
+		counter := &expr.Counter{}
+		exprs := append(l4proto(unix.IPPROTO_TCP),
+			dport(),
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{0x1f, 0x90}},
+			counter)
+		remexprs, match := MatchPort(exprs)
+		Expect(match).NotTo(BeNil())
+		Expect(remexprs).To(ConsistOf(counter))
+		Expect(*match).To(Equal(PortMatch{
+			Protocol:  "tcp",
+			Direction: DestinationPort,
+			Ranges:    []PortRange{{Min: 8080, Max: 8080}},
+		}))
+		Expect(match.Matches(8080)).To(BeTrue())
+		Expect(match.Matches(80)).To(BeFalse())
+
+		remexprs, match = MatchPort(nufftables.Expressions{counter})
+		Expect(remexprs).To(BeNil())
+		Expect(match).To(BeNil())
+		remexprs, match = OptionalMatchPort(nufftables.Expressions{counter})
+		Expect(remexprs).To(ConsistOf(counter))
+		Expect(match).To(BeNil())
+	})
+
+	It("matches inverted source ports", func() {
+		matches := PortMatches(append(l4proto(unix.IPPROTO_UDP),
+			payload(expr.PayloadBaseTransportHeader, 0, 2),
+			&expr.Cmp{Op: expr.CmpOpNeq, Register: 1, Data: []byte{0, 53}}))
+		Expect(matches).To(HaveExactElements(PortMatch{
+			Protocol:  "udp",
+			Direction: SourcePort,
+			Ranges:    []PortRange{{Min: 53, Max: 53}},
+			Invert:    true,
+		}))
+		Expect(matches[0].Matches(53)).To(BeFalse())
+		Expect(matches[0].Matches(54)).To(BeTrue())
+	})
+
+	It("matches native port ranges", func() {
+		Expect(PortMatches(append(l4proto(unix.IPPROTO_SCTP),
+			dport(),
+			&expr.Range{Op: expr.CmpOpNeq, Register: 1, FromData: []byte{0x1f, 0x40}, ToData: []byte{0x1f, 0xa4}}))).To(
+			HaveExactElements(PortMatch{
+				Protocol:  "sctp",
+				Direction: DestinationPort,
+				Ranges:    []PortRange{{Min: 8000, Max: 8100}},
+				Invert:    true,
+			}))
+	})
+
+	It("merges lower and upper port bounds, and understands host byte order", func() {
+		Expect(PortMatches(nufftables.Expressions{
+			dport(),
+			&expr.Cmp{Op: expr.CmpOpGte, Register: 1, Data: []byte{0x1f, 0x40}},
+			&expr.Cmp{Op: expr.CmpOpLte, Register: 1, Data: []byte{0x1f, 0xa4}},
+			dport(),
+			&expr.Byteorder{SourceRegister: 1, DestRegister: 1, Op: expr.ByteorderNtoh, Len: 2, Size: 2},
+			&expr.Cmp{Op: expr.CmpOpLt, Register: 1, Data: []byte{0x00, 0x04}},
+		})).To(HaveExactElements(
+			PortMatch{Direction: DestinationPort, Ranges: []PortRange{{Min: 8000, Max: 8100}}},
+			PortMatch{Direction: DestinationPort, Ranges: []PortRange{{Min: 0, Max: 1023}}},
+		))
+	})
+
+	It("ignores transport protocols without ports", func() {
+		Expect(PortMatches(append(l4proto(unix.IPPROTO_ICMP),
+			payload(expr.PayloadBaseTransportHeader, 0, 2),
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{8, 0}}))).To(BeEmpty())
+	})
+
+	It("matches xt tcp and udp port matches", func() {
+		Expect(PortMatches(nufftables.Expressions{
+			&expr.Match{Name: "tcp", Info: &xt.Tcp{
+				SrcPorts: [2]uint16{0, 0xffff},
+				DstPorts: [2]uint16{80, 90},
+			}},
+			&expr.Match{Name: "udp", Info: &xt.Udp{
+				SrcPorts: [2]uint16{53, 53},
+				DstPorts: [2]uint16{0, 0xffff},
+				InvFlags: xt.UdpInvSrcPorts,
+			}},
+		})).To(HaveExactElements(
+			PortMatch{Protocol: "tcp", Direction: DestinationPort, Ranges: []PortRange{{Min: 80, Max: 90}}},
+			PortMatch{Protocol: "udp", Direction: SourcePort, Ranges: []PortRange{{Min: 53, Max: 53}}, Invert: true},
+		))
+	})
+
+	It("resolves anonymous set lookups", func() {
+		table := &nftables.Table{Name: "filter", Family: nftables.TableFamilyINet}
+		chain := &nftables.Chain{Name: "input", Table: table}
+		conn := nufftables.NewMemConn()
+		set := &nftables.Set{Table: table, Anonymous: true, Constant: true, Interval: true,
+			KeyType: nftables.TypeInetService}
+		Expect(conn.AddSet(set, []nftables.SetElement{
+			{Key: []byte{0, 80}},
+			{Key: []byte{0, 81}, IntervalEnd: true},
+			{Key: []byte{0x1f, 0x40}},
+			{Key: []byte{0x1f, 0xa5}, IntervalEnd: true},
+		})).To(Succeed())
+		conn.AddRule(&nftables.Rule{Table: table, Chain: chain, Exprs: append(l4proto(unix.IPPROTO_TCP),
+			dport(),
+			&expr.Lookup{SourceRegister: 1, SetName: set.Name, SetID: set.ID})})
+		tables, err := nufftables.GetAllTables(conn)
+		Expect(err).NotTo(HaveOccurred())
+		rule := &tables.TableChain("filter", nufftables.TableFamilyINet, "input").Rules[0]
+
+		unresolved := PortMatches(rule.Expressions())
+		Expect(unresolved).To(HaveLen(1))
+		Expect(unresolved[0].Set).To(Equal("__set0"))
+		Expect(unresolved[0].Ranges).To(BeNil())
+		Expect(unresolved[0].Matches(80)).To(BeFalse())
+		Expect(unresolved[0].Resolve(nil)).To(BeFalse())
+
+		matches := RulePortMatches(rule)
+		Expect(matches).To(HaveExactElements(PortMatch{
+			Protocol:  "tcp",
+			Direction: DestinationPort,
+			Ranges:    []PortRange{{Min: 80, Max: 80}, {Min: 8000, Max: 8100}},
+			Set:       "__set0",
+		}))
+		Expect(matches[0].Matches(8042)).To(BeTrue())
+		Expect(matches[0].Matches(443)).To(BeFalse())
+	})
+
+})
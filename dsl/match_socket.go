@@ -0,0 +1,117 @@
+// Copyright 2023 Harald Albrecht.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy
+// of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package dsl
+
+import (
+	"github.com/google/nftables/expr"
+	"github.com/thediveo/nufftables"
+)
+
+// SocketMatch describes an xt “socket” match or a native socket expression
+// match, such as “socket transparent 1”, matching packets for which a local
+// socket exists.
+//
+// Please note that the nftables package doesn't decode native socket
+// expressions when reading rules from the kernel, leaving only the compare
+// with an unloaded register. Thus, native socket matches can only be decoded
+// from rules not read from the kernel.
+type SocketMatch struct {
+	// Transparent only matches transparent sockets; native matches set it for
+	// “socket transparent 1”.
+	Transparent bool
+	// NoWildcard ignores sockets bound to the unspecified address; native
+	// matches set it for “socket wildcard 0”.
+	NoWildcard bool
+	// RestoreSkMark restores the packet mark from the socket mark.
+	RestoreSkMark bool
+	// Native is the match of a native socket expression, such as “socket
+	// mark 0x1”; it is nil for xt “socket” matches.
+	Native *SocketKeyMatch
+}
+
+// SocketKeyMatch describes matching the value of a native socket expression,
+// such as the socket's mark or whether the socket is transparent.
+type SocketKeyMatch struct {
+	Key expr.SocketKey
+	ValueMatch
+}
+
+// Flags of the xt “socket” match extension revisions 1 and later.
+const (
+	xtSocketTransparent   = 1 << 0
+	xtSocketNoWildcard    = 1 << 1
+	xtSocketRestoreSkMark = 1 << 2
+)
+
+// MatchSocket returns the information from the first xt “socket” match
+// extension or native socket expression match, together with the remaining
+// expressions after the match. If no match is found, then nil is returned for
+// the remaining expressions.
+func MatchSocket(exprs nufftables.Expressions) (nufftables.Expressions, *SocketMatch) {
+	remexprs, match := matchXt(exprs, decodeSocket)
+	for _, pred := range Lift(exprs).Predicates {
+		native := socketMatch(&pred)
+		if native == nil {
+			continue
+		}
+		// The native match comes first if more expressions remain after it.
+		if nativeexprs := after(exprs, pred.Exprs); remexprs == nil || len(nativeexprs) > len(remexprs) {
+			return nativeexprs, native
+		}
+		break
+	}
+	return remexprs, match
+}
+
+// socketMatch returns the socket match for the specified predicate if it
+// compares the value of a native socket expression, or nil.
+func socketMatch(pred *Predicate) *SocketMatch {
+	socket, ok := pred.Operand.Field.(*expr.Socket)
+	if !ok {
+		return nil
+	}
+	vm, ok := valueMatch(pred, false)
+	if !ok {
+		return nil
+	}
+	match := &SocketMatch{Native: &SocketKeyMatch{Key: socket.Key, ValueMatch: vm}}
+	switch socket.Key {
+	case expr.SocketKeyTransparent:
+		match.Transparent = vm.Matches(1) && !vm.Matches(0)
+	case expr.SocketKeyWildcard:
+		match.NoWildcard = vm.Matches(0) && !vm.Matches(1)
+	}
+	return match
+}
+
+// decodeSocket decodes the xt “socket” match extension; revision 0 has no
+// match information at all.
+func decodeSocket(match *expr.Match) (*SocketMatch, bool) {
+	if match.Rev == 0 {
+		if _, ok := unknownInfo(match, "socket", 0); !ok {
+			return nil, false
+		}
+		return &SocketMatch{}, true
+	}
+	info, ok := unknownInfo(match, "socket", 1)
+	if !ok {
+		return nil, false
+	}
+	return &SocketMatch{
+		Transparent:   info[0]&xtSocketTransparent != 0,
+		NoWildcard:    info[0]&xtSocketNoWildcard != 0,
+		RestoreSkMark: info[0]&xtSocketRestoreSkMark != 0,
+	}, true
+}
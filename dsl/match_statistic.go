@@ -0,0 +1,117 @@
+// Copyright 2023 Harald Albrecht.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy
+// of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package dsl
+
+import (
+	"fmt"
+
+	"github.com/google/nftables/expr"
+	"github.com/thediveo/nufftables"
+)
+
+// StatisticMode is the mode of an xt “statistic” match.
+type StatisticMode uint16
+
+// Modes of the xt “statistic” match.
+const (
+	StatisticRandom StatisticMode = iota // matches packets randomly
+	StatisticNth                         // matches every nth packet
+)
+
+// StatisticMatch describes an xt “statistic” match, as used by kube-proxy in
+// iptables mode to spread the traffic of a service across its endpoints, such
+// as “-m statistic --mode random --probability 0.5”.
+type StatisticMatch struct {
+	Mode StatisticMode
+	// Probability is the probability of a packet to match in random mode,
+	// in the range of 0..1.
+	Probability float64
+	// Every and Packet specify in nth mode to match every Every-th packet,
+	// starting with the Packet-th packet (counting from zero).
+	Every, Packet uint32
+	// Invert inverts the match.
+	Invert bool
+}
+
+// Flags and modes of the xt “statistic” match extension.
+const (
+	xtStatisticInvert = 1 << 0
+	xtStatisticNth    = 1
+	// xtStatisticProbabilityScale is the scale of the random mode's
+	// probability, which the kernel compares with 31bit random numbers.
+	xtStatisticProbabilityScale = 1 << 31
+)
+
+// Rate returns the share of packets matching, in the range of 0..1, taking
+// an inverted match into account.
+func (m *StatisticMatch) Rate() float64 {
+	var rate float64
+	switch m.Mode {
+	case StatisticRandom:
+		rate = m.Probability
+	case StatisticNth:
+		if m.Every != 0 {
+			rate = 1 / float64(m.Every)
+		}
+	}
+	if m.Invert {
+		return 1 - rate
+	}
+	return rate
+}
+
+// String returns the statistic match in iptables notation, such as “--mode
+// random --probability 0.50000000000” or “! --mode nth --every 3 --packet 0”.
+func (m *StatisticMatch) String() string {
+	not := ""
+	if m.Invert {
+		not = "! "
+	}
+	if m.Mode == StatisticNth {
+		return fmt.Sprintf("%s--mode nth --every %d --packet %d", not, m.Every, m.Packet)
+	}
+	return fmt.Sprintf("%s--mode random --probability %.11f", not, m.Probability)
+}
+
+// MatchStatistic returns the information from the first xt “statistic” match
+// extension, together with the remaining expressions after the match. If no
+// match is found, then nil is returned for the remaining expressions.
+func MatchStatistic(exprs nufftables.Expressions) (nufftables.Expressions, *StatisticMatch) {
+	return matchXt(exprs, decodeStatistic)
+}
+
+// decodeStatistic decodes the xt “statistic” match extension. The info
+// payload starts with the mode and flags, followed by either the probability
+// in random mode, or the every, packet, and count values in nth mode. The
+// kernel-internal master pointer following these fields is ignored. Please
+// note that iptables stores the every value decremented by one.
+func decodeStatistic(match *expr.Match) (*StatisticMatch, bool) {
+	info, ok := unknownInfo(match, "statistic", 16)
+	if !ok {
+		return nil, false
+	}
+	m := &StatisticMatch{
+		Invert: hostOrder.Uint16(info[2:])&xtStatisticInvert != 0,
+	}
+	switch hostOrder.Uint16(info[0:]) {
+	case xtStatisticNth:
+		m.Mode = StatisticNth
+		m.Every = hostOrder.Uint32(info[4:]) + 1
+		m.Packet = hostOrder.Uint32(info[8:])
+	default:
+		m.Probability = float64(hostOrder.Uint32(info[4:])) / xtStatisticProbabilityScale
+	}
+	return m, true
+}
@@ -0,0 +1,108 @@
+// Copyright 2023 Harald Albrecht.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy
+// of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package dsl
+
+import (
+	"bytes"
+	"encoding/binary"
+
+	"github.com/google/nftables/expr"
+	"github.com/thediveo/nufftables"
+)
+
+// SpreadEntry is the data of a map element that traffic gets spread to by a
+// number generator or hash map lookup, together with its share of the
+// traffic in the range of 0..1. For verdict maps, Verdict is the verdict of
+// the map element instead.
+type SpreadEntry struct {
+	Data    []byte
+	Verdict *expr.Verdict
+	Weight  float64
+}
+
+// ResolveSpread resolves a map lookup keyed by a number generator or a hash,
+// such as in “dnat to numgen inc mod 3 map { 0 : 10.0.0.1, 1-2 : 10.0.0.2 }”
+// and “dnat to jhash ip saddr mod 2 map @backends”, into the distinct map
+// element data together with their share of the traffic. Elements mapping to
+// the same data are combined and hashes are assumed to be uniformly
+// distributed. ResolveSpread returns nil if the operand isn't such a map
+// lookup or the map is unknown.
+//
+// ResolveSpread also resolves verdict map lookups, such as kube-proxy's
+// “numgen random mod 2 vmap { 0 : goto endpoint-a, 1 : goto endpoint-b }”,
+// when passed an operand with the [Verdict.Map] and [Verdict.MapKey] of the
+// rule's verdict.
+func ResolveSpread(table *nufftables.Table, op Operand) []SpreadEntry {
+	if table == nil || op.Map == "" || op.MapKey == nil {
+		return nil
+	}
+	var modulus, offset uint32
+	switch key := op.MapKey.Field.(type) {
+	case *expr.Numgen:
+		modulus, offset = key.Modulus, key.Offset
+	case *expr.Hash:
+		modulus, offset = key.Modulus, key.Offset
+	default:
+		return nil
+	}
+	set, ok := table.SetsByName[op.Map]
+	if !ok || !set.IsMap || modulus == 0 {
+		return nil
+	}
+	// Number generators and hashes are in host byte order, but nft converts
+	// them into network byte order for interval maps.
+	var order binary.ByteOrder = hostOrder
+	if set.Interval {
+		order = binary.BigEndian
+	}
+	last := uint64(offset) + uint64(modulus) - 1
+	spread := []SpreadEntry{}
+	for _, entry := range set.Entries() {
+		if len(entry.From) != 4 || len(entry.To) != 4 {
+			continue
+		}
+		from, to := uint64(order.Uint32(entry.From)), uint64(order.Uint32(entry.To))
+		if from < uint64(offset) {
+			from = uint64(offset)
+		}
+		if to > last {
+			to = last
+		}
+		if from > to {
+			continue
+		}
+		weight := float64(to-from+1) / float64(modulus)
+		idx := 0
+		for ; idx < len(spread); idx++ {
+			if bytes.Equal(spread[idx].Data, entry.Val) && sameVerdict(spread[idx].Verdict, entry.Verdict) {
+				spread[idx].Weight += weight
+				break
+			}
+		}
+		if idx == len(spread) {
+			spread = append(spread, SpreadEntry{Data: entry.Val, Verdict: entry.Verdict, Weight: weight})
+		}
+	}
+	return spread
+}
+
+// sameVerdict returns true if both verdicts are either nil or the same
+// verdicts, jumping or going to the same chain.
+func sameVerdict(a, b *expr.Verdict) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Kind == b.Kind && a.Chain == b.Chain
+}
@@ -0,0 +1,105 @@
+// Copyright 2023 Harald Albrecht.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy
+// of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package dsl
+
+import (
+	"encoding/binary"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"github.com/thediveo/nufftables"
+	"golang.org/x/sys/unix"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+// spreadTable returns a table with the specified map.
+func spreadTable(set *nftables.Set, elements ...nftables.SetElement) *nufftables.Table {
+	table := &nufftables.Table{Table: &nftables.Table{Family: nftables.TableFamilyIPv4},
+		SetsByName: map[string]*nufftables.Set{}}
+	table.SetsByName[set.Name] = &nufftables.Set{Set: set, Elements: elements, Table: table}
+	return table
+}
+
+var _ = Describe("spreading map lookups", func() {
+
+	It("resolves numgen maps", func() {
+		table := spreadTable(&nftables.Set{Name: "__map0", IsMap: true},
+			nftables.SetElement{Key: hostUint32(0), Val: []byte{10, 0, 0, 1}},
+			nftables.SetElement{Key: hostUint32(1), Val: []byte{10, 0, 0, 2}},
+			nftables.SetElement{Key: hostUint32(2), Val: []byte{10, 0, 0, 2}},
+			nftables.SetElement{Key: hostUint32(3), Val: []byte{10, 0, 0, 3}},
+		)
+		rule := Lift(nufftables.Expressions{
+			&expr.Numgen{Register: 1, Modulus: 3, Type: unix.NFT_NG_INCREMENTAL},
+			&expr.Lookup{SourceRegister: 1, DestRegister: 1, IsDestRegSet: true, SetName: "__map0"},
+			&expr.NAT{Type: expr.NATTypeDestNAT, Family: unix.NFPROTO_IPV4, RegAddrMin: 1},
+		})
+		nat, ok := decodeNAT(&rule.Statements[0])
+		Expect(ok).To(BeTrue())
+		Expect(ResolveSpread(table, nat.AddrOperand)).To(HaveExactElements(
+			SpreadEntry{Data: []byte{10, 0, 0, 1}, Weight: 1.0 / 3},
+			SpreadEntry{Data: []byte{10, 0, 0, 2}, Weight: 2.0 / 3},
+		))
+	})
+
+	It("resolves jhash interval maps", func() {
+		be := func(v uint32) []byte { return binary.BigEndian.AppendUint32(nil, v) }
+		table := spreadTable(&nftables.Set{Name: "backends", IsMap: true, Interval: true},
+			nftables.SetElement{Key: be(0), Val: []byte{10, 0, 0, 1}},
+			nftables.SetElement{Key: be(1), Val: []byte{10, 0, 0, 2}},
+			nftables.SetElement{Key: be(4), IntervalEnd: true},
+		)
+		op := Operand{Map: "backends", MapKey: &Operand{
+			Field: &expr.Hash{Modulus: 4, Type: expr.HashTypeJenkins}}}
+		Expect(ResolveSpread(table, op)).To(HaveExactElements(
+			SpreadEntry{Data: []byte{10, 0, 0, 1}, Weight: 0.25},
+			SpreadEntry{Data: []byte{10, 0, 0, 2}, Weight: 0.75},
+		))
+	})
+
+	It("resolves numgen verdict maps", func() {
+		gotoChain := func(chain string) *expr.Verdict {
+			return &expr.Verdict{Kind: expr.VerdictGoto, Chain: chain}
+		}
+		table := spreadTable(&nftables.Set{Name: "__map0", IsMap: true},
+			nftables.SetElement{Key: hostUint32(0), VerdictData: gotoChain("a")},
+			nftables.SetElement{Key: hostUint32(1), VerdictData: gotoChain("b")},
+			nftables.SetElement{Key: hostUint32(2), VerdictData: gotoChain("b")},
+		)
+		v := TerminalVerdict(nftables.TableFamilyIPv4, nufftables.Expressions{
+			&expr.Numgen{Register: 1, Modulus: 3, Type: unix.NFT_NG_RANDOM},
+			&expr.Lookup{SourceRegister: 1, DestRegister: unix.NFT_REG_VERDICT, IsDestRegSet: true, SetName: "__map0"},
+		})
+		Expect(v.Kind).To(Equal(VerdictMap))
+		Expect(ResolveSpread(table, Operand{Map: v.Map, MapKey: &v.MapKey})).To(HaveExactElements(
+			SpreadEntry{Verdict: gotoChain("a"), Weight: 1.0 / 3},
+			SpreadEntry{Verdict: gotoChain("b"), Weight: 2.0 / 3},
+		))
+	})
+
+	It("doesn't resolve other operands or unknown maps", func() {
+		table := spreadTable(&nftables.Set{Name: "__map0", IsMap: true})
+		Expect(ResolveSpread(nil, Operand{})).To(BeNil())
+		Expect(ResolveSpread(table, Operand{Map: "__map0", MapKey: &Operand{
+			Field: &expr.Meta{Key: expr.MetaKeyMARK}}})).To(BeNil())
+		Expect(ResolveSpread(table, Operand{Map: "foo", MapKey: &Operand{
+			Field: &expr.Numgen{Modulus: 2}}})).To(BeNil())
+		Expect(ResolveSpread(table, Operand{Map: "__map0", MapKey: &Operand{
+			Field: &expr.Numgen{Modulus: 2}}})).To(BeEmpty())
+	})
+
+})
@@ -0,0 +1,457 @@
+// Copyright 2023 Harald Albrecht.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy
+// of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package dsl
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"github.com/thediveo/nufftables"
+	"golang.org/x/sys/unix"
+)
+
+// CounterStatement describes a “counter” statement.
+type CounterStatement struct {
+	Packets, Bytes uint64
+}
+
+// String returns the counter statement in nft notation.
+func (s *CounterStatement) String() string {
+	return fmt.Sprintf("counter packets %d bytes %d", s.Packets, s.Bytes)
+}
+
+// LogStatement describes a “log” statement, as well as the xt “LOG” and
+// “NFLOG” targets. Only the options flagged as being present are valid.
+type LogStatement struct {
+	Prefix     string
+	Level      expr.LogLevel
+	Group      uint16
+	Snaplen    uint32
+	QThreshold uint16
+	Flags      expr.LogFlags
+	// Present is a bit set of the NFTA_LOG_* attributes present, such as
+	// 1<<[unix.NFTA_LOG_PREFIX].
+	Present uint32
+}
+
+// Has returns true if the specified NFTA_LOG_* option is present.
+func (s *LogStatement) Has(attr uint16) bool {
+	return s.Present&(1<<attr) != 0
+}
+
+var logLevelNames = []string{
+	"emerg", "alert", "crit", "err", "warn", "notice", "info", "debug", "audit",
+}
+
+// String returns the log statement in nft notation, such as “log prefix
+// "dropped: " level warn”.
+func (s *LogStatement) String() string {
+	var b strings.Builder
+	b.WriteString("log")
+	if s.Has(unix.NFTA_LOG_PREFIX) {
+		fmt.Fprintf(&b, " prefix %q", s.Prefix)
+	}
+	if s.Has(unix.NFTA_LOG_GROUP) {
+		fmt.Fprintf(&b, " group %d", s.Group)
+	}
+	if s.Has(unix.NFTA_LOG_SNAPLEN) {
+		fmt.Fprintf(&b, " snaplen %d", s.Snaplen)
+	}
+	if s.Has(unix.NFTA_LOG_QTHRESHOLD) {
+		fmt.Fprintf(&b, " queue-threshold %d", s.QThreshold)
+	}
+	if s.Has(unix.NFTA_LOG_LEVEL) {
+		if int(s.Level) < len(logLevelNames) {
+			b.WriteString(" level " + logLevelNames[s.Level])
+		} else {
+			fmt.Fprintf(&b, " level %d", s.Level)
+		}
+	}
+	if s.Has(unix.NFTA_LOG_FLAGS) && s.Flags != 0 {
+		fmt.Fprintf(&b, " flags 0x%x", uint32(s.Flags))
+	}
+	return b.String()
+}
+
+// LimitStatement describes a “limit” statement, limiting either packets or
+// bytes per time unit.
+type LimitStatement struct {
+	Rate  uint64
+	Unit  expr.LimitTime
+	Burst uint32
+	Bytes bool // rate is in bytes instead of packets.
+	Over  bool // matches when over the limit.
+}
+
+var limitUnitNames = map[expr.LimitTime]string{
+	expr.LimitTimeSecond: "second",
+	expr.LimitTimeMinute: "minute",
+	expr.LimitTimeHour:   "hour",
+	expr.LimitTimeDay:    "day",
+	expr.LimitTimeWeek:   "week",
+}
+
+// String returns the limit statement in nft notation, such as “limit rate
+// 10/second burst 5 packets”.
+func (s *LimitStatement) String() string {
+	var b strings.Builder
+	b.WriteString("limit rate ")
+	if s.Over {
+		b.WriteString("over ")
+	}
+	unit, ok := limitUnitNames[s.Unit]
+	if !ok {
+		unit = fmt.Sprintf("%ds", s.Unit)
+	}
+	if s.Bytes {
+		fmt.Fprintf(&b, "%d bytes/%s", s.Rate, unit)
+	} else {
+		fmt.Fprintf(&b, "%d/%s", s.Rate, unit)
+	}
+	if s.Burst != 0 {
+		if s.Bytes {
+			fmt.Fprintf(&b, " burst %d bytes", s.Burst)
+		} else {
+			fmt.Fprintf(&b, " burst %d packets", s.Burst)
+		}
+	}
+	return b.String()
+}
+
+// QuotaStatement describes a “quota” statement.
+type QuotaStatement struct {
+	Bytes, Consumed uint64
+	Over            bool // matches when over the quota.
+}
+
+// String returns the quota statement in nft notation, such as “quota over
+// 1000 bytes used 42 bytes”.
+func (s *QuotaStatement) String() string {
+	over := ""
+	if s.Over {
+		over = "over "
+	}
+	return fmt.Sprintf("quota %s%d bytes used %d bytes", over, s.Bytes, s.Consumed)
+}
+
+// SetUpdateOp is the operation of a set update statement.
+type SetUpdateOp uint32
+
+// Set update operations.
+const (
+	SetAdd    SetUpdateOp = unix.NFT_DYNSET_OP_ADD
+	SetUpdate SetUpdateOp = unix.NFT_DYNSET_OP_UPDATE
+	SetDelete SetUpdateOp = 2 // NFT_DYNSET_OP_DELETE
+)
+
+// String returns the nft name of the set update operation.
+func (op SetUpdateOp) String() string {
+	switch op {
+	case SetAdd:
+		return "add"
+	case SetUpdate:
+		return "update"
+	case SetDelete:
+		return "delete"
+	}
+	return "?"
+}
+
+// SetUpdateStatement describes dynamically adding, updating, or deleting set
+// elements, such as “add @blocked { ip saddr timeout 1m }”, as well as meters
+// with their per-element statements, such as “update @flood { ip saddr limit
+// rate over 10/second }”.
+type SetUpdateStatement struct {
+	Op  SetUpdateOp
+	Set string
+	// Key is the element key and Data the element data in case of maps.
+	Key, Data Operand
+	Timeout   time.Duration
+	// Statements are the decoded per-element statements, such as limits and
+	// counters.
+	Statements []any
+}
+
+// String returns the set update statement in nft notation, albeit without
+// the key details.
+func (s *SetUpdateStatement) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s @%s", s.Op, s.Set)
+	if s.Timeout != 0 {
+		fmt.Fprintf(&b, " timeout %s", s.Timeout)
+	}
+	for _, stmt := range s.Statements {
+		fmt.Fprintf(&b, " %s", stmt)
+	}
+	return b.String()
+}
+
+// MarkStatement describes setting a packet mark or conntrack mark, such as
+// “meta mark set 0x42”, “ct mark set meta mark”, or the xt “MARK” target. The
+// new mark is computed as (mark & ^Mask) ^ Value, unless the new mark is
+// taken from another Source.
+type MarkStatement struct {
+	Ct          bool // sets the conntrack mark instead of the packet mark.
+	Value, Mask uint32
+	// Source is the operand the mark is set from if it isn't derived from
+	// immediate data or the mark itself, such as “ct mark set meta mark”.
+	Source Operand
+}
+
+// String returns the mark statement in nft notation.
+func (s *MarkStatement) String() string {
+	key := "meta mark"
+	if s.Ct {
+		key = "ct mark"
+	}
+	switch {
+	case !s.Source.IsZero():
+		return key + " set " + operandName(s.Source)
+	case s.Mask == ^uint32(0):
+		return fmt.Sprintf("%s set 0x%08x", key, s.Value)
+	}
+	return fmt.Sprintf("%s set %s & 0x%08x ^ 0x%08x", key, key, ^s.Mask, s.Value)
+}
+
+// operandName returns a short description of the specified operand.
+func operandName(op Operand) string {
+	switch field := op.Field.(type) {
+	case *expr.Meta:
+		return metaKeyName(field.Key)
+	case *expr.Ct:
+		return ctKeyName(field.Key)
+	case *expr.Payload:
+		if f := PayloadField(nftables.TableFamilyUnspecified, 0, field, op.Mask); f != nil {
+			return f.String()
+		}
+		return "payload"
+	}
+	if op.Map != "" {
+		return "map @" + op.Map
+	}
+	return "expression"
+}
+
+// DecodeStatements returns typed descriptions of all statements in the
+// specified (rule) expressions, in the order of the statements. The table
+// family is needed in order to correctly decode some xt targets. The
+// following statements are supported:
+//
+//   - counter: [*CounterStatement]
+//   - log, xt “LOG” and “NFLOG”: [*LogStatement]
+//   - limit: [*LimitStatement]
+//   - quota: [*QuotaStatement]
+//   - set updates and meters: [*SetUpdateStatement]
+//   - meta and ct mark setters, xt “MARK”, ebtables “mark”: [*MarkStatement]
+//   - NAT statements and targets: [*NAT]
+//   - tproxy, xt “TPROXY”: [*TProxy]
+//   - ebtables “snat”, “dnat”, and “redirect”: [*EtherNAT]
+//   - verdicts, reject, queue, and verdict maps: [*Verdict]
+//
+// All descriptions implement [fmt.Stringer].
+func DecodeStatements(family nftables.TableFamily, exprs nufftables.Expressions) []any {
+	stmts := []any{}
+	for _, stmt := range Lift(exprs).Statements {
+		if s := decodeStatement(family, &stmt); s != nil {
+			stmts = append(stmts, s)
+		}
+	}
+	return stmts
+}
+
+// StatementOf returns the first statement description of type T, together
+// with the remaining expressions after the statement, see also
+// [DecodeStatements]. If there is no such statement, then nil is returned for
+// the remaining expressions.
+func StatementOf[T any](family nftables.TableFamily, exprs nufftables.Expressions) (nufftables.Expressions, T) {
+	for _, stmt := range Lift(exprs).Statements {
+		if s, ok := decodeStatement(family, &stmt).(T); ok {
+			return after(exprs, nufftables.Expressions{stmt.Expr}), s
+		}
+	}
+	var zero T
+	return nil, zero
+}
+
+// decodeStatement returns the typed description of the specified (lifted)
+// statement, or nil if not supported.
+func decodeStatement(family nftables.TableFamily, stmt *Statement) any {
+	if v, ok := decodeVerdict(family, stmt); ok {
+		return v
+	}
+	if nat, ok := decodeNAT(stmt); ok {
+		return nat
+	}
+	if tproxy, ok := decodeTProxy(stmt); ok {
+		return tproxy
+	}
+	switch e := stmt.Expr.(type) {
+	case *expr.Counter:
+		return &CounterStatement{Packets: e.Packets, Bytes: e.Bytes}
+	case *expr.Log:
+		return &LogStatement{
+			Prefix:     cString(e.Data),
+			Level:      e.Level,
+			Group:      e.Group,
+			Snaplen:    e.Snaplen,
+			QThreshold: e.QThreshold,
+			Flags:      e.Flags,
+			Present:    e.Key,
+		}
+	case *expr.Limit:
+		return &LimitStatement{
+			Rate:  e.Rate,
+			Unit:  e.Unit,
+			Burst: e.Burst,
+			Bytes: e.Type == expr.LimitTypePktBytes,
+			Over:  e.Over,
+		}
+	case *expr.Quota:
+		return &QuotaStatement{Bytes: e.Bytes, Consumed: e.Consumed, Over: e.Over}
+	case *expr.Dynset:
+		s := &SetUpdateStatement{
+			Op:      SetUpdateOp(e.Operation),
+			Set:     e.SetName,
+			Key:     stmt.Operands[e.SrcRegKey],
+			Timeout: e.Timeout,
+		}
+		if e.SrcRegData != 0 {
+			s.Data = stmt.Operands[e.SrcRegData]
+		}
+		for _, sub := range e.Exprs {
+			if d := decodeStatement(family, &Statement{Expr: sub}); d != nil {
+				s.Statements = append(s.Statements, d)
+			}
+		}
+		return s
+	case *expr.Meta:
+		if e.Key == expr.MetaKeyMARK {
+			return markStatement(false, stmt.Operands[e.Register])
+		}
+	case *expr.Ct:
+		if e.Key == expr.CtKeyMARK {
+			return markStatement(true, stmt.Operands[e.Register])
+		}
+	case *expr.Target:
+		switch e.Name {
+		case "LOG", "NFLOG":
+			if s, ok := decodeXtLog(e); ok {
+				return s
+			}
+		case "MARK":
+			if s, ok := decodeXtMark(e); ok {
+				return s
+			}
+		case "mark":
+			if s, _, ok := decodeEtherMarkTarget(e); ok {
+				return s
+			}
+		case "snat", "dnat", "redirect":
+			if n, ok := decodeEtherNAT(e); ok {
+				return n
+			}
+		}
+	}
+	return nil
+}
+
+// markStatement returns the mark statement for setting the packet or
+// conntrack mark from the specified operand.
+func markStatement(ct bool, src Operand) *MarkStatement {
+	s := &MarkStatement{Ct: ct, Mask: ^uint32(0)}
+	if data := immediate(src); len(data) == 4 {
+		s.Value = hostOrder.Uint32(data)
+		return s
+	}
+	// “meta mark set meta mark & 0xffff | 0x10000” loads the mark, then
+	// transforms it using a mask and xor.
+	self := false
+	switch field := src.Field.(type) {
+	case *expr.Meta:
+		self = !ct && field.Key == expr.MetaKeyMARK
+	case *expr.Ct:
+		self = ct && field.Key == expr.CtKeyMARK
+	}
+	if self && len(src.Mask) == 4 && len(src.Xor) == 4 {
+		s.Mask = ^hostOrder.Uint32(src.Mask)
+		s.Value = hostOrder.Uint32(src.Xor)
+		return s
+	}
+	s.Source = src
+	return s
+}
+
+// decodeXtLog decodes the xt “LOG” and “NFLOG” targets.
+func decodeXtLog(target *expr.Target) (*LogStatement, bool) {
+	if target.Name == "LOG" {
+		// struct xt_log_info: level u8, logflags u8, prefix[30].
+		info, ok := rawInfo(target.Info, 32)
+		if !ok {
+			return nil, false
+		}
+		s := &LogStatement{
+			Level:   expr.LogLevel(info[0]),
+			Flags:   expr.LogFlags(info[1]),
+			Prefix:  cString(info[2:32]),
+			Present: 1<<unix.NFTA_LOG_LEVEL | 1<<unix.NFTA_LOG_FLAGS,
+		}
+		if s.Prefix != "" {
+			s.Present |= 1 << unix.NFTA_LOG_PREFIX
+		}
+		return s, true
+	}
+	// struct xt_nflog_info: len u32, group u16, threshold u16, flags u16,
+	// pad u16, prefix[64].
+	info, ok := rawInfo(target.Info, 76)
+	if !ok {
+		return nil, false
+	}
+	s := &LogStatement{
+		Snaplen:    hostOrder.Uint32(info[0:]),
+		Group:      hostOrder.Uint16(info[4:]),
+		QThreshold: hostOrder.Uint16(info[6:]),
+		Prefix:     cString(info[12:76]),
+		Present:    1 << unix.NFTA_LOG_GROUP,
+	}
+	if s.Prefix != "" {
+		s.Present |= 1 << unix.NFTA_LOG_PREFIX
+	}
+	if s.Snaplen != 0 {
+		s.Present |= 1 << unix.NFTA_LOG_SNAPLEN
+	}
+	if s.QThreshold != 0 {
+		s.Present |= 1 << unix.NFTA_LOG_QTHRESHOLD
+	}
+	return s, true
+}
+
+// decodeXtMark decodes the xt “MARK” target revision 2 with its mark and
+// mask.
+func decodeXtMark(target *expr.Target) (*MarkStatement, bool) {
+	if target.Rev != 2 {
+		return nil, false
+	}
+	info, ok := rawInfo(target.Info, 8)
+	if !ok {
+		return nil, false
+	}
+	return &MarkStatement{
+		Value: hostOrder.Uint32(info[0:]),
+		Mask:  hostOrder.Uint32(info[4:]),
+	}, true
+}
@@ -0,0 +1,130 @@
+// Copyright 2023 Harald Albrecht.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy
+// of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package dsl
+
+import (
+	"time"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"github.com/google/nftables/xt"
+	"github.com/thediveo/nufftables"
+	"golang.org/x/sys/unix"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+func hostUint32(v uint32) []byte {
+	b := make([]byte, 4)
+	hostOrder.PutUint32(b, v)
+	return b
+}
+
+var _ = Describe("statements", func() {
+
+	It("decodes all statements in order", func() {
+		stmts := DecodeStatements(nftables.TableFamilyIPv4, nufftables.Expressions{
+			&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{unix.IPPROTO_TCP}},
+			&expr.Limit{Type: expr.LimitTypePkts, Rate: 10, Unit: expr.LimitTimeSecond, Burst: 5},
+			&expr.Counter{Packets: 1, Bytes: 42},
+			&expr.Log{Key: 1<<unix.NFTA_LOG_PREFIX | 1<<unix.NFTA_LOG_LEVEL,
+				Data: []byte("dropped: "), Level: expr.LogLevelWarning},
+			&expr.Quota{Bytes: 1000, Consumed: 42, Over: true},
+			&expr.Verdict{Kind: expr.VerdictDrop},
+		})
+		Expect(stmts).To(HaveLen(5))
+		Expect(stmts[0]).To(Equal(&LimitStatement{Rate: 10, Unit: expr.LimitTimeSecond, Burst: 5}))
+		var strs []string
+		for _, stmt := range stmts {
+			strs = append(strs, stmt.(interface{ String() string }).String())
+		}
+		Expect(strs).To(HaveExactElements(
+			"limit rate 10/second burst 5 packets",
+			"counter packets 1 bytes 42",
+			`log prefix "dropped: " level warn`,
+			"quota over 1000 bytes used 42 bytes",
+			"drop",
+		))
+	})
+
+	It("returns the first statement of a particular type", func() {
+		counter := &expr.Counter{}
+		verdict := &expr.Verdict{Kind: expr.VerdictAccept}
+		remexprs, c := StatementOf[*CounterStatement](nftables.TableFamilyIPv4,
+			nufftables.Expressions{counter, verdict})
+		Expect(remexprs).To(ConsistOf(verdict))
+		Expect(c).To(Equal(&CounterStatement{}))
+
+		remexprs, q := StatementOf[*QuotaStatement](nftables.TableFamilyIPv4,
+			nufftables.Expressions{counter, verdict})
+		Expect(remexprs).To(BeNil())
+		Expect(q).To(BeNil())
+	})
+
+	It("decodes meters", func() {
+		stmts := DecodeStatements(nftables.TableFamilyIPv4, nufftables.Expressions{
+			payload(expr.PayloadBaseNetworkHeader, 12, 4),
+			&expr.Dynset{SrcRegKey: 1, SetName: "flood", Operation: uint32(SetUpdate),
+				Timeout: time.Minute, Exprs: []expr.Any{
+					&expr.Limit{Type: expr.LimitTypePktBytes, Rate: 1024, Unit: expr.LimitTimeMinute, Over: true},
+				}},
+		})
+		Expect(stmts).To(HaveLen(1))
+		s := stmts[0].(*SetUpdateStatement)
+		Expect(s.Key.Field).To(Equal(payload(expr.PayloadBaseNetworkHeader, 12, 4)))
+		Expect(s.String()).To(Equal("update @flood timeout 1m0s limit rate over 1024 bytes/minute"))
+	})
+
+	It("decodes mark setters", func() {
+		stmts := DecodeStatements(nftables.TableFamilyIPv4, nufftables.Expressions{
+			&expr.Immediate{Register: 1, Data: hostUint32(0x42)},
+			&expr.Meta{Key: expr.MetaKeyMARK, Register: 1, SourceRegister: true},
+			&expr.Meta{Key: expr.MetaKeyMARK, Register: 1},
+			&expr.Ct{Key: expr.CtKeyMARK, Register: 1, SourceRegister: true},
+			&expr.Ct{Key: expr.CtKeyMARK, Register: 1},
+			&expr.Bitwise{SourceRegister: 1, DestRegister: 1, Len: 4,
+				Mask: hostUint32(0xffff), Xor: hostUint32(0x10000)},
+			&expr.Ct{Key: expr.CtKeyMARK, Register: 1, SourceRegister: true},
+			&expr.Target{Name: "MARK", Rev: 2, Info: func() *xt.Unknown {
+				info := xt.Unknown(append(hostUint32(0x1), hostUint32(0xff)...))
+				return &info
+			}()},
+		})
+		Expect(stmts).To(HaveLen(4))
+		Expect(stmts[0]).To(Equal(&MarkStatement{Value: 0x42, Mask: 0xffffffff}))
+		Expect(stmts[1].(*MarkStatement).String()).To(Equal("ct mark set meta mark"))
+		Expect(stmts[2]).To(Equal(&MarkStatement{Ct: true, Value: 0x10000, Mask: 0xffff0000}))
+		Expect(stmts[2].(*MarkStatement).String()).To(Equal("ct mark set ct mark & 0x0000ffff ^ 0x00010000"))
+		Expect(stmts[3]).To(Equal(&MarkStatement{Value: 0x1, Mask: 0xff}))
+	})
+
+	It("decodes xt LOG and NFLOG targets", func() {
+		info := make(xt.Unknown, 32)
+		info[0] = byte(expr.LogLevelInfo)
+		copy(info[2:], "iptables: ")
+		nflog := make(xt.Unknown, 76)
+		hostOrder.PutUint16(nflog[4:], 5)
+		stmts := DecodeStatements(nftables.TableFamilyIPv4, nufftables.Expressions{
+			&expr.Target{Name: "LOG", Info: &info},
+			&expr.Target{Name: "NFLOG", Info: &nflog},
+		})
+		Expect(stmts).To(HaveLen(2))
+		Expect(stmts[0].(*LogStatement).String()).To(Equal(`log prefix "iptables: " level info`))
+		Expect(stmts[1].(*LogStatement).String()).To(Equal("log group 5"))
+	})
+
+})
@@ -24,6 +24,9 @@ import (
 // Target DNAT expression, together with the remaining expressions after the
 // Target DNAT expression. If no match is found, then nil is returned for the
 // remaining expressions.
+//
+// TargetDNAT only understands the xt “DNAT” target; see [TargetNAT] for
+// decoding all kinds of xt NAT targets as well as native NAT statements.
 func TargetDNAT(exprs nufftables.Expressions) (nufftables.Expressions, *xt.NatRange2) {
 	remexprs, target := nufftables.OfTypeFunc(exprs, isTargetDNATExpression)
 	if remexprs == nil {
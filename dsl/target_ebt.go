@@ -0,0 +1,188 @@
+// Copyright 2023 Harald Albrecht.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy
+// of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package dsl
+
+import (
+	"net"
+
+	"github.com/google/nftables/expr"
+)
+
+// EtherNAT describes the MAC address translation of the ebtables “snat”,
+// “dnat”, and “redirect” targets, as emitted by ebtables-nft in bridge
+// tables.
+type EtherNAT struct {
+	Type NATType // SNAT, DNAT, or Redirect.
+	// MAC is the MAC address to translate to; nil for Redirect, which
+	// translates to the MAC address of the receiving bridge port.
+	MAC net.HardwareAddr
+	// ARP is set for SNAT if the sender hardware address of ARP packets gets
+	// translated too.
+	ARP bool
+	// Verdict is the outcome of the rule after the translation, that is,
+	// VerdictAccept, VerdictDrop, VerdictContinue, or VerdictReturn.
+	Verdict VerdictKind
+}
+
+// String returns the MAC address translation in nft-like notation, such as
+// “ether dnat to 52:54:00:12:34:56 accept”.
+func (n *EtherNAT) String() string {
+	s := "ether " + n.Type.String()
+	if n.MAC != nil {
+		s += " to " + n.MAC.String()
+	}
+	if n.ARP {
+		s += " arp"
+	}
+	if n.Verdict != VerdictContinue {
+		s += " " + n.Verdict.String()
+	}
+	return s
+}
+
+// ebtables target verdicts are negative numbers in the lower bits of the
+// target field (EBT_VERDICT_BITS), while the upper bits might carry flags or
+// operations.
+const (
+	ebtVerdictBits = 0x0000000f
+	ebtAccept      = -1
+	ebtDrop        = -2
+	ebtContinue    = -3
+	ebtReturn      = -4
+	// ebtNATARPBit is toggled (that is, cleared) by “--snat-arp”.
+	ebtNATARPBit = 0x00000010
+)
+
+// ebtVerdict returns the verdict kind of the specified ebtables target field.
+func ebtVerdict(target uint32) (VerdictKind, bool) {
+	switch int32(target | ^uint32(ebtVerdictBits)) {
+	case ebtAccept:
+		return VerdictAccept, true
+	case ebtDrop:
+		return VerdictDrop, true
+	case ebtContinue:
+		return VerdictContinue, true
+	case ebtReturn:
+		return VerdictReturn, true
+	}
+	return VerdictContinue, false
+}
+
+// decodeEtherNAT decodes the ebtables “snat” and “dnat” targets with struct
+// ebt_nat_info: mac u8[6], pad u8[2], target int; as well as the “redirect”
+// target with struct ebt_redirect_info: target int.
+func decodeEtherNAT(target *expr.Target) (*EtherNAT, bool) {
+	switch target.Name {
+	case "snat", "dnat":
+		info, ok := rawInfo(target.Info, 12)
+		if !ok {
+			return nil, false
+		}
+		tgt := hostOrder.Uint32(info[8:])
+		verdict, ok := ebtVerdict(tgt)
+		if !ok {
+			return nil, false
+		}
+		n := &EtherNAT{
+			Type:    DNAT,
+			MAC:     net.HardwareAddr(append([]byte(nil), info[0:6]...)),
+			Verdict: verdict,
+		}
+		if target.Name == "snat" {
+			n.Type = SNAT
+			n.ARP = tgt&ebtNATARPBit == 0
+		}
+		return n, true
+	case "redirect":
+		info, ok := rawInfo(target.Info, 4)
+		if !ok {
+			return nil, false
+		}
+		verdict, ok := ebtVerdict(hostOrder.Uint32(info))
+		if !ok {
+			return nil, false
+		}
+		return &EtherNAT{Type: Redirect, Verdict: verdict}, true
+	}
+	return nil, false
+}
+
+// ebtables “mark” target operations, stored in the upper bits of the target
+// field.
+const (
+	ebtMarkSetValue = 0xfffffff0
+	ebtMarkOrValue  = 0xffffffe0
+	ebtMarkAndValue = 0xffffffd0
+	ebtMarkXorValue = 0xffffffc0
+)
+
+// decodeEtherMarkTarget decodes the ebtables “mark” target with struct
+// ebt_mark_t_info: mark (64bit) long, target int, mapping the set, or, and,
+// and xor operations onto the mask and value of a [MarkStatement]. It
+// additionally returns the verdict of the target.
+func decodeEtherMarkTarget(target *expr.Target) (*MarkStatement, VerdictKind, bool) {
+	info, ok := rawInfo(target.Info, 12)
+	if !ok {
+		return nil, VerdictContinue, false
+	}
+	mark := uint32(hostOrder.Uint64(info[0:]))
+	tgt := hostOrder.Uint32(info[8:])
+	verdict, ok := ebtVerdict(tgt)
+	if !ok {
+		return nil, VerdictContinue, false
+	}
+	s := &MarkStatement{}
+	switch tgt &^ ebtVerdictBits {
+	case ebtMarkSetValue:
+		s.Mask, s.Value = ^uint32(0), mark
+	case ebtMarkOrValue:
+		s.Mask, s.Value = mark, mark
+	case ebtMarkAndValue:
+		s.Mask = ^mark
+	case ebtMarkXorValue:
+		s.Value = mark
+	default:
+		return nil, VerdictContinue, false
+	}
+	return s, verdict, true
+}
+
+// decodeEbtVerdict returns the verdict of an ebtables target, if the
+// specified statement is an ebtables “snat”, “dnat”, “redirect”, or “mark”
+// target.
+func decodeEbtVerdict(stmt *Statement) (*Verdict, bool) {
+	target, ok := stmt.Expr.(*expr.Target)
+	if !ok {
+		return nil, false
+	}
+	var kind VerdictKind
+	switch target.Name {
+	case "snat", "dnat", "redirect":
+		n, ok := decodeEtherNAT(target)
+		if !ok {
+			return nil, false
+		}
+		kind = n.Verdict
+	case "mark":
+		_, verdict, ok := decodeEtherMarkTarget(target)
+		if !ok {
+			return nil, false
+		}
+		kind = verdict
+	default:
+		return nil, false
+	}
+	return &Verdict{Kind: kind, Expr: target}, true
+}
@@ -0,0 +1,103 @@
+// Copyright 2023 Harald Albrecht.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy
+// of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package dsl
+
+import (
+	"net"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"github.com/google/nftables/xt"
+	"github.com/thediveo/nufftables"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+// ebtTarget returns an ebtables target expression with an undecoded info
+// payload of the specified size, filled in by the specified function.
+func ebtTarget(name string, size int, fill func(info []byte)) *expr.Target {
+	info := make(xt.Unknown, size)
+	if fill != nil {
+		fill(info)
+	}
+	return &expr.Target{Name: name, Info: &info}
+}
+
+// ebtTargetValue returns the target field value of the specified (negative)
+// ebtables verdict.
+func ebtTargetValue(verdict int32) uint32 {
+	return uint32(verdict)
+}
+
+var _ = Describe("ebtables targets", func() {
+
+	mac := net.HardwareAddr{0x52, 0x54, 0, 0x12, 0x34, 0x56}
+
+	It("decodes dnat and snat targets", func() {
+		dnat := ebtTarget("dnat", 16, func(info []byte) {
+			copy(info, mac)
+			hostOrder.PutUint32(info[8:], ebtTargetValue(ebtAccept))
+		})
+		exprs := nufftables.Expressions{dnat}
+		remexprs, n := StatementOf[*EtherNAT](nftables.TableFamilyBridge, exprs)
+		Expect(remexprs).To(BeEmpty())
+		Expect(*n).To(Equal(EtherNAT{Type: DNAT, MAC: mac, Verdict: VerdictAccept}))
+		Expect(n.String()).To(Equal("ether dnat to 52:54:00:12:34:56 accept"))
+		Expect(TerminalVerdict(nftables.TableFamilyBridge, exprs)).To(
+			Equal(&Verdict{Kind: VerdictAccept, Expr: dnat}))
+
+		snat := ebtTarget("snat", 16, func(info []byte) {
+			copy(info, mac)
+			hostOrder.PutUint32(info[8:], ebtTargetValue(ebtContinue)&^ebtNATARPBit)
+		})
+		stmts := DecodeStatements(nftables.TableFamilyBridge, nufftables.Expressions{snat})
+		Expect(stmts).To(HaveLen(1))
+		Expect(stmts[0]).To(Equal(&EtherNAT{Type: SNAT, MAC: mac, ARP: true, Verdict: VerdictContinue}))
+		Expect(stmts[0].(*EtherNAT).String()).To(Equal("ether snat to 52:54:00:12:34:56 arp"))
+		Expect(TerminalVerdict(nftables.TableFamilyBridge, nufftables.Expressions{snat}).Kind).To(
+			Equal(VerdictContinue))
+	})
+
+	It("decodes redirect targets", func() {
+		redir := ebtTarget("redirect", 8, func(info []byte) {
+			hostOrder.PutUint32(info, ebtTargetValue(ebtReturn))
+		})
+		stmts := DecodeStatements(nftables.TableFamilyBridge, nufftables.Expressions{redir})
+		Expect(stmts).To(ConsistOf(&EtherNAT{Type: Redirect, Verdict: VerdictReturn}))
+		Expect(stmts[0].(*EtherNAT).String()).To(Equal("ether redirect return"))
+		Expect(DecodeStatements(nftables.TableFamilyBridge, nufftables.Expressions{
+			ebtTarget("redirect", 4, func(info []byte) { hostOrder.PutUint32(info, 42) }),
+		})).To(BeEmpty())
+	})
+
+	DescribeTable("decodes mark targets",
+		func(op uint32, mask, value uint32) {
+			mark := ebtTarget("mark", 16, func(info []byte) {
+				hostOrder.PutUint64(info, 0x42)
+				hostOrder.PutUint32(info[8:], op|ebtTargetValue(ebtDrop)&ebtVerdictBits)
+			})
+			stmts := DecodeStatements(nftables.TableFamilyBridge, nufftables.Expressions{mark})
+			Expect(stmts).To(ConsistOf(&MarkStatement{Mask: mask, Value: value}))
+			Expect(TerminalVerdict(nftables.TableFamilyBridge, nufftables.Expressions{mark}).Kind).To(
+				Equal(VerdictDrop))
+		},
+		Entry("set", uint32(ebtMarkSetValue), ^uint32(0), uint32(0x42)),
+		Entry("or", uint32(ebtMarkOrValue), uint32(0x42), uint32(0x42)),
+		Entry("and", uint32(ebtMarkAndValue), ^uint32(0x42), uint32(0)),
+		Entry("xor", uint32(ebtMarkXorValue), uint32(0), uint32(0x42)),
+	)
+
+})
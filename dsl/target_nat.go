@@ -0,0 +1,391 @@
+// Copyright 2023 Harald Albrecht.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy
+// of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package dsl
+
+import (
+	"encoding/binary"
+	"net"
+	"net/netip"
+	"strings"
+
+	"github.com/google/nftables/expr"
+	"github.com/google/nftables/xt"
+	"github.com/thediveo/nufftables"
+	"golang.org/x/sys/unix"
+)
+
+// NATType is the type of network address translation.
+type NATType int
+
+// NAT types.
+const (
+	SNAT       NATType = iota // source NAT (xt “SNAT”, “snat”)
+	DNAT                      // destination NAT (xt “DNAT”, “dnat”)
+	Masquerade                // source NAT to the outgoing interface's address
+	Redirect                  // destination NAT to the incoming interface's address
+	Netmap                    // xt “NETMAP” 1:1 prefix mapping
+)
+
+// String returns the nft name of the NAT type, such as “dnat” or
+// “masquerade”.
+func (t NATType) String() string {
+	switch t {
+	case SNAT:
+		return "snat"
+	case DNAT:
+		return "dnat"
+	case Masquerade:
+		return "masquerade"
+	case Redirect:
+		return "redirect"
+	case Netmap:
+		return "netmap"
+	}
+	return "?"
+}
+
+// NAT describes a network address translation, regardless of whether it has
+// been expressed using the xt “SNAT”, “DNAT”, “MASQUERADE”, “REDIRECT”, and
+// “NETMAP” targets of iptables-nft, or natively using nft's nat, masq, and
+// redir statements.
+type NAT struct {
+	Type NATType
+	// AddrMin and AddrMax specify the range of addresses to translate to; they
+	// are only valid if Flags contains [xt.NatRangeMapIPs].
+	AddrMin, AddrMax netip.Addr
+	// PortMin and PortMax specify the range of ports to translate to; they
+	// are only valid if Flags contains [xt.NatRangeProtoSpecified].
+	PortMin, PortMax uint16
+	// BasePort is the base port of a port offset translation; it is only
+	// valid if Flags contains [xt.NatRangeProtoOffset].
+	BasePort uint16
+	Flags    xt.NatRangeFlags
+	// AddrOperand and PortOperand are the register contents of native NAT
+	// statements when not loaded from immediate data, such as in case of map
+	// lookups “dnat to ip daddr map @targets”; they are zero otherwise.
+	AddrOperand, PortOperand Operand
+}
+
+// HasAddr returns true if the NAT specifies the address (range) to translate
+// to.
+func (n *NAT) HasAddr() bool {
+	return n.Flags&xt.NatRangeMapIPs != 0 && n.AddrMin.IsValid()
+}
+
+// HasPorts returns true if the NAT specifies the port (range) to translate to.
+func (n *NAT) HasPorts() bool {
+	return n.Flags&xt.NatRangeProtoSpecified != 0
+}
+
+// String returns the NAT in nft notation, such as “dnat to 10.0.0.1:8080” or
+// “masquerade to :1024-2048 random”.
+func (n *NAT) String() string {
+	var b strings.Builder
+	b.WriteString(n.Type.String())
+	var to string
+	switch {
+	case n.HasAddr():
+		to = n.AddrMin.String()
+		if n.AddrMax.IsValid() && n.AddrMax != n.AddrMin {
+			to += "-" + n.AddrMax.String()
+		}
+		if n.AddrMin.Is6() && n.HasPorts() {
+			to = "[" + to + "]"
+		}
+	case n.AddrOperand.Map != "":
+		to = "map @" + n.AddrOperand.Map
+	}
+	if n.HasPorts() {
+		to += ":" + PortRange{Min: n.PortMin, Max: n.PortMax}.String()
+	}
+	if to != "" {
+		b.WriteString(" to " + to)
+	}
+	if n.Flags&xt.NatRangeProtoRandom != 0 {
+		b.WriteString(" random")
+	}
+	if n.Flags&xt.NatRangeProtoRandomFully != 0 {
+		b.WriteString(" fully-random")
+	}
+	if n.Flags&xt.NatRangePersistent != 0 {
+		b.WriteString(" persistent")
+	}
+	return b.String()
+}
+
+// TargetNAT returns the first network address translation of any of the
+// specified types – or any type if none are specified – together with the
+// remaining expressions after the NAT target or statement. If no NAT is
+// found, then nil is returned for the remaining expressions.
+//
+// TargetNAT understands the xt “SNAT”, “DNAT”, “MASQUERADE”, “REDIRECT”, and
+// “NETMAP” targets, as well as native nat, masq, and redir statements,
+// including the addresses and ports loaded by immediate expressions.
+func TargetNAT(exprs nufftables.Expressions, types ...NATType) (nufftables.Expressions, *NAT) {
+	rule := Lift(exprs)
+	for _, stmt := range rule.Statements {
+		nat, ok := decodeNAT(&stmt)
+		if !ok || !isNATType(nat.Type, types) {
+			continue
+		}
+		for idx, e := range exprs {
+			if e == stmt.Expr {
+				return exprs[idx+1:], nat
+			}
+		}
+	}
+	return nil, nil
+}
+
+// TargetSNAT returns the first source NAT, see also [TargetNAT].
+func TargetSNAT(exprs nufftables.Expressions) (nufftables.Expressions, *NAT) {
+	return TargetNAT(exprs, SNAT)
+}
+
+// TargetMasquerade returns the first masquerading, see also [TargetNAT].
+func TargetMasquerade(exprs nufftables.Expressions) (nufftables.Expressions, *NAT) {
+	return TargetNAT(exprs, Masquerade)
+}
+
+// TargetRedirect returns the first redirect, see also [TargetNAT].
+func TargetRedirect(exprs nufftables.Expressions) (nufftables.Expressions, *NAT) {
+	return TargetNAT(exprs, Redirect)
+}
+
+// TargetNetmap returns the first xt “NETMAP” target, see also [TargetNAT].
+func TargetNetmap(exprs nufftables.Expressions) (nufftables.Expressions, *NAT) {
+	return TargetNAT(exprs, Netmap)
+}
+
+// isNATType returns true if the NAT type is in the list of types, or the list
+// is empty.
+func isNATType(t NATType, types []NATType) bool {
+	if len(types) == 0 {
+		return true
+	}
+	for _, typ := range types {
+		if t == typ {
+			return true
+		}
+	}
+	return false
+}
+
+// xtNATTypes maps the names of the xt NAT targets to their NAT types.
+var xtNATTypes = map[string]NATType{
+	"SNAT":       SNAT,
+	"DNAT":       DNAT,
+	"MASQUERADE": Masquerade,
+	"REDIRECT":   Redirect,
+	"NETMAP":     Netmap,
+}
+
+// decodeNAT decodes the NAT of the specified (lifted) statement, if it is a
+// NAT target or statement at all.
+func decodeNAT(stmt *Statement) (*NAT, bool) {
+	switch e := stmt.Expr.(type) {
+	case *expr.Target:
+		typ, ok := xtNATTypes[e.Name]
+		if !ok {
+			return nil, false
+		}
+		nat, ok := decodeXtNATInfo(e.Info)
+		if !ok {
+			return nil, false
+		}
+		nat.Type = typ
+		return nat, true
+	case *expr.NAT:
+		nat := &NAT{Type: SNAT}
+		if e.Type == expr.NATTypeDestNAT {
+			nat.Type = DNAT
+		}
+		addrlen := net.IPv4len
+		if e.Family == unix.NFPROTO_IPV6 {
+			addrlen = net.IPv6len
+		}
+		if e.RegAddrMin != 0 {
+			nat.Flags |= xt.NatRangeMapIPs
+			nat.AddrMin, nat.AddrMax, nat.AddrOperand = natAddrs(stmt, e.RegAddrMin, e.RegAddrMax, addrlen)
+		}
+		if e.RegProtoMin != 0 {
+			nat.Flags |= xt.NatRangeProtoSpecified
+			nat.PortMin, nat.PortMax, nat.PortOperand = natPorts(stmt, e.RegProtoMin, e.RegProtoMax)
+		}
+		nat.Flags |= natFlags(e.Random, e.FullyRandom, e.Persistent)
+		return nat, true
+	case *expr.Masq:
+		nat := &NAT{Type: Masquerade}
+		// ToPorts alone doesn't tell anything about the ports as long as
+		// there's no loaded register.
+		if e.RegProtoMin != 0 {
+			nat.Flags |= xt.NatRangeProtoSpecified
+			nat.PortMin, nat.PortMax, nat.PortOperand = natPorts(stmt, e.RegProtoMin, e.RegProtoMax)
+		}
+		nat.Flags |= natFlags(e.Random, e.FullyRandom, e.Persistent)
+		return nat, true
+	case *expr.Redir:
+		nat := &NAT{Type: Redirect, Flags: xt.NatRangeFlags(e.Flags) &^ xt.NatRangeProtoSpecified}
+		if e.RegisterProtoMin != 0 {
+			nat.Flags |= xt.NatRangeProtoSpecified
+			nat.PortMin, nat.PortMax, nat.PortOperand = natPorts(stmt, e.RegisterProtoMin, e.RegisterProtoMax)
+		}
+		return nat, true
+	}
+	return nil, false
+}
+
+// natFlags returns the NAT range flags for the specified native NAT options.
+func natFlags(random, fullyRandom, persistent bool) xt.NatRangeFlags {
+	var flags xt.NatRangeFlags
+	if random {
+		flags |= xt.NatRangeProtoRandom
+	}
+	if fullyRandom {
+		flags |= xt.NatRangeProtoRandomFully
+	}
+	if persistent {
+		flags |= xt.NatRangePersistent
+	}
+	return flags
+}
+
+// immediate returns the immediate data of the specified operand, or nil if
+// the operand hasn't been loaded from immediate data.
+func immediate(op Operand) []byte {
+	if op.Field != nil || op.Concat != nil || op.Map != "" || op.Mask != nil {
+		return nil
+	}
+	return op.Data
+}
+
+// natAddrs returns the address range of a native NAT statement from the
+// specified registers. If the minimum address isn't immediate data, then the
+// operand is returned instead.
+func natAddrs(stmt *Statement, regmin, regmax uint32, addrlen int) (netip.Addr, netip.Addr, Operand) {
+	op := stmt.Operands[regmin]
+	data := immediate(op)
+	if len(data) < addrlen {
+		return netip.Addr{}, netip.Addr{}, op
+	}
+	min, _ := netip.AddrFromSlice(data[:addrlen])
+	max := min
+	if regmax != 0 {
+		if data := immediate(stmt.Operands[regmax]); len(data) >= addrlen {
+			max, _ = netip.AddrFromSlice(data[:addrlen])
+		}
+	}
+	return min, max, Operand{}
+}
+
+// natPorts returns the port range of a native NAT statement from the
+// specified registers. If the minimum port isn't immediate data, then the
+// operand is returned instead.
+func natPorts(stmt *Statement, regmin, regmax uint32) (uint16, uint16, Operand) {
+	op := stmt.Operands[regmin]
+	data := immediate(op)
+	if len(data) < 2 {
+		return 0, 0, op
+	}
+	min := binary.BigEndian.Uint16(data)
+	max := min
+	if regmax != 0 {
+		if data := immediate(stmt.Operands[regmax]); len(data) >= 2 {
+			max = binary.BigEndian.Uint16(data)
+		}
+	}
+	return min, max, Operand{}
+}
+
+// decodeXtNATInfo decodes the range information of the xt NAT targets; this
+// is either an [xt.NatRange], [xt.NatRange2], or [xt.NatIPv4MultiRangeCompat]
+// as decoded by the nftables xt package, or otherwise an undecoded
+// nf_nat_ipv4_multi_range_compat, nf_nat_range, or nf_nat_range2.
+func decodeXtNATInfo(info xt.InfoAny) (*NAT, bool) {
+	switch info := info.(type) {
+	case *xt.NatRange2:
+		nat := natOfRange(info.Flags, info.MinIP, info.MaxIP, info.MinPort, info.MaxPort)
+		nat.BasePort = info.BasePort
+		return nat, true
+	case *xt.NatRange:
+		return natOfRange(info.Flags, info.MinIP, info.MaxIP, info.MinPort, info.MaxPort), true
+	case *xt.NatIPv4MultiRangeCompat:
+		if len(*info) != 1 {
+			return nil, false
+		}
+		r := (*info)[0]
+		return natOfRange(r.Flags, r.MinIP, r.MaxIP, r.MinPort, r.MaxPort), true
+	case *xt.Unknown:
+		return decodeNATInfo(*info)
+	}
+	return nil, false
+}
+
+// Sizes of the undecoded NAT range information.
+const (
+	natIPv4MultiRangeCompatSize = 4 + 4 + 2*4 + 2*2
+	natRangeSize                = 4 + 2*16 + 2*2
+)
+
+// decodeNATInfo decodes an undecoded nf_nat_ipv4_multi_range_compat,
+// nf_nat_range, or nf_nat_range2, telling them apart by their sizes. As
+// nf_nat_range and nf_nat_range2 don't tell the IP family, addresses with
+// only zero bytes after the first four bytes are considered to be IPv4
+// addresses.
+func decodeNATInfo(info []byte) (*NAT, bool) {
+	switch {
+	case len(info) >= natRangeSize:
+		addrlen := net.IPv4len
+		for _, b := range append(append([]byte{}, info[4+4:4+16]...), info[4+16+4:4+32]...) {
+			if b != 0 {
+				addrlen = net.IPv6len
+				break
+			}
+		}
+		nat := natOfRange(uint(hostOrder.Uint32(info)),
+			info[4:4+addrlen], info[4+16:4+16+addrlen],
+			binary.BigEndian.Uint16(info[4+32:]), binary.BigEndian.Uint16(info[4+34:]))
+		if len(info) >= natRangeSize+2 {
+			nat.BasePort = binary.BigEndian.Uint16(info[natRangeSize:])
+		}
+		return nat, true
+	case len(info) >= natIPv4MultiRangeCompatSize:
+		if hostOrder.Uint32(info) != 1 {
+			return nil, false
+		}
+		return natOfRange(uint(hostOrder.Uint32(info[4:])),
+			info[8:12], info[12:16],
+			binary.BigEndian.Uint16(info[16:]), binary.BigEndian.Uint16(info[18:])), true
+	}
+	return nil, false
+}
+
+// natOfRange returns a NAT description for the specified NAT range. The NAT
+// type still needs to be set by the caller.
+func natOfRange(flags uint, minip, maxip net.IP, minport, maxport uint16) *NAT {
+	nat := &NAT{Flags: xt.NatRangeFlags(flags)}
+	if nat.Flags&xt.NatRangeMapIPs != 0 {
+		if min, ok := netip.AddrFromSlice(minip); ok {
+			nat.AddrMin = min.Unmap()
+		}
+		if max, ok := netip.AddrFromSlice(maxip); ok {
+			nat.AddrMax = max.Unmap()
+		}
+	}
+	if nat.Flags&xt.NatRangeProtoSpecified != 0 {
+		nat.PortMin, nat.PortMax = minport, maxport
+	}
+	return nat
+}
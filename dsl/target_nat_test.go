@@ -0,0 +1,164 @@
+// Copyright 2023 Harald Albrecht.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy
+// of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package dsl
+
+import (
+	"net"
+	"net/netip"
+
+	"github.com/google/nftables/expr"
+	"github.com/google/nftables/xt"
+	"github.com/thediveo/nufftables"
+	"golang.org/x/sys/unix"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("NAT targets and statements", func() {
+
+	It("returns nil if there is no NAT", func() {
+		remexprs, nat := TargetNAT(nufftables.Expressions{&expr.Counter{}})
+		Expect(remexprs).To(BeNil())
+		Expect(nat).To(BeNil())
+	})
+
+	It("decodes xt DNAT targets", func() {
+		counter := &expr.Counter{}
+		remexprs, nat := TargetNAT(nufftables.Expressions{
+			&expr.Target{Name: "DNAT", Rev: 2, Info: &xt.NatRange2{
+				NatRange: xt.NatRange{
+					Flags:   uint(xt.NatRangeMapIPs | xt.NatRangeProtoSpecified),
+					MinIP:   net.ParseIP("10.0.0.1").To4(),
+					MaxIP:   net.ParseIP("10.0.0.1").To4(),
+					MinPort: 8080,
+					MaxPort: 8080,
+				},
+			}},
+			counter,
+		})
+		Expect(remexprs).To(ConsistOf(counter))
+		Expect(nat.Type).To(Equal(DNAT))
+		Expect(nat.HasAddr()).To(BeTrue())
+		Expect(nat.HasPorts()).To(BeTrue())
+		Expect(nat.AddrMin).To(Equal(netip.MustParseAddr("10.0.0.1")))
+		Expect(nat.String()).To(Equal("dnat to 10.0.0.1:8080"))
+	})
+
+	It("filters by NAT type", func() {
+		exprs := nufftables.Expressions{
+			&expr.Target{Name: "MASQUERADE", Info: &xt.NatIPv4MultiRangeCompat{{
+				Flags: uint(xt.NatRangeProtoRandomFully),
+			}}},
+			&expr.Target{Name: "SNAT", Info: &xt.NatIPv4MultiRangeCompat{{
+				Flags: uint(xt.NatRangeMapIPs),
+				MinIP: net.ParseIP("192.168.0.1").To4(),
+				MaxIP: net.ParseIP("192.168.0.9").To4(),
+			}}},
+		}
+		remexprs, nat := TargetMasquerade(exprs)
+		Expect(remexprs).To(HaveLen(1))
+		Expect(nat.String()).To(Equal("masquerade fully-random"))
+		remexprs, nat = TargetSNAT(exprs)
+		Expect(remexprs).To(BeEmpty())
+		Expect(nat.String()).To(Equal("snat to 192.168.0.1-192.168.0.9"))
+		remexprs, nat = TargetRedirect(exprs)
+		Expect(remexprs).To(BeNil())
+		Expect(nat).To(BeNil())
+	})
+
+	It("decodes undecoded NAT range information", func() {
+		info := make(xt.Unknown, 40)
+		hostOrder.PutUint32(info, uint32(xt.NatRangeMapIPs))
+		copy(info[4:], []byte{10, 1, 0, 0})
+		copy(info[20:], []byte{10, 1, 0, 255})
+		_, nat := TargetNetmap(nufftables.Expressions{&expr.Target{Name: "NETMAP", Info: &info}})
+		Expect(nat).NotTo(BeNil())
+		Expect(nat.String()).To(Equal("netmap to 10.1.0.0-10.1.0.255"))
+
+		info = make(xt.Unknown, 40)
+		hostOrder.PutUint32(info, uint32(xt.NatRangeMapIPs|xt.NatRangeProtoSpecified))
+		copy(info[4:], net.ParseIP("fe80::1"))
+		copy(info[20:], net.ParseIP("fe80::1"))
+		copy(info[36:], []byte{0, 80, 0, 90})
+		_, nat = TargetSNAT(nufftables.Expressions{&expr.Target{Name: "SNAT", Info: &info}})
+		Expect(nat).NotTo(BeNil())
+		Expect(nat.String()).To(Equal("snat to [fe80::1]:80-90"))
+
+		info = make(xt.Unknown, 20)
+		hostOrder.PutUint32(info, 1)
+		hostOrder.PutUint32(info[4:], uint32(xt.NatRangeProtoSpecified))
+		copy(info[16:], []byte{0x1f, 0x90, 0x1f, 0x90})
+		_, nat = TargetRedirect(nufftables.Expressions{&expr.Target{Name: "REDIRECT", Info: &info}})
+		Expect(nat).NotTo(BeNil())
+		Expect(nat.String()).To(Equal("redirect to :8080"))
+	})
+
+	It("decodes native NAT statements with immediate registers", func() {
+		counter := &expr.Counter{}
+		remexprs, nat := TargetNAT(nufftables.Expressions{
+			&expr.Immediate{Register: 1, Data: []byte{10, 0, 0, 1}},
+			&expr.Immediate{Register: 2, Data: []byte{0x1f, 0x90}},
+			&expr.NAT{Type: expr.NATTypeDestNAT, Family: unix.NFPROTO_IPV4,
+				RegAddrMin: 1, RegProtoMin: 2, Persistent: true},
+			counter,
+		}, DNAT)
+		Expect(remexprs).To(ConsistOf(counter))
+		Expect(nat).To(Equal(&NAT{
+			Type:    DNAT,
+			AddrMin: netip.MustParseAddr("10.0.0.1"),
+			AddrMax: netip.MustParseAddr("10.0.0.1"),
+			PortMin: 8080,
+			PortMax: 8080,
+			Flags:   xt.NatRangeMapIPs | xt.NatRangeProtoSpecified | xt.NatRangePersistent,
+		}))
+		Expect(nat.String()).To(Equal("dnat to 10.0.0.1:8080 persistent"))
+	})
+
+	It("decodes native NAT statements with map lookups", func() {
+		_, nat := TargetNAT(nufftables.Expressions{
+			payload(expr.PayloadBaseNetworkHeader, 16, 4),
+			&expr.Lookup{SourceRegister: 1, DestRegister: 1, IsDestRegSet: true, SetName: "targets"},
+			&expr.NAT{Type: expr.NATTypeDestNAT, Family: unix.NFPROTO_IPV4, RegAddrMin: 1},
+		})
+		Expect(nat).NotTo(BeNil())
+		Expect(nat.HasAddr()).To(BeFalse())
+		Expect(nat.AddrOperand.Map).To(Equal("targets"))
+		Expect(nat.String()).To(Equal("dnat to map @targets"))
+	})
+
+	It("decodes native masquerade and redirect statements", func() {
+		_, nat := TargetNAT(nufftables.Expressions{
+			&expr.Immediate{Register: 1, Data: []byte{0x04, 0x00}},
+			&expr.Immediate{Register: 2, Data: []byte{0x08, 0x00}},
+			&expr.Masq{RegProtoMin: 1, RegProtoMax: 2, Random: true},
+		})
+		Expect(nat.String()).To(Equal("masquerade to :1024-2048 random"))
+
+		_, nat = TargetNAT(nufftables.Expressions{
+			&expr.Masq{ToPorts: true},
+		})
+		Expect(nat.HasPorts()).To(BeFalse())
+		Expect(nat.String()).To(Equal("masquerade"))
+
+		_, nat = TargetNAT(nufftables.Expressions{
+			&expr.Immediate{Register: 1, Data: []byte{0x1f, 0x90}},
+			&expr.Redir{RegisterProtoMin: 1},
+		})
+		Expect(nat.Type).To(Equal(Redirect))
+		Expect(nat.String()).To(Equal("redirect to :8080"))
+	})
+
+})
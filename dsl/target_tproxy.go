@@ -0,0 +1,172 @@
+// Copyright 2023 Harald Albrecht.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy
+// of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package dsl
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+
+	"github.com/google/nftables/expr"
+	"github.com/thediveo/nufftables"
+	"golang.org/x/sys/unix"
+)
+
+// TProxy describes a transparent proxy redirection, regardless of whether it
+// has been expressed using the xt “TPROXY” target of iptables-nft, or natively
+// using nft's tproxy statement, such as “tproxy ip to 127.0.0.1:15001”.
+//
+// Please note that the nftables package doesn't decode native tproxy
+// statements when reading rules from the kernel, so only native tproxy
+// statements of rules not read from the kernel can be decoded.
+type TProxy struct {
+	// Addr is the local address to redirect to; it is invalid if redirecting
+	// to the primary address of the incoming interface.
+	Addr netip.Addr
+	// Port is the local port to redirect to; it is zero if the original
+	// destination port is kept.
+	Port uint16
+	// Mark and Mask are the packet mark set by the xt “TPROXY” target when
+	// redirecting, with a zero Mask not changing the packet mark.
+	Mark, Mask uint32
+	// AddrOperand and PortOperand are the register contents of a native
+	// tproxy statement when the address or port isn't loaded from immediate
+	// data; they are zero otherwise.
+	AddrOperand, PortOperand Operand
+}
+
+// String returns the transparent proxy redirection in nft notation, such as
+// “tproxy to 127.0.0.1:15001”, with the packet mark set by the xt “TPROXY”
+// target appended, such as “mark 0x1/0x1”.
+func (t *TProxy) String() string {
+	var b strings.Builder
+	b.WriteString("tproxy to ")
+	if t.Addr.IsValid() {
+		if t.Addr.Is6() {
+			b.WriteString("[" + t.Addr.String() + "]")
+		} else {
+			b.WriteString(t.Addr.String())
+		}
+	}
+	if t.Port != 0 {
+		fmt.Fprintf(&b, ":%d", t.Port)
+	}
+	if t.Mask != 0 {
+		fmt.Fprintf(&b, " mark %#x/%#x", t.Mark, t.Mask)
+	}
+	return b.String()
+}
+
+// TargetTProxy returns the first transparent proxy redirection, together with
+// the remaining expressions after the TPROXY target or tproxy statement. If no
+// transparent proxy redirection is found, then nil is returned for the
+// remaining expressions.
+func TargetTProxy(exprs nufftables.Expressions) (nufftables.Expressions, *TProxy) {
+	rule := Lift(exprs)
+	for _, stmt := range rule.Statements {
+		tproxy, ok := decodeTProxy(&stmt)
+		if !ok {
+			continue
+		}
+		for idx, e := range exprs {
+			if e == stmt.Expr {
+				return exprs[idx+1:], tproxy
+			}
+		}
+	}
+	return nil, nil
+}
+
+// Sizes of the xt “TPROXY” target information revisions 0 (IPv4 only) and 1.
+const (
+	xtTProxyInfoSize   = 4 + 4 + 4 + 2
+	xtTProxyInfoV1Size = 4 + 4 + 16 + 2
+)
+
+// decodeTProxy decodes the transparent proxy redirection of the specified
+// (lifted) statement, if it is a TPROXY target or tproxy statement at all.
+func decodeTProxy(stmt *Statement) (*TProxy, bool) {
+	switch e := stmt.Expr.(type) {
+	case *expr.Target:
+		if e.Name != "TPROXY" {
+			return nil, false
+		}
+		if e.Rev == 0 {
+			// struct xt_tproxy_target_info: mark_mask u32, mark_value u32,
+			// laddr __be32, lport __be16.
+			info, ok := rawInfo(e.Info, xtTProxyInfoSize)
+			if !ok {
+				return nil, false
+			}
+			return xtTProxy(info, net.IPv4len), true
+		}
+		// struct xt_tproxy_target_info_v1: mark_mask u32, mark_value u32,
+		// laddr nf_inet_addr, lport __be16; as the family isn't known, an
+		// address with only zero bytes after the first four bytes is
+		// considered to be an IPv4 address.
+		info, ok := rawInfo(e.Info, xtTProxyInfoV1Size)
+		if !ok {
+			return nil, false
+		}
+		addrlen := net.IPv4len
+		if !allZero(info[8+4 : 8+16]) {
+			addrlen = net.IPv6len
+		}
+		tproxy := xtTProxy(info, addrlen)
+		tproxy.Port = binary.BigEndian.Uint16(info[8+16:])
+		return tproxy, true
+	case *expr.TProxy:
+		tproxy := &TProxy{}
+		if e.RegAddr != 0 {
+			op := stmt.Operands[e.RegAddr]
+			addrlen := net.IPv4len
+			if e.Family == unix.NFPROTO_IPV6 {
+				addrlen = net.IPv6len
+			}
+			if data := immediate(op); len(data) >= addrlen {
+				tproxy.Addr, _ = netip.AddrFromSlice(data[:addrlen])
+			} else {
+				tproxy.AddrOperand = op
+			}
+		}
+		if e.RegPort != 0 {
+			op := stmt.Operands[e.RegPort]
+			if data := immediate(op); len(data) >= 2 {
+				tproxy.Port = binary.BigEndian.Uint16(data)
+			} else {
+				tproxy.PortOperand = op
+			}
+		}
+		return tproxy, true
+	}
+	return nil, false
+}
+
+// xtTProxy returns the transparent proxy redirection described by the
+// specified xt “TPROXY” target information, with an address of the specified
+// length. The port is taken from after an IPv4 address.
+func xtTProxy(info []byte, addrlen int) *TProxy {
+	tproxy := &TProxy{
+		Mask: hostOrder.Uint32(info[0:]),
+		Mark: hostOrder.Uint32(info[4:]),
+		Port: binary.BigEndian.Uint16(info[8+4:]),
+	}
+	if addr, ok := netip.AddrFromSlice(info[8 : 8+addrlen]); ok && !addr.IsUnspecified() {
+		tproxy.Addr = addr
+	}
+	return tproxy
+}
@@ -0,0 +1,120 @@
+// Copyright 2023 Harald Albrecht.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy
+// of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package dsl
+
+import (
+	"net"
+	"net/netip"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"github.com/google/nftables/xt"
+	"github.com/thediveo/nufftables"
+	"golang.org/x/sys/unix"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("transparent proxy targets and statements", func() {
+
+	It("returns nil if there is no transparent proxy", func() {
+		remexprs, tproxy := TargetTProxy(nufftables.Expressions{&expr.Counter{}})
+		Expect(remexprs).To(BeNil())
+		Expect(tproxy).To(BeNil())
+	})
+
+	It("decodes xt TPROXY targets", func() {
+		info := make(xt.Unknown, 16)
+		hostOrder.PutUint32(info[0:], 0x1)
+		hostOrder.PutUint32(info[4:], 0x1)
+		copy(info[8:], []byte{127, 0, 0, 1})
+		copy(info[12:], []byte{0x3a, 0x99})
+		counter := &expr.Counter{}
+		remexprs, tproxy := TargetTProxy(nufftables.Expressions{
+			&expr.Target{Name: "TPROXY", Rev: 0, Info: &info},
+			counter,
+		})
+		Expect(remexprs).To(ConsistOf(counter))
+		Expect(tproxy).To(Equal(&TProxy{Addr: netip.MustParseAddr("127.0.0.1"), Port: 15001, Mark: 1, Mask: 1}))
+		Expect(tproxy.String()).To(Equal("tproxy to 127.0.0.1:15001 mark 0x1/0x1"))
+
+		info1 := make(xt.Unknown, 28)
+		copy(info1[8:], netip.MustParseAddr("fd00::1").AsSlice())
+		copy(info1[24:], []byte{0x3a, 0x99})
+		_, tproxy = TargetTProxy(nufftables.Expressions{
+			&expr.Target{Name: "TPROXY", Rev: 1, Info: &info1},
+		})
+		Expect(tproxy).To(Equal(&TProxy{Addr: netip.MustParseAddr("fd00::1"), Port: 15001}))
+		Expect(tproxy.String()).To(Equal("tproxy to [fd00::1]:15001"))
+
+		info1 = make(xt.Unknown, 28)
+		copy(info1[24:], []byte{0x3a, 0x99})
+		_, tproxy = TargetTProxy(nufftables.Expressions{
+			&expr.Target{Name: "TPROXY", Rev: 1, Info: &info1},
+		})
+		Expect(tproxy.Addr.IsValid()).To(BeFalse())
+		Expect(tproxy.String()).To(Equal("tproxy to :15001"))
+
+		short := make(xt.Unknown, 8)
+		Expect(TargetTProxy(nufftables.Expressions{
+			&expr.Target{Name: "TPROXY", Rev: 1, Info: &short},
+		})).Error().To(BeNil())
+		Expect(TargetTProxy(nufftables.Expressions{
+			&expr.Target{Name: "TPROXY", Rev: 0, Info: &short},
+		})).Error().To(BeNil())
+	})
+
+	It("decodes native tproxy statements", func() {
+		_, tproxy := TargetTProxy(nufftables.Expressions{
+			&expr.Immediate{Register: 1, Data: []byte{0x3a, 0x99}},
+			&expr.TProxy{Family: unix.NFPROTO_IPV4, TableFamily: unix.NFPROTO_INET, RegPort: 1},
+		})
+		Expect(tproxy).To(Equal(&TProxy{Port: 15001}))
+
+		_, tproxy = TargetTProxy(nufftables.Expressions{
+			&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseTransportHeader, Offset: 2, Len: 2},
+			&expr.TProxy{Family: unix.NFPROTO_IPV4, TableFamily: unix.NFPROTO_INET, RegPort: 1},
+		})
+		Expect(tproxy.Port).To(BeZero())
+		Expect(tproxy.PortOperand.Field).NotTo(BeNil())
+
+		_, tproxy = TargetTProxy(nufftables.Expressions{
+			&expr.Immediate{Register: 1, Data: []byte{127, 0, 0, 1}},
+			&expr.Immediate{Register: 2, Data: []byte{0x3a, 0x99}},
+			&expr.TProxy{Family: unix.NFPROTO_IPV4, TableFamily: unix.NFPROTO_INET, RegAddr: 1, RegPort: 2},
+		})
+		Expect(tproxy.Addr).To(Equal(netip.MustParseAddr("127.0.0.1")))
+		Expect(tproxy.String()).To(Equal("tproxy to 127.0.0.1:15001"))
+
+		_, tproxy = TargetTProxy(nufftables.Expressions{
+			&expr.Immediate{Register: 1, Data: net.ParseIP("fd00::1")},
+			&expr.TProxy{Family: unix.NFPROTO_IPV6, TableFamily: unix.NFPROTO_INET, RegAddr: 1},
+		})
+		Expect(tproxy.String()).To(Equal("tproxy to [fd00::1]"))
+
+		_, tproxy = TargetTProxy(nufftables.Expressions{
+			&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: 16, Len: 4},
+			&expr.TProxy{Family: unix.NFPROTO_IPV4, TableFamily: unix.NFPROTO_IPV4, RegAddr: 1},
+		})
+		Expect(tproxy.Addr.IsValid()).To(BeFalse())
+		Expect(tproxy.AddrOperand.Field).NotTo(BeNil())
+
+		Expect(DecodeStatements(nftables.TableFamilyINet, nufftables.Expressions{
+			&expr.TProxy{Family: unix.NFPROTO_IPV4, TableFamily: unix.NFPROTO_INET},
+		})).To(ConsistOf(&TProxy{}))
+	})
+
+})
@@ -0,0 +1,290 @@
+// Copyright 2023 Harald Albrecht.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy
+// of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package dsl
+
+import (
+	"fmt"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"github.com/thediveo/nufftables"
+	"golang.org/x/sys/unix"
+)
+
+// VerdictKind is the kind of the verdict (outcome) of a rule.
+type VerdictKind int
+
+// Verdict kinds.
+const (
+	VerdictContinue VerdictKind = iota // rule evaluation continues with the next rule
+	VerdictAccept                      // packet is accepted
+	VerdictDrop                        // packet is (silently) dropped
+	VerdictReject                      // packet is dropped, notifying the sender
+	VerdictReturn                      // return from the current chain
+	VerdictJump                        // jump to another chain, returning afterwards
+	VerdictGoto                        // go to another chain, without returning
+	VerdictQueue                       // packet is passed to user space
+	VerdictMap                         // verdict depends on a verdict map lookup
+)
+
+// String returns the nft name of the verdict kind, such as “accept” or
+// “jump”.
+func (k VerdictKind) String() string {
+	switch k {
+	case VerdictContinue:
+		return "continue"
+	case VerdictAccept:
+		return "accept"
+	case VerdictDrop:
+		return "drop"
+	case VerdictReject:
+		return "reject"
+	case VerdictReturn:
+		return "return"
+	case VerdictJump:
+		return "jump"
+	case VerdictGoto:
+		return "goto"
+	case VerdictQueue:
+		return "queue"
+	case VerdictMap:
+		return "vmap"
+	}
+	return "?"
+}
+
+// Verdict describes the verdict (outcome) of a rule, regardless of whether it
+// has been expressed using a native verdict, reject, or queue statement, an xt
+// “REJECT” or “NFQUEUE” target, or a verdict map lookup.
+type Verdict struct {
+	Kind VerdictKind
+	// Chain is the name of the chain to jump or go to.
+	Chain string
+	// Target is the chain to jump or go to, if known; see also [RuleVerdict].
+	Target *nufftables.Chain
+	// RejectType and RejectCode are the reject type, such as
+	// [unix.NFT_REJECT_TCP_RST], and the ICMP, ICMPv6, or ICMPx code to reject
+	// with.
+	RejectType uint32
+	RejectCode uint8
+	// QueueNum is the first queue number, QueueTotal the number of queues
+	// (starting with QueueNum), and QueueFlags the queue flags.
+	QueueNum, QueueTotal uint16
+	QueueFlags           expr.QueueFlag
+	// Map is the name of the verdict map looked up, and MapKey the key used in
+	// the lookup.
+	Map    string
+	MapKey Operand
+	// Expr is the expression the verdict was decoded from; nil for
+	// VerdictContinue if the rule has no verdict.
+	Expr expr.Any
+}
+
+// String returns the verdict in nft notation, such as “jump foo” or “reject
+// with tcp reset”.
+func (v *Verdict) String() string {
+	switch v.Kind {
+	case VerdictJump, VerdictGoto:
+		return v.Kind.String() + " " + v.Chain
+	case VerdictReject:
+		switch v.RejectType {
+		case unix.NFT_REJECT_TCP_RST:
+			return "reject with tcp reset"
+		case unix.NFT_REJECT_ICMPX_UNREACH:
+			return fmt.Sprintf("reject with icmpx %d", v.RejectCode)
+		}
+		return fmt.Sprintf("reject with icmp %d", v.RejectCode)
+	case VerdictQueue:
+		s := fmt.Sprintf("queue num %d", v.QueueNum)
+		if v.QueueTotal > 1 {
+			s += fmt.Sprintf("-%d", v.QueueNum+v.QueueTotal-1)
+		}
+		if v.QueueFlags&expr.QueueFlagBypass != 0 {
+			s += " bypass"
+		}
+		if v.QueueFlags&expr.QueueFlagFanout != 0 {
+			s += " fanout"
+		}
+		return s
+	case VerdictMap:
+		return "vmap @" + v.Map
+	}
+	return v.Kind.String()
+}
+
+// Terminal returns true if the verdict ends the evaluation of the chain's
+// rules, that is, the verdict is neither “continue” nor “jump”, nor a
+// verdict map lookup with its outcome yet unknown.
+func (v *Verdict) Terminal() bool {
+	switch v.Kind {
+	case VerdictContinue, VerdictJump, VerdictMap:
+		return false
+	}
+	return true
+}
+
+// TerminalVerdict returns the verdict of the specified (rule) expressions,
+// which is the last verdict statement, xt target, or verdict map lookup. The
+// accept, drop, and return verdicts of ebtables targets, such as “dnat”, are
+// taken into account too. If there is no verdict, then VerdictContinue is
+// returned. The table family is needed in order to correctly decode the xt
+// “REJECT” target.
+func TerminalVerdict(family nftables.TableFamily, exprs nufftables.Expressions) *Verdict {
+	rule := Lift(exprs)
+	for idx := len(rule.Statements) - 1; idx >= 0; idx-- {
+		if v, ok := decodeVerdict(family, &rule.Statements[idx]); ok {
+			return v
+		}
+		if v, ok := decodeEbtVerdict(&rule.Statements[idx]); ok && v.Kind != VerdictContinue {
+			return v
+		}
+	}
+	return &Verdict{Kind: VerdictContinue}
+}
+
+// RuleVerdict returns the verdict of the specified rule, see also
+// [TerminalVerdict]. Additionally, RuleVerdict resolves the target chains of
+// jumps and gotos using the chains of the rule's table.
+func RuleVerdict(rule *nufftables.Rule) *Verdict {
+	family := nftables.TableFamilyUnspecified
+	var table *nufftables.Table
+	if rule.Chain != nil && rule.Chain.Table != nil {
+		table = rule.Chain.Table
+		family = table.Family
+	}
+	v := TerminalVerdict(family, rule.Expressions())
+	if table != nil && v.Chain != "" {
+		v.Target = table.ChainsByName[v.Chain]
+	}
+	return v
+}
+
+// decodeVerdict decodes the verdict of the specified (lifted) statement, if
+// it is a verdict at all.
+func decodeVerdict(family nftables.TableFamily, stmt *Statement) (*Verdict, bool) {
+	switch e := stmt.Expr.(type) {
+	case *expr.Verdict:
+		v := &Verdict{Expr: e}
+		switch e.Kind {
+		case expr.VerdictAccept:
+			v.Kind = VerdictAccept
+		case expr.VerdictDrop, expr.VerdictStolen:
+			v.Kind = VerdictDrop
+		case expr.VerdictReturn:
+			v.Kind = VerdictReturn
+		case expr.VerdictJump:
+			v.Kind, v.Chain = VerdictJump, e.Chain
+		case expr.VerdictGoto:
+			v.Kind, v.Chain = VerdictGoto, e.Chain
+		case expr.VerdictQueue:
+			v.Kind, v.QueueTotal = VerdictQueue, 1
+		default:
+			v.Kind = VerdictContinue
+		}
+		return v, true
+	case *expr.Reject:
+		return &Verdict{Kind: VerdictReject, RejectType: e.Type, RejectCode: e.Code, Expr: e}, true
+	case *expr.Queue:
+		total := e.Total
+		if total == 0 {
+			total = 1
+		}
+		return &Verdict{Kind: VerdictQueue, QueueNum: e.Num, QueueTotal: total, QueueFlags: e.Flag, Expr: e}, true
+	case *expr.Lookup:
+		return &Verdict{Kind: VerdictMap, Map: e.SetName, MapKey: stmt.Operands[e.SourceRegister], Expr: e}, true
+	case *expr.Target:
+		switch e.Name {
+		case "REJECT":
+			return decodeXtReject(family, e)
+		case "NFQUEUE":
+			return decodeXtQueue(e)
+		}
+	}
+	return nil, false
+}
+
+// rejectWith maps the “reject-with” values of the xt “REJECT” target for IPv4
+// and IPv6 to nft's reject types and ICMP/ICMPv6 codes.
+var rejectWith = map[nftables.TableFamily][]struct {
+	typ  uint32
+	code uint8
+}{
+	nftables.TableFamilyIPv4: {
+		{unix.NFT_REJECT_ICMP_UNREACH, 0},  // net-unreachable
+		{unix.NFT_REJECT_ICMP_UNREACH, 1},  // host-unreachable
+		{unix.NFT_REJECT_ICMP_UNREACH, 2},  // prot-unreachable
+		{unix.NFT_REJECT_ICMP_UNREACH, 3},  // port-unreachable
+		{unix.NFT_REJECT_ICMP_UNREACH, 3},  // echo-reply (deprecated)
+		{unix.NFT_REJECT_ICMP_UNREACH, 9},  // net-prohibited
+		{unix.NFT_REJECT_ICMP_UNREACH, 10}, // host-prohibited
+		{unix.NFT_REJECT_TCP_RST, 0},       // tcp-reset
+		{unix.NFT_REJECT_ICMP_UNREACH, 13}, // admin-prohibited
+	},
+	nftables.TableFamilyIPv6: {
+		{unix.NFT_REJECT_ICMP_UNREACH, 0}, // no-route
+		{unix.NFT_REJECT_ICMP_UNREACH, 1}, // admin-prohibited
+		{unix.NFT_REJECT_ICMP_UNREACH, 2}, // beyond-scope
+		{unix.NFT_REJECT_ICMP_UNREACH, 3}, // addr-unreachable
+		{unix.NFT_REJECT_ICMP_UNREACH, 4}, // port-unreachable
+		{unix.NFT_REJECT_ICMP_UNREACH, 4}, // echo-reply (deprecated)
+		{unix.NFT_REJECT_TCP_RST, 0},      // tcp-reset
+		{unix.NFT_REJECT_ICMP_UNREACH, 5}, // policy-fail
+		{unix.NFT_REJECT_ICMP_UNREACH, 6}, // reject-route
+	},
+}
+
+// decodeXtReject decodes the xt “REJECT” target. As the “reject-with” values
+// differ between IPv4 and IPv6, unknown table families are considered to be
+// IPv4.
+func decodeXtReject(family nftables.TableFamily, target *expr.Target) (*Verdict, bool) {
+	info, ok := rawInfo(target.Info, 4)
+	if !ok {
+		return nil, false
+	}
+	withs, ok := rejectWith[family]
+	if !ok {
+		withs = rejectWith[nftables.TableFamilyIPv4]
+	}
+	with := hostOrder.Uint32(info)
+	if with >= uint32(len(withs)) {
+		return nil, false
+	}
+	return &Verdict{
+		Kind:       VerdictReject,
+		RejectType: withs[with].typ,
+		RejectCode: withs[with].code,
+		Expr:       target,
+	}, true
+}
+
+// decodeXtQueue decodes the xt “NFQUEUE” target: revision 0 only specifies
+// the queue number, revision 1 adds the number of queues, revision 2 the
+// bypass flag, and revision 3 the bypass and fanout flags.
+func decodeXtQueue(target *expr.Target) (*Verdict, bool) {
+	info, ok := rawInfo(target.Info, 2)
+	if !ok {
+		return nil, false
+	}
+	v := &Verdict{Kind: VerdictQueue, QueueNum: hostOrder.Uint16(info), QueueTotal: 1, Expr: target}
+	if target.Rev >= 1 && len(info) >= 4 {
+		if total := hostOrder.Uint16(info[2:]); total > 1 {
+			v.QueueTotal = total
+		}
+	}
+	if target.Rev >= 2 && len(info) >= 6 {
+		v.QueueFlags = expr.QueueFlag(hostOrder.Uint16(info[4:])) & expr.QueueFlagMask
+	}
+	return v, true
+}
@@ -0,0 +1,110 @@
+// Copyright 2023 Harald Albrecht.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy
+// of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package dsl
+
+import (
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"github.com/google/nftables/xt"
+	"github.com/thediveo/nufftables"
+	"golang.org/x/sys/unix"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("verdicts", func() {
+
+	It("returns continue for rules without verdicts", func() {
+		v := TerminalVerdict(nftables.TableFamilyIPv4, nufftables.Expressions{&expr.Counter{}})
+		Expect(v.Kind).To(Equal(VerdictContinue))
+		Expect(v.Terminal()).To(BeFalse())
+		Expect(v.String()).To(Equal("continue"))
+	})
+
+	DescribeTable("decodes native verdicts",
+		func(e expr.Any, kind VerdictKind, expected string) {
+			v := TerminalVerdict(nftables.TableFamilyINet, nufftables.Expressions{&expr.Counter{}, e})
+			Expect(v.Kind).To(Equal(kind))
+			Expect(v.Expr).To(BeIdenticalTo(e))
+			Expect(v.String()).To(Equal(expected))
+		},
+		Entry("accept", &expr.Verdict{Kind: expr.VerdictAccept}, VerdictAccept, "accept"),
+		Entry("drop", &expr.Verdict{Kind: expr.VerdictDrop}, VerdictDrop, "drop"),
+		Entry("return", &expr.Verdict{Kind: expr.VerdictReturn}, VerdictReturn, "return"),
+		Entry("jump", &expr.Verdict{Kind: expr.VerdictJump, Chain: "foo"}, VerdictJump, "jump foo"),
+		Entry("goto", &expr.Verdict{Kind: expr.VerdictGoto, Chain: "bar"}, VerdictGoto, "goto bar"),
+		Entry("continue", &expr.Verdict{Kind: expr.VerdictContinue}, VerdictContinue, "continue"),
+		Entry("reject", &expr.Reject{Type: unix.NFT_REJECT_TCP_RST}, VerdictReject, "reject with tcp reset"),
+		Entry("reject icmpx", &expr.Reject{Type: unix.NFT_REJECT_ICMPX_UNREACH, Code: 1}, VerdictReject, "reject with icmpx 1"),
+		Entry("queue", &expr.Queue{Num: 4, Total: 2, Flag: expr.QueueFlagBypass}, VerdictQueue, "queue num 4-5 bypass"),
+	)
+
+	It("decodes verdict map lookups", func() {
+		v := TerminalVerdict(nftables.TableFamilyIPv4, nufftables.Expressions{
+			payload(expr.PayloadBaseNetworkHeader, 12, 4),
+			&expr.Lookup{SourceRegister: 1, DestRegister: unix.NFT_REG_VERDICT, IsDestRegSet: true, SetName: "__map0"},
+		})
+		Expect(v.Kind).To(Equal(VerdictMap))
+		Expect(v.Map).To(Equal("__map0"))
+		Expect(v.MapKey.Field).To(Equal(payload(expr.PayloadBaseNetworkHeader, 12, 4)))
+		Expect(v.String()).To(Equal("vmap @__map0"))
+	})
+
+	It("decodes xt REJECT targets depending on the family", func() {
+		info := make(xt.Unknown, 4)
+		hostOrder.PutUint32(info, 3)
+		reject := &expr.Target{Name: "REJECT", Info: &info}
+		v := TerminalVerdict(nftables.TableFamilyIPv4, nufftables.Expressions{reject})
+		Expect(v.Kind).To(Equal(VerdictReject))
+		Expect(v.RejectType).To(BeEquivalentTo(unix.NFT_REJECT_ICMP_UNREACH))
+		Expect(v.RejectCode).To(BeEquivalentTo(3))
+		v = TerminalVerdict(nftables.TableFamilyIPv6, nufftables.Expressions{reject})
+		Expect(v.RejectCode).To(BeEquivalentTo(3))
+
+		hostOrder.PutUint32(info, 7)
+		v = TerminalVerdict(nftables.TableFamilyIPv4, nufftables.Expressions{reject})
+		Expect(v.String()).To(Equal("reject with tcp reset"))
+	})
+
+	It("decodes xt NFQUEUE targets", func() {
+		info := make(xt.Unknown, 6)
+		hostOrder.PutUint16(info[0:], 42)
+		hostOrder.PutUint16(info[2:], 4)
+		hostOrder.PutUint16(info[4:], uint16(expr.QueueFlagBypass|expr.QueueFlagFanout))
+		v := TerminalVerdict(nftables.TableFamilyIPv4, nufftables.Expressions{
+			&expr.Target{Name: "NFQUEUE", Rev: 3, Info: &info}})
+		Expect(v.Terminal()).To(BeTrue())
+		Expect(v.String()).To(Equal("queue num 42-45 bypass fanout"))
+	})
+
+	It("resolves jump targets", func() {
+		conn := nufftables.NewMemConn()
+		table := &nftables.Table{Name: "filter", Family: nftables.TableFamilyIPv4}
+		input := &nftables.Chain{Name: "input", Table: table}
+		foo := &nftables.Chain{Name: "foo", Table: table}
+		conn.AddRule(&nftables.Rule{Table: table, Chain: input, Exprs: []expr.Any{
+			&expr.Verdict{Kind: expr.VerdictJump, Chain: "foo"},
+		}})
+		conn.AddChain(foo)
+		tables, err := nufftables.GetAllTables(conn)
+		Expect(err).NotTo(HaveOccurred())
+		v := RuleVerdict(&tables.TableChain("filter", nufftables.TableFamilyIPv4, "input").Rules[0])
+		Expect(v.Kind).To(Equal(VerdictJump))
+		Expect(v.Target).NotTo(BeNil())
+		Expect(v.Target.Name).To(Equal("foo"))
+	})
+
+})
@@ -0,0 +1,214 @@
+// Copyright 2023 Harald Albrecht.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy
+// of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package dsl
+
+import (
+	"bytes"
+
+	"github.com/google/nftables/expr"
+	"github.com/thediveo/nufftables"
+)
+
+// Fields returns the individual operands of a concatenation, such as “ip
+// daddr . tcp dport”, or otherwise a single-element slice with this operand.
+func (o Operand) Fields() []Operand {
+	if o.Concat != nil {
+		return o.Concat
+	}
+	return []Operand{o}
+}
+
+// DispatchTable is a map or verdict map resolved in the loaded model, with its
+// (concatenated) keys split into the individual key fields, such as “ip daddr
+// . tcp dport vmap @service-ips” used by kube-proxy in nftables mode.
+type DispatchTable struct {
+	// Map is the name of the (verdict) map; anonymous maps have names in the
+	// form of “__map%d”.
+	Map string
+	// Key are the individual fields of the key looked up and Fields their
+	// protocol header fields; Fields has nil elements for non-payload keys,
+	// such as “meta l4proto”.
+	Key    []Operand
+	Fields []*Field
+	// Entries are the map elements sorted by key.
+	Entries []DispatchEntry
+}
+
+// DispatchEntry is a map element with its key split into the individual key
+// fields. In case of intervals, KeyTo is the (inclusive) upper bound,
+// otherwise KeyTo is the same as Key.
+type DispatchEntry struct {
+	Key, KeyTo [][]byte
+	// Verdict is the verdict of a verdict map element, with jump and goto
+	// targets resolved, and Data the element data of other maps.
+	Verdict *Verdict
+	Data    []byte
+}
+
+// Names returns the names of the key fields, such as “ip daddr” and “tcp
+// dport”.
+func (t *DispatchTable) Names() []string {
+	names := make([]string, 0, len(t.Key))
+	for idx, op := range t.Key {
+		if f := t.Fields[idx]; f != nil {
+			names = append(names, f.String())
+			continue
+		}
+		names = append(names, operandName(op))
+	}
+	return names
+}
+
+// Values returns the decoded key field values of the specified key, such as
+// [netip.Addr] for addresses and uint16 for ports; see also [Field.Decode].
+// Interface names are decoded into strings, and other non-payload key fields
+// are returned as raw bytes.
+func (t *DispatchTable) Values(key [][]byte) []any {
+	values := make([]any, 0, len(key))
+	for idx, data := range key {
+		if idx < len(t.Fields) && t.Fields[idx] != nil {
+			values = append(values, t.Fields[idx].Decode(data))
+			continue
+		}
+		if idx < len(t.Key) {
+			if meta, ok := t.Key[idx].Field.(*expr.Meta); ok && isIfnameKey(meta.Key) {
+				values = append(values, cString(data))
+				continue
+			}
+		}
+		values = append(values, data)
+	}
+	return values
+}
+
+// Lookup returns the entry matching the specified key, or nil.
+func (t *DispatchTable) Lookup(key ...[]byte) *DispatchEntry {
+	for idx := range t.Entries {
+		entry := &t.Entries[idx]
+		if len(entry.Key) != len(key) {
+			continue
+		}
+		matches := true
+		for f := range key {
+			if bytes.Compare(key[f], entry.Key[f]) < 0 || bytes.Compare(key[f], entry.KeyTo[f]) > 0 {
+				matches = false
+				break
+			}
+		}
+		if matches {
+			return entry
+		}
+	}
+	return nil
+}
+
+// ResolveMap resolves the specified (verdict) map of the table into a
+// dispatch table, splitting the map keys according to the specified key
+// operand. ResolveMap returns nil if the map is unknown. The rule is used to
+// determine the protocol header fields of the key, and might be nil.
+func ResolveMap(table *nufftables.Table, name string, key Operand, rule *LiftedRule) *DispatchTable {
+	if table == nil {
+		return nil
+	}
+	set, ok := table.SetsByName[name]
+	if !ok || !set.IsMap {
+		return nil
+	}
+	if rule == nil {
+		rule = &LiftedRule{}
+	}
+	t := &DispatchTable{Map: name, Key: key.Fields()}
+	for _, op := range t.Key {
+		t.Fields = append(t.Fields, rule.Field(table.Family, op))
+	}
+	lens := keyLens(t.Key)
+	for _, entry := range set.Entries() {
+		e := DispatchEntry{
+			Key:   splitKey(entry.From, lens),
+			KeyTo: splitKey(entry.To, lens),
+			Data:  entry.Val,
+		}
+		if entry.Verdict != nil {
+			e.Verdict, _ = decodeVerdict(table.Family, &Statement{Expr: entry.Verdict})
+			if e.Verdict != nil && e.Verdict.Chain != "" {
+				e.Verdict.Target = table.ChainsByName[e.Verdict.Chain]
+			}
+		}
+		t.Entries = append(t.Entries, e)
+	}
+	return t
+}
+
+// RuleDispatchTable returns the dispatch table of the verdict map looked up
+// by the specified rule, or nil if the rule doesn't end in a verdict map
+// lookup or the verdict map is unknown.
+func RuleDispatchTable(rule *nufftables.Rule) *DispatchTable {
+	if rule.Chain == nil || rule.Chain.Table == nil {
+		return nil
+	}
+	lifted := Lift(rule.Expressions())
+	for idx := len(lifted.Statements) - 1; idx >= 0; idx-- {
+		stmt := &lifted.Statements[idx]
+		v, ok := decodeVerdict(rule.Chain.Table.Family, stmt)
+		if !ok {
+			continue
+		}
+		if v.Kind != VerdictMap {
+			return nil
+		}
+		return ResolveMap(rule.Chain.Table, v.Map, v.MapKey, lifted)
+	}
+	return nil
+}
+
+// keyLens returns the lengths of the individual key fields of a concatenated
+// map key, or nil if not a concatenation or the lengths are unknown.
+func keyLens(fields []Operand) []int {
+	if len(fields) <= 1 {
+		return nil
+	}
+	lens := make([]int, 0, len(fields))
+	for _, f := range fields {
+		if f.Len == 0 {
+			return nil
+		}
+		lens = append(lens, f.Len)
+	}
+	return lens
+}
+
+// splitKey splits the specified concatenated key into the individual key
+// fields with the specified lengths. As concatenated key fields are stored in
+// registers, each key field is padded to a multiple of 4 bytes; splitKey
+// strips this padding. If the key doesn't fit the field lengths, then the key
+// is returned as a single key field.
+func splitKey(key []byte, lens []int) [][]byte {
+	if lens == nil {
+		return [][]byte{key}
+	}
+	total := 0
+	for _, l := range lens {
+		total += slots(l) * 4
+	}
+	if total != len(key) {
+		return [][]byte{key}
+	}
+	fields := make([][]byte, 0, len(lens))
+	for _, l := range lens {
+		fields = append(fields, key[:l])
+		key = key[slots(l)*4:]
+	}
+	return fields
+}
@@ -0,0 +1,89 @@
+// Copyright 2023 Harald Albrecht.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy
+// of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package dsl
+
+import (
+	"net/netip"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"github.com/thediveo/nufftables"
+	"golang.org/x/sys/unix"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("verdict maps", func() {
+
+	It("resolves concatenated verdict maps into dispatch tables", func() {
+		table := &nftables.Table{Name: "kube-proxy", Family: nftables.TableFamilyIPv4}
+		chain := &nftables.Chain{Name: "services", Table: table}
+		svc := &nftables.Chain{Name: "service-web", Table: table}
+		conn := nufftables.NewMemConn()
+		conn.AddChain(svc)
+		vmap := &nftables.Set{Table: table, Name: "service-ips", IsMap: true,
+			KeyType:  nftables.MustConcatSetType(nftables.TypeIPAddr, nftables.TypeInetService),
+			DataType: nftables.TypeVerdict, Concatenation: true}
+		Expect(conn.AddSet(vmap, []nftables.SetElement{
+			{Key: []byte{10, 96, 0, 1, 0, 80, 0, 0},
+				VerdictData: &expr.Verdict{Kind: expr.VerdictGoto, Chain: "service-web"}},
+			{Key: []byte{10, 96, 0, 2, 0, 53, 0, 0},
+				VerdictData: &expr.Verdict{Kind: expr.VerdictDrop}},
+		})).To(Succeed())
+		conn.AddRule(&nftables.Rule{Table: table, Chain: chain, Exprs: append(l4proto(unix.IPPROTO_TCP),
+			payload(expr.PayloadBaseNetworkHeader, 16, 4),
+			&expr.Payload{DestRegister: unix.NFT_REG32_01, Base: expr.PayloadBaseTransportHeader, Offset: 2, Len: 2},
+			&expr.Lookup{SourceRegister: 1, DestRegister: unix.NFT_REG_VERDICT, IsDestRegSet: true, SetName: "service-ips"},
+		)})
+		tables, err := nufftables.GetAllTables(conn)
+		Expect(err).NotTo(HaveOccurred())
+		rule := &tables.TableChain("kube-proxy", nufftables.TableFamilyIPv4, "services").Rules[0]
+
+		dt := RuleDispatchTable(rule)
+		Expect(dt).NotTo(BeNil())
+		Expect(dt.Map).To(Equal("service-ips"))
+		Expect(dt.Names()).To(HaveExactElements("ip daddr", "tcp dport"))
+		Expect(dt.Entries).To(HaveLen(2))
+		Expect(dt.Entries[0].Key).To(HaveExactElements([]byte{10, 96, 0, 1}, []byte{0, 80}))
+		Expect(dt.Values(dt.Entries[0].Key)).To(HaveExactElements(
+			netip.MustParseAddr("10.96.0.1"), uint16(80)))
+		Expect(dt.Entries[0].Verdict.Kind).To(Equal(VerdictGoto))
+		Expect(dt.Entries[0].Verdict.Target).NotTo(BeNil())
+		Expect(dt.Entries[0].Verdict.Target.Name).To(Equal("service-web"))
+
+		entry := dt.Lookup([]byte{10, 96, 0, 2}, []byte{0, 53})
+		Expect(entry).NotTo(BeNil())
+		Expect(entry.Verdict.Kind).To(Equal(VerdictDrop))
+		Expect(dt.Lookup([]byte{10, 96, 0, 2}, []byte{0, 54})).To(BeNil())
+	})
+
+	It("doesn't resolve rules without verdict maps or unknown maps", func() {
+		table := &nufftables.Table{Table: &nftables.Table{Family: nftables.TableFamilyIPv4},
+			SetsByName: map[string]*nufftables.Set{}}
+		chain := &nufftables.Chain{Table: table}
+		Expect(RuleDispatchTable(&nufftables.Rule{Chain: chain, Rule: &nftables.Rule{
+			Exprs: []expr.Any{&expr.Verdict{Kind: expr.VerdictAccept}}}})).To(BeNil())
+		Expect(RuleDispatchTable(&nufftables.Rule{Chain: chain, Rule: &nftables.Rule{
+			Exprs: []expr.Any{&expr.Lookup{SourceRegister: 1, IsDestRegSet: true, SetName: "foo"}}}})).To(BeNil())
+		Expect(ResolveMap(nil, "foo", Operand{}, nil)).To(BeNil())
+	})
+
+	It("returns the fields of operands", func() {
+		Expect(Operand{Len: 4}.Fields()).To(HaveLen(1))
+		Expect(Operand{Concat: []Operand{{Len: 4}, {Len: 2}}}.Fields()).To(HaveLen(2))
+	})
+
+})
@@ -0,0 +1,173 @@
+// Copyright 2023 Harald Albrecht.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy
+// of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package dsl
+
+import (
+	"bytes"
+	"encoding/binary"
+
+	"github.com/google/nftables/expr"
+	"github.com/google/nftables/xt"
+	"github.com/thediveo/nufftables"
+	"golang.org/x/sys/cpu"
+)
+
+// DecodeXtMatch returns the structured information of the specified xt match
+// extension, such as a [*ConntrackMatch] for “conntrack” and “state” matches,
+// or nil if the match extension isn't supported. The following match
+// extensions are supported:
+//
+//   - “802_3” (ebtables): [*Ether8023Match]
+//   - “addrtype”: [*AddrTypeMatch]
+//   - “among” (ebtables): [*AmongMatch]
+//   - “comment”: string
+//   - “conntrack” and “state”: [*ConntrackMatch]
+//   - “iprange”: []AddrMatch
+//   - “limit”: [*LimitMatch]
+//   - “mark”: [*MarkMatch]
+//   - “mark_m” (ebtables): [*EtherMarkMatch]
+//   - “multiport”, “tcp”, and “udp”: []PortMatch
+//   - “owner”: [*OwnerMatch]
+//   - “physdev”: [*PhysdevMatch]
+//   - “set”: [*IPSetMatch]
+//   - “socket”: [*SocketMatch]
+//   - “statistic”: [*StatisticMatch]
+func DecodeXtMatch(match *expr.Match) any {
+	switch match.Name {
+	case "802_3":
+		if m, ok := decode802_3(match); ok {
+			return m
+		}
+	case "addrtype":
+		if m, ok := decodeAddrType(match); ok {
+			return m
+		}
+	case "among":
+		if m, ok := decodeAmong(match); ok {
+			return m
+		}
+	case "comment":
+		if m, ok := decodeComment(match); ok {
+			return m
+		}
+	case "conntrack", "state":
+		if m, ok := decodeConntrack(match); ok {
+			return m
+		}
+	case "iprange":
+		if m, ok := decodeIPRange(match); ok {
+			return m
+		}
+	case "limit":
+		if m, ok := decodeLimit(match); ok {
+			return m
+		}
+	case "mark":
+		if m, ok := decodeMark(match); ok {
+			return m
+		}
+	case "mark_m":
+		if m, ok := decodeEtherMark(match); ok {
+			return m
+		}
+	case "multiport", "tcp", "udp":
+		if ports := xtPortMatches([]*expr.Match{match}, nil, ""); ports != nil {
+			m := make([]PortMatch, 0, len(ports))
+			for _, port := range ports {
+				m = append(m, port.PortMatch)
+			}
+			return m
+		}
+	case "owner":
+		if m, ok := decodeOwner(match); ok {
+			return m
+		}
+	case "physdev":
+		if m, ok := decodePhysdev(match); ok {
+			return m
+		}
+	case "set":
+		if m, ok := decodeIPSet(match); ok {
+			return m
+		}
+	case "socket":
+		if m, ok := decodeSocket(match); ok {
+			return m
+		}
+	case "statistic":
+		if m, ok := decodeStatistic(match); ok {
+			return m
+		}
+	}
+	return nil
+}
+
+// matchXt returns the decoded information of the first xt match extension
+// that can be decoded using the specified decoder function, together with the
+// remaining expressions after the match extension. If no suitable match
+// extension was found, then the remaining expressions are returned as nil,
+// together with the zero value.
+func matchXt[T any](exprs nufftables.Expressions, decode func(*expr.Match) (T, bool)) (nufftables.Expressions, T) {
+	var info T
+	remexprs, _ := nufftables.OfTypeFunc(exprs, func(match *expr.Match) bool {
+		var ok bool
+		info, ok = decode(match)
+		return ok
+	})
+	if remexprs == nil {
+		var zero T
+		return nil, zero
+	}
+	return remexprs, info
+}
+
+// unknownInfo returns the raw info payload of the specified match if the
+// match has the specified name and the payload hasn't been decoded by the
+// nftables xt package, and has at least the specified size.
+func unknownInfo(match *expr.Match, name string, size int) ([]byte, bool) {
+	if match.Name != name {
+		return nil, false
+	}
+	return rawInfo(match.Info, size)
+}
+
+// rawInfo returns the raw info payload of an xt match or target if the payload
+// hasn't been decoded by the nftables xt package, and has at least the
+// specified size.
+func rawInfo(info xt.InfoAny, size int) ([]byte, bool) {
+	raw, ok := info.(*xt.Unknown)
+	if !ok || len(*raw) < size {
+		return nil, false
+	}
+	return *raw, true
+}
+
+// hostOrder is the byte order of the host, as xt match info payloads are in
+// host byte order, except for addresses and some ports.
+var hostOrder binary.ByteOrder = binary.LittleEndian
+
+func init() {
+	if cpu.IsBigEndian {
+		hostOrder = binary.BigEndian
+	}
+}
+
+// cString returns the zero-terminated string from the specified buffer.
+func cString(b []byte) string {
+	if idx := bytes.IndexByte(b, 0); idx >= 0 {
+		return string(b[:idx])
+	}
+	return string(b)
+}
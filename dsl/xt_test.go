@@ -0,0 +1,292 @@
+// Copyright 2023 Harald Albrecht.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy
+// of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package dsl
+
+import (
+	"net"
+	"net/netip"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"github.com/google/nftables/xt"
+	"github.com/thediveo/nufftables"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+// xtMatch returns an xt match extension expression with an undecoded info
+// payload of the specified size, filled in by the specified function.
+func xtMatch(name string, rev uint32, size int, fill func(info []byte)) *expr.Match {
+	info := make(xt.Unknown, size)
+	if fill != nil {
+		fill(info)
+	}
+	return &expr.Match{Name: name, Rev: rev, Info: &info}
+}
+
+var _ = Describe("xt match extensions", func() {
+
+	It("ignores unsupported match extensions", func() {
+		Expect(DecodeXtMatch(xtMatch("foobar", 0, 42, nil))).To(BeNil())
+		Expect(DecodeXtMatch(xtMatch("mark", 1, 2, nil))).To(BeNil())
+		remexprs, mark := MatchMark(nufftables.Expressions{&expr.Counter{}})
+		Expect(remexprs).To(BeNil())
+		Expect(mark).To(BeNil())
+	})
+
+	It("decodes state matches", func() {
+		counter := &expr.Counter{}
+		remexprs, ct := MatchConntrack(nufftables.Expressions{
+			xtMatch("state", 0, 4, func(info []byte) {
+				hostOrder.PutUint32(info, uint32(CtStateEstablished|CtStateRelated|1<<6))
+			}),
+			counter,
+		})
+		Expect(remexprs).To(ConsistOf(counter))
+		Expect(ct.Matches(xt.ConntrackState)).To(BeTrue())
+		Expect(ct.Inverted(xt.ConntrackState)).To(BeFalse())
+		Expect(ct.States).To(Equal(CtStateEstablished | CtStateRelated | CtStateUntracked))
+		Expect(ct.States.String()).To(Equal("established,related,untracked"))
+	})
+
+	It("decodes conntrack matches", func() {
+		info := &xt.ConntrackMtinfo3{}
+		info.MatchFlags = uint16(xt.ConntrackState | xt.ConntrackOrigDst | xt.ConntrackOrigDstPort)
+		info.InvertFlags = uint16(xt.ConntrackOrigDst)
+		info.StateMask = uint16(CtStateDNAT)
+		info.OrigDstAddr = net.ParseIP("10.0.0.0").To4()
+		info.OrigDstMask = net.CIDRMask(8, 32)
+		info.OrigDstPort = ntohs(8000)
+		info.OrigDstPortHigh = ntohs(8100)
+		ct, ok := DecodeXtMatch(&expr.Match{Name: "conntrack", Rev: 3, Info: info}).(*ConntrackMatch)
+		Expect(ok).To(BeTrue())
+		Expect(ct.States).To(Equal(CtStateDNAT))
+		Expect(ct.Inverted(xt.ConntrackOrigDst)).To(BeTrue())
+		Expect(ct.OrigDst).To(Equal(netip.MustParsePrefix("10.0.0.0/8")))
+		Expect(ct.OrigDstPorts).To(Equal(PortRange{Min: 8000, Max: 8100}))
+		Expect(ct.OrigSrcPorts).To(Equal(PortRange{}))
+	})
+
+	It("decodes addrtype matches", func() {
+		Expect(DecodeXtMatch(&expr.Match{Name: "addrtype", Rev: 1, Info: &xt.AddrTypeV1{
+			Dest:  uint16(xt.AddrTypeLocal),
+			Flags: xtAddrTypeInvertDest | xtAddrTypeLimitIfaceOut,
+		}})).To(Equal(&AddrTypeMatch{
+			Dest:          AddrTypeLocal,
+			InvertDest:    true,
+			LimitIfaceOut: true,
+		}))
+		_, m := MatchAddrType(nufftables.Expressions{&expr.Match{Name: "addrtype", Info: &xt.AddrType{
+			Source: uint16(xt.AddrTypeLocal | xt.AddrTypeBroadcast),
+		}}})
+		Expect(m.Source.String()).To(Equal("LOCAL,BROADCAST"))
+		Expect(m.String()).To(Equal("addrtype --src-type LOCAL,BROADCAST"))
+		Expect((&AddrTypeMatch{Dest: AddrTypeLocal, InvertDest: true, LimitIfaceIn: true}).String()).To(
+			Equal("addrtype ! --dst-type LOCAL --limit-iface-in"))
+	})
+
+	It("decodes comments", func() {
+		remexprs, comment := MatchComment(nufftables.Expressions{
+			xtMatch("comment", 0, 256, func(info []byte) { copy(info, "kube-proxy rocks") }),
+		})
+		Expect(remexprs).To(BeEmpty())
+		Expect(comment).To(Equal("kube-proxy rocks"))
+
+		Expect(RuleComment(&nufftables.Rule{})).To(BeEmpty())
+		Expect(RuleComment(&nufftables.Rule{Rule: &nftables.Rule{
+			UserData: []byte{1, 1, 42, 0, 5, 'f', 'o', 'o', '!', 0},
+		}})).To(Equal("foo!"))
+		Expect(RuleComment(&nufftables.Rule{Rule: &nftables.Rule{
+			UserData: []byte{0, 42},
+			Exprs: []expr.Any{
+				xtMatch("comment", 0, 256, func(info []byte) { copy(info, "kube-proxy rocks") }),
+			},
+		}})).To(Equal("kube-proxy rocks"))
+	})
+
+	It("decodes mark matches", func() {
+		Expect(DecodeXtMatch(xtMatch("mark", 1, 12, func(info []byte) {
+			hostOrder.PutUint32(info[0:], 0x4000)
+			hostOrder.PutUint32(info[4:], 0xc000)
+			info[8] = 1
+		}))).To(Equal(&MarkMatch{Mark: 0x4000, Mask: 0xc000, Invert: true}))
+		Expect(DecodeXtMatch(xtMatch("mark", 0, 24, func(info []byte) {
+			hostOrder.PutUint64(info[0:], 0x42)
+			hostOrder.PutUint64(info[8:], 0xff)
+		}))).To(Equal(&MarkMatch{Mark: 0x42, Mask: 0xff}))
+	})
+
+	DescribeTable("decodes limit matches",
+		func(avg uint32, expected string) {
+			_, m := MatchLimit(nufftables.Expressions{
+				xtMatch("limit", 0, 32, func(info []byte) {
+					hostOrder.PutUint32(info[0:], avg)
+					hostOrder.PutUint32(info[4:], 5)
+				}),
+			})
+			Expect(m).NotTo(BeNil())
+			Expect(m.String()).To(Equal(expected))
+		},
+		Entry("per second", uint32(xtLimitScale/10), "10/sec burst 5"),
+		Entry("per minute", uint32(xtLimitScale*60/3), "3/min burst 5"),
+		Entry("per hour", uint32(xtLimitScale*60*60/2), "2/hour burst 5"),
+		Entry("per day", uint32(xtLimitScale*24*60*60), "1/day burst 5"),
+	)
+
+	It("decodes statistic matches", func() {
+		counter := &expr.Counter{}
+		remexprs, m := MatchStatistic(nufftables.Expressions{
+			xtMatch("statistic", 0, 24, func(info []byte) {
+				hostOrder.PutUint32(info[4:], 0x20000000)
+			}),
+			counter,
+		})
+		Expect(remexprs).To(ConsistOf(counter))
+		Expect(m).To(Equal(&StatisticMatch{Mode: StatisticRandom, Probability: 0.25}))
+		Expect(m.Rate()).To(Equal(0.25))
+		Expect(m.String()).To(Equal("--mode random --probability 0.25000000000"))
+
+		m = DecodeXtMatch(xtMatch("statistic", 0, 24, func(info []byte) {
+			hostOrder.PutUint16(info[0:], xtStatisticNth)
+			hostOrder.PutUint16(info[2:], xtStatisticInvert)
+			hostOrder.PutUint32(info[4:], 3)
+			hostOrder.PutUint32(info[8:], 1)
+		})).(*StatisticMatch)
+		Expect(m).To(Equal(&StatisticMatch{Mode: StatisticNth, Every: 4, Packet: 1, Invert: true}))
+		Expect(m.Rate()).To(Equal(0.75))
+		Expect(m.String()).To(Equal("! --mode nth --every 4 --packet 1"))
+
+		Expect(DecodeXtMatch(xtMatch("statistic", 0, 8, nil))).To(BeNil())
+		Expect((&StatisticMatch{Mode: StatisticNth}).Rate()).To(BeZero())
+	})
+
+	It("decodes owner matches", func() {
+		counter := &expr.Counter{}
+		remexprs, m := MatchOwner(nufftables.Expressions{
+			xtMatch("owner", 1, 20, func(info []byte) {
+				hostOrder.PutUint32(info[0:], 1337)
+				hostOrder.PutUint32(info[4:], 1337)
+				info[16] = byte(OwnerUID)
+				info[17] = byte(OwnerUID)
+			}),
+			counter,
+		})
+		Expect(remexprs).To(ConsistOf(counter))
+		Expect(m).To(Equal(&OwnerMatch{UIDMin: 1337, UIDMax: 1337, Match: OwnerUID, Invert: OwnerUID}))
+		Expect(m.String()).To(Equal("owner ! --uid-owner 1337"))
+		Expect(m.MatchesUID(1337)).To(BeFalse())
+		Expect(m.MatchesUID(0)).To(BeTrue())
+
+		m = DecodeXtMatch(xtMatch("owner", 1, 20, func(info []byte) {
+			hostOrder.PutUint32(info[8:], 100)
+			hostOrder.PutUint32(info[12:], 199)
+			info[16] = byte(OwnerGID | OwnerSupplGroups | OwnerSocketExists)
+		})).(*OwnerMatch)
+		Expect(m.String()).To(Equal("owner --socket-exists --gid-owner 100-199 --suppl-groups"))
+		Expect(m.MatchesUID(42)).To(BeTrue())
+
+		Expect(DecodeXtMatch(xtMatch("owner", 0, 20, nil))).To(BeNil())
+		Expect(DecodeXtMatch(xtMatch("owner", 1, 8, nil))).To(BeNil())
+	})
+
+	It("returns xt and native owner matches", func() {
+		matches := OwnerMatches(nufftables.Expressions{
+			xtMatch("owner", 1, 20, func(info []byte) {
+				info[16] = byte(OwnerSocketExists)
+			}),
+			&expr.Meta{Key: expr.MetaKeySKUID, Register: 1},
+			&expr.Cmp{Op: expr.CmpOpNeq, Register: 1, Data: hostUint32(1337)},
+			&expr.Meta{Key: expr.MetaKeySKGID, Register: 1},
+			&expr.Range{Op: expr.CmpOpEq, Register: 1, FromData: hostUint32(100), ToData: hostUint32(199)},
+			&expr.Meta{Key: expr.MetaKeyMARK, Register: 1},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: hostUint32(42)},
+		})
+		Expect(matches).To(HaveExactElements(
+			OwnerMatch{Match: OwnerSocketExists},
+			OwnerMatch{UIDMin: 1337, UIDMax: 1337, Match: OwnerUID, Invert: OwnerUID},
+			OwnerMatch{GIDMin: 100, GIDMax: 199, Match: OwnerGID},
+		))
+	})
+
+	It("decodes physdev matches", func() {
+		Expect(DecodeXtMatch(xtMatch("physdev", 0, 66, func(info []byte) {
+			copy(info[0:], "veth")
+			copy(info[16:], []byte{0xff, 0xff, 0xff, 0xff})
+			copy(info[32:], "br0")
+			copy(info[48:], []byte{0xff, 0xff, 0xff, 0xff})
+			info[64] = byte(PhysdevOut)
+			info[65] = byte(PhysdevIn | PhysdevOut | PhysdevBridged)
+		}))).To(Equal(&PhysdevMatch{
+			InDev:  "veth+",
+			OutDev: "br0",
+			Flags:  PhysdevIn | PhysdevOut | PhysdevBridged,
+			Invert: PhysdevOut,
+		}))
+	})
+
+	It("decodes ipset matches", func() {
+		Expect(DecodeXtMatch(xtMatch("set", 4, 16, func(info []byte) {
+			hostOrder.PutUint16(info[0:], 42)
+			info[2] = 2
+			info[3] = ipsetInvMatch | 1<<2
+		}))).To(Equal(&IPSetMatch{
+			Index:      42,
+			Directions: []AddrDirection{DestinationAddr, SourceAddr},
+			Invert:     true,
+		}))
+		Expect(DecodeXtMatch(xtMatch("set", 0, 16, nil))).To(BeNil())
+	})
+
+	It("decodes iprange matches", func() {
+		m := DecodeXtMatch(xtMatch("iprange", 1, 68, func(info []byte) {
+			copy(info[32:], []byte{192, 168, 0, 10})
+			copy(info[48:], []byte{192, 168, 0, 20})
+			info[64] = iprangeDst | iprangeDstInv
+		}))
+		Expect(m).To(HaveExactElements(AddrMatch{
+			Direction: DestinationAddr,
+			Op:        OpNotInRange,
+			From:      netip.MustParseAddr("192.168.0.10"),
+			To:        netip.MustParseAddr("192.168.0.20"),
+		}))
+		Expect(m.([]AddrMatch)[0].Is6()).To(BeFalse())
+	})
+
+	It("decodes multiport matches", func() {
+		multiport := xtMatch("multiport", 1, 48, func(info []byte) {
+			info[0] = multiportEither
+			info[1] = 3
+			hostOrder.PutUint16(info[2:], 8000)
+			hostOrder.PutUint16(info[4:], 8100)
+			hostOrder.PutUint16(info[6:], 80)
+			info[32] = 1
+			info[47] = 1
+		})
+		Expect(DecodeXtMatch(multiport)).To(HaveExactElements(PortMatch{
+			Direction: EitherPort,
+			Ranges:    []PortRange{{Min: 80, Max: 80}, {Min: 8000, Max: 8100}},
+			Invert:    true,
+		}))
+		Expect(EitherPort.String()).To(Equal("port"))
+
+		matches := PortMatches(append(l4proto(6), multiport))
+		Expect(matches).To(HaveLen(1))
+		Expect(matches[0].Protocol).To(Equal("tcp"))
+		Expect(matches[0].Matches(8042)).To(BeFalse())
+		Expect(matches[0].Matches(443)).To(BeTrue())
+	})
+
+})
@@ -1,15 +1,15 @@
 module github.com/thediveo/nufftables
 
-go 1.19
+go 1.21
 
-require golang.org/x/net v0.17.0 // indirect
+require golang.org/x/net v0.33.0 // indirect
 
 require (
 	github.com/davecgh/go-spew v1.1.1
-	github.com/google/nftables v0.1.0
+	github.com/google/nftables v0.3.0
 	github.com/onsi/ginkgo/v2 v2.13.0
 	github.com/onsi/gomega v1.28.0
-	golang.org/x/sys v0.13.0
+	golang.org/x/sys v0.28.0
 )
 
 require (
@@ -17,21 +17,18 @@ require (
 	github.com/google/pprof v0.0.0-20210407192527-94a9f03dee38 // indirect
 	github.com/inconshreveable/mousetrap v1.1.0 // indirect
 	github.com/spf13/pflag v1.0.5 // indirect
+	golang.org/x/sync v0.10.0 // indirect
 )
 
 require (
-	github.com/BurntSushi/toml v0.4.1 // indirect
 	github.com/go-logr/logr v1.2.4 // indirect
-	github.com/google/go-cmp v0.5.9 // indirect
-	github.com/josharian/native v0.0.0-20200817173448-b6b71def0850 // indirect
-	github.com/mdlayher/netlink v1.4.2 // indirect
-	github.com/mdlayher/socket v0.0.0-20211102153432-57e3fa563ecb // indirect
+	github.com/google/go-cmp v0.6.0 // indirect
+	github.com/mdlayher/netlink v1.7.3-0.20250113171957-fbb4dce95f42
+	github.com/mdlayher/socket v0.5.0 // indirect
 	github.com/spf13/cobra v1.7.0
 	github.com/thediveo/enumflag/v2 v2.0.4
 	golang.org/x/exp v0.0.0-20231006140011-7918f672742d
-	golang.org/x/mod v0.13.0 // indirect
-	golang.org/x/text v0.13.0 // indirect
-	golang.org/x/tools v0.14.0 // indirect
+	golang.org/x/text v0.21.0 // indirect
+	golang.org/x/tools v0.21.1-0.20240508182429-e35e4ccd0d2d // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
-	honnef.co/go/tools v0.2.2 // indirect
 )
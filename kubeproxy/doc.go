@@ -0,0 +1,13 @@
+/*
+Package kubeproxy reconstructs the Kubernetes services programmed by
+kube-proxy into netfilter, regardless of whether kube-proxy runs in iptables
+mode (using iptables-nft) or in nftables mode.
+
+[Services] returns the service ports with their namespaces and names, as well
+as their frontends, that is, their cluster IPs, node ports, external IPs, and
+load balancer IPs. Each [Frontend] lists the endpoints the traffic gets
+forwarded to as [portfinder.Endpoint] elements, together with their shares of
+the traffic, and [Service.Forwards] returns the frontends as
+[portfinder.ForwardedPortRange] port forwardings.
+*/
+package kubeproxy
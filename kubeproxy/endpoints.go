@@ -0,0 +1,165 @@
+// Copyright 2023 Harald Albrecht.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy
+// of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package kubeproxy
+
+import (
+	"net"
+	"strings"
+
+	"github.com/thediveo/nufftables"
+	"github.com/thediveo/nufftables/dsl"
+	"github.com/thediveo/nufftables/portfinder"
+)
+
+// endpoints returns the endpoints reachable from the specified chain, such as
+// a “KUBE-SVC-*” or “service-*” chain, together with their shares of the
+// traffic.
+func endpoints(chain *nufftables.Chain) []portfinder.Endpoint {
+	r := resolver{stack: map[*nufftables.Chain]bool{}}
+	r.resolve(chain, 1)
+	return r.endpoints
+}
+
+// resolver follows the jumps, gotos, and verdict maps from a service chain to
+// the endpoint chains with their DNAT rules.
+type resolver struct {
+	stack     map[*nufftables.Chain]bool // breaks jump cycles.
+	endpoints []portfinder.Endpoint
+}
+
+// resolve adds the endpoints reachable from the specified chain, with the
+// chain getting the specified share of the traffic. Rules with xt “statistic”
+// matches pass on only their share of the traffic to the chains jumped to,
+// with later rules getting the remaining traffic. Jumps to the chains marking
+// packets for masquerading or dropping are skipped, as well as jumps with
+// further match conditions, such as for pod traffic to external IPs; thus,
+// the endpoints reflect the traffic not meeting any special conditions.
+func (r *resolver) resolve(chain *nufftables.Chain, weight float64) {
+	if r.stack[chain] {
+		return
+	}
+	r.stack[chain] = true
+	defer delete(r.stack, chain)
+	remaining := 1.0
+	for idx := range chain.Rules {
+		rule := &chain.Rules[idx]
+		if ep, ok := endpoint(rule); ok {
+			ep.Weight = weight * remaining
+			r.add(ep)
+			return
+		}
+		lifted := dsl.Lift(rule.Expressions())
+		rate, conditional := sampling(lifted)
+		if conditional {
+			continue
+		}
+		share := weight * remaining * rate
+		if v := dsl.RuleVerdict(rule); v.Target != nil {
+			if isMarkChain(v.Target) {
+				continue
+			}
+			r.resolve(v.Target, share)
+		} else if spread := verdictSpread(rule, v); len(spread) != 0 {
+			for _, entry := range spread {
+				if target := rule.Chain.Table.ChainsByName[entry.Verdict.Chain]; target != nil {
+					r.resolve(target, share*entry.Weight)
+				}
+			}
+		} else if dt := dsl.RuleDispatchTable(rule); dt != nil {
+			targets := []*nufftables.Chain{}
+			for _, entry := range dt.Entries {
+				if entry.Verdict != nil && entry.Verdict.Target != nil {
+					targets = append(targets, entry.Verdict.Target)
+				}
+			}
+			for _, target := range targets {
+				r.resolve(target, share/float64(len(targets)))
+			}
+		} else {
+			continue
+		}
+		if remaining *= 1 - rate; remaining <= 0 {
+			return
+		}
+	}
+}
+
+// verdictSpread returns the jumps and gotos of a verdict map lookup keyed by
+// a number generator or hash, such as “numgen random mod 2 vmap { 0 : goto
+// endpoint-a, 1 : goto endpoint-b }”, together with their shares, or nil.
+func verdictSpread(rule *nufftables.Rule, v *dsl.Verdict) []dsl.SpreadEntry {
+	if v.Kind != dsl.VerdictMap || rule.Chain == nil || rule.Chain.Table == nil {
+		return nil
+	}
+	spread := dsl.ResolveSpread(rule.Chain.Table, dsl.Operand{Map: v.Map, MapKey: &v.MapKey})
+	for _, entry := range spread {
+		if entry.Verdict == nil || entry.Verdict.Chain == "" {
+			return nil
+		}
+	}
+	return spread
+}
+
+// add adds the endpoint, combining the shares of the same endpoint reached
+// along different paths.
+func (r *resolver) add(ep portfinder.Endpoint) {
+	for idx := range r.endpoints {
+		if r.endpoints[idx].IP.Equal(ep.IP) && r.endpoints[idx].Port == ep.Port {
+			r.endpoints[idx].Weight += ep.Weight
+			return
+		}
+	}
+	r.endpoints = append(r.endpoints, ep)
+}
+
+// endpoint returns the endpoint of the specified DNAT rule, such as the rule
+// of a “KUBE-SEP-*” or “endpoint-*” chain.
+func endpoint(rule *nufftables.Rule) (portfinder.Endpoint, bool) {
+	_, dnat := dsl.TargetNAT(rule.Expressions(), dsl.DNAT)
+	if dnat == nil || !dnat.HasAddr() {
+		return portfinder.Endpoint{}, false
+	}
+	ep := portfinder.Endpoint{IP: net.IP(dnat.AddrMin.AsSlice())}
+	if dnat.HasPorts() {
+		ep.Port = dnat.PortMin
+	}
+	return ep, true
+}
+
+// sampling returns the share of packets matching the xt “statistic” matches
+// of the specified lifted rule, and whether the rule has further match
+// conditions besides statistic and comment matches.
+func sampling(lifted *dsl.LiftedRule) (float64, bool) {
+	rate := 1.0
+	conditional := len(lifted.Predicates) != 0
+	for _, match := range lifted.XtMatches {
+		switch m := dsl.DecodeXtMatch(match).(type) {
+		case *dsl.StatisticMatch:
+			rate *= m.Rate()
+		case string:
+			// comment
+		default:
+			conditional = true
+		}
+	}
+	return rate, conditional
+}
+
+// isMarkChain returns true if the specified chain marks packets for
+// masquerading or dropping, such as “KUBE-MARK-MASQ” and
+// “mark-for-masquerade”.
+func isMarkChain(chain *nufftables.Chain) bool {
+	return strings.HasPrefix(chain.Name, "KUBE-MARK-") || strings.HasPrefix(chain.Name, "mark-")
+}
@@ -0,0 +1,126 @@
+// Copyright 2023 Harald Albrecht.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy
+// of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package kubeproxy
+
+import (
+	"net"
+	"strings"
+
+	"github.com/thediveo/nufftables"
+	"github.com/thediveo/nufftables/dsl"
+)
+
+// Names of the kube-proxy chains in iptables mode.
+const (
+	kubeServicesChain  = "KUBE-SERVICES"
+	kubeNodePortsChain = "KUBE-NODEPORTS"
+)
+
+// frontendSuffixes maps the suffixes of the rule comments in the
+// “KUBE-SERVICES” chain to the kinds of frontends.
+var frontendSuffixes = []struct {
+	suffix string
+	kind   FrontendKind
+}{
+	{" cluster IP", ClusterIP},
+	{" external IP", ExternalIP},
+	{" loadbalancer IP", LoadBalancerIP},
+}
+
+// iptablesServices collects the service ports of kube-proxy in iptables mode
+// from the specified table, if it contains a “KUBE-SERVICES” chain.
+func iptablesServices(c *collector, table *nufftables.Table) {
+	services, ok := table.ChainsByName[kubeServicesChain]
+	if !ok {
+		return
+	}
+	for idx := range services.Rules {
+		rule := &services.Rules[idx]
+		target := dsl.RuleVerdict(rule).Target
+		if target == nil {
+			continue
+		}
+		if target.Name == kubeNodePortsChain {
+			for idx := range target.Rules {
+				iptablesFrontend(c, table, &target.Rules[idx], NodePort, "")
+			}
+			continue
+		}
+		comment := dsl.RuleComment(rule)
+		for _, fs := range frontendSuffixes {
+			if strings.HasSuffix(comment, fs.suffix) {
+				iptablesFrontend(c, table, rule, fs.kind, strings.TrimSuffix(comment, fs.suffix))
+				break
+			}
+		}
+	}
+}
+
+// iptablesFrontend adds the frontend of the specified rule jumping to a
+// service chain. The service port name is either the specified name or the
+// rule comment, such as “kube-system/kube-dns:dns”.
+func iptablesFrontend(c *collector, table *nufftables.Table, rule *nufftables.Rule, kind FrontendKind, name string) {
+	target := dsl.RuleVerdict(rule).Target
+	if target == nil {
+		return
+	}
+	if name == "" {
+		name = dsl.RuleComment(rule)
+	}
+	namespace, rest, ok := strings.Cut(name, "/")
+	if !ok || strings.Contains(rest, " ") {
+		return
+	}
+	svcname, portname, _ := strings.Cut(rest, ":")
+	var port *dsl.PortMatch
+	for _, match := range dsl.PortMatches(rule.Expressions()) {
+		if match.Direction == dsl.DestinationPort && !match.Invert &&
+			len(match.Ranges) == 1 && match.Ranges[0].Min == match.Ranges[0].Max {
+			match := match
+			port = &match
+			break
+		}
+	}
+	if port == nil {
+		return
+	}
+	f := Frontend{
+		Kind:      kind,
+		Port:      port.Ranges[0].Min,
+		Endpoints: endpoints(target),
+		Mode:      IPTablesMode,
+		Family:    nufftables.TableFamily(table.Family),
+		Table:     table.Name,
+		Chain:     rule.Chain.Name,
+		Handle:    rule.Handle,
+	}
+	if kind != NodePort {
+		for _, match := range dsl.RuleAddrMatches(rule) {
+			if match.Direction == dsl.DestinationAddr && match.Op == dsl.OpEq && match.Prefix.IsSingleIP() {
+				f.IP = net.IP(match.Prefix.Addr().AsSlice())
+				break
+			}
+		}
+		if f.IP == nil {
+			return
+		}
+	}
+	c.add(serviceKey{
+		namespace: namespace,
+		name:      svcname,
+		port:      portname,
+		protocol:  port.Protocol,
+	}, f)
+}
@@ -0,0 +1,163 @@
+// Copyright 2023 Harald Albrecht.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy
+// of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package kubeproxy
+
+import (
+	"encoding/binary"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"github.com/google/nftables/xt"
+	"github.com/thediveo/nufftables"
+	"github.com/thediveo/nufftables/nufftablestest"
+	"github.com/thediveo/nufftables/portfinder"
+	"golang.org/x/sys/cpu"
+	"golang.org/x/sys/unix"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+// jump returns a jump verdict to the specified chain.
+func jump(chain string) *expr.Verdict {
+	return &expr.Verdict{Kind: expr.VerdictJump, Chain: chain}
+}
+
+// dport returns the expressions of “-p <proto> -m <proto> --dport <port>”.
+func dport(proto byte, port uint16) []expr.Any {
+	exprs := []expr.Any{
+		&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{proto}},
+	}
+	if proto == unix.IPPROTO_UDP {
+		return append(exprs, &expr.Match{Name: "udp", Info: &xt.Udp{DstPorts: [2]uint16{port, port}}})
+	}
+	return append(exprs, &expr.Match{Name: "tcp", Info: &xt.Tcp{DstPorts: [2]uint16{port, port}}})
+}
+
+// probability returns an xt “statistic” match with the specified probability.
+func probability(p float64) *expr.Match {
+	info := make(xt.Unknown, 24)
+	order := binary.ByteOrder(binary.LittleEndian)
+	if cpu.IsBigEndian {
+		order = binary.BigEndian
+	}
+	order.PutUint32(info[4:], uint32(p*(1<<31)))
+	return &expr.Match{Name: "statistic", Info: &info}
+}
+
+// sep returns the expressions of a “KUBE-SEP-*” DNAT rule.
+func sep(proto byte, port uint16, addr ...byte) []expr.Any {
+	return append(dport(proto, 0)[:2], &expr.Target{Name: "DNAT", Info: &xt.NatRange2{
+		NatRange: xt.NatRange{
+			Flags:   uint(xt.NatRangeMapIPs | xt.NatRangeProtoSpecified),
+			MinIP:   addr,
+			MaxIP:   addr,
+			MinPort: port,
+			MaxPort: port,
+		},
+	}})
+}
+
+var _ = Describe("kube-proxy in iptables mode", func() {
+
+	It("reconstructs services", func() {
+		conn := nufftables.NewMemConn()
+		nat := &nftables.Table{Name: "nat", Family: nftables.TableFamilyIPv4}
+		chains := map[string]*nftables.Chain{}
+		for _, name := range []string{
+			"KUBE-SERVICES", "KUBE-NODEPORTS", "KUBE-MARK-MASQ",
+			"KUBE-SVC-WEB", "KUBE-EXT-WEB", "KUBE-SEP-WEB1", "KUBE-SEP-WEB2",
+			"KUBE-SVC-DNS", "KUBE-SEP-DNS",
+		} {
+			chains[name] = &nftables.Chain{Name: name, Table: nat}
+			conn.AddChain(chains[name])
+		}
+		add := func(chain string, comm string, exprs ...[]expr.Any) {
+			var all []expr.Any
+			for _, e := range exprs {
+				all = append(all, e...)
+			}
+			rule := &nftables.Rule{Table: nat, Chain: chains[chain], Exprs: all}
+			if comm != "" {
+				rule.UserData = nufftablestest.Comment(comm)
+			}
+			conn.AddRule(rule)
+		}
+
+		add("KUBE-SERVICES", "default/web:http cluster IP",
+			nufftablestest.DAddr4("10.96.0.1"), dport(unix.IPPROTO_TCP, 80), []expr.Any{jump("KUBE-SVC-WEB")})
+		add("KUBE-SERVICES", "default/web:http loadbalancer IP",
+			nufftablestest.DAddr4("198.51.100.7"), dport(unix.IPPROTO_TCP, 80), []expr.Any{jump("KUBE-EXT-WEB")})
+		add("KUBE-SERVICES", "kube-system/kube-dns cluster IP",
+			nufftablestest.DAddr4("10.96.0.10"), dport(unix.IPPROTO_UDP, 53), []expr.Any{jump("KUBE-SVC-DNS")})
+		add("KUBE-SERVICES", "kubernetes service nodeports; NOTE: this must be the last rule in this chain",
+			[]expr.Any{
+				&expr.Match{Name: "addrtype", Rev: 1, Info: &xt.AddrTypeV1{Dest: uint16(xt.AddrTypeLocal)}},
+				jump("KUBE-NODEPORTS"),
+			})
+		add("KUBE-NODEPORTS", "default/web:http",
+			dport(unix.IPPROTO_TCP, 30080), []expr.Any{jump("KUBE-EXT-WEB")})
+
+		add("KUBE-EXT-WEB", "masquerade traffic for default/web:http external destinations",
+			[]expr.Any{jump("KUBE-MARK-MASQ")})
+		add("KUBE-EXT-WEB", "", []expr.Any{jump("KUBE-SVC-WEB")})
+
+		add("KUBE-SVC-WEB", "default/web:http cluster IP",
+			nufftablestest.DAddr4("10.96.0.1"), dport(unix.IPPROTO_TCP, 80), []expr.Any{jump("KUBE-MARK-MASQ")})
+		add("KUBE-SVC-WEB", "default/web:http -> 10.244.1.5:8080",
+			[]expr.Any{probability(0.25), jump("KUBE-SEP-WEB1")})
+		add("KUBE-SVC-WEB", "default/web:http -> 10.244.2.6:8080",
+			[]expr.Any{jump("KUBE-SEP-WEB2")})
+		add("KUBE-SEP-WEB1", "default/web:http", sep(unix.IPPROTO_TCP, 8080, 10, 244, 1, 5))
+		add("KUBE-SEP-WEB2", "default/web:http", sep(unix.IPPROTO_TCP, 8080, 10, 244, 2, 6))
+
+		add("KUBE-SVC-DNS", "kube-system/kube-dns -> 10.244.0.2:53",
+			[]expr.Any{jump("KUBE-SEP-DNS")})
+		add("KUBE-SEP-DNS", "kube-system/kube-dns", sep(unix.IPPROTO_UDP, 53, 10, 244, 0, 2))
+
+		tables, err := nufftables.GetAllTables(conn)
+		Expect(err).NotTo(HaveOccurred())
+		services := Services(tables)
+		Expect(services).To(HaveLen(2))
+
+		Expect(services[0].String()).To(Equal("default/web:http tcp"))
+		Expect(services[0].Frontends).To(HaveLen(3))
+		Expect(services[0].Frontends[0].String()).To(Equal(
+			"cluster IP 10.96.0.1:80 to 10.244.1.5:8080 (25%), 10.244.2.6:8080 (75%)"))
+		Expect(services[0].Frontends[1].String()).To(Equal(
+			"node port 30080 to 10.244.1.5:8080 (25%), 10.244.2.6:8080 (75%)"))
+		Expect(services[0].Frontends[2].String()).To(Equal(
+			"loadbalancer IP 198.51.100.7:80 to 10.244.1.5:8080 (25%), 10.244.2.6:8080 (75%)"))
+		Expect(services[0].Frontends[0].Mode).To(Equal(IPTablesMode))
+		Expect(services[0].Frontends[0].Table).To(Equal("nat"))
+
+		Expect(services[1].Namespace).To(Equal("kube-system"))
+		Expect(services[1].Name).To(Equal("kube-dns"))
+		Expect(services[1].PortName).To(BeEmpty())
+		Expect(services[1].String()).To(Equal("kube-system/kube-dns udp"))
+		Expect(services[1].Frontends).To(ConsistOf(HaveField("Endpoints", ConsistOf(
+			portfinder.Endpoint{IP: []byte{10, 244, 0, 2}, Port: 53, Weight: 1}))))
+
+		fwds := services[0].Forwards()
+		Expect(fwds).To(HaveLen(3))
+		Expect(fwds[1].String()).To(Equal("forwarding tcp from 0.0.0.0:30080 to " +
+			"10.244.1.5:8080 (25%), 10.244.2.6:8080 (75%) (ip nat KUBE-NODEPORTS handle 5)"))
+		fwds = services[1].Forwards()
+		Expect(fwds).To(HaveLen(1))
+		Expect(fwds[0].String()).To(Equal("forwarding udp from 10.96.0.10:53 to 10.244.0.2:53 (ip nat KUBE-SERVICES handle 3)"))
+	})
+
+})
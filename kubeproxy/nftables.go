@@ -0,0 +1,139 @@
+// Copyright 2023 Harald Albrecht.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy
+// of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package kubeproxy
+
+import (
+	"encoding/binary"
+	"net"
+	"strings"
+
+	"github.com/thediveo/nufftables"
+	"github.com/thediveo/nufftables/dsl"
+	"golang.org/x/sys/unix"
+)
+
+// Names of the kube-proxy table and chain in nftables mode.
+const (
+	kubeProxyTable = "kube-proxy"
+	servicesChain  = "services"
+)
+
+// nftablesServices collects the service ports of kube-proxy in nftables mode
+// from the specified table, if it is a “kube-proxy” table. The frontends are
+// the elements of the verdict maps looked up in the “services” chain, that
+// is, the “service-ips” map with keys consisting of address, protocol, and
+// port, and the “service-nodeports” map with keys consisting of protocol and
+// port.
+func nftablesServices(c *collector, table *nufftables.Table) {
+	if table.Name != kubeProxyTable {
+		return
+	}
+	services, ok := table.ChainsByName[servicesChain]
+	if !ok {
+		return
+	}
+	for idx := range services.Rules {
+		rule := &services.Rules[idx]
+		dt := dsl.RuleDispatchTable(rule)
+		if dt == nil {
+			continue
+		}
+		for _, entry := range dt.Entries {
+			if entry.Verdict == nil || entry.Verdict.Target == nil {
+				continue
+			}
+			nftablesFrontend(c, rule, entry.Key, entry.Verdict.Target)
+		}
+	}
+}
+
+// nftablesFrontend adds the frontend of the specified verdict map key with
+// the specified target chain, such as
+// “service-ULMVA6XW-kube-system/kube-dns/udp/dns” or
+// “external-42GJEOPJ-default/web/tcp/http”, looked up by the specified rule.
+func nftablesFrontend(c *collector, rule *nufftables.Rule, key [][]byte, target *nufftables.Chain) {
+	prefix, key4, ok := parseChainName(target.Name)
+	if !ok {
+		return
+	}
+	f := Frontend{
+		Endpoints: endpoints(target),
+		Mode:      NFTablesMode,
+		Family:    nufftables.TableFamily(rule.Chain.Table.Family),
+		Table:     rule.Chain.Table.Name,
+		Chain:     rule.Chain.Name,
+		Handle:    rule.Handle,
+	}
+	switch len(key) {
+	case 3:
+		if l := len(key[0]); l != net.IPv4len && l != net.IPv6len {
+			return
+		}
+		f.Kind = ExternalIP
+		if prefix == "service" {
+			f.Kind = ClusterIP
+		}
+		f.IP = net.IP(key[0])
+		key = key[1:]
+	case 2:
+		f.Kind = NodePort
+	default:
+		return
+	}
+	if len(key[0]) != 1 || len(key[1]) != 2 {
+		return
+	}
+	f.Port = binary.BigEndian.Uint16(key[1])
+	if key4.protocol == "" {
+		key4.protocol = protocolName(key[0][0])
+	}
+	c.add(key4, f)
+}
+
+// parseChainName parses the name of a service chain into its prefix, such as
+// “service” or “external”, and the service port, with the chain name being in
+// the form of “prefix-HASH-namespace/name/protocol/portname”.
+func parseChainName(name string) (string, serviceKey, bool) {
+	prefix, rest, ok := strings.Cut(name, "-")
+	if !ok {
+		return "", serviceKey{}, false
+	}
+	if _, rest, ok = strings.Cut(rest, "-"); !ok {
+		return "", serviceKey{}, false
+	}
+	parts := strings.Split(rest, "/")
+	if len(parts) != 4 {
+		return "", serviceKey{}, false
+	}
+	return prefix, serviceKey{
+		namespace: parts[0],
+		name:      parts[1],
+		protocol:  parts[2],
+		port:      parts[3],
+	}, true
+}
+
+// protocolName returns the name of the specified transport protocol.
+func protocolName(proto byte) string {
+	switch proto {
+	case unix.IPPROTO_TCP:
+		return "tcp"
+	case unix.IPPROTO_UDP:
+		return "udp"
+	case unix.IPPROTO_SCTP:
+		return "sctp"
+	}
+	return ""
+}
@@ -0,0 +1,206 @@
+// Copyright 2023 Harald Albrecht.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy
+// of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package kubeproxy
+
+import (
+	"encoding/binary"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"github.com/thediveo/nufftables"
+	"github.com/thediveo/nufftables/nufftablestest"
+	"golang.org/x/sys/cpu"
+	"golang.org/x/sys/unix"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+// hostUint32 returns the specified value in host byte order, as used by
+// number generator map keys.
+func hostUint32(v uint32) []byte {
+	b := make([]byte, 4)
+	order := binary.ByteOrder(binary.LittleEndian)
+	if cpu.IsBigEndian {
+		order = binary.BigEndian
+	}
+	order.PutUint32(b, v)
+	return b
+}
+
+// gotoChain returns a goto verdict to the specified chain.
+func gotoChain(chain string) *expr.Verdict {
+	return &expr.Verdict{Kind: expr.VerdictGoto, Chain: chain}
+}
+
+var _ = Describe("kube-proxy in nftables mode", func() {
+
+	// nftablesMode returns a kube-proxy ruleset fixture in nftables mode with a
+	// “web” service having two endpoints and a “kube-dns” service with a
+	// single endpoint.
+	nftablesMode := func() nufftablestest.Ruleset {
+		const (
+			webService  = "service-HXUVQ5BM-default/web/tcp/http"
+			webExternal = "external-HXUVQ5BM-default/web/tcp/http"
+			webEp1      = "endpoint-OGK6EG5Y-default/web/tcp/http__10.244.1.5/8080"
+			webEp2      = "endpoint-QRNOZ5TJ-default/web/tcp/http__10.244.2.6/8080"
+			dnsService  = "service-ULMVA6XW-kube-system/kube-dns/udp/dns"
+			dnsEp       = "endpoint-5OJB2KTY-kube-system/kube-dns/udp/dns__10.244.0.2/53"
+		)
+		// numgen random mod <n> vmap { 0 : goto ..., 1 : goto ... }
+		numgenMap := func(name string, targets ...string) (nufftablestest.Set, nufftablestest.Rule) {
+			elements := []nftables.SetElement{}
+			for idx, target := range targets {
+				elements = append(elements, nftables.SetElement{
+					Key: hostUint32(uint32(idx)), VerdictData: gotoChain(target)})
+			}
+			return nufftablestest.Set{Name: name, Anonymous: true, IsMap: true,
+					KeyType: nftables.TypeInteger, DataType: nftables.TypeVerdict, Elements: elements},
+				nufftablestest.Rule{
+					&expr.Numgen{Register: 1, Modulus: uint32(len(targets)), Type: unix.NFT_NG_RANDOM},
+					&expr.Lookup{SourceRegister: 1, DestRegister: unix.NFT_REG_VERDICT, IsDestRegSet: true, SetName: name},
+				}
+		}
+		webMap, webDispatch := numgenMap("web-endpoints", webEp1, webEp2)
+		dnsMap, dnsDispatch := numgenMap("dns-endpoints", dnsEp)
+
+		dnat := func(name string, port uint16, addr ...byte) nufftablestest.Chain {
+			return nufftablestest.Chain{Name: name, Rules: []nufftablestest.Rule{
+				{
+					&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: 12, Len: 4},
+					&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: addr},
+					jump("mark-for-masquerade"),
+				},
+				{
+					&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
+					&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{unix.IPPROTO_TCP}},
+					&expr.Immediate{Register: 1, Data: addr},
+					&expr.Immediate{Register: 2, Data: []byte{byte(port >> 8), byte(port)}},
+					&expr.NAT{Type: expr.NATTypeDestNAT, Family: unix.NFPROTO_IPV4, RegAddrMin: 1, RegProtoMin: 2},
+				},
+			}}
+		}
+
+		return nufftablestest.Ruleset{{
+			Name:   "kube-proxy",
+			Family: nftables.TableFamilyIPv4,
+			Sets: []nufftablestest.Set{
+				{
+					Name: "service-ips", IsMap: true,
+					KeyType: nftables.MustConcatSetType(
+						nftables.TypeIPAddr, nftables.TypeInetProto, nftables.TypeInetService),
+					DataType: nftables.TypeVerdict,
+					Elements: []nftables.SetElement{
+						{Key: []byte{10, 96, 0, 1, 6, 0, 0, 0, 0, 80, 0, 0}, VerdictData: gotoChain(webService)},
+						{Key: []byte{10, 96, 0, 10, 17, 0, 0, 0, 0, 53, 0, 0}, VerdictData: gotoChain(dnsService)},
+						{Key: []byte{203, 0, 113, 5, 6, 0, 0, 0, 0, 80, 0, 0}, VerdictData: gotoChain(webExternal)},
+					},
+				},
+				{
+					Name: "service-nodeports", IsMap: true,
+					KeyType:  nftables.MustConcatSetType(nftables.TypeInetProto, nftables.TypeInetService),
+					DataType: nftables.TypeVerdict,
+					Elements: []nftables.SetElement{
+						{Key: []byte{6, 0, 0, 0, 0x75, 0x80, 0, 0}, VerdictData: gotoChain(webExternal)},
+					},
+				},
+				webMap,
+				dnsMap,
+			},
+			Chains: []nufftablestest.Chain{
+				{Name: "services", Rules: []nufftablestest.Rule{
+					// ip daddr . meta l4proto . th dport vmap @service-ips
+					{
+						&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: 16, Len: 4},
+						&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: unix.NFT_REG32_01},
+						&expr.Payload{DestRegister: unix.NFT_REG32_02, Base: expr.PayloadBaseTransportHeader, Offset: 2, Len: 2},
+						&expr.Lookup{SourceRegister: 1, DestRegister: unix.NFT_REG_VERDICT, IsDestRegSet: true, SetName: "service-ips"},
+					},
+					// meta l4proto . th dport vmap @service-nodeports
+					{
+						&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
+						&expr.Payload{DestRegister: unix.NFT_REG32_01, Base: expr.PayloadBaseTransportHeader, Offset: 2, Len: 2},
+						&expr.Lookup{SourceRegister: 1, DestRegister: unix.NFT_REG_VERDICT, IsDestRegSet: true, SetName: "service-nodeports"},
+					},
+				}},
+				{Name: "mark-for-masquerade"},
+				{Name: webExternal, Rules: []nufftablestest.Rule{
+					{jump("mark-for-masquerade")},
+					{gotoChain(webService)},
+				}},
+				{Name: webService, Rules: []nufftablestest.Rule{
+					{
+						&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: 12, Len: 4},
+						&expr.Cmp{Op: expr.CmpOpNeq, Register: 1, Data: []byte{10, 244, 0, 0}},
+						jump("mark-for-masquerade"),
+					},
+					webDispatch,
+				}},
+				{Name: dnsService, Rules: []nufftablestest.Rule{dnsDispatch}},
+				dnat(webEp1, 8080, 10, 244, 1, 5),
+				dnat(webEp2, 8080, 10, 244, 2, 6),
+				dnat(dnsEp, 53, 10, 244, 0, 2),
+			},
+		}}
+	}
+
+	DescribeTable("reconstructs services",
+		func(conn func(nufftablestest.Ruleset) nufftables.Conn) {
+			tables, err := nufftables.GetAllTables(conn(nftablesMode()))
+			Expect(err).NotTo(HaveOccurred())
+			services := Services(tables)
+			Expect(services).To(HaveLen(2))
+
+			Expect(services[0].String()).To(Equal("default/web:http tcp"))
+			Expect(services[0].Frontends).To(HaveLen(3))
+			Expect(services[0].Frontends[0].String()).To(Equal(
+				"cluster IP 10.96.0.1:80 to 10.244.1.5:8080 (50%), 10.244.2.6:8080 (50%)"))
+			Expect(services[0].Frontends[1].String()).To(Equal(
+				"node port 30080 to 10.244.1.5:8080 (50%), 10.244.2.6:8080 (50%)"))
+			Expect(services[0].Frontends[2].String()).To(Equal(
+				"external IP 203.0.113.5:80 to 10.244.1.5:8080 (50%), 10.244.2.6:8080 (50%)"))
+			Expect(services[0].Frontends[0].Mode).To(Equal(NFTablesMode))
+			Expect(services[0].Frontends[0].Chain).To(Equal("services"))
+
+			Expect(services[1].String()).To(Equal("kube-system/kube-dns:dns udp"))
+			Expect(services[1].Frontends).To(HaveLen(1))
+			Expect(services[1].Frontends[0].String()).To(Equal(
+				"cluster IP 10.96.0.10:53 to 10.244.0.2:53 (100%)"))
+		},
+		Entry("in memory", func(fixture nufftablestest.Ruleset) nufftables.Conn {
+			conn := nufftables.NewMemConn()
+			Expect(fixture.Apply(conn)).To(Succeed())
+			return conn
+		}),
+		Entry("read from the kernel", func(fixture nufftablestest.Ruleset) nufftables.Conn {
+			return nufftablestest.NewConn(fixture)
+		}),
+	)
+
+	It("parses chain names", func() {
+		prefix, key, ok := parseChainName("service-ULMVA6XW-kube-system/kube-dns/udp/dns")
+		Expect(ok).To(BeTrue())
+		Expect(prefix).To(Equal("service"))
+		Expect(key).To(Equal(serviceKey{namespace: "kube-system", name: "kube-dns", protocol: "udp", port: "dns"}))
+
+		_, _, ok = parseChainName("services")
+		Expect(ok).To(BeFalse())
+		_, _, ok = parseChainName("mark-for-masquerade")
+		Expect(ok).To(BeFalse())
+		_, _, ok = parseChainName("service-ULMVA6XW-kube-system/kube-dns")
+		Expect(ok).To(BeFalse())
+	})
+
+})
@@ -0,0 +1,282 @@
+// Copyright 2023 Harald Albrecht.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy
+// of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package kubeproxy
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/thediveo/nufftables"
+	"github.com/thediveo/nufftables/portfinder"
+	"golang.org/x/exp/slices"
+)
+
+// Mode is the proxy mode of kube-proxy.
+type Mode int
+
+// Proxy modes of kube-proxy.
+const (
+	IPTablesMode Mode = iota // “iptables” mode, using iptables-nft
+	NFTablesMode             // “nftables” mode
+)
+
+// String returns the name of the proxy mode, such as “iptables”.
+func (m Mode) String() string {
+	switch m {
+	case IPTablesMode:
+		return "iptables"
+	case NFTablesMode:
+		return "nftables"
+	}
+	return "?"
+}
+
+// FrontendKind is the kind of address a service can be reached at.
+type FrontendKind int
+
+// Kinds of service frontends.
+const (
+	ClusterIP      FrontendKind = iota // the service's virtual cluster IP
+	NodePort                           // a port on all local node addresses
+	ExternalIP                         // an external IP routed to the node
+	LoadBalancerIP                     // the ingress IP of a load balancer
+)
+
+// String returns the frontend kind in the same notation as kube-proxy's rule
+// comments, such as “cluster IP” and “loadbalancer IP”.
+func (k FrontendKind) String() string {
+	switch k {
+	case ClusterIP:
+		return "cluster IP"
+	case NodePort:
+		return "node port"
+	case ExternalIP:
+		return "external IP"
+	case LoadBalancerIP:
+		return "loadbalancer IP"
+	}
+	return "?"
+}
+
+// Service is a port of a Kubernetes service, identified by the service's
+// namespace and name, as well as the port name and protocol, together with
+// the frontends the service port can be reached at.
+type Service struct {
+	Namespace string
+	Name      string
+	PortName  string // empty for unnamed ports.
+	Protocol  string // such as "tcp", "udp", and "sctp".
+	Frontends []Frontend
+}
+
+// Frontend is an address and port a service port can be reached at, together
+// with the endpoints the traffic gets forwarded to and their shares of the
+// traffic.
+type Frontend struct {
+	Kind FrontendKind
+	// IP is the frontend's address; it is nil for node ports, which are
+	// available on all local addresses.
+	IP        net.IP
+	Port      uint16
+	Endpoints []portfinder.Endpoint
+	// Mode is the proxy mode, and Family, Table, Chain, and Handle reference
+	// the rule the frontend has been found in, such as the rule jumping from
+	// the “KUBE-SERVICES” chain or the rule looking up the “service-ips”
+	// verdict map in the “services” chain.
+	Mode   Mode
+	Family nufftables.TableFamily
+	Table  string
+	Chain  string
+	Handle uint64
+}
+
+// String returns the service port in kube-proxy's notation, such as
+// “kube-system/kube-dns:dns”, followed by the protocol, such as
+// “kube-system/kube-dns:dns udp”.
+func (s *Service) String() string {
+	name := s.Namespace + "/" + s.Name
+	if s.PortName != "" {
+		name += ":" + s.PortName
+	}
+	return name + " " + s.Protocol
+}
+
+// String returns the frontend in textual format, such as “cluster IP
+// 10.96.0.10:53 to 10.244.0.2:53 (50%), 10.244.0.3:53 (50%)”.
+func (f Frontend) String() string {
+	s := f.Kind.String() + " "
+	if f.IP != nil {
+		s += net.JoinHostPort(f.IP.String(), fmt.Sprint(f.Port))
+	} else {
+		s += fmt.Sprint(f.Port)
+	}
+	if len(f.Endpoints) == 0 {
+		return s + " without endpoints"
+	}
+	eps := make([]string, 0, len(f.Endpoints))
+	for _, ep := range f.Endpoints {
+		eps = append(eps, ep.String())
+	}
+	return s + " to " + strings.Join(eps, ", ")
+}
+
+// Forwards returns the frontends with endpoints as port forwardings, with
+// node ports forwarding from the unspecified address. In case of a single
+// endpoint, Endpoints of the port forwarding is nil.
+func (s *Service) Forwards() []portfinder.ForwardedPortRange {
+	fwds := make([]portfinder.ForwardedPortRange, 0, len(s.Frontends))
+	for _, f := range s.Frontends {
+		if len(f.Endpoints) == 0 {
+			continue
+		}
+		ip := f.IP
+		if ip == nil {
+			ip = net.IPv6zero
+			if f.Family != nufftables.TableFamilyIPv6 {
+				ip = net.IPv4zero.To4()
+			}
+		}
+		ep := f.Endpoints[0]
+		fwd := portfinder.ForwardedPortRange{
+			Protocol:       s.Protocol,
+			IP:             ip,
+			PortMin:        f.Port,
+			PortMax:        f.Port,
+			ForwardIP:      ep.IP,
+			ForwardIPMax:   ep.IP,
+			ForwardPortMin: ep.Port,
+			ForwardPortMax: ep.Port,
+			Family:         f.Family,
+			Table:          f.Table,
+			Chain:          f.Chain,
+			Handle:         f.Handle,
+		}
+		if len(f.Endpoints) > 1 {
+			fwd.Endpoints = f.Endpoints
+		}
+		fwds = append(fwds, fwd)
+	}
+	return fwds
+}
+
+// Services returns the service ports found in kube-proxy's tables of the
+// specified tables, regardless of whether kube-proxy runs in iptables or
+// nftables mode. The services are sorted by namespace, name, port name, and
+// protocol, with their frontends sorted by kind, address, and port.
+//
+// In iptables mode, Services follows the “KUBE-SERVICES” and
+// “KUBE-NODEPORTS” chains of the “nat” tables to the “KUBE-SVC-*”,
+// “KUBE-SVL-*”, “KUBE-EXT-*”, and “KUBE-FW-*” chains and finally the
+// “KUBE-SEP-*” endpoint chains, taking the probabilities of the xt
+// “statistic” matches into account. The service port names are taken from
+// the rule comments.
+//
+// In nftables mode, Services resolves the “service-ips” and
+// “service-nodeports” verdict maps of the “kube-proxy” tables, following the
+// “service-*” and “external-*” chains to the “endpoint-*” chains. The service
+// port names are taken from the chain names, and the shares of the endpoints
+// from the number generator verdict maps dispatching to them.
+func Services(tables nufftables.TableMap) []*Service {
+	c := collector{services: map[serviceKey]*Service{}}
+	for _, table := range sortedTables(tables) {
+		switch nufftables.TableFamily(table.Family) {
+		case nufftables.TableFamilyIPv4, nufftables.TableFamilyIPv6:
+		default:
+			continue
+		}
+		iptablesServices(&c, table)
+		nftablesServices(&c, table)
+	}
+	services := make([]*Service, 0, len(c.services))
+	for _, svc := range c.services {
+		slices.SortFunc(svc.Frontends, frontendOrder)
+		services = append(services, svc)
+	}
+	slices.SortFunc(services, func(a, b *Service) int {
+		if c := strings.Compare(a.Namespace, b.Namespace); c != 0 {
+			return c
+		}
+		if c := strings.Compare(a.Name, b.Name); c != 0 {
+			return c
+		}
+		if c := strings.Compare(a.PortName, b.PortName); c != 0 {
+			return c
+		}
+		return strings.Compare(a.Protocol, b.Protocol)
+	})
+	return services
+}
+
+// frontendOrder orders frontends by kind, then IPv4 before IPv6 addresses,
+// address, and finally port.
+func frontendOrder(a, b Frontend) int {
+	if c := int(a.Kind) - int(b.Kind); c != 0 {
+		return c
+	}
+	av4, bv4 := a.IP.To4() != nil, b.IP.To4() != nil
+	if av4 != bv4 {
+		if av4 {
+			return -1
+		}
+		return 1
+	}
+	if c := bytes.Compare(a.IP, b.IP); c != 0 {
+		return c
+	}
+	return int(a.Port) - int(b.Port)
+}
+
+// sortedTables returns the specified tables ordered by family and name.
+func sortedTables(tables nufftables.TableMap) []*nufftables.Table {
+	sorted := make([]*nufftables.Table, 0, len(tables))
+	for _, table := range tables {
+		sorted = append(sorted, table)
+	}
+	slices.SortFunc(sorted, func(a, b *nufftables.Table) int {
+		if c := int(a.Family) - int(b.Family); c != 0 {
+			return c
+		}
+		return strings.Compare(a.Name, b.Name)
+	})
+	return sorted
+}
+
+// serviceKey identifies a service port.
+type serviceKey struct {
+	namespace, name, port, protocol string
+}
+
+// collector collects the frontends of service ports.
+type collector struct {
+	services map[serviceKey]*Service
+}
+
+// add adds the frontend to the specified service port, creating the service
+// port as necessary.
+func (c *collector) add(key serviceKey, f Frontend) {
+	svc, ok := c.services[key]
+	if !ok {
+		svc = &Service{
+			Namespace: key.namespace,
+			Name:      key.name,
+			PortName:  key.port,
+			Protocol:  key.protocol,
+		}
+		c.services[key] = svc
+	}
+	svc.Frontends = append(svc.Frontends, f)
+}
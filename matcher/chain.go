@@ -0,0 +1,161 @@
+// Copyright 2023 Harald Albrecht.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy
+// of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package matcher
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/google/nftables"
+	"github.com/onsi/gomega/types"
+	"github.com/thediveo/nufftables"
+)
+
+// ChainOption additionally constrains the chains accepted by [HaveChain].
+type ChainOption func(*haveChainMatcher)
+
+// WithType constrains [HaveChain] to chains of the specified type, such as
+// [nftables.ChainTypeNAT].
+func WithType(typ nftables.ChainType) ChainOption {
+	return func(m *haveChainMatcher) { m.typ = &typ }
+}
+
+// WithHook constrains [HaveChain] to (base) chains attached to the specified
+// hook, such as [nftables.ChainHookPrerouting].
+func WithHook(hook *nftables.ChainHook) ChainOption {
+	return func(m *haveChainMatcher) { m.hook = hook }
+}
+
+// WithPriority constrains [HaveChain] to (base) chains with the specified
+// priority, such as [nftables.ChainPriorityNATDest].
+func WithPriority(prio *nftables.ChainPriority) ChainOption {
+	return func(m *haveChainMatcher) { m.prio = prio }
+}
+
+// WithPolicy constrains [HaveChain] to (base) chains with the specified
+// policy, such as [nftables.ChainPolicyDrop].
+func WithPolicy(policy nftables.ChainPolicy) ChainOption {
+	return func(m *haveChainMatcher) { m.policy = &policy }
+}
+
+// HaveChain succeeds if actual is a [*nufftables.Table] containing the named
+// chain, optionally additionally satisfying the specified type, hook,
+// priority and policy options.
+func HaveChain(name string, opts ...ChainOption) types.GomegaMatcher {
+	m := &haveChainMatcher{name: name}
+	for _, opt := range opts {
+		opt(m)
+	}
+	return m
+}
+
+type haveChainMatcher struct {
+	name   string
+	typ    *nftables.ChainType
+	hook   *nftables.ChainHook
+	prio   *nftables.ChainPriority
+	policy *nftables.ChainPolicy
+}
+
+func (m *haveChainMatcher) Match(actual interface{}) (bool, error) {
+	table, ok := actual.(*nufftables.Table)
+	if !ok || table == nil {
+		return false, fmt.Errorf("HaveChain expects a non-nil *nufftables.Table, got %T", actual)
+	}
+	chain, ok := table.ChainsByName[m.name]
+	if !ok {
+		return false, nil
+	}
+	if m.typ != nil && chain.Type != *m.typ {
+		return false, nil
+	}
+	if m.hook != nil && (chain.Hooknum == nil || *chain.Hooknum != *m.hook) {
+		return false, nil
+	}
+	if m.prio != nil && (chain.Priority == nil || *chain.Priority != *m.prio) {
+		return false, nil
+	}
+	if m.policy != nil && (chain.Policy == nil || *chain.Policy != *m.policy) {
+		return false, nil
+	}
+	return true, nil
+}
+
+func (m *haveChainMatcher) FailureMessage(actual interface{}) string {
+	return fmt.Sprintf("Expected table with chains\n%s\nto contain chain %s",
+		chainDescriptions(actual), m.description())
+}
+
+func (m *haveChainMatcher) NegatedFailureMessage(actual interface{}) string {
+	return fmt.Sprintf("Expected table with chains\n%s\nnot to contain chain %s",
+		chainDescriptions(actual), m.description())
+}
+
+// description returns the name of the expected chain together with any
+// additional constraints.
+func (m *haveChainMatcher) description() string {
+	desc := fmt.Sprintf("%q", m.name)
+	if m.typ != nil {
+		desc += fmt.Sprintf(" type %s", *m.typ)
+	}
+	if m.hook != nil {
+		desc += " hook " + nufftables.ChainHook(*m.hook).Name(nufftables.TableFamilyUnspecified)
+	}
+	if m.prio != nil {
+		desc += fmt.Sprintf(" priority %d", *m.prio)
+	}
+	if m.policy != nil {
+		desc += " policy " + policyName(*m.policy)
+	}
+	return desc
+}
+
+// chainDescriptions returns the (sorted) descriptions of the chains of the
+// specified table, one per line and indented.
+func chainDescriptions(actual interface{}) string {
+	table, _ := actual.(*nufftables.Table)
+	if table == nil || len(table.ChainsByName) == 0 {
+		return "    (no chains)"
+	}
+	descs := make([]string, 0, len(table.ChainsByName))
+	for _, chain := range table.ChainsByName {
+		desc := fmt.Sprintf("    %q", chain.Name)
+		if chain.Hooknum != nil {
+			desc += fmt.Sprintf(" type %s hook %s", chain.Type,
+				nufftables.ChainHook(*chain.Hooknum).Name(nufftables.TableFamily(table.Family)))
+			if chain.Priority != nil {
+				desc += fmt.Sprintf(" priority %d", *chain.Priority)
+			}
+			if chain.Policy != nil {
+				desc += " policy " + policyName(*chain.Policy)
+			}
+		}
+		descs = append(descs, desc)
+	}
+	sort.Strings(descs)
+	return strings.Join(descs, "\n")
+}
+
+// policyName returns the name of the specified chain policy.
+func policyName(policy nftables.ChainPolicy) string {
+	switch policy {
+	case nftables.ChainPolicyAccept:
+		return "accept"
+	case nftables.ChainPolicyDrop:
+		return "drop"
+	}
+	return fmt.Sprintf("%d", policy)
+}
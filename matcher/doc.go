@@ -0,0 +1,30 @@
+/*
+Package matcher provides Gomega matchers for nufftables objects, such as tables,
+chains, rules, and expressions.
+
+  - [HaveTable] succeeds if a [nufftables.TableMap] contains the specified
+    table.
+  - [HaveChain] succeeds if a [nufftables.Table] contains the specified chain,
+    optionally additionally checking the chain's type, hook, priority and
+    policy.
+  - [HaveRuleMatching] succeeds if a [nufftables.Chain] contains a rule
+    satisfying a particular matcher.
+  - [HaveExpressionSequence] succeeds if the expressions of a rule contain the
+    specified sequence of expressions.
+  - [ForwardPort] succeeds if the rules of a [nufftables.TableMap] forward a
+    particular port.
+
+For instance:
+
+	Expect(tables.Table("nat", nufftables.TableFamilyIPv4)).To(
+	  HaveChain("PREROUTING", WithHook(nftables.ChainHookPrerouting)))
+	Expect(tables.TableChain("nat", nufftables.TableFamilyIPv4, "DOCKER")).To(
+	  HaveRuleMatching(HaveExpressionSequence(
+	    BeAssignableToTypeOf(&expr.Match{}),
+	    BeAssignableToTypeOf(&expr.Target{}))))
+	Expect(tables).To(ForwardPort("tcp", 8080, "172.17.0.2", 80))
+
+Failure messages render the offending rules in nft's netlink debug syntax, as
+also shown by “nft --debug=netlink list ruleset”.
+*/
+package matcher
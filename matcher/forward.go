@@ -0,0 +1,119 @@
+// Copyright 2023 Harald Albrecht.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy
+// of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package matcher
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/onsi/gomega/types"
+	"github.com/thediveo/nufftables"
+	"github.com/thediveo/nufftables/portfinder"
+	"golang.org/x/exp/slices"
+)
+
+// ForwardPort succeeds if actual is a [nufftables.TableMap] with a rule
+// forwarding the specified protocol and (original destination) port to the
+// specified IP address and port. The port matches if it is inside a forwarded
+// port range, taking port range shifts into account, and the IP address and
+// port match either the destination or any of the load-balanced endpoints.
+func ForwardPort(protocol string, port uint16, forwardIP string, forwardPort uint16) types.GomegaMatcher {
+	return &forwardPortMatcher{
+		protocol:    protocol,
+		port:        port,
+		forwardIP:   net.ParseIP(forwardIP),
+		forwardPort: forwardPort,
+	}
+}
+
+type forwardPortMatcher struct {
+	protocol    string
+	port        uint16
+	forwardIP   net.IP
+	forwardPort uint16
+}
+
+func (m *forwardPortMatcher) Match(actual interface{}) (bool, error) {
+	tables, ok := actual.(nufftables.TableMap)
+	if !ok {
+		return false, fmt.Errorf("ForwardPort expects a nufftables.TableMap, got %T", actual)
+	}
+	if m.forwardIP == nil {
+		return false, fmt.Errorf("ForwardPort expects a valid IP address to forward to")
+	}
+	for _, fp := range forwardedPorts(tables) {
+		if fp.Protocol != m.protocol || m.port < fp.PortMin || m.port > fp.PortMax {
+			continue
+		}
+		if fp.ForwardIP.Equal(m.forwardIP) && fp.TargetPort(m.port) == m.forwardPort {
+			return true, nil
+		}
+		for _, ep := range fp.Endpoints {
+			if ep.IP.Equal(m.forwardIP) && ep.Port == m.forwardPort {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+func (m *forwardPortMatcher) FailureMessage(actual interface{}) string {
+	return fmt.Sprintf("Expected port forwardings\n%s\nto forward %s",
+		forwardedPortsText(actual), m.description())
+}
+
+func (m *forwardPortMatcher) NegatedFailureMessage(actual interface{}) string {
+	return fmt.Sprintf("Expected port forwardings\n%s\nnot to forward %s",
+		forwardedPortsText(actual), m.description())
+}
+
+// description returns the expected port forwarding in textual form.
+func (m *forwardPortMatcher) description() string {
+	return fmt.Sprintf("%s port %d to %s",
+		m.protocol, m.port, net.JoinHostPort(m.forwardIP.String(), fmt.Sprint(m.forwardPort)))
+}
+
+// forwardedPorts returns the forwarded ports found in all rules of all chains of
+// all tables in the specified TableMap, sorted by [portfinder.ForwardedPortOrder].
+func forwardedPorts(tables nufftables.TableMap) []*portfinder.ForwardedPortRange {
+	fps := []*portfinder.ForwardedPortRange{}
+	for _, table := range tables {
+		for _, chain := range table.ChainsByName {
+			for _, rule := range chain.Rules {
+				if fp := portfinder.ForwardedPort(rule); fp != nil {
+					fps = append(fps, fp)
+				}
+			}
+		}
+	}
+	slices.SortFunc(fps, portfinder.ForwardedPortOrder)
+	return fps
+}
+
+// forwardedPortsText returns the forwarded ports found in the passed TableMap
+// in textual form, one per line and indented.
+func forwardedPortsText(actual interface{}) string {
+	tables, _ := actual.(nufftables.TableMap)
+	fps := forwardedPorts(tables)
+	if len(fps) == 0 {
+		return "    (no port forwardings)"
+	}
+	lines := make([]string, 0, len(fps))
+	for _, fp := range fps {
+		lines = append(lines, "    "+fp.String())
+	}
+	return strings.Join(lines, "\n")
+}
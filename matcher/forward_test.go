@@ -0,0 +1,47 @@
+// Copyright 2023 Harald Albrecht.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy
+// of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package matcher
+
+import (
+	"github.com/thediveo/nufftables"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("port forwarding matcher", func() {
+
+	It("matches forwarded ports", func() {
+		tables := tableMap()
+		Expect(tables).To(ForwardPort("tcp", 8080, "172.17.0.2", 80))
+		Expect(tables).NotTo(ForwardPort("udp", 8080, "172.17.0.2", 80))
+		Expect(tables).NotTo(ForwardPort("tcp", 8081, "172.17.0.2", 80))
+		Expect(tables).NotTo(ForwardPort("tcp", 8080, "172.17.0.3", 80))
+		Expect(tables).NotTo(ForwardPort("tcp", 8080, "172.17.0.2", 81))
+
+		Expect(ForwardPort("tcp", 8080, "172.17.0.2", 81).FailureMessage(tables)).To(Equal(
+			`Expected port forwardings
+    forwarding tcp from 0.0.0.0:8080 to 172.17.0.2:80 managed by docker (ip nat DOCKER handle 2)
+to forward tcp port 8080 to 172.17.0.2:81`))
+		Expect(ForwardPort("tcp", 8080, "172.17.0.2", 81).FailureMessage(nufftables.TableMap{})).To(
+			ContainSubstring("(no port forwardings)"))
+
+		_, err := ForwardPort("tcp", 8080, "foo", 80).Match(tables)
+		Expect(err).To(HaveOccurred())
+		_, err = ForwardPort("tcp", 8080, "172.17.0.2", 80).Match(nil)
+		Expect(err).To(HaveOccurred())
+	})
+
+})
@@ -0,0 +1,96 @@
+// Copyright 2023 Harald Albrecht.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy
+// of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package matcher
+
+import (
+	"net"
+	"testing"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"github.com/google/nftables/xt"
+	"github.com/thediveo/nufftables"
+	"github.com/thediveo/nufftables/nufftablestest"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+func TestNamespaceTypes(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "nufftables/matcher package")
+}
+
+// ruleset is an (iptables-nft-like) ruleset with a port forwarding from tcp
+// port 8080 to 172.17.0.2:80.
+var ruleset = nufftablestest.Ruleset{
+	{
+		Name:   "nat",
+		Family: nftables.TableFamilyIPv4,
+		Chains: []nufftablestest.Chain{
+			{
+				Name:     "PREROUTING",
+				Type:     nftables.ChainTypeNAT,
+				Hook:     nftables.ChainHookPrerouting,
+				Priority: nftables.ChainPriorityNATDest,
+				Policy:   policyRef(nftables.ChainPolicyAccept),
+				Rules: []nufftablestest.Rule{
+					{
+						&expr.Counter{},
+						&expr.Verdict{Kind: expr.VerdictJump, Chain: "DOCKER"},
+					},
+				},
+			},
+			{
+				Name: "DOCKER",
+				Rules: []nufftablestest.Rule{
+					{
+						&expr.Match{
+							Name: "tcp",
+							Info: &xt.Tcp{DstPorts: [2]uint16{8080, 8080}},
+						},
+						&expr.Counter{},
+						&expr.Target{
+							Name: "DNAT",
+							Rev:  2,
+							Info: &xt.NatRange2{
+								NatRange: xt.NatRange{
+									Flags:   uint(xt.NatRangeMapIPs | xt.NatRangeProtoSpecified),
+									MinIP:   net.ParseIP("172.17.0.2").To4(),
+									MaxIP:   net.ParseIP("172.17.0.2").To4(),
+									MinPort: 80,
+									MaxPort: 80,
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+	},
+}
+
+func policyRef(p nftables.ChainPolicy) *nftables.ChainPolicy {
+	return &p
+}
+
+// tableMap returns the TableMap for the ruleset fixture.
+func tableMap() nufftables.TableMap {
+	conn := nufftables.NewMemConn()
+	Expect(ruleset.Apply(conn)).To(Succeed())
+	tables, err := nufftables.GetAllTables(conn)
+	Expect(err).NotTo(HaveOccurred())
+	return tables
+}
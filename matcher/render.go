@@ -0,0 +1,350 @@
+// Copyright 2023 Harald Albrecht.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy
+// of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package matcher
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+
+	"github.com/google/nftables/expr"
+	"github.com/thediveo/nufftables"
+)
+
+// renderChain renders all rules of the specified chain in nft's netlink debug
+// syntax, indented by the specified number of spaces.
+func renderChain(chain *nufftables.Chain, indent uint) string {
+	if len(chain.Rules) == 0 {
+		return strings.Repeat(" ", int(indent)) + "(no rules)"
+	}
+	rules := make([]string, 0, len(chain.Rules))
+	for idx := range chain.Rules {
+		rules = append(rules, renderRule(&chain.Rules[idx], indent))
+	}
+	return strings.Join(rules, "\n")
+}
+
+// renderRule renders the specified rule in nft's netlink debug syntax,
+// indented by the specified number of spaces. The first line identifies the
+// rule by its table family, table name, chain name, and handle, followed by
+// the rule's expressions, one per line.
+func renderRule(rule *nufftables.Rule, indent uint) string {
+	indentation := strings.Repeat(" ", int(indent))
+	var b strings.Builder
+	b.WriteString(indentation)
+	switch {
+	case rule.Chain != nil && rule.Chain.Table != nil:
+		fmt.Fprintf(&b, "%s %s %s ",
+			nufftables.TableFamily(rule.Chain.Table.Family),
+			rule.Chain.Table.Name, rule.Chain.Name)
+	case rule.Rule.Table != nil && rule.Rule.Chain != nil:
+		fmt.Fprintf(&b, "%s %s %s ",
+			nufftables.TableFamily(rule.Rule.Table.Family),
+			rule.Rule.Table.Name, rule.Rule.Chain.Name)
+	}
+	fmt.Fprintf(&b, "handle %d", rule.Handle)
+	for _, e := range rule.Exprs {
+		b.WriteString("\n")
+		b.WriteString(indentation)
+		b.WriteString("  ")
+		b.WriteString(renderExpr(e))
+	}
+	return b.String()
+}
+
+// renderExprs renders the specified expressions in nft's netlink debug syntax,
+// one expression per line, indented by the specified number of spaces.
+func renderExprs(exprs nufftables.Expressions, indent uint) string {
+	indentation := strings.Repeat(" ", int(indent))
+	lines := make([]string, 0, len(exprs))
+	for _, e := range exprs {
+		lines = append(lines, indentation+renderExpr(e))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// renderExpr renders a single expression in nft's netlink debug syntax.
+func renderExpr(e expr.Any) string {
+	return "[ " + exprText(e) + " ]"
+}
+
+// exprText returns the textual representation of a single expression, without
+// the enclosing brackets.
+func exprText(e expr.Any) string {
+	switch e := e.(type) {
+	case *expr.Payload:
+		if e.OperationType == expr.PayloadWrite {
+			return fmt.Sprintf("payload write reg %d => %db @ %s + %d csum_type %d csum_off %d csum_flags 0x%x",
+				e.SourceRegister, e.Len, payloadBaseName(e.Base), e.Offset,
+				e.CsumType, e.CsumOffset, e.CsumFlags)
+		}
+		return fmt.Sprintf("payload load %db @ %s + %d => reg %d",
+			e.Len, payloadBaseName(e.Base), e.Offset, e.DestRegister)
+	case *expr.Meta:
+		if e.SourceRegister {
+			return fmt.Sprintf("meta set %s with reg %d", metaKeyName(e.Key), e.Register)
+		}
+		return fmt.Sprintf("meta load %s => reg %d", metaKeyName(e.Key), e.Register)
+	case *expr.Ct:
+		if e.SourceRegister {
+			return fmt.Sprintf("ct set %s with reg %d", ctKeyName(e.Key), e.Register)
+		}
+		return fmt.Sprintf("ct load %s => reg %d", ctKeyName(e.Key), e.Register)
+	case *expr.Cmp:
+		return fmt.Sprintf("cmp %s reg %d %s", cmpOpName(e.Op), e.Register, hexWords(e.Data))
+	case *expr.Range:
+		return fmt.Sprintf("range %s reg %d %s %s",
+			cmpOpName(e.Op), e.Register, hexWords(e.FromData), hexWords(e.ToData))
+	case *expr.Bitwise:
+		return fmt.Sprintf("bitwise reg %d = ( reg %d & %s ) ^ %s",
+			e.DestRegister, e.SourceRegister, hexWords(e.Mask), hexWords(e.Xor))
+	case *expr.Byteorder:
+		op := "hton"
+		if e.Op == expr.ByteorderNtoh {
+			op = "ntoh"
+		}
+		return fmt.Sprintf("byteorder reg %d = %s(reg %d, %d, %d)",
+			e.DestRegister, op, e.SourceRegister, e.Size, e.Len)
+	case *expr.Lookup:
+		s := fmt.Sprintf("lookup reg %d set %s", e.SourceRegister, e.SetName)
+		if e.IsDestRegSet {
+			s += fmt.Sprintf(" dreg %d", e.DestRegister)
+		}
+		if e.Invert {
+			s += " 0x1"
+		}
+		return s
+	case *expr.Immediate:
+		return fmt.Sprintf("immediate reg %d %s", e.Register, hexWords(e.Data))
+	case *expr.Verdict:
+		return "immediate reg 0 " + verdictText(e)
+	case *expr.Counter:
+		return fmt.Sprintf("counter pkts %d bytes %d", e.Packets, e.Bytes)
+	case *expr.Match:
+		return fmt.Sprintf("match name %s rev %d", e.Name, e.Rev)
+	case *expr.Target:
+		return fmt.Sprintf("target name %s rev %d", e.Name, e.Rev)
+	case *expr.NAT:
+		s := "nat snat"
+		if e.Type == expr.NATTypeDestNAT {
+			s = "nat dnat"
+		}
+		s += " " + nufftables.TableFamily(e.Family).String()
+		if e.RegAddrMin != 0 {
+			s += fmt.Sprintf(" addr_min reg %d", e.RegAddrMin)
+		}
+		if e.RegAddrMax != 0 {
+			s += fmt.Sprintf(" addr_max reg %d", e.RegAddrMax)
+		}
+		if e.RegProtoMin != 0 {
+			s += fmt.Sprintf(" proto_min reg %d", e.RegProtoMin)
+		}
+		if e.RegProtoMax != 0 {
+			s += fmt.Sprintf(" proto_max reg %d", e.RegProtoMax)
+		}
+		return s
+	case *expr.Masq:
+		s := "masq"
+		if e.RegProtoMin != 0 {
+			s += fmt.Sprintf(" proto_min reg %d", e.RegProtoMin)
+		}
+		if e.RegProtoMax != 0 {
+			s += fmt.Sprintf(" proto_max reg %d", e.RegProtoMax)
+		}
+		return s
+	case *expr.Redir:
+		s := "redir"
+		if e.RegisterProtoMin != 0 {
+			s += fmt.Sprintf(" proto_min reg %d", e.RegisterProtoMin)
+		}
+		if e.RegisterProtoMax != 0 {
+			s += fmt.Sprintf(" proto_max reg %d", e.RegisterProtoMax)
+		}
+		return s
+	case *expr.Reject:
+		return fmt.Sprintf("reject type %d code %d", e.Type, e.Code)
+	case *expr.Log:
+		return fmt.Sprintf("log prefix %s", string(e.Data))
+	case *expr.Limit:
+		return fmt.Sprintf("limit rate %d/%d burst %d", e.Rate, e.Unit, e.Burst)
+	case *expr.Quota:
+		over := ""
+		if e.Over {
+			over = "over "
+		}
+		return fmt.Sprintf("quota bytes %s%d consumed %d", over, e.Bytes, e.Consumed)
+	case *expr.Dynset:
+		return fmt.Sprintf("dynset op %d reg_key %d set %s", e.Operation, e.SrcRegKey, e.SetName)
+	case *expr.Queue:
+		return fmt.Sprintf("queue num %d total %d flags 0x%x", e.Num, e.Total, e.Flag)
+	case *expr.Numgen:
+		return fmt.Sprintf("numgen reg %d mod %d type %d offset %d",
+			e.Register, e.Modulus, e.Type, e.Offset)
+	case *expr.Hash:
+		return fmt.Sprintf("hash reg %d = jhash(reg %d, %d, 0x%x) %% mod %d offset %d",
+			e.DestRegister, e.SourceRegister, e.Length, e.Seed, e.Modulus, e.Offset)
+	case *expr.Objref:
+		return fmt.Sprintf("objref type %d name %s", e.Type, e.Name)
+	case *expr.Notrack:
+		return "notrack"
+	}
+	return fmt.Sprintf("%T", e)
+}
+
+// verdictText returns the textual representation of a verdict, including the
+// chain for jump and goto verdicts.
+func verdictText(v *expr.Verdict) string {
+	switch v.Kind {
+	case expr.VerdictReturn:
+		return "return"
+	case expr.VerdictGoto:
+		return "goto -> " + v.Chain
+	case expr.VerdictJump:
+		return "jump -> " + v.Chain
+	case expr.VerdictBreak:
+		return "break"
+	case expr.VerdictContinue:
+		return "continue"
+	case expr.VerdictDrop:
+		return "drop"
+	case expr.VerdictAccept:
+		return "accept"
+	case expr.VerdictStolen:
+		return "stolen"
+	case expr.VerdictQueue:
+		return "queue"
+	case expr.VerdictRepeat:
+		return "repeat"
+	case expr.VerdictStop:
+		return "stop"
+	}
+	return fmt.Sprintf("verdict(%d)", v.Kind)
+}
+
+// hexWords renders data in form of 32bit words in host byte order, as done by
+// nft's netlink debug output, such as "0x0100007f" for the IPv4 address
+// 127.0.0.1.
+func hexWords(data []byte) string {
+	if len(data) == 0 {
+		return "0x00000000"
+	}
+	words := make([]string, 0, (len(data)+3)/4)
+	for idx := 0; idx < len(data); idx += 4 {
+		var word [4]byte
+		copy(word[:], data[idx:])
+		words = append(words, fmt.Sprintf("0x%08x", binary.LittleEndian.Uint32(word[:])))
+	}
+	return strings.Join(words, " ")
+}
+
+// payloadBaseName returns the name of the specified payload base.
+func payloadBaseName(base expr.PayloadBase) string {
+	switch base {
+	case expr.PayloadBaseLLHeader:
+		return "link header"
+	case expr.PayloadBaseNetworkHeader:
+		return "network header"
+	case expr.PayloadBaseTransportHeader:
+		return "transport header"
+	}
+	return fmt.Sprintf("base %d", base)
+}
+
+// cmpOpName returns the name of the specified compare operation.
+func cmpOpName(op expr.CmpOp) string {
+	switch op {
+	case expr.CmpOpEq:
+		return "eq"
+	case expr.CmpOpNeq:
+		return "neq"
+	case expr.CmpOpLt:
+		return "lt"
+	case expr.CmpOpLte:
+		return "lte"
+	case expr.CmpOpGt:
+		return "gt"
+	case expr.CmpOpGte:
+		return "gte"
+	}
+	return fmt.Sprintf("op(%d)", op)
+}
+
+// metaKeyNames maps meta keys to their names, as used by nft.
+var metaKeyNames = map[expr.MetaKey]string{
+	expr.MetaKeyLEN:        "len",
+	expr.MetaKeyPROTOCOL:   "protocol",
+	expr.MetaKeyPRIORITY:   "priority",
+	expr.MetaKeyMARK:       "mark",
+	expr.MetaKeyIIF:        "iif",
+	expr.MetaKeyOIF:        "oif",
+	expr.MetaKeyIIFNAME:    "iifname",
+	expr.MetaKeyOIFNAME:    "oifname",
+	expr.MetaKeyIIFTYPE:    "iiftype",
+	expr.MetaKeyOIFTYPE:    "oiftype",
+	expr.MetaKeySKUID:      "skuid",
+	expr.MetaKeySKGID:      "skgid",
+	expr.MetaKeyNFTRACE:    "nftrace",
+	expr.MetaKeyRTCLASSID:  "rtclassid",
+	expr.MetaKeySECMARK:    "secmark",
+	expr.MetaKeyNFPROTO:    "nfproto",
+	expr.MetaKeyL4PROTO:    "l4proto",
+	expr.MetaKeyBRIIIFNAME: "bri_iifname",
+	expr.MetaKeyBRIOIFNAME: "bri_oifname",
+	expr.MetaKeyPKTTYPE:    "pkttype",
+	expr.MetaKeyCPU:        "cpu",
+	expr.MetaKeyIIFGROUP:   "iifgroup",
+	expr.MetaKeyOIFGROUP:   "oifgroup",
+	expr.MetaKeyCGROUP:     "cgroup",
+	expr.MetaKeyPRANDOM:    "prandom",
+}
+
+// metaKeyName returns the name of the specified meta key.
+func metaKeyName(key expr.MetaKey) string {
+	if name, ok := metaKeyNames[key]; ok {
+		return name
+	}
+	return fmt.Sprintf("unknown(%d)", key)
+}
+
+// ctKeyNames maps conntrack keys to their names, as used by nft.
+var ctKeyNames = map[expr.CtKey]string{
+	expr.CtKeySTATE:      "state",
+	expr.CtKeyDIRECTION:  "direction",
+	expr.CtKeySTATUS:     "status",
+	expr.CtKeyMARK:       "mark",
+	expr.CtKeySECMARK:    "secmark",
+	expr.CtKeyEXPIRATION: "expiration",
+	expr.CtKeyHELPER:     "helper",
+	expr.CtKeyL3PROTOCOL: "l3protocol",
+	expr.CtKeySRC:        "src",
+	expr.CtKeyDST:        "dst",
+	expr.CtKeyPROTOCOL:   "protocol",
+	expr.CtKeyPROTOSRC:   "proto_src",
+	expr.CtKeyPROTODST:   "proto_dst",
+	expr.CtKeyLABELS:     "label",
+	expr.CtKeyPKTS:       "packets",
+	expr.CtKeyBYTES:      "bytes",
+	expr.CtKeyAVGPKT:     "avgpkt",
+	expr.CtKeyZONE:       "zone",
+	expr.CtKeyEVENTMASK:  "event",
+}
+
+// ctKeyName returns the name of the specified conntrack key.
+func ctKeyName(key expr.CtKey) string {
+	if name, ok := ctKeyNames[key]; ok {
+		return name
+	}
+	return fmt.Sprintf("unknown(%d)", key)
+}
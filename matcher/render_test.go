@@ -0,0 +1,54 @@
+// Copyright 2023 Harald Albrecht.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy
+// of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package matcher
+
+import (
+	"github.com/google/nftables/expr"
+	"github.com/thediveo/nufftables"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("rendering rules", func() {
+
+	DescribeTable("renders expressions in nft netlink debug syntax",
+		func(e expr.Any, expected string) {
+			Expect(renderExpr(e)).To(Equal(expected))
+		},
+		Entry(nil, &expr.Payload{Base: expr.PayloadBaseNetworkHeader, Offset: 16, Len: 4, DestRegister: 1},
+			"[ payload load 4b @ network header + 16 => reg 1 ]"),
+		Entry(nil, &expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{127, 0, 0, 1}},
+			"[ cmp eq reg 1 0x0100007f ]"),
+		Entry(nil, &expr.Cmp{Op: expr.CmpOpNeq, Register: 1, Data: []byte{0, 80}},
+			"[ cmp neq reg 1 0x00005000 ]"),
+		Entry(nil, &expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
+			"[ meta load l4proto => reg 1 ]"),
+		Entry(nil, &expr.Ct{Key: expr.CtKeySTATE, Register: 1},
+			"[ ct load state => reg 1 ]"),
+		Entry(nil, &expr.Lookup{SourceRegister: 1, SetName: "__set0", Invert: true},
+			"[ lookup reg 1 set __set0 0x1 ]"),
+		Entry(nil, &expr.Verdict{Kind: expr.VerdictGoto, Chain: "foo"},
+			"[ immediate reg 0 goto -> foo ]"),
+		Entry(nil, &expr.NAT{Type: expr.NATTypeDestNAT, Family: 2, RegAddrMin: 1, RegProtoMin: 2},
+			"[ nat dnat ip addr_min reg 1 proto_min reg 2 ]"),
+		Entry(nil, &expr.Notrack{}, "[ notrack ]"),
+	)
+
+	It("renders a chain without rules", func() {
+		Expect(renderChain(&nufftables.Chain{}, 2)).To(Equal("  (no rules)"))
+	})
+
+})
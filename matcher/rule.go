@@ -0,0 +1,147 @@
+// Copyright 2023 Harald Albrecht.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy
+// of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package matcher
+
+import (
+	"fmt"
+
+	"github.com/google/nftables/expr"
+	"github.com/onsi/gomega"
+	"github.com/onsi/gomega/format"
+	"github.com/onsi/gomega/types"
+	"github.com/thediveo/nufftables"
+)
+
+// HaveRuleMatching succeeds if actual is a [*nufftables.Chain] containing at
+// least one rule satisfying the specified matcher. The matcher gets passed
+// each rule as a [nufftables.Rule].
+func HaveRuleMatching(matcher types.GomegaMatcher) types.GomegaMatcher {
+	return &haveRuleMatchingMatcher{matcher: matcher}
+}
+
+type haveRuleMatchingMatcher struct {
+	matcher types.GomegaMatcher
+}
+
+func (m *haveRuleMatchingMatcher) Match(actual interface{}) (bool, error) {
+	chain, ok := actual.(*nufftables.Chain)
+	if !ok || chain == nil {
+		return false, fmt.Errorf("HaveRuleMatching expects a non-nil *nufftables.Chain, got %T", actual)
+	}
+	for _, rule := range chain.Rules {
+		success, err := m.matcher.Match(rule)
+		if err != nil {
+			return false, err
+		}
+		if success {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (m *haveRuleMatchingMatcher) FailureMessage(actual interface{}) string {
+	return fmt.Sprintf("Expected chain with rules\n%s\nto have a rule matching\n%s",
+		renderChain(actual.(*nufftables.Chain), 4), format.Object(m.matcher, 1))
+}
+
+func (m *haveRuleMatchingMatcher) NegatedFailureMessage(actual interface{}) string {
+	return fmt.Sprintf("Expected chain with rules\n%s\nnot to have a rule matching\n%s",
+		renderChain(actual.(*nufftables.Chain), 4), format.Object(m.matcher, 1))
+}
+
+// HaveExpressionSequence succeeds if actual is a [nufftables.Rule] (or a
+// pointer to it), or [nufftables.Expressions], with expressions containing the
+// specified sequence of elements in the order given. The matching expressions
+// don't need to be adjacent, so other expressions might come in between.
+//
+// An element can either be a matcher, such as [gomega.BeAssignableToTypeOf],
+// or an expression that must be equal to the matching expression.
+func HaveExpressionSequence(elements ...interface{}) types.GomegaMatcher {
+	matchers := make([]types.GomegaMatcher, 0, len(elements))
+	for _, element := range elements {
+		if matcher, ok := element.(types.GomegaMatcher); ok {
+			matchers = append(matchers, matcher)
+			continue
+		}
+		matchers = append(matchers, gomega.Equal(element))
+	}
+	return &haveExpressionSequenceMatcher{matchers: matchers}
+}
+
+type haveExpressionSequenceMatcher struct {
+	matchers []types.GomegaMatcher
+}
+
+func (m *haveExpressionSequenceMatcher) Match(actual interface{}) (bool, error) {
+	exprs, err := expressionsOf(actual)
+	if err != nil {
+		return false, err
+	}
+	next := 0
+	for _, e := range exprs {
+		if next == len(m.matchers) {
+			break
+		}
+		success, err := m.matchers[next].Match(e)
+		if err != nil {
+			return false, err
+		}
+		if success {
+			next++
+		}
+	}
+	return next == len(m.matchers), nil
+}
+
+func (m *haveExpressionSequenceMatcher) FailureMessage(actual interface{}) string {
+	return fmt.Sprintf("Expected\n%s\nto contain the expression sequence\n%s",
+		renderActual(actual), format.Object(m.matchers, 1))
+}
+
+func (m *haveExpressionSequenceMatcher) NegatedFailureMessage(actual interface{}) string {
+	return fmt.Sprintf("Expected\n%s\nnot to contain the expression sequence\n%s",
+		renderActual(actual), format.Object(m.matchers, 1))
+}
+
+// expressionsOf returns the expressions of the passed rule or expressions.
+func expressionsOf(actual interface{}) (nufftables.Expressions, error) {
+	switch actual := actual.(type) {
+	case nufftables.Rule:
+		return actual.Expressions(), nil
+	case *nufftables.Rule:
+		if actual != nil {
+			return actual.Expressions(), nil
+		}
+	case nufftables.Expressions:
+		return actual, nil
+	case []expr.Any:
+		return nufftables.Expressions(actual), nil
+	}
+	return nil, fmt.Errorf("expects a nufftables.Rule or nufftables.Expressions, got %T", actual)
+}
+
+// renderActual renders the passed rule or expressions in nft's netlink debug
+// syntax.
+func renderActual(actual interface{}) string {
+	switch actual := actual.(type) {
+	case nufftables.Rule:
+		return renderRule(&actual, 4)
+	case *nufftables.Rule:
+		return renderRule(actual, 4)
+	}
+	exprs, _ := expressionsOf(actual)
+	return renderExprs(exprs, 4)
+}
@@ -0,0 +1,75 @@
+// Copyright 2023 Harald Albrecht.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy
+// of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package matcher
+
+import (
+	"github.com/google/nftables/expr"
+	"github.com/thediveo/nufftables"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("rule and expression matchers", func() {
+
+	It("matches expression sequences", func() {
+		exprs := nufftables.Expressions{
+			&expr.Counter{},
+			&expr.Verdict{Kind: expr.VerdictJump, Chain: "DOCKER"},
+		}
+		Expect(exprs).To(HaveExpressionSequence(&expr.Counter{}))
+		Expect(exprs).To(HaveExpressionSequence(
+			BeAssignableToTypeOf(&expr.Counter{}),
+			&expr.Verdict{Kind: expr.VerdictJump, Chain: "DOCKER"}))
+		Expect([]expr.Any(exprs)).To(HaveExpressionSequence(
+			BeAssignableToTypeOf(&expr.Verdict{})))
+		Expect(exprs).NotTo(HaveExpressionSequence(
+			BeAssignableToTypeOf(&expr.Verdict{}),
+			BeAssignableToTypeOf(&expr.Counter{})))
+		Expect(exprs).NotTo(HaveExpressionSequence(&expr.Verdict{Kind: expr.VerdictAccept}))
+
+		Expect(HaveExpressionSequence(&expr.Masq{}).FailureMessage(exprs)).To(HavePrefix(
+			`Expected
+    [ counter pkts 0 bytes 0 ]
+    [ immediate reg 0 jump -> DOCKER ]
+to contain the expression sequence`))
+
+		_, err := HaveExpressionSequence().Match("foo")
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("matches rules in chains", func() {
+		chain := tableMap().TableChain("nat", nufftables.TableFamilyIPv4, "DOCKER")
+		Expect(chain.Rules[0]).To(HaveExpressionSequence(BeAssignableToTypeOf(&expr.Target{})))
+		Expect(&chain.Rules[0]).To(HaveExpressionSequence(BeAssignableToTypeOf(&expr.Target{})))
+		Expect(chain).To(HaveRuleMatching(HaveExpressionSequence(
+			BeAssignableToTypeOf(&expr.Match{}),
+			BeAssignableToTypeOf(&expr.Target{}))))
+		Expect(chain).NotTo(HaveRuleMatching(HaveExpressionSequence(
+			BeAssignableToTypeOf(&expr.Verdict{}))))
+
+		Expect(HaveRuleMatching(HaveExpressionSequence(&expr.Masq{})).FailureMessage(chain)).To(HavePrefix(
+			`Expected chain with rules
+    ip nat DOCKER handle 2
+      [ match name tcp rev 0 ]
+      [ counter pkts 0 bytes 0 ]
+      [ target name DNAT rev 2 ]
+to have a rule matching`))
+
+		_, err := HaveRuleMatching(BeNil()).Match(42)
+		Expect(err).To(HaveOccurred())
+	})
+
+})
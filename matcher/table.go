@@ -0,0 +1,68 @@
+// Copyright 2023 Harald Albrecht.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy
+// of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package matcher
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/onsi/gomega/types"
+	"github.com/thediveo/nufftables"
+)
+
+// HaveTable succeeds if actual is a [nufftables.TableMap] containing the table
+// with the specified name and family.
+func HaveTable(name string, family nufftables.TableFamily) types.GomegaMatcher {
+	return &haveTableMatcher{name: name, family: family}
+}
+
+type haveTableMatcher struct {
+	name   string
+	family nufftables.TableFamily
+}
+
+func (m *haveTableMatcher) Match(actual interface{}) (bool, error) {
+	tables, ok := actual.(nufftables.TableMap)
+	if !ok {
+		return false, fmt.Errorf("HaveTable expects a nufftables.TableMap, got %T", actual)
+	}
+	return tables.Table(m.name, m.family) != nil, nil
+}
+
+func (m *haveTableMatcher) FailureMessage(actual interface{}) string {
+	return fmt.Sprintf("Expected tables\n%s\nto contain table %s %s",
+		tableNames(actual), m.family, m.name)
+}
+
+func (m *haveTableMatcher) NegatedFailureMessage(actual interface{}) string {
+	return fmt.Sprintf("Expected tables\n%s\nnot to contain table %s %s",
+		tableNames(actual), m.family, m.name)
+}
+
+// tableNames returns the (sorted) family and names of the tables in the
+// specified TableMap, one per line and indented.
+func tableNames(actual interface{}) string {
+	tables, _ := actual.(nufftables.TableMap)
+	if len(tables) == 0 {
+		return "    (no tables)"
+	}
+	names := make([]string, 0, len(tables))
+	for key := range tables {
+		names = append(names, fmt.Sprintf("    %s %s", key.Family, key.Name))
+	}
+	sort.Strings(names)
+	return strings.Join(names, "\n")
+}
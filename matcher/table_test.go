@@ -0,0 +1,62 @@
+// Copyright 2023 Harald Albrecht.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy
+// of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package matcher
+
+import (
+	"github.com/google/nftables"
+	"github.com/thediveo/nufftables"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("table and chain matchers", func() {
+
+	It("matches tables", func() {
+		tables := tableMap()
+		Expect(tables).To(HaveTable("nat", nufftables.TableFamilyIPv4))
+		Expect(tables).NotTo(HaveTable("nat", nufftables.TableFamilyIPv6))
+		Expect(HaveTable("nat", nufftables.TableFamilyIPv6).FailureMessage(tables)).To(
+			Equal("Expected tables\n    ip nat\nto contain table ipv6 nat"))
+
+		_, err := HaveTable("nat", nufftables.TableFamilyIPv4).Match(42)
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("matches chains", func() {
+		table := tableMap().Table("nat", nufftables.TableFamilyIPv4)
+		Expect(table).To(HaveChain("DOCKER"))
+		Expect(table).To(HaveChain("PREROUTING",
+			WithType(nftables.ChainTypeNAT),
+			WithHook(nftables.ChainHookPrerouting),
+			WithPriority(nftables.ChainPriorityNATDest),
+			WithPolicy(nftables.ChainPolicyAccept)))
+		Expect(table).NotTo(HaveChain("POSTROUTING"))
+		Expect(table).NotTo(HaveChain("DOCKER", WithHook(nftables.ChainHookPrerouting)))
+		Expect(table).NotTo(HaveChain("PREROUTING", WithType(nftables.ChainTypeFilter)))
+		Expect(table).NotTo(HaveChain("PREROUTING", WithPolicy(nftables.ChainPolicyDrop)))
+		Expect(table).NotTo(HaveChain("PREROUTING", WithPriority(nftables.ChainPriorityFilter)))
+
+		Expect(HaveChain("PREROUTING", WithPolicy(nftables.ChainPolicyDrop)).FailureMessage(table)).To(
+			Equal(`Expected table with chains
+    "DOCKER"
+    "PREROUTING" type nat hook PREROUTING priority -100 policy accept
+to contain chain "PREROUTING" policy drop`))
+
+		_, err := HaveChain("DOCKER").Match(nil)
+		Expect(err).To(HaveOccurred())
+	})
+
+})
@@ -0,0 +1,248 @@
+// Copyright 2023 Harald Albrecht.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy
+// of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package nufftables
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/google/nftables"
+)
+
+// MemConn is an in-memory [Conn] that gets populated programmatically with
+// tables, chains, rules, and sets, instead of retrieving them from the kernel. This
+// allows unit testing code building on nufftables without needing root,
+// network namespaces, or a kernel at all.
+//
+// Similar to [nftables.Conn], tables and chains are identified by their names
+// and the family of the (containing) table.
+type MemConn struct {
+	mu     sync.Mutex
+	tables []*nftables.Table
+	chains []*nftables.Chain
+	rules  map[memChainKey][]*nftables.Rule
+	handle uint64 // last rule handle assigned.
+	sets   map[TableKey][]*nftables.Set
+	elems  map[*nftables.Set][]nftables.SetElement
+	setid  uint32 // last set ID assigned.
+}
+
+// memChainKey identifies a particular chain inside a particular table.
+type memChainKey struct {
+	TableKey
+	Chain string
+}
+
+var _ Conn = (*MemConn)(nil)
+
+// NewMemConn returns a new and empty in-memory [Conn].
+func NewMemConn() *MemConn {
+	return &MemConn{
+		rules: map[memChainKey][]*nftables.Rule{},
+		sets:  map[TableKey][]*nftables.Set{},
+		elems: map[*nftables.Set][]nftables.SetElement{},
+	}
+}
+
+// AddTable adds the specified table, returning it. If a table with the same
+// name and family has already been added, then the existing table is returned
+// instead.
+func (m *MemConn) AddTable(t *nftables.Table) *nftables.Table {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if table := m.table(t.Name, t.Family); table != nil {
+		return table
+	}
+	m.tables = append(m.tables, t)
+	return t
+}
+
+// AddChain adds the specified chain to the table referenced by the chain,
+// returning the chain. The referenced table is automatically added if not
+// already done so.
+func (m *MemConn) AddChain(c *nftables.Chain) *nftables.Chain {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if table := m.table(c.Table.Name, c.Table.Family); table == nil {
+		m.tables = append(m.tables, c.Table)
+	}
+	key := memChainKey{
+		TableKey: TableKey{Name: c.Table.Name, Family: TableFamily(c.Table.Family)},
+		Chain:    c.Name,
+	}
+	if _, ok := m.rules[key]; ok {
+		return c
+	}
+	m.chains = append(m.chains, c)
+	m.rules[key] = []*nftables.Rule{}
+	return c
+}
+
+// AddRule appends the specified rule to the chain referenced by the rule,
+// returning the rule. Similar to the kernel, a rule without a handle gets the
+// next available handle assigned, and a rule without a position gets the
+// handle of the rule it follows as its position.
+func (m *MemConn) AddRule(r *nftables.Rule) *nftables.Rule {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := memChainKey{
+		TableKey: TableKey{Name: r.Table.Name, Family: TableFamily(r.Table.Family)},
+		Chain:    r.Chain.Name,
+	}
+	rules, ok := m.rules[key]
+	if !ok {
+		if table := m.table(r.Table.Name, r.Table.Family); table == nil {
+			m.tables = append(m.tables, r.Table)
+		}
+		m.chains = append(m.chains, r.Chain)
+	}
+	if r.Handle == 0 {
+		m.handle++
+		r.Handle = m.handle
+	} else if r.Handle > m.handle {
+		m.handle = r.Handle
+	}
+	if r.Position == 0 && len(rules) > 0 {
+		r.Position = rules[len(rules)-1].Handle
+	}
+	m.rules[key] = append(rules, r)
+	return r
+}
+
+// AddSet adds the specified set together with its elements to the table
+// referenced by the set. The referenced table is automatically added if not
+// already done so. If a set with the same name has already been added to the
+// table, then the specified elements are appended to the existing set instead.
+//
+// Similar to [nftables.Conn.AddSet], anonymous sets must be constant and get
+// their names assigned in the form of “__set0”, “__map1”, et cetera.
+func (m *MemConn) AddSet(s *nftables.Set, elements []nftables.SetElement) error {
+	if s.Anonymous && !s.Constant {
+		return errors.New("anonymous sets must be constant")
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := TableKey{Name: s.Table.Name, Family: TableFamily(s.Table.Family)}
+	if s.ID == 0 {
+		m.setid++
+		s.ID = m.setid
+		if s.Anonymous {
+			anons := 0
+			for _, set := range m.sets[key] {
+				if set.Anonymous {
+					anons++
+				}
+			}
+			format := "__set%d"
+			if s.IsMap {
+				format = "__map%d"
+			}
+			s.Name = fmt.Sprintf(format, anons)
+		}
+	}
+	if s.Name == "" {
+		return errors.New("missing set name")
+	}
+	if table := m.table(s.Table.Name, s.Table.Family); table == nil {
+		m.tables = append(m.tables, s.Table)
+	}
+	for _, set := range m.sets[key] {
+		if set.Name == s.Name {
+			m.elems[set] = append(m.elems[set], elements...)
+			return nil
+		}
+	}
+	m.sets[key] = append(m.sets[key], s)
+	m.elems[s] = append([]nftables.SetElement{}, elements...)
+	return nil
+}
+
+// ListTables returns all tables, regardless of their family.
+func (m *MemConn) ListTables() ([]*nftables.Table, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]*nftables.Table{}, m.tables...), nil
+}
+
+// ListChains returns all chains in all tables, regardless of their table
+// family.
+func (m *MemConn) ListChains() ([]*nftables.Chain, error) {
+	return m.ListChainsOfTableFamily(nftables.TableFamilyUnspecified)
+}
+
+// ListChainsOfTableFamily returns all chains in tables of the specified family;
+// it returns all chains if the family is [nftables.TableFamilyUnspecified].
+func (m *MemConn) ListChainsOfTableFamily(family nftables.TableFamily) ([]*nftables.Chain, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	chains := []*nftables.Chain{}
+	for _, chain := range m.chains {
+		if family != nftables.TableFamilyUnspecified && chain.Table.Family != family {
+			continue
+		}
+		chains = append(chains, chain)
+	}
+	return chains, nil
+}
+
+// GetRules returns the rules of the specified table and chain, or an error if
+// there is no such chain.
+func (m *MemConn) GetRules(table *nftables.Table, chain *nftables.Chain) ([]*nftables.Rule, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	rules, ok := m.rules[memChainKey{
+		TableKey: TableKey{Name: table.Name, Family: TableFamily(table.Family)},
+		Chain:    chain.Name,
+	}]
+	if !ok {
+		return nil, fmt.Errorf("no chain %q in table %q of family %s",
+			chain.Name, table.Name, TableFamily(table.Family))
+	}
+	return append([]*nftables.Rule{}, rules...), nil
+}
+
+// GetSets returns the sets of the specified table.
+func (m *MemConn) GetSets(table *nftables.Table) ([]*nftables.Set, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]*nftables.Set{},
+		m.sets[TableKey{Name: table.Name, Family: TableFamily(table.Family)}]...), nil
+}
+
+// GetSetElements returns the elements of the specified set, or an error if
+// there is no such set.
+func (m *MemConn) GetSetElements(set *nftables.Set) ([]nftables.SetElement, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, s := range m.sets[TableKey{Name: set.Table.Name, Family: TableFamily(set.Table.Family)}] {
+		if s.Name == set.Name {
+			return append([]nftables.SetElement{}, m.elems[s]...), nil
+		}
+	}
+	return nil, fmt.Errorf("no set %q in table %q of family %s",
+		set.Name, set.Table.Name, TableFamily(set.Table.Family))
+}
+
+// table returns the table with the specified name and family, if known,
+// otherwise nil. The caller must hold the lock.
+func (m *MemConn) table(name string, family nftables.TableFamily) *nftables.Table {
+	for _, table := range m.tables {
+		if table.Name == name && table.Family == family {
+			return table
+		}
+	}
+	return nil
+}
@@ -0,0 +1,132 @@
+// Copyright 2023 Harald Albrecht.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy
+// of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package nufftables
+
+import (
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("in-memory connection", func() {
+
+	var conn *MemConn
+	var nat4, filter6 *nftables.Table
+	var postrouting, forward *nftables.Chain
+
+	BeforeEach(func() {
+		conn = NewMemConn()
+		nat4 = conn.AddTable(&nftables.Table{Name: "nat", Family: nftables.TableFamilyIPv4})
+		filter6 = conn.AddTable(&nftables.Table{Name: "filter", Family: nftables.TableFamilyIPv6})
+		Expect(conn.AddTable(&nftables.Table{Name: "nat", Family: nftables.TableFamilyIPv4})).To(
+			BeIdenticalTo(nat4))
+		postrouting = conn.AddChain(&nftables.Chain{
+			Name:     "POSTROUTING",
+			Table:    nat4,
+			Type:     nftables.ChainTypeNAT,
+			Hooknum:  nftables.ChainHookPostrouting,
+			Priority: nftables.ChainPriorityNATSource,
+		})
+		forward = conn.AddChain(&nftables.Chain{
+			Name:  "FORWARD",
+			Table: filter6,
+		})
+		conn.AddRule(&nftables.Rule{
+			Table: nat4,
+			Chain: postrouting,
+			Exprs: []expr.Any{&expr.Masq{}},
+		})
+		conn.AddRule(&nftables.Rule{
+			Table: nat4,
+			Chain: postrouting,
+			Exprs: []expr.Any{&expr.Counter{}},
+		})
+	})
+
+	It("lists tables and chains", func() {
+		Expect(conn.ListTables()).To(ConsistOf(nat4, filter6))
+		Expect(conn.ListChains()).To(ConsistOf(postrouting, forward))
+		Expect(conn.ListChainsOfTableFamily(nftables.TableFamilyIPv6)).To(ConsistOf(forward))
+		Expect(conn.ListChainsOfTableFamily(nftables.TableFamilyINet)).To(BeEmpty())
+	})
+
+	It("assigns rule handles and positions", func() {
+		rules, err := conn.GetRules(nat4, postrouting)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(rules).To(HaveExactElements(
+			HaveField("Handle", uint64(1)),
+			And(HaveField("Handle", uint64(2)), HaveField("Position", uint64(1))),
+		))
+		Expect(conn.GetRules(filter6, forward)).To(BeEmpty())
+		_, err = conn.GetRules(filter6, postrouting)
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("implicitly adds tables and chains", func() {
+		table := &nftables.Table{Name: "foo", Family: nftables.TableFamilyINet}
+		chain := &nftables.Chain{Name: "bar", Table: table}
+		conn.AddRule(&nftables.Rule{Table: table, Chain: chain})
+		Expect(conn.ListTables()).To(ContainElement(table))
+		Expect(conn.ListChains()).To(ContainElement(chain))
+	})
+
+	It("adds and lists sets", func() {
+		ports := &nftables.Set{Table: nat4, Name: "ports", KeyType: nftables.TypeInetService}
+		Expect(conn.AddSet(ports, []nftables.SetElement{{Key: []byte{0, 80}}})).To(Succeed())
+		Expect(conn.AddSet(&nftables.Set{Table: nat4, Name: "ports"},
+			[]nftables.SetElement{{Key: []byte{1, 187}}})).To(Succeed())
+		anon := &nftables.Set{Table: nat4, Anonymous: true, Constant: true}
+		Expect(conn.AddSet(anon, nil)).To(Succeed())
+		Expect(anon.Name).To(Equal("__set0"))
+		Expect(conn.AddSet(&nftables.Set{Table: nat4, Anonymous: true}, nil)).NotTo(Succeed())
+		Expect(conn.AddSet(&nftables.Set{Table: nat4}, nil)).NotTo(Succeed())
+
+		Expect(conn.GetSets(nat4)).To(ConsistOf(ports, anon))
+		Expect(conn.GetSets(filter6)).To(BeEmpty())
+		Expect(conn.GetSetElements(ports)).To(HaveLen(2))
+		_, err := conn.GetSetElements(&nftables.Set{Table: filter6, Name: "ports"})
+		Expect(err).To(HaveOccurred())
+
+		tables, err := GetAllTables(conn)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(tables.Table("nat", TableFamilyIPv4).SetsByName).To(HaveKeyWithValue(
+			"ports", HaveField("Elements", HaveLen(2))))
+		tables, err = GetFamilyTables(conn, TableFamilyIPv4)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(tables.Table("nat", TableFamilyIPv4).SetsByName).To(HaveLen(2))
+	})
+
+	It("loads a TableMap", func() {
+		tables, err := GetAllTables(conn)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(tables).To(HaveLen(2))
+		chain := tables.TableChain("nat", TableFamilyIPv4, "POSTROUTING")
+		Expect(chain).NotTo(BeNil())
+		Expect(chain.Table).To(BeIdenticalTo(tables.Table("nat", TableFamilyIPv4)))
+		Expect(chain.Rules).To(HaveExactElements(
+			HaveField("Exprs", ConsistOf(BeAssignableToTypeOf(&expr.Masq{}))),
+			HaveField("Exprs", ConsistOf(BeAssignableToTypeOf(&expr.Counter{}))),
+		))
+		Expect(tables.TableChain("filter", TableFamilyIPv6, "FORWARD")).NotTo(BeNil())
+
+		tables, err = GetFamilyTables(conn, TableFamilyIPv6)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(tables).To(HaveLen(1))
+		Expect(tables.Table("filter", TableFamilyIPv6)).NotTo(BeNil())
+	})
+
+})
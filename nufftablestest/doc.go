@@ -0,0 +1,32 @@
+/*
+Package nufftablestest helps with writing hermetic tests that need netfilter
+tables, chains, and rules.
+
+A [Ruleset] declares a ruleset fixture in form of tables with their chains and
+rules. [NewConn] then creates a transient network namespace, applies the
+ruleset fixture there, and returns a [nftables.Conn] connected to this
+transient network namespace. After the current test has finished, the
+connection gets closed and the transient network namespace automatically
+vanishes. As each test gets its own network namespace, tests don't depend on
+the host's ruleset anymore and can also run in parallel.
+
+	conn := nufftablestest.NewConn(nufftablestest.Ruleset{
+	  {
+	    Name:   "nat",
+	    Family: nftables.TableFamilyIPv4,
+	    Chains: []nufftablestest.Chain{
+	      {
+	        Name:     "POSTROUTING",
+	        Type:     nftables.ChainTypeNAT,
+	        Hook:     nftables.ChainHookPostrouting,
+	        Priority: nftables.ChainPriorityNATSource,
+	        Rules:    []nufftablestest.Rule{{&expr.Masq{}}},
+	      },
+	    },
+	  },
+	})
+
+Ruleset fixtures can also be applied to anything else able to add tables, sets,
+chains, and rules, such as an in-memory [github.com/thediveo/nufftables.MemConn].
+*/
+package nufftablestest
@@ -0,0 +1,60 @@
+// Copyright 2023 Harald Albrecht.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy
+// of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package nufftablestest
+
+import (
+	"net"
+	"net/netip"
+
+	"github.com/google/nftables/expr"
+)
+
+// Comment returns rule user data carrying the specified rule comment, as
+// stored by nft and iptables-nft.
+func Comment(s string) []byte {
+	return append([]byte{0, byte(len(s) + 1)}, append([]byte(s), 0)...)
+}
+
+// SAddr4 returns the expressions matching the specified IPv4 source address
+// or prefix, such as in “-s 10.0.0.0/8”.
+func SAddr4(addr string) []expr.Any {
+	return addr4(12, addr)
+}
+
+// DAddr4 returns the expressions matching the specified IPv4 destination
+// address or prefix, such as in “-d 10.96.0.1”.
+func DAddr4(addr string) []expr.Any {
+	return addr4(16, addr)
+}
+
+// addr4 returns the expressions matching the IPv4 address or prefix at the
+// specified network header offset. Prefixes are matched using a bitwise mask
+// on the full address.
+func addr4(offset uint32, addr string) []expr.Any {
+	prefix, err := netip.ParsePrefix(addr)
+	if err != nil {
+		prefix = netip.PrefixFrom(netip.MustParseAddr(addr), 32)
+	}
+	prefix = prefix.Masked()
+	exprs := []expr.Any{
+		&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: offset, Len: 4},
+	}
+	if prefix.Bits() < 32 {
+		exprs = append(exprs, &expr.Bitwise{SourceRegister: 1, DestRegister: 1, Len: 4,
+			Mask: net.CIDRMask(prefix.Bits(), 32), Xor: []byte{0, 0, 0, 0}})
+	}
+	data := prefix.Addr().As4()
+	return append(exprs, &expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: data[:]})
+}
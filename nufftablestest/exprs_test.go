@@ -0,0 +1,41 @@
+// Copyright 2023 Harald Albrecht.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy
+// of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package nufftablestest
+
+import (
+	"github.com/google/nftables"
+	"github.com/thediveo/nufftables"
+	"github.com/thediveo/nufftables/dsl"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("expression fixtures", func() {
+
+	It("matches addresses and prefixes", func() {
+		matches := dsl.AddrMatches(append(SAddr4("10.1.2.3/8"), DAddr4("192.0.2.1")...))
+		Expect(matches).To(HaveLen(2))
+		Expect(matches[0].String()).To(Equal("ip saddr 10.0.0.0/8"))
+		Expect(matches[1].String()).To(Equal("ip daddr 192.0.2.1"))
+	})
+
+	It("returns rule comments", func() {
+		Expect(dsl.RuleComment(&nufftables.Rule{Rule: &nftables.Rule{
+			UserData: Comment("foo"),
+		}})).To(Equal("foo"))
+	})
+
+})
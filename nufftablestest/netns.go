@@ -0,0 +1,135 @@
+// Copyright 2023 Harald Albrecht.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy
+// of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package nufftablestest
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+
+	"github.com/google/nftables"
+	"golang.org/x/sys/unix"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+// Netns is a transient network namespace that stays alive as long as it
+// hasn't been closed.
+type Netns struct {
+	fd int
+}
+
+// NewNetns creates a new transient network namespace, without switching the
+// caller into it. Creating network namespaces requires CAP_SYS_ADMIN.
+func NewNetns() (*Netns, error) {
+	type result struct {
+		fd  int
+		err error
+	}
+	ch := make(chan result)
+	// Unsharing the network namespace taints the OS-level thread we're
+	// currently running on, so we do this in a separate go routine locked to
+	// its OS-level thread. Returning from this go routine without unlocking
+	// then causes the Go runtime to throw away the tainted thread.
+	go func() {
+		runtime.LockOSThread()
+		if err := unix.Unshare(unix.CLONE_NEWNET); err != nil {
+			ch <- result{fd: -1, err: fmt.Errorf("cannot create network namespace, reason: %w", err)}
+			return
+		}
+		fd, err := unix.Open(fmt.Sprintf("/proc/self/task/%d/ns/net", unix.Gettid()),
+			unix.O_RDONLY|unix.O_CLOEXEC, 0)
+		if err != nil {
+			ch <- result{fd: -1, err: fmt.Errorf("cannot reference network namespace, reason: %w", err)}
+			return
+		}
+		ch <- result{fd: fd}
+	}()
+	res := <-ch
+	if res.err != nil {
+		return nil, res.err
+	}
+	return &Netns{fd: res.fd}, nil
+}
+
+// Fd returns the file descriptor referencing this network namespace.
+func (n *Netns) Fd() int {
+	return n.fd
+}
+
+// Conn returns a new lasting [nftables.Conn] connected to this network
+// namespace. The caller is responsible for closing the returned connection
+// using [nftables.Conn.CloseLasting].
+func (n *Netns) Conn() (*nftables.Conn, error) {
+	return nftables.New(nftables.WithNetNSFd(n.fd), nftables.AsLasting())
+}
+
+// Apply applies the specified ruleset fixture to this network namespace.
+func (n *Netns) Apply(r Ruleset) error {
+	conn, err := n.Conn()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = conn.CloseLasting() }()
+	if err := r.Apply(conn); err != nil {
+		return err
+	}
+	if err := conn.Flush(); err != nil {
+		return fmt.Errorf("cannot apply ruleset, reason: %w", err)
+	}
+	return nil
+}
+
+// Close releases this network namespace; the network namespace then vanishes
+// as soon as no other references to it remain.
+func (n *Netns) Close() error {
+	if n.fd < 0 {
+		return nil
+	}
+	err := unix.Close(n.fd)
+	n.fd = -1
+	return err
+}
+
+// NewConn creates a transient network namespace, applies the specified
+// ruleset fixture to it, and then returns a lasting [nftables.Conn] connected
+// to the transient network namespace. The connection is closed and the
+// network namespace released after the current test has finished.
+//
+// NewConn must be called from within a Ginkgo setup or subject node. It skips
+// the current test when not running as root, or when the transient network
+// namespace cannot be created, such as when lacking CAP_SYS_ADMIN in a
+// container.
+func NewConn(fixture Ruleset) *nftables.Conn {
+	GinkgoHelper()
+	if os.Getuid() != 0 {
+		Skip("needs root")
+	}
+	netns, err := NewNetns()
+	if err != nil {
+		Skip(err.Error())
+	}
+	DeferCleanup(func() {
+		Expect(netns.Close()).To(Succeed())
+	})
+	Expect(netns.Apply(fixture)).To(Succeed())
+	conn, err := netns.Conn()
+	Expect(err).NotTo(HaveOccurred())
+	DeferCleanup(func() {
+		_ = conn.CloseLasting()
+	})
+	return conn
+}
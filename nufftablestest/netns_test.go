@@ -0,0 +1,121 @@
+// Copyright 2023 Harald Albrecht.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy
+// of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package nufftablestest
+
+import (
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"golang.org/x/sys/unix"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var fixture = Ruleset{
+	{
+		Name:   "nat",
+		Family: nftables.TableFamilyIPv4,
+		Chains: []Chain{
+			{
+				Name:     "POSTROUTING",
+				Type:     nftables.ChainTypeNAT,
+				Hook:     nftables.ChainHookPostrouting,
+				Priority: nftables.ChainPriorityNATSource,
+				Rules: []Rule{
+					{&expr.Verdict{Kind: expr.VerdictJump, Chain: "MASQ"}},
+				},
+			},
+			{
+				Name:  "MASQ",
+				Rules: []Rule{{&expr.Counter{}}},
+			},
+		},
+	},
+}
+
+var _ = Describe("transient network namespaces", func() {
+
+	It("creates and releases a transient network namespace", func() {
+		netns, err := NewNetns()
+		if err != nil {
+			Skip("cannot create network namespaces")
+		}
+		defer func() { Expect(netns.Close()).To(Succeed()) }()
+		var hoststat, nsstat unix.Stat_t
+		Expect(unix.Stat("/proc/self/ns/net", &hoststat)).To(Succeed())
+		Expect(unix.Fstat(netns.Fd(), &nsstat)).To(Succeed())
+		Expect(nsstat.Ino).NotTo(Equal(hoststat.Ino))
+	})
+
+	It("applies a ruleset fixture", func() {
+		conn := NewConn(fixture)
+		tables, err := conn.ListTables()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(tables).To(ConsistOf(HaveField("Name", "nat")))
+		chains, err := conn.ListChains()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(chains).To(ConsistOf(
+			HaveField("Name", "POSTROUTING"),
+			HaveField("Name", "MASQ"),
+		))
+		rules, err := conn.GetRules(tables[0], &nftables.Chain{Name: "MASQ", Table: tables[0]})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(rules).To(HaveLen(1))
+	})
+
+	It("references anonymous sets by their assigned names", func() {
+		conn := NewConn(Ruleset{
+			{
+				Name:   "nat",
+				Family: nftables.TableFamilyIPv4,
+				Sets: []Set{
+					{
+						Name:      "spread",
+						KeyType:   nftables.TypeInteger,
+						DataType:  nftables.TypeIPAddr,
+						IsMap:     true,
+						Anonymous: true,
+						Elements: []nftables.SetElement{
+							{Key: []byte{0, 0, 0, 0}, Val: []byte{10, 0, 0, 1}},
+							{Key: []byte{1, 0, 0, 0}, Val: []byte{10, 0, 0, 2}},
+						},
+					},
+				},
+				Chains: []Chain{
+					{
+						Name: "FWD",
+						Rules: []Rule{{
+							&expr.Numgen{Register: 1, Modulus: 2, Type: unix.NFT_NG_INCREMENTAL},
+							&expr.Lookup{SourceRegister: 1, DestRegister: 1, IsDestRegSet: true, SetName: "spread"},
+						}},
+					},
+				},
+			},
+		})
+		tables, err := conn.ListTables()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(tables).To(HaveLen(1))
+		rules, err := conn.GetRules(tables[0], &nftables.Chain{Name: "FWD", Table: tables[0]})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(rules).To(ConsistOf(HaveField("Exprs", ContainElement(
+			HaveField("SetName", HavePrefix("__map"))))))
+	})
+
+	It("isolates ruleset fixtures", func() {
+		conn := NewConn(nil)
+		Expect(conn.ListTables()).To(BeEmpty())
+	})
+
+})
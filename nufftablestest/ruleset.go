@@ -0,0 +1,157 @@
+// Copyright 2023 Harald Albrecht.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy
+// of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package nufftablestest
+
+import (
+	"fmt"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+)
+
+// Ruleset declares a ruleset fixture in form of tables, together with their
+// sets, chains, and rules.
+type Ruleset []Table
+
+// Table declares a table of a particular family, together with its sets and
+// chains.
+type Table struct {
+	Name   string
+	Family nftables.TableFamily
+	Sets   []Set
+	Chains []Chain
+}
+
+// Set declares a named set or map with its elements. Rules reference named
+// sets by their names, such as in [expr.Lookup.SetName].
+//
+// Anonymous sets, such as in “dnat to numgen inc mod 2 map { 0 : 10.0.0.1, 1 :
+// 10.0.0.2 }”, are declared with a name too, so that rules are able to
+// reference them. [Ruleset.Apply] then references the anonymous set by its
+// assigned name and ID instead.
+type Set struct {
+	Name      string
+	KeyType   nftables.SetDatatype
+	DataType  nftables.SetDatatype // only for maps.
+	Interval  bool
+	IsMap     bool
+	Anonymous bool
+	Elements  []nftables.SetElement
+}
+
+// Chain declares a chain with its rules. Base chains additionally specify
+// their type, hook, priority, and optionally a policy; regular chains leave
+// these unset.
+type Chain struct {
+	Name     string
+	Type     nftables.ChainType
+	Hook     *nftables.ChainHook
+	Priority *nftables.ChainPriority
+	Policy   *nftables.ChainPolicy
+	Rules    []Rule
+}
+
+// Rule declares a rule in form of its expressions.
+type Rule []expr.Any
+
+// Applier adds tables, sets, chains, and rules. Both [*nftables.Conn] and the
+// in-memory [github.com/thediveo/nufftables.MemConn] are Appliers.
+type Applier interface {
+	AddTable(t *nftables.Table) *nftables.Table
+	AddSet(s *nftables.Set, vals []nftables.SetElement) error
+	AddChain(c *nftables.Chain) *nftables.Chain
+	AddRule(r *nftables.Rule) *nftables.Rule
+}
+
+var _ Applier = (*nftables.Conn)(nil)
+
+// Apply adds the tables, sets, chains, and rules of this ruleset fixture using
+// the specified Applier. In case of a [*nftables.Conn] the caller then needs to
+// flush the connection in order to actually apply the ruleset.
+//
+// Apply first adds all sets and chains of a table before adding any rules, so
+// that rules can reference sets and jump to or go to chains declared later in
+// the same table.
+func (r Ruleset) Apply(a Applier) error {
+	for _, t := range r {
+		table := a.AddTable(&nftables.Table{
+			Name:   t.Name,
+			Family: t.Family,
+		})
+		// Chains come before sets, so that verdict map elements are able to
+		// jump to them.
+		chains := make([]*nftables.Chain, 0, len(t.Chains))
+		for _, c := range t.Chains {
+			chains = append(chains, a.AddChain(&nftables.Chain{
+				Name:     c.Name,
+				Table:    table,
+				Type:     c.Type,
+				Hooknum:  c.Hook,
+				Priority: c.Priority,
+				Policy:   c.Policy,
+			}))
+		}
+		anons := map[string]*nftables.Set{}
+		for _, s := range t.Sets {
+			set := &nftables.Set{
+				Table:     table,
+				Name:      s.Name,
+				KeyType:   s.KeyType,
+				DataType:  s.DataType,
+				Interval:  s.Interval,
+				IsMap:     s.IsMap,
+				Anonymous: s.Anonymous,
+				Constant:  s.Anonymous,
+			}
+			if err := a.AddSet(set, s.Elements); err != nil {
+				return fmt.Errorf("cannot add set %q, reason: %w", s.Name, err)
+			}
+			if s.Anonymous {
+				anons[s.Name] = set
+			}
+		}
+		for idx, c := range t.Chains {
+			for _, exprs := range c.Rules {
+				a.AddRule(&nftables.Rule{
+					Table: table,
+					Chain: chains[idx],
+					Exprs: anonLookups(exprs, anons),
+				})
+			}
+		}
+	}
+	return nil
+}
+
+// anonLookups returns the specified rule expressions with the lookups of the
+// specified anonymous sets referencing the sets by their assigned names and
+// IDs. The expressions of the rule fixture are left untouched.
+func anonLookups(exprs Rule, anons map[string]*nftables.Set) []expr.Any {
+	if len(anons) == 0 {
+		return exprs
+	}
+	rexprs := make([]expr.Any, 0, len(exprs))
+	for _, e := range exprs {
+		if lookup, ok := e.(*expr.Lookup); ok {
+			if set, ok := anons[lookup.SetName]; ok {
+				lookup := *lookup
+				lookup.SetName, lookup.SetID = set.Name, set.ID
+				e = &lookup
+			}
+		}
+		rexprs = append(rexprs, e)
+	}
+	return rexprs
+}
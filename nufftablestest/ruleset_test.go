@@ -0,0 +1,37 @@
+// Copyright 2023 Harald Albrecht.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy
+// of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package nufftablestest
+
+import (
+	"github.com/thediveo/nufftables"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("ruleset fixtures", func() {
+
+	It("applies to an in-memory connection", func() {
+		conn := nufftables.NewMemConn()
+		Expect(fixture.Apply(conn)).To(Succeed())
+		tables, err := nufftables.GetAllTables(conn)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(tables.TableChain("nat", nufftables.TableFamilyIPv4, "POSTROUTING")).To(
+			HaveField("Rules", HaveLen(1)))
+		Expect(tables.TableChain("nat", nufftables.TableFamilyIPv4, "MASQ")).To(
+			HaveField("Rules", HaveLen(1)))
+	})
+
+})
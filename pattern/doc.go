@@ -0,0 +1,52 @@
+/*
+Package pattern implements a composable pattern language for matching sequences
+of rule expressions, returning all named captures in a single call.
+
+Where [github.com/thediveo/nufftables.OfType] and friends find only a single
+expression at a time and thus need to be hand-chained, patterns allow writing
+expression detectors declaratively instead:
+
+	p := pattern.Sequence(
+	  pattern.Optional(pattern.Capture("ip", pattern.TypeFunc(isIPCompare))),
+	  pattern.Capture("match", pattern.Type[*expr.Match]()),
+	  pattern.Absent(pattern.Type[*expr.Verdict]()),
+	  pattern.Capture("target", pattern.Type[*expr.Target]()),
+	)
+	if _, caps := pattern.Match(rule.Expressions(), p); caps != nil {
+	  target := pattern.Captured[*expr.Target](caps, "target")
+	  ...
+	}
+
+For instance, [github.com/thediveo/nufftables/portfinder] detects the port
+forwardings of iptables-nft using a pattern capturing the xt “tcp” or “udp”
+match extension together with the following xt “DNAT” target.
+
+# Searching versus Adjacency
+
+The elements of a [Sequence] or [Repeat] are searched for, skipping any other
+expressions in between, the same way as chaining
+[github.com/thediveo/nufftables.OfType] calls does. [Next] instead requires its
+pattern to match immediately at the current position, without skipping any
+expressions. [Match] searches for the specified pattern, unless the pattern is
+a Next pattern.
+
+# Combinators
+
+  - [Type] and [TypeFunc] match a single expression of a specific type,
+    optionally satisfying an additional condition; [Any] matches any single
+    expression.
+  - [Sequence] matches its patterns one after another.
+  - [Next] requires its pattern to directly follow the previous match.
+  - [Optional] matches its pattern if possible, otherwise nothing.
+  - [OneOf] matches the first of its alternative patterns leading to an
+    overall match.
+  - [Repeat] matches its pattern repeatedly.
+  - [Absent] is a negative lookahead that succeeds without consuming any
+    expressions if its pattern cannot be matched.
+  - [Capture] records the expressions matched by its pattern under a name.
+
+Matching backtracks, so optional, alternative, and repeated patterns always
+try the remaining possibilities when a later pattern cannot be matched
+otherwise.
+*/
+package pattern
@@ -0,0 +1,276 @@
+// Copyright 2023 Harald Albrecht.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy
+// of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package pattern
+
+import (
+	"github.com/google/nftables/expr"
+	"github.com/thediveo/nufftables"
+)
+
+// Pattern matches a sequence of expressions. Patterns are created using the
+// combinators of this package, such as [Type], [Sequence], [Optional], et
+// cetera.
+type Pattern interface {
+	// match tries to match this pattern at position pos, or any later position
+	// if search is true. For each possible match it calls the continuation k
+	// with the position after the match, until k returns true.
+	match(m *matcher, pos int, search bool, k func(pos int) bool) bool
+}
+
+// Captures maps capture names to the expressions captured by [Capture]
+// patterns. If a capture matched multiple times, such as inside a [Repeat]
+// pattern, then all matched expressions are captured in order.
+type Captures map[string]nufftables.Expressions
+
+// matcher keeps the state of a single pattern matching run. In particular, it
+// keeps track of the indices of the individual expressions matched so far, as
+// well as the spans of these matched expressions that are captured.
+type matcher struct {
+	exprs nufftables.Expressions
+	trail []int     // indices of individually matched expressions.
+	caps  []capture // captures, referencing spans of the trail.
+}
+
+// capture references the span of individually matched expressions captured
+// under a particular name.
+type capture struct {
+	name     string
+	from, to int // trail span.
+}
+
+// Match searches the specified expressions for the specified pattern. If the
+// pattern matches, Match returns the remaining expressions after the match,
+// together with the captures (which might be empty). Otherwise, Match returns
+// nil remaining expressions and nil captures.
+func Match(exprs nufftables.Expressions, p Pattern) (nufftables.Expressions, Captures) {
+	m := &matcher{exprs: exprs}
+	var rem nufftables.Expressions
+	var caps Captures
+	if !p.match(m, 0, true, func(pos int) bool {
+		rem = exprs[pos:]
+		caps = m.captures()
+		return true
+	}) {
+		return nil, nil
+	}
+	return rem, caps
+}
+
+// Captured returns the first expression of the specified type captured under
+// the specified name, otherwise a zero matching expression (~nil).
+func Captured[E expr.Any](caps Captures, name string) E {
+	for _, elem := range caps[name] {
+		if e, ok := elem.(E); ok {
+			return e
+		}
+	}
+	var nill E
+	return nill
+}
+
+// captures returns the expressions captured so far.
+func (m *matcher) captures() Captures {
+	caps := Captures{}
+	for _, c := range m.caps {
+		exprs := caps[c.name]
+		for _, idx := range m.trail[c.from:c.to] {
+			exprs = append(exprs, m.exprs[idx])
+		}
+		if exprs == nil {
+			exprs = nufftables.Expressions{}
+		}
+		caps[c.name] = exprs
+	}
+	return caps
+}
+
+// Type returns a pattern matching a single expression of the specified type.
+// The type parameter must be a pointer to a concrete expression type, such as
+// [*expr.Match], et cetera.
+func Type[E expr.Any]() Pattern {
+	return &typePattern[E]{}
+}
+
+// TypeFunc returns a pattern matching a single expression of the specified
+// type and additionally satisfying f(expression).
+func TypeFunc[E expr.Any](f func(e E) bool) Pattern {
+	return &typePattern[E]{f: f}
+}
+
+// Any returns a pattern matching any single expression.
+func Any() Pattern {
+	return &typePattern[expr.Any]{}
+}
+
+type typePattern[E expr.Any] struct {
+	f func(e E) bool
+}
+
+func (p *typePattern[E]) match(m *matcher, pos int, search bool, k func(int) bool) bool {
+	for idx := pos; idx < len(m.exprs); idx++ {
+		if e, ok := m.exprs[idx].(E); ok && (p.f == nil || p.f(e)) {
+			m.trail = append(m.trail, idx)
+			if k(idx + 1) {
+				return true
+			}
+			m.trail = m.trail[:len(m.trail)-1]
+		}
+		if !search {
+			break
+		}
+	}
+	return false
+}
+
+// Sequence returns a pattern matching the specified patterns one after
+// another, skipping any other expressions in between unless a pattern is a
+// [Next] pattern.
+func Sequence(ps ...Pattern) Pattern {
+	return sequencePattern(ps)
+}
+
+type sequencePattern []Pattern
+
+func (p sequencePattern) match(m *matcher, pos int, search bool, k func(int) bool) bool {
+	var next func(idx, pos int, search bool) bool
+	next = func(idx, pos int, search bool) bool {
+		if idx == len(p) {
+			return k(pos)
+		}
+		return p[idx].match(m, pos, search, func(pos int) bool {
+			return next(idx+1, pos, true)
+		})
+	}
+	return next(0, pos, search)
+}
+
+// Next returns a pattern requiring the specified pattern to match immediately
+// at the current position, without skipping any expressions. Inside a
+// [Sequence] this means that the specified pattern must directly follow the
+// previous match.
+func Next(p Pattern) Pattern {
+	return &nextPattern{p: p}
+}
+
+type nextPattern struct {
+	p Pattern
+}
+
+func (p *nextPattern) match(m *matcher, pos int, _ bool, k func(int) bool) bool {
+	return p.p.match(m, pos, false, k)
+}
+
+// Optional returns a pattern matching the specified pattern if possible,
+// otherwise matching nothing.
+func Optional(p Pattern) Pattern {
+	return &optionalPattern{p: p}
+}
+
+type optionalPattern struct {
+	p Pattern
+}
+
+func (p *optionalPattern) match(m *matcher, pos int, search bool, k func(int) bool) bool {
+	return p.p.match(m, pos, search, k) || k(pos)
+}
+
+// OneOf returns a pattern matching one of the specified alternative patterns.
+// The alternatives are tried in the order specified.
+func OneOf(ps ...Pattern) Pattern {
+	return oneOfPattern(ps)
+}
+
+type oneOfPattern []Pattern
+
+func (p oneOfPattern) match(m *matcher, pos int, search bool, k func(int) bool) bool {
+	for _, alt := range p {
+		if alt.match(m, pos, search, k) {
+			return true
+		}
+	}
+	return false
+}
+
+// Repeat returns a pattern matching the specified pattern at least min times
+// and at most max times; a negative max allows for any number of repetitions.
+// Repeat is greedy, matching as many repetitions as possible. Repetitions not
+// consuming any expressions are not considered.
+func Repeat(p Pattern, min, max int) Pattern {
+	return &repeatPattern{p: p, min: min, max: max}
+}
+
+type repeatPattern struct {
+	p        Pattern
+	min, max int
+}
+
+func (p *repeatPattern) match(m *matcher, pos int, search bool, k func(int) bool) bool {
+	var next func(count, pos int, search bool) bool
+	next = func(count, pos int, search bool) bool {
+		if p.max < 0 || count < p.max {
+			if p.p.match(m, pos, search, func(end int) bool {
+				return end > pos && next(count+1, end, true)
+			}) {
+				return true
+			}
+		}
+		return count >= p.min && k(pos)
+	}
+	return next(0, pos, search)
+}
+
+// Absent returns a negative lookahead pattern that matches without consuming
+// any expressions if the specified pattern cannot be matched. Inside a
+// [Sequence] this means that the specified pattern cannot be found in the
+// remaining expressions, while Next(Absent(p)) only checks the immediately
+// following expressions.
+func Absent(p Pattern) Pattern {
+	return &notPattern{p: p}
+}
+
+type notPattern struct {
+	p Pattern
+}
+
+func (p *notPattern) match(m *matcher, pos int, search bool, k func(int) bool) bool {
+	trail, caps := len(m.trail), len(m.caps)
+	found := p.p.match(m, pos, search, func(int) bool { return true })
+	m.trail, m.caps = m.trail[:trail], m.caps[:caps]
+	return !found && k(pos)
+}
+
+// Capture returns a pattern capturing the expressions matched by the specified
+// pattern under the specified name. Only expressions actually matched get
+// captured, not any expressions skipped in between.
+func Capture(name string, p Pattern) Pattern {
+	return &capturePattern{name: name, p: p}
+}
+
+type capturePattern struct {
+	name string
+	p    Pattern
+}
+
+func (p *capturePattern) match(m *matcher, pos int, search bool, k func(int) bool) bool {
+	from := len(m.trail)
+	return p.p.match(m, pos, search, func(end int) bool {
+		m.caps = append(m.caps, capture{name: p.name, from: from, to: len(m.trail)})
+		if k(end) {
+			return true
+		}
+		m.caps = m.caps[:len(m.caps)-1]
+		return false
+	})
+}
@@ -0,0 +1,175 @@
+// Copyright 2023 Harald Albrecht.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy
+// of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package pattern
+
+import (
+	"github.com/google/nftables/expr"
+	"github.com/thediveo/nufftables"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("expression patterns", func() {
+
+	payload := &expr.Payload{}
+	cmp1 := &expr.Cmp{Op: expr.CmpOpEq}
+	cmp2 := &expr.Cmp{Op: expr.CmpOpNeq}
+	counter := &expr.Counter{}
+	verdict := &expr.Verdict{Kind: expr.VerdictAccept}
+
+	exprs := nufftables.Expressions{payload, cmp1, counter, cmp2, verdict}
+
+	It("matches single expressions by type", func() {
+		rem, caps := Match(exprs, Capture("cmp", Type[*expr.Cmp]()))
+		Expect(rem).To(HaveExactElements(counter, cmp2, verdict))
+		Expect(caps).To(HaveKeyWithValue("cmp", ConsistOf(cmp1)))
+		Expect(Captured[*expr.Cmp](caps, "cmp")).To(BeIdenticalTo(cmp1))
+		Expect(Captured[*expr.Counter](caps, "cmp")).To(BeNil())
+		Expect(Captured[*expr.Cmp](caps, "foo")).To(BeNil())
+
+		rem, caps = Match(exprs, Capture("cmp", TypeFunc(func(cmp *expr.Cmp) bool {
+			return cmp.Op == expr.CmpOpNeq
+		})))
+		Expect(rem).To(HaveExactElements(verdict))
+		Expect(caps).To(HaveKeyWithValue("cmp", ConsistOf(cmp2)))
+
+		rem, caps = Match(exprs, Type[*expr.Masq]())
+		Expect(rem).To(BeNil())
+		Expect(caps).To(BeNil())
+
+		rem, caps = Match(exprs, Any())
+		Expect(rem).To(HaveLen(4))
+		Expect(caps).To(BeEmpty())
+	})
+
+	It("matches sequences, skipping other expressions", func() {
+		rem, caps := Match(exprs, Sequence(
+			Capture("payload", Type[*expr.Payload]()),
+			Capture("counter", Type[*expr.Counter]()),
+			Capture("verdict", Type[*expr.Verdict]()),
+		))
+		Expect(rem).To(BeEmpty())
+		Expect(caps).To(And(
+			HaveKeyWithValue("payload", ConsistOf(payload)),
+			HaveKeyWithValue("counter", ConsistOf(counter)),
+			HaveKeyWithValue("verdict", ConsistOf(verdict)),
+		))
+
+		_, caps = Match(exprs, Sequence(Type[*expr.Counter](), Type[*expr.Payload]()))
+		Expect(caps).To(BeNil())
+	})
+
+	It("matches strictly adjacent expressions", func() {
+		_, caps := Match(exprs, Sequence(
+			Type[*expr.Payload](),
+			Next(Capture("cmp", Type[*expr.Cmp]())),
+		))
+		Expect(caps).To(HaveKeyWithValue("cmp", ConsistOf(cmp1)))
+
+		_, caps = Match(exprs, Sequence(
+			Type[*expr.Payload](),
+			Next(Type[*expr.Counter]()),
+		))
+		Expect(caps).To(BeNil())
+
+		_, caps = Match(exprs, Next(Type[*expr.Cmp]()))
+		Expect(caps).To(BeNil())
+
+		// backtracks to find the cmp directly followed by the verdict.
+		_, caps = Match(exprs, Sequence(
+			Capture("cmp", Type[*expr.Cmp]()),
+			Next(Type[*expr.Verdict]()),
+		))
+		Expect(caps).To(HaveKeyWithValue("cmp", ConsistOf(cmp2)))
+	})
+
+	It("matches optional expressions", func() {
+		_, caps := Match(exprs, Sequence(
+			Optional(Capture("masq", Type[*expr.Masq]())),
+			Capture("counter", Type[*expr.Counter]()),
+		))
+		Expect(caps).NotTo(HaveKey("masq"))
+		Expect(caps).To(HaveKeyWithValue("counter", ConsistOf(counter)))
+
+		_, caps = Match(exprs, Sequence(
+			Optional(Capture("cmp", Type[*expr.Cmp]())),
+			Type[*expr.Counter](),
+		))
+		Expect(caps).To(HaveKeyWithValue("cmp", ConsistOf(cmp1)))
+	})
+
+	It("matches alternatives", func() {
+		_, caps := Match(exprs, Sequence(
+			Type[*expr.Counter](),
+			OneOf(
+				Capture("masq", Type[*expr.Masq]()),
+				Capture("verdict", Type[*expr.Verdict]()),
+			),
+		))
+		Expect(caps).NotTo(HaveKey("masq"))
+		Expect(caps).To(HaveKeyWithValue("verdict", ConsistOf(verdict)))
+	})
+
+	It("matches repetitions", func() {
+		_, caps := Match(exprs, Capture("cmps", Repeat(Type[*expr.Cmp](), 1, -1)))
+		Expect(caps).To(HaveKeyWithValue("cmps", HaveExactElements(cmp1, cmp2)))
+
+		_, caps = Match(exprs, Capture("cmps", Repeat(Type[*expr.Cmp](), 0, 1)))
+		Expect(caps).To(HaveKeyWithValue("cmps", HaveExactElements(cmp1)))
+
+		_, caps = Match(exprs, Repeat(Type[*expr.Cmp](), 3, -1))
+		Expect(caps).To(BeNil())
+
+		_, caps = Match(exprs, Sequence(
+			Repeat(Capture("cmp", Type[*expr.Cmp]()), 0, -1),
+			Type[*expr.Counter](),
+		))
+		Expect(caps).To(HaveKeyWithValue("cmp", HaveExactElements(cmp1)))
+
+		_, caps = Match(exprs, Capture("none", Repeat(Optional(Type[*expr.Masq]()), 0, -1)))
+		Expect(caps).To(HaveKeyWithValue("none", BeEmpty()))
+	})
+
+	It("matches negative lookaheads", func() {
+		_, caps := Match(exprs, Sequence(
+			Type[*expr.Counter](),
+			Absent(Type[*expr.Masq]()),
+		))
+		Expect(caps).NotTo(BeNil())
+
+		_, caps = Match(exprs, Sequence(
+			Type[*expr.Counter](),
+			Absent(Type[*expr.Verdict]()),
+		))
+		Expect(caps).To(BeNil())
+
+		_, caps = Match(exprs, Sequence(
+			Type[*expr.Counter](),
+			Next(Absent(Type[*expr.Verdict]())),
+			Capture("verdict", Type[*expr.Verdict]()),
+		))
+		Expect(caps).To(HaveKeyWithValue("verdict", ConsistOf(verdict)))
+
+		// a cmp that isn't followed by another cmp.
+		_, caps = Match(exprs, Sequence(
+			Capture("cmp", Type[*expr.Cmp]()),
+			Absent(Capture("other", Type[*expr.Cmp]())),
+		))
+		Expect(caps).To(HaveKeyWithValue("cmp", ConsistOf(cmp2)))
+		Expect(caps).NotTo(HaveKey("other"))
+	})
+
+})
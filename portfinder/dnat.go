@@ -16,11 +16,15 @@ package portfinder
 
 import (
 	"bytes"
+	"encoding/binary"
 	"net"
+	"strings"
 
+	"github.com/google/nftables/expr"
 	"github.com/google/nftables/xt"
 	"github.com/thediveo/nufftables"
 	"github.com/thediveo/nufftables/dsl"
+	"github.com/thediveo/nufftables/pattern"
 )
 
 // dnatWithIPsAndPorts are the flags that need to be set in order for the
@@ -35,39 +39,236 @@ var ipv4zero = net.ParseIP("0.0.0.0").To4()
 // ForwardedPort returns the port range forwarding if contained in the passed
 // [nufftables.Rule], otherwise nil.
 //
+// ForwardedPort understands port forwardings expressed by iptables-nft in
+// form of an xt “tcp” or “udp” match extension with an xt “DNAT” target, as
+// well as native nft port forwardings, such as “tcp dport 8080 dnat to
+// 10.0.0.1:80” and “ip daddr 192.168.0.1 tcp dport 8000-8010 dnat ip to
+// 10.0.0.1:9000” in inet tables, as used by Docker's nftables backend,
+// firewalld, incus, and hand-written rulesets.
+//
+// ForwardedPort returns the full address and port ranges forwarded to,
+// including port range shifts. For native DNATs to number generator and hash
+// maps, such as “dnat to numgen inc mod 2 map { 0 : 10.0.0.1, 1 : 10.0.0.2
+// }”, ForwardedPort returns the map destinations as Endpoints with their
+// shares of the traffic, with ForwardIP and the forwarded ports being those of
+// the first endpoint.
+//
+// ForwardedPort additionally returns the interface, source address, and
+// address type conditions of the rule, as well as a reference to the rule's
+// table, chain, and handle, if known. The port forwarding gets attributed to
+// its managing tool based on the names of the rule's chain and table, and the
+// rule's comment.
+//
 // ForwardedPort ensures that the returned IP addresses are always in their
 // canonical IPv4 format, and never in form of IPv4-mapped addresses.
 func ForwardedPort(rule nufftables.Rule) *ForwardedPortRange {
+	fwd := forwardedXtPort(rule)
+	if fwd == nil {
+		fwd = forwardedNativePort(rule)
+		if fwd == nil {
+			return nil
+		}
+	}
+	fwd.addConditions(&rule)
+	if rule.Rule != nil {
+		fwd.Handle = rule.Handle
+	}
+	if chain := rule.Chain; chain != nil && chain.Chain != nil {
+		fwd.Chain = chain.Name
+		if chain.Table != nil && chain.Table.Table != nil {
+			fwd.Family = nufftables.TableFamily(chain.Table.Family)
+			fwd.Table = chain.Table.Name
+		}
+	}
+	fwd.attribute(&rule)
+	return fwd
+}
+
+// xtPortForwarding matches the port range forwardings expressed by
+// iptables-nft in form of an xt “tcp” or “udp” match extension followed by an
+// xt “DNAT” target.
+var xtPortForwarding = pattern.Sequence(
+	pattern.Capture("ports", pattern.TypeFunc(func(match *expr.Match) bool {
+		_, proto, _, _ := dsl.MatchPortRange(nufftables.Expressions{match})
+		return proto != ""
+	})),
+	pattern.Capture("dnat", pattern.TypeFunc(func(target *expr.Target) bool {
+		_, dnat := dsl.TargetDNAT(nufftables.Expressions{target})
+		return dnat != nil
+	})),
+)
+
+// forwardedXtPort returns the port range forwarding expressed by
+// iptables-nft, if any, otherwise nil.
+func forwardedXtPort(rule nufftables.Rule) *ForwardedPortRange {
+	exprs := rule.Expressions()
 	// Pick up the match and target DNAT expressions and make sure that both are
 	// present and that the DNAT information contains both IP and port
 	// information. An optional original destination IP address match might be
 	// present to narrow down the port forwarding.
-	exprs, origIP := dsl.OptionalCompareIP(rule.Expressions())
-	exprs, proto, minPort, maxPort := dsl.MatchPortRange(exprs)
-	exprs, dnat := dsl.TargetDNAT(exprs)
-	if exprs == nil || dnat.Flags&dnatWithIPsAndPorts != dnatWithIPsAndPorts ||
+	_, caps := pattern.Match(exprs, xtPortForwarding)
+	if caps == nil {
+		return nil
+	}
+	_, proto, minPort, maxPort := dsl.MatchPortRange(caps["ports"])
+	_, dnat := dsl.TargetDNAT(caps["dnat"])
+	if dnat.Flags&dnatWithIPsAndPorts != dnatWithIPsAndPorts ||
 		minPort == 0 || dnat.MinPort == 0 {
 		return nil
 	}
+	v4 := dnat.MinIP.To4() != nil
+	origIP := origDestination(dsl.RuleAddrMatches(&rule), v4)
 	// In case we didn't find any original (host) destination IP address we
 	// return the unspecified IP address instead of nil. However, we ensure that
 	// we always return "canonical" IPv4 and not IPv4-mapped IPv6 addresses as
 	// this can terribly mess up API users further down the road.
 	if origIP == nil {
-		if dnat.MinIP.To4() == nil {
-			origIP = net.IPv6zero
-		} else {
-			origIP = ipv4zero // DON'T use the FUBAR'd net.IPv4zero
-		}
+		origIP = unspecifiedIP(v4)
 	}
-	return &ForwardedPortRange{
+	fwd := &ForwardedPortRange{
 		Protocol:       proto, // "tcp" or "udp"
 		IP:             origIP,
 		PortMin:        minPort,
 		PortMax:        maxPort,
 		ForwardIP:      dnat.MinIP,
+		ForwardIPMax:   dnat.MaxIP,
 		ForwardPortMin: dnat.MinPort,
+		ForwardPortMax: dnat.MaxPort,
 	}
+	if fwd.ForwardIPMax == nil {
+		fwd.ForwardIPMax = fwd.ForwardIP
+	}
+	if fwd.ForwardPortMax < fwd.ForwardPortMin {
+		fwd.ForwardPortMax = fwd.ForwardPortMin
+	}
+	if dnat.Flags&uint(xt.NatRangeProtoOffset) != 0 {
+		fwd.ForwardPortBase = dnat.BasePort
+	}
+	return fwd
+}
+
+// origDestination returns the original destination address from the
+// specified address matches, or nil. Only a match of a single original
+// destination address of the specified IP family narrows down a port
+// forwarding; source addresses, prefixes, and sets cannot be represented as a
+// single original destination address.
+func origDestination(matches []dsl.AddrMatch, v4 bool) net.IP {
+	for _, match := range matches {
+		if match.Direction != dsl.DestinationAddr || match.Op != dsl.OpEq ||
+			match.Is6() == v4 || !match.Prefix.IsSingleIP() {
+			continue
+		}
+		return net.IP(match.Prefix.Addr().AsSlice())
+	}
+	return nil
+}
+
+// forwardedNativePort returns the port range forwarding expressed using a
+// native nat statement together with native (or xt) port and address matches,
+// if any, otherwise nil. The destination port match must be a single port or
+// port range, while the DNAT must translate either to a fixed address (range)
+// or to a number generator or hash map of addresses, optionally concatenated
+// with ports. If the DNAT doesn't specify a port, then the ports are kept.
+func forwardedNativePort(rule nufftables.Rule) *ForwardedPortRange {
+	exprs := rule.Expressions()
+	_, dnat := dsl.TargetNAT(exprs, dsl.DNAT)
+	if dnat == nil {
+		return nil
+	}
+	var endpoints []Endpoint
+	if !dnat.HasAddr() {
+		if endpoints = spreadEndpoints(rule, dnat); len(endpoints) == 0 {
+			return nil
+		}
+	}
+	var ports *dsl.PortMatch
+	for _, match := range dsl.PortMatches(exprs) {
+		if match.Direction == dsl.DestinationPort {
+			match := match
+			ports = &match
+			break
+		}
+	}
+	if ports == nil || ports.Protocol == "" || ports.Invert ||
+		len(ports.Ranges) != 1 || ports.Ranges[0].Min == 0 {
+		return nil
+	}
+	fwd := &ForwardedPortRange{
+		Protocol:       ports.Protocol,
+		PortMin:        ports.Ranges[0].Min,
+		PortMax:        ports.Ranges[0].Max,
+		ForwardPortMin: ports.Ranges[0].Min,
+		ForwardPortMax: ports.Ranges[0].Max,
+	}
+	if dnat.HasPorts() && dnat.PortMin != 0 {
+		fwd.ForwardPortMin = dnat.PortMin
+		fwd.ForwardPortMax = dnat.PortMax
+		if fwd.ForwardPortMax < fwd.ForwardPortMin {
+			fwd.ForwardPortMax = fwd.ForwardPortMin
+		}
+		if dnat.Flags&xt.NatRangeProtoOffset != 0 {
+			fwd.ForwardPortBase = dnat.BasePort
+		}
+	}
+	if endpoints != nil {
+		for idx := range endpoints {
+			if endpoints[idx].Port == 0 {
+				endpoints[idx].Port = fwd.ForwardPortMin
+			}
+		}
+		fwd.Endpoints = endpoints
+		fwd.ForwardIP, fwd.ForwardIPMax = endpoints[0].IP, endpoints[0].IP
+		fwd.ForwardPortMin, fwd.ForwardPortMax = endpoints[0].Port, endpoints[0].Port
+	} else {
+		fwd.ForwardIP = net.IP(dnat.AddrMin.AsSlice())
+		fwd.ForwardIPMax = fwd.ForwardIP
+		if dnat.AddrMax.IsValid() {
+			fwd.ForwardIPMax = net.IP(dnat.AddrMax.AsSlice())
+		}
+	}
+	v4 := fwd.ForwardIP.To4() != nil
+	fwd.IP = origDestination(dsl.RuleAddrMatches(&rule), v4)
+	if fwd.IP == nil {
+		fwd.IP = unspecifiedIP(v4)
+	}
+	return fwd
+}
+
+// spreadEndpoints returns the endpoints of a DNAT to a number generator or
+// hash map, such as “dnat to numgen inc mod 2 map { 0 : 10.0.0.1, 1 :
+// 10.0.0.2 }”, or nil. The map data are either addresses or addresses
+// concatenated with ports, such as “10.0.0.1 . 8080”; as concatenations are
+// stored in registers, addresses are padded to multiples of 4 bytes. If the
+// map data lacks ports, then the endpoint ports are zero.
+func spreadEndpoints(rule nufftables.Rule, dnat *dsl.NAT) []Endpoint {
+	if rule.Chain == nil {
+		return nil
+	}
+	var endpoints []Endpoint
+	for _, entry := range dsl.ResolveSpread(rule.Chain.Table, dnat.AddrOperand) {
+		var ep Endpoint
+		switch len(entry.Data) {
+		case net.IPv4len, net.IPv6len:
+			ep.IP = net.IP(entry.Data)
+		case net.IPv4len + 4, net.IPv6len + 4:
+			ep.IP = net.IP(entry.Data[:len(entry.Data)-4])
+			ep.Port = binary.BigEndian.Uint16(entry.Data[len(entry.Data)-4:])
+		default:
+			continue
+		}
+		ep.Weight = entry.Weight
+		endpoints = append(endpoints, ep)
+	}
+	return endpoints
+}
+
+// unspecifiedIP returns the unspecified IPv4 or IPv6 address, always in
+// canonical format.
+func unspecifiedIP(v4 bool) net.IP {
+	if v4 {
+		return ipv4zero // DON'T use the FUBAR'd net.IPv4zero
+	}
+	return net.IPv6zero
 }
 
 // ForwardedPortOrder returns true if the forwarded port range a comes before b.
@@ -76,7 +277,8 @@ func ForwardedPort(rule nufftables.Rule) *ForwardedPortRange {
 //     addresses are less than IPv6 addresses *snicker*).
 //   - by the original (host) IP address,
 //   - by the original beginning of the port range,
-//   - finally by the IP address forwarding to.
+//   - by the IP address forwarding to,
+//   - finally by the table family, table name, chain name, and rule handle.
 func ForwardedPortOrder(a, b *ForwardedPortRange) int {
 	// sorts IPv4 before IPv6
 	av4 := len(a.IP) == net.IPv4len
@@ -95,5 +297,24 @@ func ForwardedPortOrder(a, b *ForwardedPortRange) int {
 	if c := int(a.PortMin) - int(b.PortMin); c != 0 {
 		return c
 	}
-	return bytes.Compare(a.ForwardIP, b.ForwardIP)
+	if c := bytes.Compare(a.ForwardIP, b.ForwardIP); c != 0 {
+		return c
+	}
+	// sorts by the originating rule
+	if c := int(a.Family) - int(b.Family); c != 0 {
+		return c
+	}
+	if c := strings.Compare(a.Table, b.Table); c != 0 {
+		return c
+	}
+	if c := strings.Compare(a.Chain, b.Chain); c != 0 {
+		return c
+	}
+	switch {
+	case a.Handle < b.Handle:
+		return -1
+	case a.Handle > b.Handle:
+		return 1
+	}
+	return 0
 }
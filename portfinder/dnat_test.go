@@ -16,11 +16,14 @@ package portfinder
 
 import (
 	"net"
+	"net/netip"
 
 	"github.com/google/nftables"
 	"github.com/google/nftables/expr"
 	"github.com/google/nftables/xt"
 	"github.com/thediveo/nufftables"
+	"github.com/thediveo/nufftables/nufftablestest"
+	"golang.org/x/sys/unix"
 
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
@@ -108,6 +111,20 @@ var _ = Describe("forwarded ports", func() {
 			Entry(nil, "fe80::1", "::1", 1),
 		)
 
+		It("finally by originating rule", func() {
+			a := &ForwardedPortRange{IP: ip("::1"), Family: nufftables.TableFamilyIPv4, Table: "nat", Chain: "DOCKER", Handle: 42}
+			b := *a
+			Expect(ForwardedPortOrder(a, &b)).To(HasOrder(0))
+			b.Handle = 1
+			Expect(ForwardedPortOrder(a, &b)).To(HasOrder(1))
+			b.Chain = "FOO"
+			Expect(ForwardedPortOrder(a, &b)).To(HasOrder(-1))
+			b.Table = "docker"
+			Expect(ForwardedPortOrder(a, &b)).To(HasOrder(1))
+			b.Family = nufftables.TableFamilyINet
+			Expect(ForwardedPortOrder(a, &b)).To(HasOrder(1))
+		})
+
 	})
 
 	Context("expression", func() {
@@ -157,7 +174,9 @@ var _ = Describe("forwarded ports", func() {
 				PortMin:        m.Info.(*xt.Tcp).DstPorts[0],
 				PortMax:        m.Info.(*xt.Tcp).DstPorts[1],
 				ForwardIP:      dnat4.Info.(*xt.NatRange2).MinIP,
+				ForwardIPMax:   dnat4.Info.(*xt.NatRange2).MaxIP,
 				ForwardPortMin: dnat4.Info.(*xt.NatRange2).MinPort,
+				ForwardPortMax: dnat4.Info.(*xt.NatRange2).MaxPort,
 			})))
 
 			r = nufftables.Rule{
@@ -171,7 +190,9 @@ var _ = Describe("forwarded ports", func() {
 				PortMin:        m.Info.(*xt.Tcp).DstPorts[0],
 				PortMax:        m.Info.(*xt.Tcp).DstPorts[1],
 				ForwardIP:      dnat6.Info.(*xt.NatRange2).MinIP,
+				ForwardIPMax:   dnat6.Info.(*xt.NatRange2).MaxIP,
 				ForwardPortMin: dnat6.Info.(*xt.NatRange2).MinPort,
+				ForwardPortMax: dnat6.Info.(*xt.NatRange2).MaxPort,
 			})))
 		})
 
@@ -182,6 +203,298 @@ var _ = Describe("forwarded ports", func() {
 			Expect(ForwardedPort(r)).To(BeNil())
 		})
 
+		It("returns shifted port ranges", func() {
+			fwd := ForwardedPort(nufftables.Rule{Rule: &nftables.Rule{Exprs: []expr.Any{
+				&expr.Match{Name: "tcp", Info: &xt.Tcp{DstPorts: [2]uint16{8000, 8010}}},
+				&expr.Target{Name: "DNAT", Info: &xt.NatRange2{
+					NatRange: xt.NatRange{
+						MinIP:   ip("10.0.0.1"),
+						MaxIP:   ip("10.0.0.1"),
+						MinPort: 9000,
+						MaxPort: 9010,
+						Flags:   dnatWithIPsAndPorts | uint(xt.NatRangeProtoOffset),
+					},
+					BasePort: 8000,
+				}},
+			}}})
+			Expect(fwd).NotTo(BeNil())
+			Expect(fwd.ForwardPortBase).To(Equal(uint16(8000)))
+			Expect(fwd.TargetPort(8005)).To(Equal(uint16(9005)))
+			Expect(fwd.String()).To(Equal("forwarding tcp from 0.0.0.0:8000-8010 to 10.0.0.1:9000-9010/8000"))
+		})
+
+		It("finds the original destination using the table family", func() {
+			table := &nufftables.Table{Table: &nftables.Table{Name: "nat", Family: nftables.TableFamilyIPv6}}
+			chain := &nufftables.Chain{Chain: &nftables.Chain{Name: "DOCKER"}, Table: table}
+			fwd := ForwardedPort(nufftables.Rule{Chain: chain, Rule: &nftables.Rule{Exprs: []expr.Any{
+				// -d fd00::1
+				&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: 24, Len: 16},
+				&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: ip("fd00::1")},
+				&expr.Match{Name: "tcp", Info: &xt.Tcp{DstPorts: [2]uint16{80, 80}}},
+				&expr.Target{Name: "DNAT", Info: &xt.NatRange2{
+					NatRange: xt.NatRange{
+						MinIP:   ip("fd00::42"),
+						MaxIP:   ip("fd00::42"),
+						MinPort: 8080,
+						MaxPort: 8080,
+						Flags:   dnatWithIPsAndPorts,
+					},
+				}},
+			}}})
+			Expect(fwd).NotTo(BeNil())
+			Expect(fwd.IP.String()).To(Equal("fd00::1"))
+			Expect(fwd.String()).To(HavePrefix("forwarding tcp from [fd00::1]:80 to [fd00::42]:8080"))
+		})
+
+		It("returns the conditions and originating rule", func() {
+			table := &nufftables.Table{Table: &nftables.Table{Name: "nat", Family: nftables.TableFamilyIPv4}}
+			chain := &nufftables.Chain{Chain: &nftables.Chain{Name: "DOCKER"}, Table: table}
+			iprange := make(xt.Unknown, 65)
+			copy(iprange[0:], []byte{10, 0, 0, 1})
+			copy(iprange[16:], []byte{10, 0, 0, 9})
+			iprange[64] = 0x01 // source range
+			fwd := ForwardedPort(nufftables.Rule{Chain: chain, Rule: &nftables.Rule{Handle: 42, Exprs: []expr.Any{
+				&expr.Meta{Key: expr.MetaKeyIIFNAME, Register: 1},
+				&expr.Cmp{Op: expr.CmpOpNeq, Register: 1, Data: []byte("docker0\x00")},
+				&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: 12, Len: 1},
+				&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{192}},
+				&expr.Match{Name: "iprange", Rev: 1, Info: &iprange},
+				&expr.Match{Name: "addrtype", Rev: 1, Info: &xt.AddrTypeV1{Dest: uint16(xt.AddrTypeLocal)}},
+				m, dnat4,
+			}}})
+			Expect(fwd).NotTo(BeNil())
+			Expect(fwd.Ifaces).To(HaveLen(1))
+			Expect(fwd.Sources).To(HaveLen(2))
+			Expect(fwd.AddrTypes).To(HaveLen(1))
+			Expect(fwd.String()).To(Equal(`forwarding tcp from 0.0.0.0:123-124 to 1.2.3.4-1.2.3.5:666-667 ` +
+				`if iifname != "docker0", ip saddr 192.0.0.0/8, ip saddr 10.0.0.1-10.0.0.9, addrtype --dst-type LOCAL ` +
+				`managed by docker (ip nat DOCKER handle 42)`))
+		})
+
+		It("doesn't mistake source addresses for the original destination", func() {
+			fwd := ForwardedPort(nufftables.Rule{Rule: &nftables.Rule{Exprs: []expr.Any{
+				// -s 192.168.1.5
+				&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: 12, Len: 4},
+				&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{192, 168, 1, 5}},
+				m, dnat4,
+			}}})
+			Expect(fwd).NotTo(BeNil())
+			Expect(fwd.IP).To(Equal(net.IP{0, 0, 0, 0}))
+			Expect(fwd.Sources).To(ConsistOf(HaveField("Prefix", netip.MustParsePrefix("192.168.1.5/32"))))
+
+			fwd = ForwardedPort(nufftables.Rule{Rule: &nftables.Rule{Exprs: []expr.Any{
+				// -d 192.168.1.5
+				&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: 16, Len: 4},
+				&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{192, 168, 1, 5}},
+				m, dnat4,
+			}}})
+			Expect(fwd).NotTo(BeNil())
+			Expect(fwd.IP.String()).To(Equal("192.168.1.5"))
+			Expect(fwd.Sources).To(BeEmpty())
+		})
+
+	})
+
+	Context("native expressions", func() {
+
+		payload := func(base expr.PayloadBase, offset, len uint32) *expr.Payload {
+			return &expr.Payload{DestRegister: 1, Base: base, Offset: offset, Len: len}
+		}
+
+		// meta nfproto ipv4 meta l4proto tcp
+		inet4tcp := []expr.Any{
+			&expr.Meta{Key: expr.MetaKeyNFPROTO, Register: 1},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{unix.NFPROTO_IPV4}},
+			&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{unix.IPPROTO_TCP}},
+		}
+
+		rule := func(exprs ...[]expr.Any) nufftables.Rule {
+			var all []expr.Any
+			for _, e := range exprs {
+				all = append(all, e...)
+			}
+			return nufftables.Rule{Rule: &nftables.Rule{Exprs: all}}
+		}
+
+		It("finds a native port range forwarding in inet tables", func() {
+			// ip daddr 192.168.0.1 tcp dport 8000-8010 dnat ip to 10.0.0.1:9000
+			Expect(ForwardedPort(rule(inet4tcp, []expr.Any{
+				payload(expr.PayloadBaseNetworkHeader, 16, 4),
+				&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{192, 168, 0, 1}},
+				payload(expr.PayloadBaseTransportHeader, 2, 2),
+				&expr.Range{Op: expr.CmpOpEq, Register: 1,
+					FromData: []byte{0x1f, 0x40}, ToData: []byte{0x1f, 0x4a}},
+				&expr.Immediate{Register: 1, Data: []byte{10, 0, 0, 1}},
+				&expr.Immediate{Register: 2, Data: []byte{0x23, 0x28}},
+				&expr.NAT{Type: expr.NATTypeDestNAT, Family: unix.NFPROTO_IPV4,
+					RegAddrMin: 1, RegProtoMin: 2},
+			}))).To(HaveValue(Equal(ForwardedPortRange{
+				Protocol:       "tcp",
+				IP:             ip("192.168.0.1"),
+				PortMin:        8000,
+				PortMax:        8010,
+				ForwardIP:      ip("10.0.0.1"),
+				ForwardIPMax:   ip("10.0.0.1"),
+				ForwardPortMin: 9000,
+				ForwardPortMax: 9000,
+			})))
+		})
+
+		It("finds a native IPv6 port forwarding keeping the port", func() {
+			// tcp dport 80 dnat to [fe80::1]
+			Expect(ForwardedPort(rule([]expr.Any{
+				&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
+				&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{unix.IPPROTO_TCP}},
+				payload(expr.PayloadBaseTransportHeader, 2, 2),
+				&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{0, 80}},
+				&expr.Immediate{Register: 1, Data: ip("fe80::1")},
+				&expr.NAT{Type: expr.NATTypeDestNAT, Family: unix.NFPROTO_IPV6, RegAddrMin: 1},
+			}))).To(HaveValue(Equal(ForwardedPortRange{
+				Protocol:       "tcp",
+				IP:             ip("::"),
+				PortMin:        80,
+				PortMax:        80,
+				ForwardIP:      ip("fe80::1"),
+				ForwardIPMax:   ip("fe80::1"),
+				ForwardPortMin: 80,
+				ForwardPortMax: 80,
+			})))
+		})
+
+		It("finds a native port forwarding to an address range", func() {
+			// tcp dport 80 dnat ip to 10.0.0.1-10.0.0.3:8080-8082
+			fwd := ForwardedPort(rule(inet4tcp, []expr.Any{
+				payload(expr.PayloadBaseTransportHeader, 2, 2),
+				&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{0, 80}},
+				&expr.Immediate{Register: 1, Data: []byte{10, 0, 0, 1}},
+				&expr.Immediate{Register: 2, Data: []byte{10, 0, 0, 3}},
+				&expr.Immediate{Register: 3, Data: []byte{0x1f, 0x90}},
+				&expr.Immediate{Register: 4, Data: []byte{0x1f, 0x92}},
+				&expr.NAT{Type: expr.NATTypeDestNAT, Family: unix.NFPROTO_IPV4,
+					RegAddrMin: 1, RegAddrMax: 2, RegProtoMin: 3, RegProtoMax: 4},
+			}))
+			Expect(fwd).NotTo(BeNil())
+			Expect(fwd.ForwardIPMax).To(Equal(ip("10.0.0.3")))
+			Expect(fwd.ForwardPortMax).To(Equal(uint16(8082)))
+			Expect(fwd.String()).To(Equal("forwarding tcp from 0.0.0.0:80 to 10.0.0.1-10.0.0.3:8080-8082"))
+		})
+
+		It("finds native port forwardings to numgen maps", func() {
+			table := &nufftables.Table{
+				Table:      &nftables.Table{Name: "lb", Family: nftables.TableFamilyIPv4},
+				SetsByName: map[string]*nufftables.Set{},
+			}
+			table.SetsByName["__map0"] = &nufftables.Set{Table: table,
+				Set: &nftables.Set{Name: "__map0", IsMap: true},
+				Elements: []nftables.SetElement{
+					{Key: hostUint32(0), Val: []byte{10, 0, 0, 1, 0x1f, 0x90, 0, 0}},
+					{Key: hostUint32(1), Val: []byte{10, 0, 0, 2, 0x1f, 0x91, 0, 0}},
+					{Key: hostUint32(2), Val: []byte{10, 0, 0, 2, 0x1f, 0x91, 0, 0}},
+				}}
+			chain := &nufftables.Chain{Chain: &nftables.Chain{Name: "prerouting"}, Table: table}
+			// tcp dport 80 dnat ip to numgen inc mod 3 map { 0 : 10.0.0.1 . 8080, 1-2 : 10.0.0.2 . 8081 }
+			r := rule(inet4tcp, []expr.Any{
+				payload(expr.PayloadBaseTransportHeader, 2, 2),
+				&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{0, 80}},
+				&expr.Numgen{Register: 1, Modulus: 3, Type: unix.NFT_NG_INCREMENTAL},
+				&expr.Lookup{SourceRegister: 1, DestRegister: 1, IsDestRegSet: true, SetName: "__map0"},
+				&expr.NAT{Type: expr.NATTypeDestNAT, Family: unix.NFPROTO_IPV4,
+					RegAddrMin: 1, RegProtoMin: unix.NFT_REG32_01},
+			})
+			r.Chain = chain
+			fwd := ForwardedPort(r)
+			Expect(fwd).NotTo(BeNil())
+			Expect(fwd.Endpoints).To(HaveExactElements(
+				Endpoint{IP: ip("10.0.0.1"), Port: 8080, Weight: 1.0 / 3},
+				Endpoint{IP: ip("10.0.0.2"), Port: 8081, Weight: 2.0 / 3},
+			))
+			Expect(fwd.ForwardIP).To(Equal(ip("10.0.0.1")))
+			Expect(fwd.ForwardPortMin).To(Equal(uint16(8080)))
+			Expect(fwd.String()).To(Equal("forwarding tcp from 0.0.0.0:80 to " +
+				"10.0.0.1:8080 (33.33%), 10.0.0.2:8081 (66.67%) (ip lb prerouting handle 0)"))
+
+			r.Chain = nil
+			Expect(ForwardedPort(r)).To(BeNil())
+		})
+
+		DescribeTable("finds native port forwardings to spreading maps read from the kernel",
+			func(spread []expr.Any) {
+				// tcp dport 80 dnat to ... map { 0 : 10.0.0.1, 1 : 10.0.0.2 }
+				conn := nufftablestest.NewConn(nufftablestest.Ruleset{{
+					Name:   "lb",
+					Family: nftables.TableFamilyIPv4,
+					Sets: []nufftablestest.Set{{
+						Name:      "backends",
+						KeyType:   nftables.TypeInteger,
+						DataType:  nftables.TypeIPAddr,
+						IsMap:     true,
+						Anonymous: true,
+						Elements: []nftables.SetElement{
+							{Key: hostUint32(0), Val: []byte{10, 0, 0, 1}},
+							{Key: hostUint32(1), Val: []byte{10, 0, 0, 2}},
+						},
+					}},
+					Chains: []nufftablestest.Chain{{
+						Name:     "prerouting",
+						Type:     nftables.ChainTypeNAT,
+						Hook:     nftables.ChainHookPrerouting,
+						Priority: nftables.ChainPriorityNATDest,
+						Rules: []nufftablestest.Rule{
+							append(append(append(tcp(),
+								payload(expr.PayloadBaseTransportHeader, 2, 2),
+								&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{0, 80}}),
+								spread...),
+								&expr.Lookup{SourceRegister: 1, DestRegister: 1, IsDestRegSet: true, SetName: "backends"},
+								&expr.NAT{Type: expr.NATTypeDestNAT, Family: unix.NFPROTO_IPV4, RegAddrMin: 1}),
+						},
+					}},
+				}})
+				tables, err := nufftables.GetAllTables(conn)
+				Expect(err).NotTo(HaveOccurred())
+				fwds := ForwardedPorts(tables)
+				Expect(fwds).To(HaveLen(1))
+				Expect(fwds[0].Endpoints).To(HaveExactElements(
+					Endpoint{IP: ip("10.0.0.1"), Port: 80, Weight: 0.5},
+					Endpoint{IP: ip("10.0.0.2"), Port: 80, Weight: 0.5},
+				))
+				Expect(fwds[0].String()).To(MatchRegexp(
+					`^forwarding tcp from 0\.0\.0\.0:80 to 10\.0\.0\.1:80 \(50%\), 10\.0\.0\.2:80 \(50%\) ` +
+						`\(ip lb prerouting handle \d+\)$`))
+			},
+			Entry("numgen inc mod 2", []expr.Any{
+				&expr.Numgen{Register: 1, Modulus: 2, Type: unix.NFT_NG_INCREMENTAL},
+			}),
+			Entry("jhash ip saddr mod 2", []expr.Any{
+				payload(expr.PayloadBaseNetworkHeader, 12, 4),
+				&expr.Hash{SourceRegister: 1, DestRegister: 1, Length: 4, Modulus: 2,
+					Type: expr.HashTypeJenkins},
+			}),
+		)
+
+		It("skips native DNATs without a single port range or address", func() {
+			dnat := []expr.Any{
+				&expr.Immediate{Register: 1, Data: []byte{10, 0, 0, 1}},
+				&expr.NAT{Type: expr.NATTypeDestNAT, Family: unix.NFPROTO_IPV4, RegAddrMin: 1},
+			}
+			Expect(ForwardedPort(rule(inet4tcp, dnat))).To(BeNil())
+			Expect(ForwardedPort(rule(inet4tcp, []expr.Any{
+				payload(expr.PayloadBaseTransportHeader, 2, 2),
+				&expr.Cmp{Op: expr.CmpOpNeq, Register: 1, Data: []byte{0, 80}},
+			}, dnat))).To(BeNil())
+			Expect(ForwardedPort(rule(inet4tcp, []expr.Any{
+				payload(expr.PayloadBaseTransportHeader, 2, 2),
+				&expr.Lookup{SourceRegister: 1, SetName: "ports"},
+			}, dnat))).To(BeNil())
+			Expect(ForwardedPort(rule(inet4tcp, []expr.Any{
+				payload(expr.PayloadBaseTransportHeader, 2, 2),
+				&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{0, 80}},
+				payload(expr.PayloadBaseNetworkHeader, 16, 4),
+				&expr.Lookup{SourceRegister: 1, DestRegister: 1, IsDestRegSet: true, SetName: "targets"},
+				&expr.NAT{Type: expr.NATTypeDestNAT, Family: unix.NFPROTO_IPV4, RegAddrMin: 1},
+			}))).To(BeNil())
+		})
+
 	})
 
 })
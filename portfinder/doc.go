@@ -1,5 +1,58 @@
 /*
 Package portfinder helps with reasoning about rule expressions about port
 forwarding in combination with destination NAT (“DNAT”).
+
+[ForwardedPort] detects port forwardings created by iptables-nft using xt
+match extensions and the xt “DNAT” target, as well as native port forwardings
+using payload matches and nft's dnat statement, such as “tcp dport 8080 dnat ip
+to 10.0.0.1:80”.
+
+[AnalyzeForwards] follows the jumps and gotos from all base chains of type
+“nat” hooked at prerouting or output ([NATBaseChains]), regardless of table
+names and families, accumulating the match conditions along the way and
+telling active port forwardings from dead ones. [ForwardedPorts] returns only
+the active port forwardings.
+
+Port forwardings report the full address and port ranges forwarded to,
+including port range shifts ([ForwardedPortRange.TargetPort]). When traffic is
+spread across multiple destinations, either by rules with xt “statistic”
+matches as used by kube-proxy in iptables mode, or by number generator and
+hash maps, such as “dnat to numgen inc mod 2 map { 0 : 10.0.0.1, 1 : 10.0.0.2
+}”, the port forwarding lists all destinations as [Endpoint] elements together
+with their shares of the traffic.
+
+Port forwardings are attributed to the tools managing them ([Manager]) based
+on the chain and table names along the way to the forwarding rule: Docker's
+“DOCKER” chain and “docker” table, the CNI portmap plugin's
+“CNI-HOSTPORT-DNAT” and “CNI-DN-*” chains and “cni_hostport” table,
+netavark's “NETAVARK-*” and “nv_*” chains and “netavark” table, as well as
+libvirt's “LIBVIRT_*” chains and “libvirt*” tables. The network names and
+container IDs embedded in rule comments, such as “dnat name: "cbr0" id:
+"4d0c…"”, and in netavark's nftables chain names are reported too.
+
+[Redirections] finds the traffic redirected to local ports instead, using the
+xt “REDIRECT” target or nft's redir statement in “nat” chains, as well as the
+xt “TPROXY” target or nft's tproxy statement in “filter” chains hooked at
+prerouting, such as in iptables-nft's “mangle” table. Service mesh sidecars,
+such as Istio and Linkerd, exempt their own traffic from redirection by
+earlier rules returning it, such as “-m owner --uid-owner 1337 -j RETURN”;
+each [Redirection] thus lists such [Exclusion] rules together with their
+interface, address, port, and socket owner conditions.
+
+[EgressNATs] covers the outgoing direction: it finds the source networks that
+get masqueraded or SNATed to which addresses on which output interfaces, using
+the xt “MASQUERADE”, “SNAT”, and “NETMAP” targets or nft's masq and snat
+statements in “nat” chains hooked at postrouting. Each [EgressNAT] lists its
+exclusions, such as kube-proxy's “-m mark ! --mark 0x4000/0x4000 -j RETURN”,
+and [EgressNATOrder] sorts egress NATs by their source networks.
+
+A DNAT rule alone doesn't make a port reachable, as the filter chains hooked
+at forward, such as Docker's “DOCKER-USER”, “DOCKER-ISOLATION-STAGE-1”, and
+“DOCKER” chains, might still drop the forwarded traffic. [CheckForward] and
+[CheckForwards] thus evaluate these chains for new connections to the
+addresses and ports forwarded to, deciding rule conditions using the
+conditions of the port forwarding itself, and report each port forwarding in
+a [ForwardCheck] as [Open], [Blocked], or [Conditional], together with the
+deciding rule and its undecided conditions, such as “iifname "br-4d0c…"”.
 */
 package portfinder
@@ -0,0 +1,284 @@
+// Copyright 2023 Harald Albrecht.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy
+// of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package portfinder
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/xt"
+	"github.com/thediveo/nufftables"
+	"github.com/thediveo/nufftables/dsl"
+	"golang.org/x/exp/slices"
+	"golang.org/x/sys/unix"
+)
+
+// EgressNAT describes source NAT of outgoing traffic, that is, which source
+// networks get masqueraded or SNATed to which addresses on which output
+// interfaces, regardless of whether expressed using the xt “MASQUERADE”,
+// “SNAT”, and “NETMAP” targets of iptables-nft, or natively using nft's masq
+// and snat statements.
+type EgressNAT struct {
+	// Type is either [dsl.Masquerade], [dsl.SNAT], or [dsl.Netmap].
+	Type dsl.NATType
+	// Protocol is the transport protocol translated, such as "tcp", or empty
+	// if not restricted.
+	Protocol string
+	// TrafficMatch are the conditions accumulated along the way to the
+	// translating rule and of the rule itself, such as Docker's “ip saddr
+	// 172.17.0.0/16” and “oifname != "docker0"”.
+	TrafficMatch
+	// ToIP and ToIPMax are the address range translated to; they are nil when
+	// masquerading to the address of the output interface.
+	ToIP, ToIPMax net.IP
+	// ToPortMin and ToPortMax are the port range translated to; they are zero
+	// if the ports are only changed as necessary.
+	ToPortMin, ToPortMax uint16
+	// Flags are the NAT range flags, such as [xt.NatRangeProtoRandomFully].
+	Flags xt.NatRangeFlags
+	// Exclusions lists the traffic exempted from this translation by earlier
+	// rules, such as kube-proxy's “-m mark ! --mark 0x4000/0x4000 -j RETURN”.
+	Exclusions []Exclusion
+
+	// Rule is the translating rule, and Path lists the rules jumping (or
+	// going) from a base chain to the chain of the translating rule, starting
+	// with the rule in the base chain.
+	Rule *nufftables.Rule
+	Path []*nufftables.Rule
+
+	// Family, Table, Chain, and Handle reference the translating rule.
+	Family nufftables.TableFamily
+	Table  string
+	Chain  string
+	Handle uint64
+}
+
+// String returns the egress NAT in plain textual format, such as
+// “masquerading any protocol to interface address if ip saddr 172.17.0.0/16,
+// oifname != "docker0" (ip nat POSTROUTING handle 5)”, listing the conditions
+// after “if” and the exclusions after “unless”.
+func (e *EgressNAT) String() string {
+	var b strings.Builder
+	switch e.Type {
+	case dsl.Masquerade:
+		b.WriteString("masquerading ")
+	case dsl.Netmap:
+		b.WriteString("netmapping ")
+	default:
+		b.WriteString("snatting ")
+	}
+	if e.Protocol != "" {
+		b.WriteString(e.Protocol)
+	} else {
+		b.WriteString("any protocol")
+	}
+	b.WriteString(" to ")
+	if e.ToIP != nil {
+		to := e.ToIP.String()
+		if e.ToIPMax != nil && !e.ToIPMax.Equal(e.ToIP) {
+			to += "-" + e.ToIPMax.String()
+		}
+		if e.ToPortMin != 0 && e.ToIP.To4() == nil {
+			to = "[" + to + "]"
+		}
+		b.WriteString(to)
+	} else {
+		b.WriteString("interface address")
+	}
+	if e.ToPortMin != 0 {
+		b.WriteString(":" + portRangeString(e.ToPortMin, e.ToPortMax))
+	}
+	if e.Flags&xt.NatRangeProtoRandom != 0 {
+		b.WriteString(" random")
+	}
+	if e.Flags&xt.NatRangeProtoRandomFully != 0 {
+		b.WriteString(" fully-random")
+	}
+	if e.Flags&xt.NatRangePersistent != 0 {
+		b.WriteString(" persistent")
+	}
+	if conds := e.conditions(); len(conds) != 0 {
+		b.WriteString(" if " + strings.Join(conds, ", "))
+	}
+	if len(e.Exclusions) != 0 {
+		excls := make([]string, 0, len(e.Exclusions))
+		for _, excl := range e.Exclusions {
+			excls = append(excls, excl.String())
+		}
+		b.WriteString(" unless " + strings.Join(excls, "; "))
+	}
+	if e.Table != "" {
+		fmt.Fprintf(&b, " (%s %s %s handle %d)", e.Family, e.Table, e.Chain, e.Handle)
+	}
+	return b.String()
+}
+
+// EgressNATOf returns the egress NAT of the specified rule, or nil if the rule
+// doesn't masquerade or SNAT. Only the rule's own conditions are taken into
+// account; see [EgressNATs] for also taking the conditions and exclusions
+// along the way to the rule into account.
+func EgressNATOf(rule nufftables.Rule) *EgressNAT {
+	_, nat := dsl.TargetNAT(rule.Expressions(), dsl.Masquerade, dsl.SNAT, dsl.Netmap)
+	if nat == nil {
+		return nil
+	}
+	e := &EgressNAT{Type: nat.Type, Flags: nat.Flags, Rule: &rule}
+	if nat.HasAddr() {
+		e.ToIP = net.IP(nat.AddrMin.AsSlice())
+		e.ToIPMax = e.ToIP
+		if nat.AddrMax.IsValid() {
+			e.ToIPMax = net.IP(nat.AddrMax.AsSlice())
+		}
+	}
+	if nat.HasPorts() && nat.PortMin != 0 {
+		e.ToPortMin, e.ToPortMax = nat.PortMin, nat.PortMax
+		if e.ToPortMax < e.ToPortMin {
+			e.ToPortMax = e.ToPortMin
+		}
+	}
+	if rule.Rule != nil {
+		e.Handle = rule.Handle
+	}
+	if chain := rule.Chain; chain != nil && chain.Chain != nil {
+		e.Chain = chain.Name
+		if chain.Table != nil && chain.Table.Table != nil {
+			e.Family = nufftables.TableFamily(chain.Table.Family)
+			e.Table = chain.Table.Name
+		}
+	}
+	e.add(&rule)
+	e.Protocol = ruleProtocol(&rule, nil)
+	return e
+}
+
+// EgressNATs returns the egress NATs found in the specified tables, sorted
+// using [EgressNATOrder].
+//
+// EgressNATs follows the jump and goto verdicts, including verdict maps,
+// starting from the base chains of type “nat” hooked at postrouting or input,
+// regardless of the names and families of their tables. Along each path,
+// EgressNATs accumulates the conditions of the jumping rules, as well as the
+// conditions of earlier rules ending the evaluation of their chains as
+// Exclusions. Rules shadowed by an earlier unconditional rule ending the
+// evaluation of its chain are skipped.
+func EgressNATs(tables nufftables.TableMap) []*EgressNAT {
+	egresses := []*EgressNAT{}
+	walkFrom(tables, isSNATBaseChain, func(rule *nufftables.Rule, path []*nufftables.Rule, exclusions []Exclusion) {
+		e := EgressNATOf(*rule)
+		if e == nil {
+			return
+		}
+		// The conditions along the path come before the rule's own
+		// conditions.
+		e.prepend(path)
+		e.Protocol = ruleProtocol(rule, path)
+		e.Exclusions = exclusions
+		e.Rule = rule
+		e.Path = path
+		egresses = append(egresses, e)
+	})
+	slices.SortStableFunc(egresses, EgressNATOrder)
+	return egresses
+}
+
+// isSNATBaseChain returns true if the specified chain is a base chain of type
+// “nat” hooked at postrouting or input of a table of the ip, ip6, or inet
+// family.
+func isSNATBaseChain(chain *nufftables.Chain) bool {
+	if chain.Chain == nil || chain.Table == nil || chain.Hooknum == nil ||
+		chain.Type != nftables.ChainTypeNAT {
+		return false
+	}
+	switch chain.Table.Family {
+	case nftables.TableFamilyIPv4, nftables.TableFamilyIPv6, nftables.TableFamilyINet:
+	default:
+		return false
+	}
+	switch *chain.Hooknum {
+	case unix.NF_INET_POST_ROUTING, unix.NF_INET_LOCAL_IN:
+		return true
+	}
+	return false
+}
+
+// EgressNATOrder returns a negative number if the egress NAT a comes before b,
+// a positive number if a comes after b, and zero if they are the same. The
+// sorting order is defined as follows:
+//   - egress NATs without source address conditions come first, followed by
+//     IPv4 and finally IPv6 source networks,
+//   - by the first source network address,
+//   - by the address translated to, with masquerading first,
+//   - finally by the table family, table name, chain name, and rule handle.
+func EgressNATOrder(a, b *EgressNAT) int {
+	asrc, bsrc := a.sourceAddr(), b.sourceAddr()
+	if c := addrRank(asrc) - addrRank(bsrc); c != 0 {
+		return c
+	}
+	if c := asrc.Compare(bsrc); c != 0 {
+		return c
+	}
+	if c := bytes.Compare(a.ToIP, b.ToIP); c != 0 {
+		return c
+	}
+	if c := int(a.Family) - int(b.Family); c != 0 {
+		return c
+	}
+	if c := strings.Compare(a.Table, b.Table); c != 0 {
+		return c
+	}
+	if c := strings.Compare(a.Chain, b.Chain); c != 0 {
+		return c
+	}
+	switch {
+	case a.Handle < b.Handle:
+		return -1
+	case a.Handle > b.Handle:
+		return 1
+	}
+	return 0
+}
+
+// sourceAddr returns the (first) address of the first source network
+// condition that isn't inverted, or the zero address.
+func (e *EgressNAT) sourceAddr() netip.Addr {
+	for idx := range e.Sources {
+		src := &e.Sources[idx]
+		if src.Inverted() {
+			continue
+		}
+		switch {
+		case src.Prefix.IsValid():
+			return src.Prefix.Addr()
+		case src.From.IsValid():
+			return src.From
+		}
+	}
+	return netip.Addr{}
+}
+
+// addrRank ranks the zero address before IPv4 before IPv6 addresses.
+func addrRank(addr netip.Addr) int {
+	switch {
+	case !addr.IsValid():
+		return 0
+	case addr.Is4():
+		return 1
+	}
+	return 2
+}
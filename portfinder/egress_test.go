@@ -0,0 +1,223 @@
+// Copyright 2023 Harald Albrecht.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy
+// of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package portfinder
+
+import (
+	"net/netip"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"github.com/google/nftables/xt"
+	"github.com/thediveo/nufftables"
+	"github.com/thediveo/nufftables/dsl"
+	"github.com/thediveo/nufftables/nufftablestest"
+	"golang.org/x/sys/unix"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("egress NAT", func() {
+
+	It("finds masquerading and SNAT with their exclusions", func() {
+		conn := nufftables.NewMemConn()
+		nat := &nftables.Table{Name: "nat", Family: nftables.TableFamilyIPv4}
+		postrouting := &nftables.Chain{Name: "POSTROUTING", Table: nat,
+			Type: nftables.ChainTypeNAT, Hooknum: nftables.ChainHookPostrouting}
+		prerouting := &nftables.Chain{Name: "PREROUTING", Table: nat,
+			Type: nftables.ChainTypeNAT, Hooknum: nftables.ChainHookPrerouting}
+		kube := &nftables.Chain{Name: "KUBE-POSTROUTING", Table: nat}
+		conn.AddChain(postrouting)
+		conn.AddChain(prerouting)
+		conn.AddChain(kube)
+		conn.AddRule(&nftables.Rule{Table: nat, Chain: postrouting, Exprs: []expr.Any{
+			&expr.Verdict{Kind: expr.VerdictJump, Chain: "KUBE-POSTROUTING"}}})
+		conn.AddRule(&nftables.Rule{Table: nat, Chain: postrouting, Exprs: append(
+			nufftablestest.SAddr4("172.17.0.0/16"),
+			&expr.Meta{Key: expr.MetaKeyOIFNAME, Register: 1},
+			&expr.Cmp{Op: expr.CmpOpNeq, Register: 1, Data: []byte("docker0\x00")},
+			&expr.Target{Name: "MASQUERADE", Info: &xt.NatIPv4MultiRangeCompat{{}}})})
+		mark := make(xt.Unknown, 9)
+		copy(mark[0:], hostUint32(0x4000))
+		copy(mark[4:], hostUint32(0x4000))
+		mark[8] = 1
+		conn.AddRule(&nftables.Rule{Table: nat, Chain: kube, Exprs: []expr.Any{
+			&expr.Match{Name: "mark", Rev: 1, Info: &mark},
+			&expr.Verdict{Kind: expr.VerdictReturn}}})
+		conn.AddRule(&nftables.Rule{Table: nat, Chain: kube, Exprs: []expr.Any{
+			&expr.Target{Name: "MASQUERADE", Info: &xt.NatIPv4MultiRangeCompat{{
+				Flags: uint(xt.NatRangeProtoRandomFully)}}}}})
+		// SNAT in a prerouting chain must be ignored.
+		conn.AddRule(&nftables.Rule{Table: nat, Chain: prerouting, Exprs: []expr.Any{
+			&expr.Target{Name: "MASQUERADE", Info: &xt.NatIPv4MultiRangeCompat{{}}}}})
+
+		egress := &nftables.Table{Name: "egress", Family: nftables.TableFamilyINet}
+		srcnat := &nftables.Chain{Name: "srcnat", Table: egress,
+			Type: nftables.ChainTypeNAT, Hooknum: nftables.ChainHookPostrouting}
+		conn.AddChain(srcnat)
+		conn.AddRule(&nftables.Rule{Table: egress, Chain: srcnat, Exprs: append(append([]expr.Any{
+			&expr.Meta{Key: expr.MetaKeyNFPROTO, Register: 1},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{unix.NFPROTO_IPV4}},
+			&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{unix.IPPROTO_TCP}},
+		}, nufftablestest.SAddr4("10.0.0.0/8")...),
+			&expr.Meta{Key: expr.MetaKeyOIFNAME, Register: 1},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte("eth0\x00")},
+			&expr.Immediate{Register: 1, Data: []byte{192, 0, 2, 1}},
+			&expr.Immediate{Register: 2, Data: []byte{0x04, 0x00}},
+			&expr.Immediate{Register: 3, Data: []byte{0x08, 0x00}},
+			&expr.NAT{Type: expr.NATTypeSourceNAT, Family: unix.NFPROTO_IPV4,
+				RegAddrMin: 1, RegProtoMin: 2, RegProtoMax: 3})})
+
+		tables, err := nufftables.GetAllTables(conn)
+		Expect(err).NotTo(HaveOccurred())
+		egresses := EgressNATs(tables)
+		Expect(egresses).To(HaveLen(3))
+
+		Expect(egresses[0].Type).To(Equal(dsl.Masquerade))
+		Expect(egresses[0].Path).To(HaveLen(1))
+		Expect(egresses[0].String()).To(MatchRegexp(
+			`^masquerading any protocol to interface address fully-random ` +
+				`unless rule KUBE-POSTROUTING handle \d+ \(ip nat KUBE-POSTROUTING handle \d+\)$`))
+
+		Expect(egresses[1].Type).To(Equal(dsl.SNAT))
+		Expect(egresses[1].Protocol).To(Equal("tcp"))
+		Expect(egresses[1].Ifaces).To(HaveLen(1))
+		Expect(egresses[1].ToIP.String()).To(Equal("192.0.2.1"))
+		Expect(egresses[1].String()).To(MatchRegexp(
+			`^snatting tcp to 192\.0\.2\.1:1024-2048 if oifname "eth0", ip saddr 10\.0\.0\.0/8 ` +
+				`\(inet egress srcnat handle \d+\)$`))
+
+		Expect(egresses[2].String()).To(MatchRegexp(
+			`^masquerading any protocol to interface address if oifname != "docker0", ip saddr 172\.17\.0\.0/16 ` +
+				`\(ip nat POSTROUTING handle \d+\)$`))
+	})
+
+	It("treats earlier translating rules as exclusions or shadowing", func() {
+		conn := nufftables.NewMemConn()
+		nat := &nftables.Table{Name: "nat", Family: nftables.TableFamilyIPv4}
+		postrouting := &nftables.Chain{Name: "POSTROUTING", Table: nat,
+			Type: nftables.ChainTypeNAT, Hooknum: nftables.ChainHookPostrouting}
+		conn.AddChain(postrouting)
+		conn.AddRule(&nftables.Rule{Table: nat, Chain: postrouting, Exprs: append(
+			nufftablestest.SAddr4("10.0.0.0/8"),
+			&expr.Target{Name: "MASQUERADE", Info: &xt.NatIPv4MultiRangeCompat{{}}})})
+		conn.AddRule(&nftables.Rule{Table: nat, Chain: postrouting, Exprs: []expr.Any{
+			&expr.Target{Name: "SNAT", Info: &xt.NatIPv4MultiRangeCompat{{
+				Flags: uint(xt.NatRangeMapIPs),
+				MinIP: []byte{192, 0, 2, 1},
+				MaxIP: []byte{192, 0, 2, 1},
+			}}}}})
+		// shadowed by the unconditional SNAT rule.
+		conn.AddRule(&nftables.Rule{Table: nat, Chain: postrouting, Exprs: []expr.Any{
+			&expr.Target{Name: "MASQUERADE", Info: &xt.NatIPv4MultiRangeCompat{{}}}}})
+
+		tables, err := nufftables.GetAllTables(conn)
+		Expect(err).NotTo(HaveOccurred())
+		egresses := EgressNATs(tables)
+		Expect(egresses).To(HaveLen(2))
+		Expect(egresses[1].Type).To(Equal(dsl.Masquerade))
+		Expect(egresses[1].Exclusions).To(BeEmpty())
+		Expect(egresses[0].Type).To(Equal(dsl.SNAT))
+		Expect(egresses[0].String()).To(MatchRegexp(
+			`^snatting any protocol to 192\.0\.2\.1 unless ip saddr 10\.0\.0\.0/8 \(ip nat POSTROUTING handle \d+\)$`))
+	})
+
+	It("finds native masquerading read from the kernel", func() {
+		conn := nufftablestest.NewConn(nufftablestest.Ruleset{{
+			Name:   "nat",
+			Family: nftables.TableFamilyINet,
+			Chains: []nufftablestest.Chain{{
+				Name:     "srcnat",
+				Type:     nftables.ChainTypeNAT,
+				Hook:     nftables.ChainHookPostrouting,
+				Priority: nftables.ChainPriorityNATSource,
+				Rules: []nufftablestest.Rule{
+					append(append([]expr.Any{
+						&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
+						&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{unix.IPPROTO_TCP}},
+						&expr.Meta{Key: expr.MetaKeyNFPROTO, Register: 1},
+						&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{unix.NFPROTO_IPV4}},
+					}, nufftablestest.SAddr4("10.0.0.0/8")...),
+						&expr.Immediate{Register: 1, Data: []byte{0x04, 0x00}},
+						&expr.Immediate{Register: 2, Data: []byte{0x08, 0x00}},
+						&expr.Masq{ToPorts: true, RegProtoMin: 1, RegProtoMax: 2}),
+					{
+						&expr.Meta{Key: expr.MetaKeyOIFNAME, Register: 1},
+						&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte("eth0\x00")},
+						&expr.Counter{},
+						&expr.Masq{FullyRandom: true},
+					},
+				},
+			}},
+		}})
+		tables, err := nufftables.GetAllTables(conn)
+		Expect(err).NotTo(HaveOccurred())
+		egresses := EgressNATs(tables)
+		Expect(egresses).To(HaveLen(2))
+		Expect(egresses[0].String()).To(MatchRegexp(
+			`^masquerading any protocol to interface address fully-random if oifname "eth0" unless ip saddr 10\.0\.0\.0/8 ` +
+				`\(inet nat srcnat handle \d+\)$`))
+		Expect(egresses[1].String()).To(MatchRegexp(
+			`^masquerading tcp to interface address:1024-2048 if ip saddr 10\.0\.0\.0/8 ` +
+				`\(inet nat srcnat handle \d+\)$`))
+	})
+
+	It("returns the egress NAT of single rules", func() {
+		Expect(EgressNATOf(nufftables.Rule{Rule: &nftables.Rule{Exprs: nativeForward(80, []byte{10, 0, 0, 1})}})).To(BeNil())
+
+		e := EgressNATOf(nufftables.Rule{Rule: &nftables.Rule{Handle: 42, Exprs: []expr.Any{
+			&expr.Target{Name: "SNAT", Info: &xt.NatRange2{NatRange: xt.NatRange{
+				Flags:   uint(xt.NatRangeMapIPs | xt.NatRangeProtoSpecified | xt.NatRangePersistent),
+				MinIP:   []byte{0xfd, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1},
+				MaxIP:   []byte{0xfd, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 9},
+				MinPort: 1024,
+			}}},
+		}}})
+		Expect(e).NotTo(BeNil())
+		Expect(e.Handle).To(Equal(uint64(42)))
+		Expect(e.String()).To(Equal("snatting any protocol to [fd00::1-fd00::9]:1024 persistent"))
+
+		e = EgressNATOf(nufftables.Rule{Rule: &nftables.Rule{Exprs: []expr.Any{
+			&expr.Target{Name: "NETMAP", Info: &xt.NatRange{
+				Flags: uint(xt.NatRangeMapIPs),
+				MinIP: []byte{192, 0, 2, 0},
+				MaxIP: []byte{192, 0, 2, 255},
+			}},
+		}}})
+		Expect(e.String()).To(Equal("netmapping any protocol to 192.0.2.0-192.0.2.255"))
+
+		e = EgressNATOf(nufftables.Rule{Rule: &nftables.Rule{Exprs: []expr.Any{
+			&expr.Masq{Random: true},
+		}}})
+		Expect(e.String()).To(Equal("masquerading any protocol to interface address random"))
+	})
+
+	It("sorts egress NATs", func() {
+		unrestricted := &EgressNAT{}
+		v4 := &EgressNAT{TrafficMatch: TrafficMatch{Sources: dsl.AddrMatches(
+			nufftablestest.SAddr4("10.0.0.0/8"))}}
+		Expect(v4.Sources).To(HaveLen(1))
+		v6 := &EgressNAT{TrafficMatch: TrafficMatch{Sources: []dsl.AddrMatch{{
+			Direction: dsl.SourceAddr, Op: dsl.OpEq, Prefix: netip.MustParsePrefix("fd00::/8")}}}}
+		Expect(EgressNATOrder(unrestricted, v4)).To(BeNumerically("<", 0))
+		Expect(EgressNATOrder(v6, v4)).To(BeNumerically(">", 0))
+		Expect(EgressNATOrder(v4, v4)).To(BeZero())
+		Expect(EgressNATOrder(&EgressNAT{Handle: 1}, &EgressNAT{Handle: 2})).To(BeNumerically("<", 0))
+		Expect(EgressNATOrder(&EgressNAT{Handle: 2}, &EgressNAT{Handle: 1})).To(BeNumerically(">", 0))
+		Expect(EgressNATOrder(&EgressNAT{Chain: "a"}, &EgressNAT{Chain: "b"})).To(BeNumerically("<", 0))
+	})
+
+})
@@ -0,0 +1,687 @@
+// Copyright 2023 Harald Albrecht.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy
+// of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package portfinder
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"github.com/google/nftables/xt"
+	"github.com/thediveo/nufftables"
+	"github.com/thediveo/nufftables/dsl"
+	"golang.org/x/exp/slices"
+	"golang.org/x/sys/unix"
+)
+
+// Reachability tells whether the filter chains hooked at forward let the
+// traffic of a port forwarding pass after destination NAT.
+type Reachability int
+
+// Reachabilities of port forwardings.
+const (
+	Open        Reachability = iota // forwarded traffic gets accepted.
+	Blocked                         // forwarded traffic gets dropped or rejected.
+	Conditional                     // depends on conditions not known from the port forwarding.
+)
+
+// String returns the reachability in textual format, such as “open”.
+func (r Reachability) String() string {
+	switch r {
+	case Open:
+		return "open"
+	case Blocked:
+		return "blocked"
+	case Conditional:
+		return "conditional"
+	}
+	return "?"
+}
+
+// ForwardCheck is the outcome of checking a port forwarding against the
+// filter chains hooked at forward, such as Docker's “FORWARD” chain with its
+// “DOCKER-USER”, “DOCKER-ISOLATION-STAGE-1”, and “DOCKER” chains.
+type ForwardCheck struct {
+	*ForwardedPortRange
+	Reachability Reachability
+	// Rule is the deciding rule: the rule accepting the forwarded traffic
+	// for Open, the rule dropping or rejecting it for Blocked, and the first
+	// rule with conditions that cannot be decided for Conditional. Rule is
+	// nil if the forwarded traffic is decided by the policy of a base chain,
+	// as indicated by Policy, or if there are no filter chains hooked at
+	// forward at all.
+	Rule   *nufftables.Rule
+	Policy bool
+	// Conditions are the undecided conditions of the deciding rule of a
+	// conditional port forwarding, such as “iifname "br-4d0c…"”, as far as
+	// they can be rendered.
+	Conditions []string
+	// OutputIface is the output interface of the forwarded traffic inferred
+	// from the filter rules, such as “docker0”, if any.
+	OutputIface string
+}
+
+// String returns the port forwarding together with its reachability and the
+// deciding rule, such as “forwarding tcp from 0.0.0.0:8080 to 172.17.0.2:80
+// … is open (accepted by ip filter DOCKER handle 12)”.
+func (c *ForwardCheck) String() string {
+	s := c.ForwardedPortRange.String() + " is " + c.Reachability.String()
+	if c.Reachability == Conditional && len(c.Conditions) != 0 {
+		s += " on " + strings.Join(c.Conditions, ", ")
+	}
+	var by string
+	switch c.Reachability {
+	case Open:
+		by = "accepted by "
+	case Blocked:
+		by = "dropped by "
+	}
+	switch {
+	case c.Rule != nil:
+		s += " (" + by + ruleRef(c.Rule) + ")"
+	case c.Policy:
+		s += " (" + by + "policy)"
+	}
+	return s
+}
+
+// ruleRef returns the table family, table name, chain name, and handle of the
+// specified rule in textual format, such as “ip filter DOCKER handle 12”.
+func ruleRef(rule *nufftables.Rule) string {
+	var table string
+	if rule.Chain != nil && rule.Chain.Table != nil && rule.Chain.Table.Table != nil {
+		table = fmt.Sprintf("%s %s ", nufftables.TableFamily(rule.Chain.Table.Family), rule.Chain.Table.Name)
+	}
+	return fmt.Sprintf("%s%s handle %d", table, chainName(rule), rule.Handle)
+}
+
+// CheckForwards checks all active port forwardings found in the specified
+// tables against the filter chains hooked at forward; see [ForwardedPorts]
+// and [CheckForward] for details.
+func CheckForwards(tables nufftables.TableMap) []*ForwardCheck {
+	checks := []*ForwardCheck{}
+	for _, fwd := range ForwardedPorts(tables) {
+		checks = append(checks, CheckForward(tables, fwd))
+	}
+	return checks
+}
+
+// CheckForward checks whether the filter base chains hooked at forward in the
+// specified tables accept the traffic of the specified port forwarding after
+// destination NAT, that is, new connections with “ct status dnat” of the
+// forwarding's protocol to the address and port forwarded to. A port
+// forwarding is Open if all base chains accept this traffic, Blocked if any
+// base chain drops or rejects it, and otherwise Conditional.
+//
+// CheckForward follows the jumps, gotos, and verdict maps from the base chains
+// of type “filter” hooked at forward in the ip, ip6, and inet tables of the
+// forwarding's IP family, such as iptables-nft's “FORWARD” chain. Rule
+// conditions are decided using the interface and source address conditions of
+// the port forwarding itself, such as Docker's “iifname != "docker0"”. The
+// output interface is inferred from rules matching the exact address
+// forwarded to together with an output interface, such as Docker's “-d
+// 172.17.0.2/32 ! -i docker0 -o docker0 -p tcp --dport 80 -j ACCEPT”. All
+// other conditions, such as marks, are left undecided.
+//
+// For load-balanced port forwardings, CheckForward checks each endpoint; if
+// the endpoints differ in their reachability, then the port forwarding is
+// Conditional, with the deciding rule being that of the first endpoint not
+// being Open.
+func CheckForward(tables nufftables.TableMap, fwd *ForwardedPortRange) *ForwardCheck {
+	type destination struct {
+		ip   net.IP
+		port uint16
+	}
+	dests := []destination{{ip: fwd.ForwardIP, port: fwd.TargetPort(fwd.PortMin)}}
+	if len(fwd.Endpoints) != 0 {
+		dests = dests[:0]
+		for _, ep := range fwd.Endpoints {
+			dests = append(dests, destination{ip: ep.IP, port: ep.Port})
+		}
+	}
+	var check *ForwardCheck
+	for _, dest := range dests {
+		c := checkDestination(tables, fwd, dest.ip, dest.port)
+		switch {
+		case check == nil:
+			check = c
+		case c.Reachability != check.Reachability:
+			if check.Reachability == Open {
+				check = c
+			}
+			check.Reachability = Conditional
+		}
+	}
+	return check
+}
+
+// checkDestination checks the traffic of the specified port forwarding to the
+// specified destination address and port.
+func checkDestination(tables nufftables.TableMap, fwd *ForwardedPortRange, ip net.IP, port uint16) *ForwardCheck {
+	check := &ForwardCheck{ForwardedPortRange: fwd}
+	daddr, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		check.Reachability = Conditional
+		return check
+	}
+	f := &flow{
+		family:  nftables.TableFamilyIPv4,
+		proto:   protocolNumber(fwd.Protocol),
+		daddr:   daddr.Unmap(),
+		dport:   port,
+		ifaces:  fwd.Ifaces,
+		sources: fwd.Sources,
+	}
+	if f.daddr.Is6() {
+		f.family = nftables.TableFamilyIPv6
+	}
+	chains := forwardBaseChains(tables, f.family)
+	f.oifname = f.outputIface(chains)
+	check.OutputIface = f.oifname
+
+	var open *filterVerdict
+	for _, chain := range chains {
+		v := f.chain(chain, 0, map[*nufftables.Chain]bool{chain: true})
+		if v.outcomes&returned != 0 {
+			policy := accepted
+			if chain.Policy != nil && *chain.Policy == nftables.ChainPolicyDrop {
+				policy = dropped
+			}
+			if v.outcomes == returned {
+				v = filterVerdict{outcomes: policy, policy: true}
+			} else {
+				v.outcomes = v.outcomes&^returned | policy
+			}
+		}
+		switch v.outcomes {
+		case dropped:
+			check.Reachability = Blocked
+			check.Rule, check.Policy, check.Conditions = v.rule, v.policy, nil
+			return check
+		case accepted:
+			if open == nil || (open.rule == nil && v.rule != nil) {
+				open = &v
+			}
+		default:
+			if check.Reachability != Conditional {
+				check.Reachability = Conditional
+				check.Rule, check.Conditions = v.rule, v.conditions
+			}
+		}
+	}
+	if check.Reachability == Open && open != nil {
+		check.Rule, check.Policy = open.rule, open.policy
+	}
+	return check
+}
+
+// forwardBaseChains returns the base chains of type “filter” hooked at
+// forward in the ip, ip6, and inet tables of the specified IP family, sorted
+// by their priorities and then in the order of [sortedChains].
+func forwardBaseChains(tables nufftables.TableMap, family nftables.TableFamily) []*nufftables.Chain {
+	chains := []*nufftables.Chain{}
+	for _, chain := range sortedChains(tables) {
+		if chain.Chain == nil || chain.Type != nftables.ChainTypeFilter ||
+			chain.Hooknum == nil || *chain.Hooknum != unix.NF_INET_FORWARD {
+			continue
+		}
+		switch chain.Table.Family {
+		case family, nftables.TableFamilyINet:
+			chains = append(chains, chain)
+		}
+	}
+	slices.SortStableFunc(chains, func(a, b *nufftables.Chain) int {
+		return int(priority(a)) - int(priority(b))
+	})
+	return chains
+}
+
+// priority returns the priority of the specified base chain, defaulting to
+// the filter priority.
+func priority(chain *nufftables.Chain) nftables.ChainPriority {
+	if chain.Priority == nil {
+		return *nftables.ChainPriorityFilter
+	}
+	return *chain.Priority
+}
+
+// protocolNumber returns the number of the named transport protocol, or zero
+// if unknown.
+func protocolNumber(name string) uint8 {
+	for proto, protoName := range transportProtocols {
+		if protoName == name {
+			return proto
+		}
+	}
+	return 0
+}
+
+// tristate is the outcome of matching a condition against a flow that is
+// only partially known: the condition is either met, not met, or may be met.
+type tristate int
+
+const (
+	no tristate = iota
+	maybe
+	yes
+)
+
+// tri returns yes if the specified condition is true, otherwise no.
+func tri(cond bool) tristate {
+	if cond {
+		return yes
+	}
+	return no
+}
+
+// and returns the conjunction of the specified tristates.
+func (t tristate) and(other tristate) tristate {
+	if other < t {
+		return other
+	}
+	return t
+}
+
+// outcomes is a set of the possible outcomes of evaluating a chain.
+type outcomes uint8
+
+const (
+	accepted outcomes = 1 << iota
+	dropped
+	returned // evaluation returns to the calling chain, or the policy applies.
+	next     // evaluation continues with the next rule in the same chain.
+)
+
+// filterVerdict are the possible outcomes of evaluating (the remaining rules
+// of) a chain, together with the deciding rule and its undecided
+// conditions.
+type filterVerdict struct {
+	outcomes   outcomes
+	rule       *nufftables.Rule
+	policy     bool
+	conditions []string
+}
+
+// flow is the partially known traffic of a port forwarding after destination
+// NAT.
+type flow struct {
+	family  nftables.TableFamily // either IPv4 or IPv6.
+	proto   uint8
+	daddr   netip.Addr
+	dport   uint16
+	oifname string // output interface, if known.
+	ifaces  []dsl.IfaceMatch
+	sources []dsl.AddrMatch
+}
+
+// outputIface returns the output interface name of rules reachable from the
+// specified base chains matching exactly the destination address of the flow
+// together with a single output interface name, or the empty string.
+func (f *flow) outputIface(chains []*nufftables.Chain) string {
+	var oifname string
+	seen := map[*nufftables.Chain]bool{}
+	var visit func(chain *nufftables.Chain) bool
+	visit = func(chain *nufftables.Chain) bool {
+		if seen[chain] {
+			return false
+		}
+		seen[chain] = true
+		for idx := range chain.Rules {
+			rule := &chain.Rules[idx]
+			if oifname = f.ruleOutputIface(rule); oifname != "" {
+				return true
+			}
+			for _, target := range ruleTargets(rule) {
+				if visit(target) {
+					return true
+				}
+			}
+		}
+		return false
+	}
+	for _, chain := range chains {
+		if visit(chain) {
+			break
+		}
+	}
+	return oifname
+}
+
+// ruleOutputIface returns the output interface name matched by the specified
+// rule if the rule also matches exactly the destination address of the flow,
+// otherwise the empty string.
+func (f *flow) ruleOutputIface(rule *nufftables.Rule) string {
+	exprs := rule.Expressions()
+	if !slices.ContainsFunc(dsl.RuleAddrMatches(rule), func(m dsl.AddrMatch) bool {
+		return m.Direction == dsl.DestinationAddr && m.Op == dsl.OpEq &&
+			m.Prefix.IsSingleIP() && m.Prefix.Addr() == f.daddr
+	}) {
+		return ""
+	}
+	for _, m := range dsl.IfaceMatches(exprs) {
+		if m.Key == expr.MetaKeyOIFNAME && !m.Invert && !m.Wildcard && m.Set == "" {
+			return m.Name
+		}
+	}
+	return ""
+}
+
+// chain evaluates the rules of the specified chain, starting with the rule at
+// the specified index. The stack contains the chains along the way in order
+// to break jump cycles.
+func (f *flow) chain(chain *nufftables.Chain, idx int, stack map[*nufftables.Chain]bool) filterVerdict {
+	for ; idx < len(chain.Rules); idx++ {
+		rule := &chain.Rules[idx]
+		matched, conds := f.match(rule)
+		if matched == no {
+			continue
+		}
+		action := f.action(rule, stack)
+		if matched == maybe && action.outcomes != next {
+			action = filterVerdict{outcomes: action.outcomes | next, rule: rule, conditions: conds}
+		}
+		if action.outcomes&next == 0 {
+			return action
+		}
+		if action.outcomes == next {
+			continue
+		}
+		rest := f.chain(chain, idx+1, stack)
+		outcomes := action.outcomes&^next | rest.outcomes
+		if outcomes == rest.outcomes && outcomes&(outcomes-1) == 0 {
+			return rest
+		}
+		action.outcomes = outcomes
+		return action
+	}
+	return filterVerdict{outcomes: returned}
+}
+
+// action returns the possible outcomes of the verdict of the specified
+// matching rule.
+func (f *flow) action(rule *nufftables.Rule, stack map[*nufftables.Chain]bool) filterVerdict {
+	v := dsl.RuleVerdict(rule)
+	switch v.Kind {
+	case dsl.VerdictAccept:
+		return filterVerdict{outcomes: accepted, rule: rule}
+	case dsl.VerdictDrop, dsl.VerdictReject:
+		return filterVerdict{outcomes: dropped, rule: rule}
+	case dsl.VerdictReturn:
+		return filterVerdict{outcomes: returned, rule: rule}
+	case dsl.VerdictJump, dsl.VerdictGoto:
+		return f.call(rule, v, stack)
+	case dsl.VerdictMap:
+		union := filterVerdict{outcomes: next, rule: rule, conditions: []string{v.String()}}
+		if dt := dsl.RuleDispatchTable(rule); dt != nil {
+			for _, entry := range dt.Entries {
+				if entry.Verdict == nil {
+					continue
+				}
+				switch entry.Verdict.Kind {
+				case dsl.VerdictJump, dsl.VerdictGoto:
+					union.outcomes |= f.call(rule, entry.Verdict, stack).outcomes
+				case dsl.VerdictAccept:
+					union.outcomes |= accepted
+				case dsl.VerdictDrop, dsl.VerdictReject:
+					union.outcomes |= dropped
+				case dsl.VerdictReturn:
+					union.outcomes |= returned
+				}
+			}
+		}
+		return union
+	case dsl.VerdictQueue:
+		return filterVerdict{outcomes: accepted | dropped, rule: rule, conditions: []string{v.String()}}
+	}
+	return filterVerdict{outcomes: next}
+}
+
+// call evaluates the chain jumped or gone to by the specified verdict of the
+// specified rule. Returning from a chain jumped to continues with the next
+// rule, while returning from a chain gone to returns from the calling chain.
+// Jump cycles as well as unknown chains have unknown outcomes.
+func (f *flow) call(rule *nufftables.Rule, v *dsl.Verdict, stack map[*nufftables.Chain]bool) filterVerdict {
+	target := v.Target
+	if target == nil || stack[target] {
+		return filterVerdict{outcomes: accepted | dropped | next, rule: rule, conditions: []string{v.String()}}
+	}
+	stack[target] = true
+	sub := f.chain(target, 0, stack)
+	delete(stack, target)
+	if v.Kind == dsl.VerdictJump && sub.outcomes&returned != 0 {
+		sub.outcomes = sub.outcomes&^returned | next
+	}
+	return sub
+}
+
+// match matches the conditions of the specified rule against the flow,
+// returning the undecided conditions in textual format, as far as they can be
+// rendered.
+func (f *flow) match(rule *nufftables.Rule) (tristate, []string) {
+	lifted := dsl.Lift(rule.Expressions())
+	var table *nufftables.Table
+	if rule.Chain != nil {
+		table = rule.Chain.Table
+	}
+	result := yes
+	var undecided []string
+	note := func(t tristate, cond string) {
+		result = result.and(t)
+		if t == maybe && cond != "" {
+			undecided = append(undecided, cond)
+		}
+	}
+	for idx := range lifted.Predicates {
+		note(f.predicate(&lifted.Predicates[idx], table))
+		if result == no {
+			return no, nil
+		}
+	}
+	for _, match := range lifted.XtMatches {
+		note(f.xtMatch(match))
+		if result == no {
+			return no, nil
+		}
+	}
+	return result, undecided
+}
+
+// predicate matches the specified predicate against the flow, returning the
+// predicate in textual format if known.
+func (f *flow) predicate(pred *dsl.Predicate, table *nufftables.Table) (tristate, string) {
+	if m := dsl.IfaceMatches(pred.Exprs); len(m) == 1 {
+		return f.iface(&m[0]), m[0].String()
+	}
+	family := nftables.TableFamilyUnspecified
+	if table != nil {
+		family = table.Family
+	}
+	if m := dsl.FamilyAddrMatches(family, pred.Exprs); len(m) == 1 {
+		return f.addr(&m[0]), m[0].String()
+	}
+	if m := dsl.PortMatches(pred.Exprs); len(m) == 1 {
+		m[0].Resolve(table)
+		return f.port(&m[0]), m[0].String()
+	}
+	if _, m := dsl.MatchMeta(pred.Exprs, expr.MetaKeyNFPROTO, expr.MetaKeyL4PROTO); m != nil && m.Set == "" {
+		if m.Key == expr.MetaKeyNFPROTO {
+			nfproto := uint32(unix.NFPROTO_IPV4)
+			if f.family == nftables.TableFamilyIPv6 {
+				nfproto = unix.NFPROTO_IPV6
+			}
+			return tri(m.Matches(nfproto)), ""
+		}
+		return tri(m.Matches(uint32(f.proto))), ""
+	}
+	if _, m := dsl.MatchCt(pred.Exprs, expr.CtKeySTATE, expr.CtKeySTATUS); m != nil && m.Set == "" {
+		if m.Key == expr.CtKeySTATE {
+			return tri(m.Matches(uint32(dsl.CtStateNew))), ""
+		}
+		return tri(m.Matches(uint32(dsl.CtStatusDNAT))), ""
+	}
+	return maybe, ""
+}
+
+// xtMatch matches the specified xt match extension against the flow,
+// returning the match in textual format if known.
+func (f *flow) xtMatch(match *expr.Match) (tristate, string) {
+	switch m := dsl.DecodeXtMatch(match).(type) {
+	case string:
+		return yes, "" // comments always match.
+	case []dsl.PortMatch:
+		result := yes
+		conds := []string{}
+		for idx := range m {
+			result = result.and(f.port(&m[idx]))
+			conds = append(conds, m[idx].String())
+		}
+		return result, strings.Join(conds, ", ")
+	case []dsl.AddrMatch:
+		result := yes
+		conds := []string{}
+		for idx := range m {
+			result = result.and(f.addr(&m[idx]))
+			conds = append(conds, m[idx].String())
+		}
+		return result, strings.Join(conds, ", ")
+	case *dsl.ConntrackMatch:
+		return f.conntrack(m), ""
+	case fmt.Stringer:
+		return maybe, m.String()
+	}
+	return maybe, ""
+}
+
+// iface matches the specified interface match against the flow. Input
+// interface matches are decided by the interface conditions of the port
+// forwarding, either by being the same or inverted conditions, or by the port
+// forwarding being restricted to a particular input interface. Output
+// interface matches are decided by the output interface, if known.
+func (f *flow) iface(m *dsl.IfaceMatch) tristate {
+	if !m.Input() {
+		if f.oifname != "" && m.Key == expr.MetaKeyOIFNAME && m.Set == "" {
+			return tri(m.Matches(f.oifname))
+		}
+		return maybe
+	}
+	for idx := range f.ifaces {
+		known := &f.ifaces[idx]
+		if known.Key != m.Key {
+			continue
+		}
+		if known.Name == m.Name && known.Wildcard == m.Wildcard &&
+			known.Index == m.Index && known.Set == m.Set {
+			return tri(known.Invert == m.Invert)
+		}
+		if known.Key == expr.MetaKeyIIFNAME && !known.Invert && !known.Wildcard &&
+			known.Set == "" && m.Set == "" {
+			return tri(m.Matches(known.Name))
+		}
+	}
+	return maybe
+}
+
+// addr matches the specified address match against the flow. Destination
+// address matches are decided by the destination address forwarded to, as
+// long as they aren't set lookups. Source address matches are decided by the
+// source address conditions of the port forwarding, if any.
+func (f *flow) addr(m *dsl.AddrMatch) tristate {
+	if m.Is6() != f.daddr.Is6() {
+		return no
+	}
+	if m.Direction == dsl.DestinationAddr {
+		switch m.Op {
+		case dsl.OpInSet, dsl.OpNotInSet:
+			return maybe
+		}
+		return tri(m.Overlaps(netip.PrefixFrom(f.daddr, f.daddr.BitLen())))
+	}
+	for idx := range f.sources {
+		known := &f.sources[idx]
+		if known.Is6() != m.Is6() {
+			continue
+		}
+		if known.Prefix == m.Prefix && known.From == m.From && known.To == m.To && known.Set == m.Set {
+			if known.Op == m.Op {
+				return yes
+			}
+			if complementary(known.Op, m.Op) {
+				return no
+			}
+		}
+		if known.Op != dsl.OpEq || (m.Op != dsl.OpEq && m.Op != dsl.OpNeq) {
+			continue
+		}
+		if m.Prefix.Bits() <= known.Prefix.Bits() && m.Prefix.Contains(known.Prefix.Addr()) {
+			return tri(m.Op == dsl.OpEq)
+		}
+		if !m.Prefix.Overlaps(known.Prefix) {
+			return tri(m.Op == dsl.OpNeq)
+		}
+	}
+	return maybe
+}
+
+// complementary returns true if the specified address match operations are
+// the inverse of each other, such as “==” and “!=”.
+func complementary(a, b dsl.PredicateOp) bool {
+	switch {
+	case a == dsl.OpEq && b == dsl.OpNeq, a == dsl.OpNeq && b == dsl.OpEq,
+		a == dsl.OpInRange && b == dsl.OpNotInRange, a == dsl.OpNotInRange && b == dsl.OpInRange,
+		a == dsl.OpInSet && b == dsl.OpNotInSet, a == dsl.OpNotInSet && b == dsl.OpInSet:
+		return true
+	}
+	return false
+}
+
+// port matches the specified port match against the flow; source port matches
+// always may match.
+func (f *flow) port(m *dsl.PortMatch) tristate {
+	if m.Protocol != "" && m.Protocol != transportProtocols[f.proto] {
+		return no
+	}
+	if m.Direction == dsl.SourcePort || m.Ranges == nil {
+		return maybe
+	}
+	if m.Direction == dsl.EitherPort {
+		if !m.Invert && m.Matches(f.dport) {
+			return yes
+		}
+		return maybe
+	}
+	return tri(m.Matches(f.dport))
+}
+
+// conntrack matches the specified xt “conntrack” or “state” match against the
+// flow, which is in conntrack state “new” with the “dnat” status and virtual
+// state. Other conntrack conditions always may match.
+func (f *flow) conntrack(m *dsl.ConntrackMatch) tristate {
+	result := yes
+	if m.Matches(xt.ConntrackState) {
+		result = result.and(tri(
+			(m.States&(dsl.CtStateNew|dsl.CtStateDNAT) != 0) != m.Inverted(xt.ConntrackState)))
+	}
+	if m.Matches(xt.ConntrackStatus) {
+		result = result.and(tri(
+			(m.Status&dsl.CtStatusDNAT != 0) != m.Inverted(xt.ConntrackStatus)))
+	}
+	if m.Flags&^(xt.ConntrackState|xt.ConntrackStatus|xt.ConntrackStateAlias) != 0 {
+		result = result.and(maybe)
+	}
+	return result
+}
@@ -0,0 +1,296 @@
+// Copyright 2023 Harald Albrecht.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy
+// of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package portfinder
+
+import (
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"github.com/google/nftables/xt"
+	"github.com/thediveo/nufftables"
+	"github.com/thediveo/nufftables/dsl"
+	"github.com/thediveo/nufftables/nufftablestest"
+	"golang.org/x/sys/unix"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+// ifname returns the expressions of “iifname "<name>"”, “oifname != "<name>"”,
+// et cetera.
+func ifname(key expr.MetaKey, op expr.CmpOp, name string) []expr.Any {
+	return []expr.Any{
+		&expr.Meta{Key: key, Register: 1},
+		&expr.Cmp{Op: op, Register: 1, Data: []byte(name + "\x00")},
+	}
+}
+
+// exprs concatenates the specified expressions.
+func exprs(parts ...[]expr.Any) []expr.Any {
+	var all []expr.Any
+	for _, part := range parts {
+		all = append(all, part...)
+	}
+	return all
+}
+
+// verdict returns the expressions of the specified verdict.
+func verdict(kind expr.VerdictKind, chain ...string) []expr.Any {
+	v := &expr.Verdict{Kind: kind}
+	if len(chain) != 0 {
+		v.Chain = chain[0]
+	}
+	return []expr.Any{v}
+}
+
+// dockerFilter returns the tables with Docker's forward filter chains in the
+// iptables-nft “filter” table, with the specified rules in “DOCKER-USER”.
+func dockerFilter(user ...[]expr.Any) nufftables.TableMap {
+	conn := nufftables.NewMemConn()
+	filter := &nftables.Table{Name: "filter", Family: nftables.TableFamilyIPv4}
+	drop := nftables.ChainPolicyDrop
+	forward := &nftables.Chain{Name: "FORWARD", Table: filter, Policy: &drop,
+		Type: nftables.ChainTypeFilter, Hooknum: nftables.ChainHookForward}
+	chains := map[string]*nftables.Chain{}
+	conn.AddChain(forward)
+	for _, name := range []string{"DOCKER", "DOCKER-USER", "DOCKER-ISOLATION-STAGE-1", "DOCKER-ISOLATION-STAGE-2"} {
+		chains[name] = &nftables.Chain{Name: name, Table: filter}
+		conn.AddChain(chains[name])
+	}
+	state := make(xt.Unknown, 4)
+	copy(state, hostUint32(uint32(dsl.CtStateRelated|dsl.CtStateEstablished)))
+	for _, rule := range [][]expr.Any{
+		verdict(expr.VerdictJump, "DOCKER-USER"),
+		verdict(expr.VerdictJump, "DOCKER-ISOLATION-STAGE-1"),
+		exprs(ifname(expr.MetaKeyOIFNAME, expr.CmpOpEq, "docker0"),
+			[]expr.Any{&expr.Match{Name: "state", Info: &state}},
+			verdict(expr.VerdictAccept)),
+		exprs(ifname(expr.MetaKeyOIFNAME, expr.CmpOpEq, "docker0"), verdict(expr.VerdictJump, "DOCKER")),
+		exprs(ifname(expr.MetaKeyIIFNAME, expr.CmpOpEq, "docker0"),
+			ifname(expr.MetaKeyOIFNAME, expr.CmpOpNeq, "docker0"),
+			verdict(expr.VerdictAccept)),
+	} {
+		conn.AddRule(&nftables.Rule{Table: filter, Chain: forward, Exprs: rule})
+	}
+	for _, rule := range append(user, verdict(expr.VerdictReturn)) {
+		conn.AddRule(&nftables.Rule{Table: filter, Chain: chains["DOCKER-USER"], Exprs: rule})
+	}
+	conn.AddRule(&nftables.Rule{Table: filter, Chain: chains["DOCKER-ISOLATION-STAGE-1"], Exprs: exprs(
+		ifname(expr.MetaKeyIIFNAME, expr.CmpOpEq, "br-1"),
+		ifname(expr.MetaKeyOIFNAME, expr.CmpOpNeq, "br-1"),
+		verdict(expr.VerdictJump, "DOCKER-ISOLATION-STAGE-2"))})
+	conn.AddRule(&nftables.Rule{Table: filter, Chain: chains["DOCKER-ISOLATION-STAGE-1"], Exprs: verdict(expr.VerdictReturn)})
+	conn.AddRule(&nftables.Rule{Table: filter, Chain: chains["DOCKER-ISOLATION-STAGE-2"], Exprs: exprs(
+		ifname(expr.MetaKeyOIFNAME, expr.CmpOpEq, "docker0"), verdict(expr.VerdictDrop))})
+	conn.AddRule(&nftables.Rule{Table: filter, Chain: chains["DOCKER-ISOLATION-STAGE-2"], Exprs: verdict(expr.VerdictReturn)})
+	conn.AddRule(&nftables.Rule{Table: filter, Chain: chains["DOCKER"], Exprs: exprs(
+		nufftablestest.DAddr4("172.17.0.2"),
+		ifname(expr.MetaKeyIIFNAME, expr.CmpOpNeq, "docker0"),
+		ifname(expr.MetaKeyOIFNAME, expr.CmpOpEq, "docker0"),
+		tcp(),
+		[]expr.Any{&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseTransportHeader, Offset: 2, Len: 2},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{0, 80}}},
+		verdict(expr.VerdictAccept))})
+	tables, err := nufftables.GetAllTables(conn)
+	Expect(err).NotTo(HaveOccurred())
+	return tables
+}
+
+// forwardTo returns a port forwarding of tcp port 8080 to port 80 of the
+// specified address, with the specified interface conditions.
+func forwardTo(addr string, ifaces ...[]expr.Any) *ForwardedPortRange {
+	fwd := &ForwardedPortRange{
+		Protocol:       "tcp",
+		IP:             ip("0.0.0.0"),
+		PortMin:        8080,
+		PortMax:        8080,
+		ForwardIP:      ip(addr),
+		ForwardIPMax:   ip(addr),
+		ForwardPortMin: 80,
+		ForwardPortMax: 80,
+	}
+	for _, iface := range ifaces {
+		fwd.Ifaces = append(fwd.Ifaces, dsl.IfaceMatches(iface)...)
+	}
+	return fwd
+}
+
+var _ = Describe("forward filter checks", func() {
+
+	It("returns reachability names", func() {
+		Expect(Open.String()).To(Equal("open"))
+		Expect(Blocked.String()).To(Equal("blocked"))
+		Expect(Conditional.String()).To(Equal("conditional"))
+		Expect(Reachability(42).String()).To(Equal("?"))
+	})
+
+	It("reports forwardings accepted by Docker's chains as open", func() {
+		tables := dockerFilter()
+		check := CheckForward(tables, forwardTo("172.17.0.2", ifname(expr.MetaKeyIIFNAME, expr.CmpOpEq, "eth0")))
+		Expect(check.Reachability).To(Equal(Open))
+		Expect(check.OutputIface).To(Equal("docker0"))
+		Expect(check.Rule).NotTo(BeNil())
+		Expect(check.Rule.Chain.Name).To(Equal("DOCKER"))
+		Expect(check.String()).To(MatchRegexp(
+			`^forwarding tcp from 0\.0\.0\.0:8080 to 172\.17\.0\.2:80 if iifname "eth0" ` +
+				`is open \(accepted by ip filter DOCKER handle \d+\)$`))
+	})
+
+	It("reports forwardings depending on the input interface as conditional", func() {
+		tables := dockerFilter()
+		check := CheckForward(tables, forwardTo("172.17.0.2", ifname(expr.MetaKeyIIFNAME, expr.CmpOpNeq, "docker0")))
+		Expect(check.Reachability).To(Equal(Conditional))
+		Expect(check.Rule.Chain.Name).To(Equal("DOCKER-ISOLATION-STAGE-1"))
+		Expect(check.Conditions).To(ConsistOf(`iifname "br-1"`))
+		Expect(check.String()).To(MatchRegexp(
+			`is conditional on iifname "br-1" \(ip filter DOCKER-ISOLATION-STAGE-1 handle \d+\)$`))
+	})
+
+	It("reports forwardings dropped by policy as blocked", func() {
+		tables := dockerFilter()
+		check := CheckForward(tables, forwardTo("172.17.0.3", ifname(expr.MetaKeyIIFNAME, expr.CmpOpEq, "eth0")))
+		Expect(check.Reachability).To(Equal(Blocked))
+		Expect(check.OutputIface).To(BeEmpty())
+		Expect(check.Rule).To(BeNil())
+		Expect(check.Policy).To(BeTrue())
+		Expect(check.String()).To(HaveSuffix(" is blocked (dropped by policy)"))
+	})
+
+	It("decides source address conditions", func() {
+		tables := dockerFilter(exprs(nufftablestest.SAddr4("10.0.0.0/8"), verdict(expr.VerdictDrop)))
+		eth0 := ifname(expr.MetaKeyIIFNAME, expr.CmpOpEq, "eth0")
+
+		check := CheckForward(tables, forwardTo("172.17.0.2", eth0))
+		Expect(check.Reachability).To(Equal(Conditional))
+		Expect(check.Rule.Chain.Name).To(Equal("DOCKER-USER"))
+		Expect(check.Conditions).To(ConsistOf("ip saddr 10.0.0.0/8"))
+
+		fwd := forwardTo("172.17.0.2", eth0)
+		fwd.Sources = dsl.AddrMatches(nufftablestest.SAddr4("10.1.0.0/16"))
+		check = CheckForward(tables, fwd)
+		Expect(check.Reachability).To(Equal(Blocked))
+		Expect(check.Rule.Chain.Name).To(Equal("DOCKER-USER"))
+		Expect(check.String()).To(MatchRegexp(`is blocked \(dropped by ip filter DOCKER-USER handle \d+\)$`))
+
+		fwd.Sources = dsl.AddrMatches(nufftablestest.SAddr4("192.168.0.0/16"))
+		Expect(CheckForward(tables, fwd).Reachability).To(Equal(Open))
+	})
+
+	It("checks all endpoints of load-balanced forwardings", func() {
+		tables := dockerFilter()
+		fwd := forwardTo("172.17.0.2", ifname(expr.MetaKeyIIFNAME, expr.CmpOpEq, "eth0"))
+		fwd.Endpoints = []Endpoint{
+			{IP: ip("172.17.0.2"), Port: 80, Weight: 0.5},
+			{IP: ip("172.17.0.3"), Port: 80, Weight: 0.5},
+		}
+		check := CheckForward(tables, fwd)
+		Expect(check.Reachability).To(Equal(Conditional))
+		Expect(check.Policy).To(BeTrue())
+	})
+
+	It("evaluates xt matches, gotos, and verdict maps", func() {
+		conn := nufftables.NewMemConn()
+		fw := &nftables.Table{Name: "fw", Family: nftables.TableFamilyIPv4}
+		accept := nftables.ChainPolicyAccept
+		forward := &nftables.Chain{Name: "forward", Table: fw, Policy: &accept,
+			Type: nftables.ChainTypeFilter, Hooknum: nftables.ChainHookForward}
+		checked := &nftables.Chain{Name: "checked", Table: fw}
+		allowed := &nftables.Chain{Name: "allowed", Table: fw}
+		conn.AddChain(forward)
+		conn.AddChain(checked)
+		conn.AddChain(allowed)
+		conn.AddRule(&nftables.Rule{Table: fw, Chain: forward, Exprs: exprs(tcp(), []expr.Any{
+			&expr.Match{Name: "tcp", Info: &xt.Tcp{DstPorts: [2]uint16{22, 22}}},
+			&expr.Reject{Type: unix.NFT_REJECT_TCP_RST}})})
+		ct := &xt.ConntrackMtinfo3{}
+		ct.MatchFlags = uint16(xt.ConntrackState | xt.ConntrackStatus)
+		ct.StateMask = uint16(dsl.CtStateNew)
+		ct.StatusMask = uint16(dsl.CtStatusDNAT)
+		conn.AddRule(&nftables.Rule{Table: fw, Chain: forward, Exprs: []expr.Any{
+			&expr.Match{Name: "conntrack", Rev: 3, Info: ct},
+			&expr.Verdict{Kind: expr.VerdictGoto, Chain: "checked"}}})
+		conn.AddRule(&nftables.Rule{Table: fw, Chain: forward, Exprs: verdict(expr.VerdictDrop)})
+		conn.AddRule(&nftables.Rule{Table: fw, Chain: checked, Exprs: []expr.Any{
+			&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: 12, Len: 1},
+			&expr.Cmp{Op: expr.CmpOpNeq, Register: 1, Data: []byte{10}},
+			&expr.Verdict{Kind: expr.VerdictDrop}}})
+		Expect(conn.AddSet(&nftables.Set{Table: fw, Name: "ports", IsMap: true,
+			KeyType: nftables.TypeInetService, DataType: nftables.TypeVerdict}, []nftables.SetElement{
+			{Key: []byte{0, 80}, VerdictData: &expr.Verdict{Kind: expr.VerdictJump, Chain: "allowed"}},
+		})).To(Succeed())
+		conn.AddRule(&nftables.Rule{Table: fw, Chain: checked, Exprs: exprs(tcp(), []expr.Any{
+			&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseTransportHeader, Offset: 2, Len: 2},
+			&expr.Lookup{SourceRegister: 1, DestRegister: unix.NFT_REG_VERDICT, IsDestRegSet: true, SetName: "ports"}})})
+		conn.AddRule(&nftables.Rule{Table: fw, Chain: allowed, Exprs: verdict(expr.VerdictAccept)})
+		tables, err := nufftables.GetAllTables(conn)
+		Expect(err).NotTo(HaveOccurred())
+
+		fwd := forwardTo("172.17.0.2")
+		fwd.Sources = dsl.AddrMatches(nufftablestest.SAddr4("10.0.0.0/8"))
+		check := CheckForward(tables, fwd)
+		Expect(check.Reachability).To(Equal(Open))
+		Expect(check.Rule.Chain.Name).To(Equal("checked"))
+
+		// returning from the chain gone to applies the base chain policy.
+		fwd.Protocol = "udp"
+		check = CheckForward(tables, fwd)
+		Expect(check.Reachability).To(Equal(Open))
+		Expect(check.Rule).To(BeNil())
+		Expect(check.Policy).To(BeTrue())
+		Expect(check.String()).To(HaveSuffix(" is open (accepted by policy)"))
+
+		fwd = forwardTo("172.17.0.2")
+		check = CheckForward(tables, fwd)
+		Expect(check.Reachability).To(Equal(Conditional))
+		Expect(check.Conditions).To(ConsistOf("ip saddr != 10.0.0.0/8"))
+	})
+
+	It("checks native forwardings against native filter chains", func() {
+		conn := nufftables.NewMemConn()
+		nat := &nftables.Table{Name: "nat", Family: nftables.TableFamilyIPv4}
+		prerouting := &nftables.Chain{Name: "prerouting", Table: nat,
+			Type: nftables.ChainTypeNAT, Hooknum: nftables.ChainHookPrerouting}
+		conn.AddChain(prerouting)
+		conn.AddRule(&nftables.Rule{Table: nat, Chain: prerouting, Exprs: nativeForward(80, []byte{172, 17, 0, 2})})
+
+		tables, err := nufftables.GetAllTables(conn)
+		Expect(err).NotTo(HaveOccurred())
+		checks := CheckForwards(tables)
+		Expect(checks).To(HaveLen(1))
+		Expect(checks[0].Reachability).To(Equal(Open))
+		Expect(checks[0].Rule).To(BeNil())
+		Expect(checks[0].Policy).To(BeFalse())
+		Expect(checks[0].String()).To(HaveSuffix(" is open"))
+
+		fw := &nftables.Table{Name: "fw", Family: nftables.TableFamilyINet}
+		drop := nftables.ChainPolicyDrop
+		forward := &nftables.Chain{Name: "forward", Table: fw, Policy: &drop,
+			Type: nftables.ChainTypeFilter, Hooknum: nftables.ChainHookForward}
+		conn.AddChain(forward)
+		conn.AddRule(&nftables.Rule{Table: fw, Chain: forward, Exprs: []expr.Any{
+			&expr.Ct{Key: expr.CtKeySTATUS, Register: 1},
+			&expr.Bitwise{SourceRegister: 1, DestRegister: 1, Len: 4,
+				Mask: hostUint32(uint32(dsl.CtStatusDNAT)), Xor: []byte{0, 0, 0, 0}},
+			&expr.Cmp{Op: expr.CmpOpNeq, Register: 1, Data: []byte{0, 0, 0, 0}},
+			&expr.Verdict{Kind: expr.VerdictAccept},
+		}})
+		tables, err = nufftables.GetAllTables(conn)
+		Expect(err).NotTo(HaveOccurred())
+		checks = CheckForwards(tables)
+		Expect(checks).To(HaveLen(1))
+		Expect(checks[0].Reachability).To(Equal(Open))
+		Expect(checks[0].String()).To(MatchRegexp(`is open \(accepted by inet fw forward handle \d+\)$`))
+	})
+
+})
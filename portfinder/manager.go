@@ -0,0 +1,119 @@
+// Copyright 2023 Harald Albrecht.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy
+// of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package portfinder
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/thediveo/nufftables"
+	"github.com/thediveo/nufftables/dsl"
+)
+
+// Manager is the tool managing a port forwarding.
+type Manager int
+
+// Tools managing port forwardings.
+const (
+	Unmanaged  Manager = iota // not recognized
+	Docker                    // Docker, with either its iptables or nftables backend
+	CNIPortmap                // the CNI “portmap” plugin
+	Netavark                  // Podman's netavark, with either its iptables or nftables backend
+	Libvirt                   // libvirt
+)
+
+// String returns the name of the tool managing a port forwarding, such as
+// “netavark”.
+func (m Manager) String() string {
+	switch m {
+	case Unmanaged:
+		return "unmanaged"
+	case Docker:
+		return "docker"
+	case CNIPortmap:
+		return "cni-portmap"
+	case Netavark:
+		return "netavark"
+	case Libvirt:
+		return "libvirt"
+	}
+	return "?"
+}
+
+// managedChains maps the names (or name prefixes, ending in “-” or “_”) of
+// chains and tables to the tools managing them.
+var managedChains = []struct {
+	name    string
+	manager Manager
+}{
+	{"DOCKER", Docker},
+	{"docker", Docker},
+	{"CNI-HOSTPORT-", CNIPortmap},
+	{"CNI-DN-", CNIPortmap},
+	{"cni_hostport", CNIPortmap},
+	{"NETAVARK-", Netavark},
+	{"netavark", Netavark},
+	{"nv_", Netavark},
+	{"LIBVIRT_", Libvirt},
+	{"libvirt_", Libvirt},
+	{"libvirt", Libvirt},
+}
+
+// managerOf returns the tool managing the chain or table of the specified
+// name.
+func managerOf(name string) Manager {
+	for _, mc := range managedChains {
+		if name == mc.name ||
+			(strings.HasSuffix(mc.name, "-") || strings.HasSuffix(mc.name, "_")) && strings.HasPrefix(name, mc.name) {
+			return mc.manager
+		}
+	}
+	return Unmanaged
+}
+
+// dnatComment matches the rule comments of the CNI portmap plugin and
+// netavark, such as “dnat name: "cbr0" id: "4d0c…"” and “dnat name: podman
+// id: 4d0c…”, capturing the network name and container ID.
+var dnatComment = regexp.MustCompile(`dnat name: "?([^" ]+)"? id: "?([^" ]+)"?`)
+
+// netavarkChain matches netavark's nftables chain names, such as
+// “nv_2f259bab_10_88_0_0_nm16_dnat”, capturing the network ID prefix.
+var netavarkChain = regexp.MustCompile(`^nv_([0-9a-f]+)_`)
+
+// attribute attributes the port forwarding to the tool managing the specified
+// rule, based on the names of the rule's chain and table, and extracts the
+// network and container identifiers from the chain name and rule comment.
+// Already known information is kept.
+func (f *ForwardedPortRange) attribute(rule *nufftables.Rule) {
+	if chain := rule.Chain; chain != nil && chain.Chain != nil {
+		if f.Manager == Unmanaged {
+			f.Manager = managerOf(chain.Name)
+		}
+		if f.Manager == Unmanaged && chain.Table != nil && chain.Table.Table != nil {
+			f.Manager = managerOf(chain.Table.Name)
+		}
+		if m := netavarkChain.FindStringSubmatch(chain.Name); m != nil && f.Network == "" {
+			f.Network = m[1]
+		}
+	}
+	if m := dnatComment.FindStringSubmatch(dsl.RuleComment(rule)); m != nil {
+		if f.Network == "" {
+			f.Network = m[1]
+		}
+		if f.ContainerID == "" {
+			f.ContainerID = m[2]
+		}
+	}
+}
@@ -0,0 +1,136 @@
+// Copyright 2023 Harald Albrecht.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy
+// of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package portfinder
+
+import (
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"github.com/thediveo/nufftables"
+	"github.com/thediveo/nufftables/nufftablestest"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("forwarding managers", func() {
+
+	It("returns manager names", func() {
+		Expect(Unmanaged.String()).To(Equal("unmanaged"))
+		Expect(Docker.String()).To(Equal("docker"))
+		Expect(CNIPortmap.String()).To(Equal("cni-portmap"))
+		Expect(Netavark.String()).To(Equal("netavark"))
+		Expect(Libvirt.String()).To(Equal("libvirt"))
+		Expect(Manager(42).String()).To(Equal("?"))
+	})
+
+	DescribeTable("recognizes managed chains and tables",
+		func(name string, expected Manager) {
+			Expect(managerOf(name)).To(Equal(expected))
+		},
+		Entry(nil, "DOCKER", Docker),
+		Entry(nil, "DOCKER-INGRESS", Unmanaged),
+		Entry(nil, "CNI-HOSTPORT-DNAT", CNIPortmap),
+		Entry(nil, "CNI-DN-6ab1d4a3c1ac1b0ea5a4a", CNIPortmap),
+		Entry(nil, "cni_hostport", CNIPortmap),
+		Entry(nil, "NETAVARK-HOSTPORT-DNAT", Netavark),
+		Entry(nil, "NETAVARK-DN-1D8721804F16F", Netavark),
+		Entry(nil, "netavark", Netavark),
+		Entry(nil, "nv_2f259bab_10_88_0_0_nm16_dnat", Netavark),
+		Entry(nil, "LIBVIRT_PRT", Libvirt),
+		Entry(nil, "libvirt_network", Libvirt),
+		Entry(nil, "PREROUTING", Unmanaged),
+	)
+
+	It("attributes CNI portmap forwardings with network and container", func() {
+		conn := nufftables.NewMemConn()
+		nat := &nftables.Table{Name: "nat", Family: nftables.TableFamilyIPv4}
+		prerouting := &nftables.Chain{Name: "PREROUTING", Table: nat,
+			Type: nftables.ChainTypeNAT, Hooknum: nftables.ChainHookPrerouting}
+		hostport := &nftables.Chain{Name: "CNI-HOSTPORT-DNAT", Table: nat}
+		dn := &nftables.Chain{Name: "CNI-DN-6ab1d4a3c1ac1b0ea5a4a", Table: nat}
+		conn.AddChain(prerouting)
+		conn.AddChain(hostport)
+		conn.AddChain(dn)
+		conn.AddRule(&nftables.Rule{Table: nat, Chain: prerouting, Exprs: []expr.Any{
+			&expr.Verdict{Kind: expr.VerdictJump, Chain: "CNI-HOSTPORT-DNAT"},
+		}})
+		conn.AddRule(&nftables.Rule{Table: nat, Chain: hostport,
+			UserData: nufftablestest.Comment(`dnat name: "cbr0" id: "4d0c5e4e1b6a"`),
+			Exprs: []expr.Any{
+				&expr.Verdict{Kind: expr.VerdictJump, Chain: "CNI-DN-6ab1d4a3c1ac1b0ea5a4a"},
+			}})
+		conn.AddRule(&nftables.Rule{Table: nat, Chain: dn, Exprs: nativeForward(8080, []byte{10, 88, 0, 5})})
+
+		tables, err := nufftables.GetAllTables(conn)
+		Expect(err).NotTo(HaveOccurred())
+		fps := ForwardedPorts(tables)
+		Expect(fps).To(HaveLen(1))
+		Expect(fps[0].Manager).To(Equal(CNIPortmap))
+		Expect(fps[0].Network).To(Equal("cbr0"))
+		Expect(fps[0].ContainerID).To(Equal("4d0c5e4e1b6a"))
+		Expect(fps[0].String()).To(HavePrefix(
+			"forwarding tcp from 0.0.0.0:8080 to 10.88.0.5:8080 managed by cni-portmap network cbr0 container 4d0c5e4e1b6a (ip nat CNI-DN-"))
+
+		// on its own, the forwarding rule only tells its manager.
+		fp := ForwardedPort(tables.TableChain("nat", nufftables.TableFamilyIPv4, dn.Name).Rules[0])
+		Expect(fp).NotTo(BeNil())
+		Expect(fp.Manager).To(Equal(CNIPortmap))
+		Expect(fp.ContainerID).To(BeEmpty())
+	})
+
+	It("attributes netavark forwardings", func() {
+		conn := nufftables.NewMemConn()
+		netavark := &nftables.Table{Name: "netavark", Family: nftables.TableFamilyINet}
+		prerouting := &nftables.Chain{Name: "PREROUTING", Table: netavark,
+			Type: nftables.ChainTypeNAT, Hooknum: nftables.ChainHookPrerouting}
+		hostport := &nftables.Chain{Name: "NETAVARK-HOSTPORT-DNAT", Table: netavark}
+		dnat := &nftables.Chain{Name: "nv_2f259bab_10_88_0_0_nm16_dnat", Table: netavark}
+		conn.AddChain(prerouting)
+		conn.AddChain(hostport)
+		conn.AddChain(dnat)
+		conn.AddRule(&nftables.Rule{Table: netavark, Chain: prerouting, Exprs: []expr.Any{
+			&expr.Verdict{Kind: expr.VerdictJump, Chain: "NETAVARK-HOSTPORT-DNAT"},
+		}})
+		conn.AddRule(&nftables.Rule{Table: netavark, Chain: hostport, Exprs: []expr.Any{
+			&expr.Verdict{Kind: expr.VerdictJump, Chain: dnat.Name},
+		}})
+		conn.AddRule(&nftables.Rule{Table: netavark, Chain: dnat,
+			UserData: nufftablestest.Comment("dnat name: podman id: 9f2c1d"),
+			Exprs:    nativeForward(8080, []byte{10, 88, 0, 2})})
+		conn.AddRule(&nftables.Rule{Table: netavark, Chain: dnat, Exprs: nativeForward(8081, []byte{10, 88, 0, 3})})
+
+		tables, err := nufftables.GetAllTables(conn)
+		Expect(err).NotTo(HaveOccurred())
+		fwds := AnalyzeForwards(tables)
+		Expect(fwds).To(HaveLen(2))
+		Expect(fwds[0].Manager).To(Equal(Netavark))
+		Expect(fwds[0].Network).To(Equal("2f259bab"))
+		Expect(fwds[0].ContainerID).To(Equal("9f2c1d"))
+		Expect(fwds[1].Manager).To(Equal(Netavark))
+		Expect(fwds[1].Network).To(Equal("2f259bab"))
+		Expect(fwds[1].ContainerID).To(BeEmpty())
+	})
+
+	It("doesn't attribute unmanaged forwardings", func() {
+		table := &nufftables.Table{Table: &nftables.Table{Name: "nat", Family: nftables.TableFamilyIPv4}}
+		chain := &nufftables.Chain{Chain: &nftables.Chain{Name: "custom"}, Table: table}
+		fp := ForwardedPort(nufftables.Rule{Chain: chain, Rule: &nftables.Rule{
+			Exprs: nativeForward(80, []byte{10, 0, 0, 1})}})
+		Expect(fp).NotTo(BeNil())
+		Expect(fp.Manager).To(Equal(Unmanaged))
+		Expect(fp.String()).NotTo(ContainSubstring("managed by"))
+	})
+
+})
@@ -18,34 +18,197 @@ import (
 	"fmt"
 	"net"
 	"strconv"
+	"strings"
+
+	"github.com/google/nftables/expr"
+	"github.com/thediveo/nufftables"
+	"github.com/thediveo/nufftables/dsl"
 )
 
 // ForwardedPortRange describes a port or port range in a network namespace
 // (such as the "host") to be forwarded to a potentially shifted range of ports
-// on one or more new destination IP(s). Multiple forwarded destination IPs can
-// used in case of load-balancing between multiple instances of the same
-// service.
+// on a new destination IP address or address range. In case of load-balancing
+// between multiple instances of the same service, Endpoints lists all the
+// destinations with their share of the traffic.
 type ForwardedPortRange struct {
 	Protocol       string // such as "tcp" and "udp".
 	IP             net.IP // the original destination IP address to forward from, if any.
 	PortMin        uint16 // original destination port...
 	PortMax        uint16 // ...or port range.
-	ForwardIP      net.IP // new destionation IP address to forward to.
-	ForwardPortMin uint16 // the new (min) destination port to forward to.
+	ForwardIP      net.IP // new destination IP address to forward to...
+	ForwardIPMax   net.IP // ...or address range.
+	ForwardPortMin uint16 // the new (min) destination port to forward to...
+	ForwardPortMax uint16 // ...or port range.
+	// ForwardPortBase is the original port mapped to ForwardPortMin when
+	// shifting port ranges, such as in “--to-destination 10.0.0.1:9000-9010/8000”;
+	// it is zero if no shifting takes place. See also [ForwardedPortRange.TargetPort].
+	ForwardPortBase uint16
+	// Endpoints lists the destinations in case the traffic is spread across
+	// multiple destinations, either by rules with statistic matches, such as
+	// “-m statistic --mode random --probability 0.5”, or number generator and
+	// hash maps, such as “dnat to numgen inc mod 2 map { 0 : 10.0.0.1, 1 :
+	// 10.0.0.2 }”; it is nil otherwise.
+	Endpoints []Endpoint
+
+	// Ifaces are the input and output interface constraints, such as
+	// Docker's “iifname != "docker0"”.
+	Ifaces []dsl.IfaceMatch
+	// Sources are the source address restrictions, such as “ip saddr
+	// 10.0.0.0/8”.
+	Sources []dsl.AddrMatch
+	// AddrTypes are the address type conditions, such as Docker's “addrtype
+	// --dst-type LOCAL” forwarding only packets destined to local addresses.
+	AddrTypes []dsl.AddrTypeMatch
+
+	// Manager is the tool managing the port forwarding, such as Docker or
+	// netavark, if recognized. Network and ContainerID are the network name
+	// (or ID) and container ID embedded in chain names and rule comments, such
+	// as the CNI portmap plugin's “dnat name: "cbr0" id: "4d0c…"”.
+	Manager     Manager
+	Network     string
+	ContainerID string
+
+	// Family, Table, Chain, and Handle reference the rule the port forwarding
+	// has been found in, if known; for instance, in order to delete the rule.
+	Family nufftables.TableFamily
+	Table  string
+	Chain  string
+	Handle uint64
 }
 
 // String returns the port forwarding information in plain textual format, such
 // as for simple logging, et cetera. In case of a single forwarded port only,
-// the port range automatically will be collapsed into a single port only.
+// the port range automatically will be collapsed into a single port only. In
+// case of load-balancing, the endpoints are listed together with their shares
+// of the traffic. Interface, source address, and address type conditions are
+// listed after “if”, followed by the managing tool with the network and
+// container identifiers, if known, and the originating rule in parentheses, if
+// known, such as “(ip nat DOCKER handle 42)”.
 func (f ForwardedPortRange) String() string {
-	portRange := strconv.FormatUint(uint64(f.PortMin), 10)
-	if f.PortMax != f.PortMin {
-		portRange += "-" + strconv.FormatUint(uint64(f.PortMax), 10)
+	var to string
+	if len(f.Endpoints) != 0 {
+		eps := make([]string, 0, len(f.Endpoints))
+		for _, ep := range f.Endpoints {
+			eps = append(eps, ep.String())
+		}
+		to = strings.Join(eps, ", ")
+	} else {
+		to = f.ipString(f.ForwardIP)
+		if f.ForwardIPMax != nil && !f.ForwardIPMax.Equal(f.ForwardIP) {
+			to += "-" + f.ipString(f.ForwardIPMax)
+		}
+		to += ":" + portRangeString(f.ForwardPortMin, f.ForwardPortMax)
+		if f.ForwardPortBase != 0 {
+			to += "/" + strconv.FormatUint(uint64(f.ForwardPortBase), 10)
+		}
 	}
-	return fmt.Sprintf("forwarding %s from %s:%s to %s:%d",
+	s := fmt.Sprintf("forwarding %s from %s:%s to %s",
 		f.Protocol,
-		f.ipString(f.IP), portRange,
-		f.ipString(f.ForwardIP), f.ForwardPortMin)
+		f.ipString(f.IP), portRangeString(f.PortMin, f.PortMax),
+		to)
+	if conds := f.conditions(); len(conds) != 0 {
+		s += " if " + strings.Join(conds, ", ")
+	}
+	if f.Manager != Unmanaged {
+		s += " managed by " + f.Manager.String()
+		if f.Network != "" {
+			s += " network " + f.Network
+		}
+		if f.ContainerID != "" {
+			s += " container " + f.ContainerID
+		}
+	}
+	if f.Table != "" {
+		s += fmt.Sprintf(" (%s %s %s handle %d)", f.Family, f.Table, f.Chain, f.Handle)
+	}
+	return s
+}
+
+// TargetPort returns the destination port the specified original port gets
+// forwarded to. When shifting port ranges, the original port is mapped
+// relative to ForwardPortBase onto the forwarded port range. Otherwise, the
+// original port is kept if inside the forwarded port range, else packets get
+// forwarded to any of the ports in the forwarded port range, with TargetPort
+// then returning ForwardPortMin.
+func (f ForwardedPortRange) TargetPort(port uint16) uint16 {
+	if f.ForwardPortMax <= f.ForwardPortMin {
+		return f.ForwardPortMin
+	}
+	size := uint32(f.ForwardPortMax) - uint32(f.ForwardPortMin) + 1
+	if f.ForwardPortBase != 0 {
+		return f.ForwardPortMin + uint16((uint32(port-f.ForwardPortBase))%size)
+	}
+	if port >= f.ForwardPortMin && port <= f.ForwardPortMax {
+		return port
+	}
+	return f.ForwardPortMin
+}
+
+// Endpoint is one of multiple destinations of a port forwarding, together
+// with its share of the traffic in the range of 0..1.
+type Endpoint struct {
+	IP     net.IP
+	Port   uint16
+	Weight float64
+}
+
+// String returns the endpoint in textual format, such as “10.0.0.1:80 (50%)”.
+func (e Endpoint) String() string {
+	return fmt.Sprintf("%s:%d (%.4g%%)", ForwardedPortRange{}.ipString(e.IP), e.Port, e.Weight*100)
+}
+
+// portRangeString returns the specified port range in textual format,
+// collapsing single-port ranges into a single port.
+func portRangeString(min, max uint16) string {
+	s := strconv.FormatUint(uint64(min), 10)
+	if max > min {
+		s += "-" + strconv.FormatUint(uint64(max), 10)
+	}
+	return s
+}
+
+// conditions returns the interface, source address, and address type
+// conditions in textual format.
+func (f ForwardedPortRange) conditions() []string {
+	conds := make([]string, 0, len(f.Ifaces)+len(f.Sources)+len(f.AddrTypes))
+	for idx := range f.Ifaces {
+		conds = append(conds, f.Ifaces[idx].String())
+	}
+	for idx := range f.Sources {
+		conds = append(conds, f.Sources[idx].String())
+	}
+	for idx := range f.AddrTypes {
+		conds = append(conds, f.AddrTypes[idx].String())
+	}
+	return conds
+}
+
+// addConditions adds the interface, source address, and address type
+// conditions of the specified rule.
+func (f *ForwardedPortRange) addConditions(rule *nufftables.Rule) {
+	exprs := rule.Expressions()
+	f.Ifaces = append(f.Ifaces, dsl.IfaceMatches(exprs)...)
+	for _, match := range dsl.RuleAddrMatches(rule) {
+		if match.Direction == dsl.SourceAddr {
+			f.Sources = append(f.Sources, match)
+		}
+	}
+	for _, e := range exprs {
+		match, ok := e.(*expr.Match)
+		if !ok {
+			continue
+		}
+		switch m := dsl.DecodeXtMatch(match).(type) {
+		case *dsl.AddrTypeMatch:
+			f.AddrTypes = append(f.AddrTypes, *m)
+		case []dsl.AddrMatch:
+			for _, addr := range m {
+				if addr.Direction == dsl.SourceAddr {
+					f.Sources = append(f.Sources, addr)
+				}
+			}
+		}
+	}
 }
 
 // ipString returns the IP address in its textual form so that it can be
@@ -56,4 +56,52 @@ var _ = Describe("chain hooks", func() {
 		Expect(fwpr.String()).To(Equal("forwarding xdp from 1.2.3.4:42 to 8.8.8.8:777"))
 	})
 
+	It("stringifies forwarded address and port ranges", func() {
+		fwpr := ForwardedPortRange{
+			Protocol:        "tcp",
+			IP:              net.ParseIP("1.2.3.4"),
+			PortMin:         8000,
+			PortMax:         8010,
+			ForwardIP:       net.ParseIP("fe80::1"),
+			ForwardIPMax:    net.ParseIP("fe80::2"),
+			ForwardPortMin:  9000,
+			ForwardPortMax:  9010,
+			ForwardPortBase: 8000,
+		}
+		Expect(fwpr.String()).To(Equal(
+			"forwarding tcp from 1.2.3.4:8000-8010 to [fe80::1]-[fe80::2]:9000-9010/8000"))
+	})
+
+	It("stringifies load-balanced endpoints", func() {
+		fwpr := ForwardedPortRange{
+			Protocol: "tcp",
+			IP:       net.ParseIP("1.2.3.4"),
+			PortMin:  80,
+			PortMax:  80,
+			Endpoints: []Endpoint{
+				{IP: net.ParseIP("10.0.0.1"), Port: 8080, Weight: 0.75},
+				{IP: net.ParseIP("fe80::1"), Port: 8080, Weight: 0.25},
+			},
+		}
+		Expect(fwpr.String()).To(Equal(
+			"forwarding tcp from 1.2.3.4:80 to 10.0.0.1:8080 (75%), [fe80::1]:8080 (25%)"))
+	})
+
+	DescribeTable("maps original ports onto forwarded ports",
+		func(min, max, base, port, expected int) {
+			fwpr := ForwardedPortRange{
+				ForwardPortMin:  uint16(min),
+				ForwardPortMax:  uint16(max),
+				ForwardPortBase: uint16(base),
+			}
+			Expect(fwpr.TargetPort(uint16(port))).To(Equal(uint16(expected)))
+		},
+		Entry("single port", 80, 80, 0, 8080, 80),
+		Entry("single port without maximum", 80, 0, 0, 8080, 80),
+		Entry("shifted", 9000, 9010, 8000, 8005, 9005),
+		Entry("shifted beyond range", 9000, 9009, 8000, 8015, 9005),
+		Entry("kept", 8000, 8010, 0, 8005, 8005),
+		Entry("outside range", 9000, 9010, 0, 8005, 9000),
+	)
+
 })
@@ -0,0 +1,235 @@
+// Copyright 2023 Harald Albrecht.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy
+// of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package portfinder
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/google/nftables"
+	"github.com/thediveo/nufftables"
+	"github.com/thediveo/nufftables/dsl"
+	"golang.org/x/exp/slices"
+	"golang.org/x/sys/unix"
+)
+
+// Redirection describes traffic redirected to a local port, either using
+// destination NAT to the address of the incoming interface, such as the xt
+// “REDIRECT” target and nft's redir statement, or transparent proxying using
+// the xt “TPROXY” target and nft's tproxy statement, as done by service mesh
+// sidecars.
+type Redirection struct {
+	// Protocol is the transport protocol redirected, such as "tcp", or empty
+	// if not restricted.
+	Protocol string
+	// TrafficMatch are the conditions accumulated along the way to the
+	// redirecting rule and of the rule itself.
+	TrafficMatch
+	// ToPortMin and ToPortMax are the local port range redirected to; they
+	// are zero if the original destination port is kept.
+	ToPortMin, ToPortMax uint16
+	// TProxy is true for transparent proxying, with ToIP being the local
+	// address redirected to, if specified, and Mark and MarkMask the packet
+	// mark set by the xt “TPROXY” target.
+	TProxy         bool
+	ToIP           net.IP
+	Mark, MarkMask uint32
+	// Exclusions lists the traffic exempted from this redirection by earlier
+	// rules, such as returning the traffic of a particular socket owner.
+	Exclusions []Exclusion
+
+	// Rule is the redirecting rule, and Path lists the rules jumping (or
+	// going) from a base chain to the chain of the redirecting rule, starting
+	// with the rule in the base chain.
+	Rule *nufftables.Rule
+	Path []*nufftables.Rule
+
+	// Family, Table, Chain, and Handle reference the redirecting rule.
+	Family nufftables.TableFamily
+	Table  string
+	Chain  string
+	Handle uint64
+}
+
+// String returns the redirection in plain textual format, such as
+// “redirecting tcp to local port 15001 unless owner --uid-owner 1337 (ip nat
+// ISTIO_REDIRECT handle 3)”, listing the conditions after “if” and the
+// exclusions after “unless”.
+func (r *Redirection) String() string {
+	var b strings.Builder
+	b.WriteString("redirecting ")
+	if r.Protocol != "" {
+		b.WriteString(r.Protocol)
+	} else {
+		b.WriteString("any protocol")
+	}
+	switch {
+	case r.ToPortMin == 0:
+		b.WriteString(" to same local port")
+	case r.ToPortMax > r.ToPortMin:
+		b.WriteString(" to local ports " + portRangeString(r.ToPortMin, r.ToPortMax))
+	default:
+		b.WriteString(" to local port " + portRangeString(r.ToPortMin, r.ToPortMax))
+	}
+	if r.TProxy {
+		b.WriteString(" via tproxy")
+		if r.ToIP != nil {
+			b.WriteString(" at " + r.ToIP.String())
+		}
+		if r.MarkMask != 0 {
+			fmt.Fprintf(&b, " mark %#x/%#x", r.Mark, r.MarkMask)
+		}
+	}
+	if conds := r.conditions(); len(conds) != 0 {
+		b.WriteString(" if " + strings.Join(conds, ", "))
+	}
+	if len(r.Exclusions) != 0 {
+		excls := make([]string, 0, len(r.Exclusions))
+		for _, excl := range r.Exclusions {
+			excls = append(excls, excl.String())
+		}
+		b.WriteString(" unless " + strings.Join(excls, "; "))
+	}
+	if r.Table != "" {
+		fmt.Fprintf(&b, " (%s %s %s handle %d)", r.Family, r.Table, r.Chain, r.Handle)
+	}
+	return b.String()
+}
+
+// RedirectedPort returns the redirection of the specified rule, or nil if the
+// rule doesn't redirect to a local port. Only the rule's own conditions are
+// taken into account; see [Redirections] for also taking the conditions and
+// exclusions along the way to the rule into account.
+func RedirectedPort(rule nufftables.Rule) *Redirection {
+	exprs := rule.Expressions()
+	r := &Redirection{Rule: &rule}
+	if _, nat := dsl.TargetNAT(exprs, dsl.Redirect); nat != nil {
+		if nat.HasPorts() {
+			r.ToPortMin, r.ToPortMax = nat.PortMin, nat.PortMax
+		}
+	} else if _, tproxy := dsl.TargetTProxy(exprs); tproxy != nil {
+		r.TProxy = true
+		r.ToPortMin, r.ToPortMax = tproxy.Port, tproxy.Port
+		if tproxy.Addr.IsValid() {
+			r.ToIP = net.IP(tproxy.Addr.AsSlice())
+		}
+		r.Mark, r.MarkMask = tproxy.Mark, tproxy.Mask
+	} else {
+		return nil
+	}
+	if r.ToPortMax < r.ToPortMin {
+		r.ToPortMax = r.ToPortMin
+	}
+	if rule.Rule != nil {
+		r.Handle = rule.Handle
+	}
+	if chain := rule.Chain; chain != nil && chain.Chain != nil {
+		r.Chain = chain.Name
+		if chain.Table != nil && chain.Table.Table != nil {
+			r.Family = nufftables.TableFamily(chain.Table.Family)
+			r.Table = chain.Table.Name
+		}
+	}
+	r.add(&rule)
+	r.setProtocol(&rule, nil)
+	return r
+}
+
+// setProtocol sets the transport protocol matched by the specified rule or
+// path, or otherwise by the port conditions.
+func (r *Redirection) setProtocol(rule *nufftables.Rule, path []*nufftables.Rule) {
+	r.Protocol = ruleProtocol(rule, path)
+	for _, ports := range r.Ports {
+		if r.Protocol != "" {
+			return
+		}
+		r.Protocol = ports.Protocol
+	}
+}
+
+// Redirections returns the redirections to local ports found in the
+// specified tables, sorted by table family, table name, chain name, and rule
+// handle.
+//
+// Redirections follows the jump and goto verdicts, including verdict maps,
+// starting from the base chains of type “nat” or “filter” hooked at
+// prerouting or output, regardless of the names and families of their
+// tables. Thus, it finds REDIRECT targets in “nat” tables as well as TPROXY
+// targets in “mangle” tables of iptables-nft, and redir and tproxy statements
+// in tables of the inet family. Along each path, Redirections accumulates the
+// conditions of the jumping rules, as well as the conditions of earlier rules
+// ending the evaluation of their chains as Exclusions, such as the socket
+// owner exclusions service mesh sidecars rely on. Rules shadowed by an
+// earlier unconditional rule ending the evaluation of its chain are skipped.
+//
+// Please note that native tproxy statements are currently lost when reading
+// rules from the kernel.
+func Redirections(tables nufftables.TableMap) []*Redirection {
+	redirections := []*Redirection{}
+	walkFrom(tables, isRedirectBaseChain, func(rule *nufftables.Rule, path []*nufftables.Rule, exclusions []Exclusion) {
+		r := RedirectedPort(*rule)
+		if r == nil {
+			return
+		}
+		// The conditions along the path come before the rule's own
+		// conditions.
+		r.prepend(path)
+		if r.Protocol == "" {
+			r.setProtocol(rule, path)
+		}
+		r.Exclusions = exclusions
+		r.Rule = rule
+		r.Path = path
+		redirections = append(redirections, r)
+	})
+	slices.SortStableFunc(redirections, func(a, b *Redirection) int {
+		if c := int(a.Family) - int(b.Family); c != 0 {
+			return c
+		}
+		if c := strings.Compare(a.Table, b.Table); c != 0 {
+			return c
+		}
+		if c := strings.Compare(a.Chain, b.Chain); c != 0 {
+			return c
+		}
+		return int(a.Handle) - int(b.Handle)
+	})
+	return redirections
+}
+
+// isRedirectBaseChain returns true if the specified chain is a base chain of
+// type “nat” or “filter” hooked at prerouting or output of a table of the ip,
+// ip6, or inet family.
+func isRedirectBaseChain(chain *nufftables.Chain) bool {
+	if chain.Chain == nil || chain.Table == nil || chain.Hooknum == nil {
+		return false
+	}
+	switch chain.Table.Family {
+	case nftables.TableFamilyIPv4, nftables.TableFamilyIPv6, nftables.TableFamilyINet:
+	default:
+		return false
+	}
+	switch chain.Type {
+	case nftables.ChainTypeNAT, nftables.ChainTypeFilter:
+	default:
+		return false
+	}
+	switch *chain.Hooknum {
+	case unix.NF_INET_PRE_ROUTING, unix.NF_INET_LOCAL_OUT:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,290 @@
+// Copyright 2023 Harald Albrecht.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy
+// of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package portfinder
+
+import (
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"github.com/google/nftables/xt"
+	"github.com/thediveo/nufftables"
+	"github.com/thediveo/nufftables/nufftablestest"
+	"golang.org/x/sys/unix"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+// tcp returns the expressions of “-p tcp”.
+func tcp() []expr.Any {
+	return []expr.Any{
+		&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{unix.IPPROTO_TCP}},
+	}
+}
+
+// uidOwner returns an xt “owner” match of the specified user ID.
+func uidOwner(uid uint32) *expr.Match {
+	info := make(xt.Unknown, 20)
+	copy(info[0:], hostUint32(uid))
+	copy(info[4:], hostUint32(uid))
+	info[16] = 1 // XT_OWNER_UID
+	return &expr.Match{Name: "owner", Rev: 1, Info: &info}
+}
+
+// redirectTo returns an xt “REDIRECT” target to the specified local port.
+func redirectTo(port uint16) *expr.Target {
+	return &expr.Target{Name: "REDIRECT", Info: &xt.NatIPv4MultiRangeCompat{{
+		Flags: uint(xt.NatRangeProtoSpecified), MinPort: port, MaxPort: port,
+	}}}
+}
+
+var _ = Describe("redirections", func() {
+
+	It("finds sidecar redirections with their exclusions", func() {
+		conn := nufftables.NewMemConn()
+		nat := &nftables.Table{Name: "nat", Family: nftables.TableFamilyIPv4}
+		prerouting := &nftables.Chain{Name: "PREROUTING", Table: nat,
+			Type: nftables.ChainTypeNAT, Hooknum: nftables.ChainHookPrerouting}
+		output := &nftables.Chain{Name: "OUTPUT", Table: nat,
+			Type: nftables.ChainTypeNAT, Hooknum: nftables.ChainHookOutput}
+		inbound := &nftables.Chain{Name: "ISTIO_INBOUND", Table: nat}
+		inredirect := &nftables.Chain{Name: "ISTIO_IN_REDIRECT", Table: nat}
+		outbound := &nftables.Chain{Name: "ISTIO_OUTPUT", Table: nat}
+		redirect := &nftables.Chain{Name: "ISTIO_REDIRECT", Table: nat}
+		for _, chain := range []*nftables.Chain{prerouting, output, inbound, inredirect, outbound, redirect} {
+			conn.AddChain(chain)
+		}
+		conn.AddRule(&nftables.Rule{Table: nat, Chain: prerouting, Exprs: append(tcp(),
+			&expr.Verdict{Kind: expr.VerdictJump, Chain: "ISTIO_INBOUND"})})
+		conn.AddRule(&nftables.Rule{Table: nat, Chain: inbound, Exprs: append(tcp(),
+			&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseTransportHeader, Offset: 2, Len: 2},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{0x3a, 0xc0}},
+			&expr.Verdict{Kind: expr.VerdictReturn})})
+		conn.AddRule(&nftables.Rule{Table: nat, Chain: inbound, Exprs: append(tcp(),
+			&expr.Verdict{Kind: expr.VerdictJump, Chain: "ISTIO_IN_REDIRECT"})})
+		conn.AddRule(&nftables.Rule{Table: nat, Chain: inredirect, Exprs: append(tcp(), redirectTo(15006))})
+
+		conn.AddRule(&nftables.Rule{Table: nat, Chain: output, Exprs: []expr.Any{
+			&expr.Verdict{Kind: expr.VerdictJump, Chain: "ISTIO_OUTPUT"}}})
+		conn.AddRule(&nftables.Rule{Table: nat, Chain: outbound, Exprs: []expr.Any{
+			&expr.Meta{Key: expr.MetaKeyOIFNAME, Register: 1},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte("lo\x00")},
+			&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: 12, Len: 4},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{127, 0, 0, 6}},
+			&expr.Verdict{Kind: expr.VerdictReturn}}})
+		conn.AddRule(&nftables.Rule{Table: nat, Chain: outbound, Exprs: []expr.Any{
+			uidOwner(1337),
+			&expr.Verdict{Kind: expr.VerdictReturn}}})
+		conn.AddRule(&nftables.Rule{Table: nat, Chain: outbound, Exprs: []expr.Any{
+			&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: 16, Len: 4},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{127, 0, 0, 1}},
+			&expr.Verdict{Kind: expr.VerdictReturn}}})
+		conn.AddRule(&nftables.Rule{Table: nat, Chain: outbound, Exprs: append(tcp(),
+			&expr.Verdict{Kind: expr.VerdictJump, Chain: "ISTIO_REDIRECT"})})
+		conn.AddRule(&nftables.Rule{Table: nat, Chain: redirect, Exprs: []expr.Any{redirectTo(15001)}})
+
+		tables, err := nufftables.GetAllTables(conn)
+		Expect(err).NotTo(HaveOccurred())
+		rs := Redirections(tables)
+		Expect(rs).To(HaveLen(2))
+
+		Expect(rs[0].Chain).To(Equal("ISTIO_IN_REDIRECT"))
+		Expect(rs[0].Path).To(HaveLen(2))
+		Expect(rs[0].Exclusions).To(HaveLen(1))
+		Expect(rs[0].String()).To(MatchRegexp(
+			`^redirecting tcp to local port 15006 unless tcp dport 15040 \(ip nat ISTIO_IN_REDIRECT handle \d+\)$`))
+
+		Expect(rs[1].Chain).To(Equal("ISTIO_REDIRECT"))
+		Expect(rs[1].Protocol).To(Equal("tcp"))
+		Expect(rs[1].ToPortMin).To(Equal(uint16(15001)))
+		Expect(rs[1].Exclusions).To(HaveLen(3))
+		Expect(rs[1].Exclusions[1].Owners).To(HaveLen(1))
+		Expect(rs[1].Exclusions[1].Owners[0].MatchesUID(1337)).To(BeTrue())
+		Expect(rs[1].String()).To(MatchRegexp(
+			`^redirecting tcp to local port 15001 unless oifname "lo", ip saddr 127\.0\.0\.6; ` +
+				`owner --uid-owner 1337; ip daddr 127\.0\.0\.1 \(ip nat ISTIO_REDIRECT handle \d+\)$`))
+	})
+
+	It("finds transparent proxy redirections", func() {
+		conn := nufftables.NewMemConn()
+		mangle := &nftables.Table{Name: "mangle", Family: nftables.TableFamilyIPv4}
+		prerouting := &nftables.Chain{Name: "PREROUTING", Table: mangle,
+			Type: nftables.ChainTypeFilter, Hooknum: nftables.ChainHookPrerouting}
+		conn.AddChain(prerouting)
+		socket := make(xt.Unknown, 4)
+		conn.AddRule(&nftables.Rule{Table: mangle, Chain: prerouting, Exprs: []expr.Any{
+			&expr.Match{Name: "socket", Rev: 1, Info: &socket},
+			&expr.Verdict{Kind: expr.VerdictAccept}}})
+		info := make(xt.Unknown, 28)
+		copy(info[0:], hostUint32(1))
+		copy(info[4:], hostUint32(1))
+		copy(info[8:], []byte{127, 0, 0, 1})
+		copy(info[24:], []byte{0x3a, 0x99})
+		conn.AddRule(&nftables.Rule{Table: mangle, Chain: prerouting, Exprs: append(tcp(),
+			&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseTransportHeader, Offset: 2, Len: 2},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{0, 80}},
+			&expr.Target{Name: "TPROXY", Rev: 1, Info: &info})})
+
+		tables, err := nufftables.GetAllTables(conn)
+		Expect(err).NotTo(HaveOccurred())
+		rs := Redirections(tables)
+		Expect(rs).To(HaveLen(1))
+		Expect(rs[0].TProxy).To(BeTrue())
+		Expect(rs[0].ToIP.String()).To(Equal("127.0.0.1"))
+		Expect(rs[0].String()).To(MatchRegexp(
+			`^redirecting tcp to local port 15001 via tproxy at 127\.0\.0\.1 mark 0x1/0x1 if tcp dport 80 ` +
+				`unless rule PREROUTING handle \d+ \(ip mangle PREROUTING handle \d+\)$`))
+	})
+
+	It("finds native redirections and skips shadowed ones", func() {
+		conn := nufftables.NewMemConn()
+		mesh := &nftables.Table{Name: "mesh", Family: nftables.TableFamilyINet}
+		output := &nftables.Chain{Name: "output", Table: mesh,
+			Type: nftables.ChainTypeNAT, Hooknum: nftables.ChainHookOutput}
+		conn.AddChain(output)
+		conn.AddRule(&nftables.Rule{Table: mesh, Chain: output, Exprs: []expr.Any{
+			&expr.Meta{Key: expr.MetaKeySKUID, Register: 1},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: hostUint32(1000)},
+			&expr.Verdict{Kind: expr.VerdictReturn}}})
+		conn.AddRule(&nftables.Rule{Table: mesh, Chain: output, Exprs: []expr.Any{
+			&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{unix.IPPROTO_UDP}},
+			&expr.Immediate{Register: 1, Data: []byte{0x1f, 0x90}},
+			&expr.Redir{RegisterProtoMin: 1}}})
+		conn.AddRule(&nftables.Rule{Table: mesh, Chain: output, Exprs: []expr.Any{
+			&expr.Verdict{Kind: expr.VerdictReturn}}})
+		conn.AddRule(&nftables.Rule{Table: mesh, Chain: output, Exprs: []expr.Any{
+			&expr.Redir{}}})
+
+		tables, err := nufftables.GetAllTables(conn)
+		Expect(err).NotTo(HaveOccurred())
+		rs := Redirections(tables)
+		Expect(rs).To(HaveLen(1))
+		Expect(rs[0].String()).To(MatchRegexp(
+			`^redirecting udp to local port 8080 unless owner --uid-owner 1000 \(inet mesh output handle \d+\)$`))
+	})
+
+	It("finds native transparent proxy redirections", func() {
+		conn := nufftables.NewMemConn()
+		mesh := &nftables.Table{Name: "mesh", Family: nftables.TableFamilyINet}
+		prerouting := &nftables.Chain{Name: "prerouting", Table: mesh,
+			Type: nftables.ChainTypeFilter, Hooknum: nftables.ChainHookPrerouting}
+		conn.AddChain(prerouting)
+		// meta l4proto tcp tproxy ip to 127.0.0.1:15001
+		conn.AddRule(&nftables.Rule{Table: mesh, Chain: prerouting, Exprs: append(tcp(),
+			&expr.Immediate{Register: 1, Data: []byte{127, 0, 0, 1}},
+			&expr.Immediate{Register: 2, Data: []byte{0x3a, 0x99}},
+			&expr.TProxy{Family: unix.NFPROTO_IPV4, TableFamily: unix.NFPROTO_INET, RegAddr: 1, RegPort: 2})})
+
+		tables, err := nufftables.GetAllTables(conn)
+		Expect(err).NotTo(HaveOccurred())
+		rs := Redirections(tables)
+		Expect(rs).To(HaveLen(1))
+		Expect(rs[0].String()).To(MatchRegexp(
+			`^redirecting tcp to local port 15001 via tproxy at 127\.0\.0\.1 \(inet mesh prerouting handle \d+\)$`))
+	})
+
+	It("finds redirections read from the kernel", func() {
+		info := make(xt.Unknown, 28)
+		copy(info[0:], hostUint32(1))
+		copy(info[4:], hostUint32(1))
+		copy(info[8:], []byte{127, 0, 0, 1})
+		copy(info[24:], []byte{0x3a, 0x99})
+		conn := nufftablestest.NewConn(nufftablestest.Ruleset{
+			{
+				Name:   "mangle",
+				Family: nftables.TableFamilyIPv4,
+				Chains: []nufftablestest.Chain{{
+					Name:     "PREROUTING",
+					Type:     nftables.ChainTypeFilter,
+					Hook:     nftables.ChainHookPrerouting,
+					Priority: nftables.ChainPriorityMangle,
+					Rules: []nufftablestest.Rule{
+						// The kernel checks the protocol of TPROXY targets
+						// using the protocol of the xt “tcp” match.
+						append(tcp(),
+							&expr.Match{Name: "tcp", Info: &xt.Tcp{
+								SrcPorts: [2]uint16{0, 0xffff}, DstPorts: [2]uint16{80, 80}}},
+							&expr.Target{Name: "TPROXY", Rev: 1, Info: &info}),
+					},
+				}},
+			},
+			{
+				Name:   "mesh",
+				Family: nftables.TableFamilyINet,
+				Chains: []nufftablestest.Chain{{
+					Name:     "output",
+					Type:     nftables.ChainTypeNAT,
+					Hook:     nftables.ChainHookOutput,
+					Priority: nftables.ChainPriorityNATDest,
+					Rules: []nufftablestest.Rule{
+						{
+							&expr.Meta{Key: expr.MetaKeySKUID, Register: 1},
+							&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: hostUint32(1000)},
+							&expr.Verdict{Kind: expr.VerdictReturn},
+						},
+						append(tcp(),
+							&expr.Immediate{Register: 1, Data: []byte{0x3a, 0x98}},
+							&expr.Redir{RegisterProtoMin: 1}),
+					},
+				}},
+			},
+		})
+
+		tables, err := nufftables.GetAllTables(conn)
+		Expect(err).NotTo(HaveOccurred())
+		rs := Redirections(tables)
+		Expect(rs).To(HaveLen(2))
+		Expect(rs[0].String()).To(MatchRegexp(
+			`^redirecting tcp to local port 15000 unless owner --uid-owner 1000 \(inet mesh output handle \d+\)$`))
+		Expect(rs[1].String()).To(MatchRegexp(
+			`^redirecting tcp to local port 15001 via tproxy at 127\.0\.0\.1 mark 0x1/0x1 if tcp dport 80 ` +
+				`\(ip mangle PREROUTING handle \d+\)$`))
+	})
+
+	It("keeps the protocol of port matches", func() {
+		conn := nufftables.NewMemConn()
+		nat := &nftables.Table{Name: "nat", Family: nftables.TableFamilyIPv4}
+		prerouting := &nftables.Chain{Name: "PREROUTING", Table: nat,
+			Type: nftables.ChainTypeNAT, Hooknum: nftables.ChainHookPrerouting}
+		conn.AddChain(prerouting)
+		conn.AddRule(&nftables.Rule{Table: nat, Chain: prerouting, Exprs: []expr.Any{
+			&expr.Match{Name: "tcp", Info: &xt.Tcp{DstPorts: [2]uint16{80, 80}}},
+			redirectTo(8080)}})
+
+		tables, err := nufftables.GetAllTables(conn)
+		Expect(err).NotTo(HaveOccurred())
+		rs := Redirections(tables)
+		Expect(rs).To(HaveLen(1))
+		Expect(rs[0].Protocol).To(Equal("tcp"))
+	})
+
+	It("returns redirections of single rules", func() {
+		Expect(RedirectedPort(nufftables.Rule{Rule: &nftables.Rule{Exprs: nativeForward(80, []byte{10, 0, 0, 1})}})).To(BeNil())
+
+		r := RedirectedPort(nufftables.Rule{Rule: &nftables.Rule{Handle: 42, Exprs: []expr.Any{
+			&expr.Redir{}}}})
+		Expect(r).NotTo(BeNil())
+		Expect(r.Handle).To(Equal(uint64(42)))
+		Expect(r.String()).To(Equal("redirecting any protocol to same local port"))
+
+		r = RedirectedPort(nufftables.Rule{Rule: &nftables.Rule{Exprs: []expr.Any{
+			&expr.Target{Name: "REDIRECT", Info: &xt.NatIPv4MultiRangeCompat{{
+				Flags: uint(xt.NatRangeProtoSpecified), MinPort: 15000, MaxPort: 15009,
+			}}}}}})
+		Expect(r.String()).To(Equal("redirecting any protocol to local ports 15000-15009"))
+	})
+
+})
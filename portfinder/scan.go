@@ -0,0 +1,477 @@
+// Copyright 2023 Harald Albrecht.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy
+// of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package portfinder
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"github.com/thediveo/nufftables"
+	"github.com/thediveo/nufftables/dsl"
+	"golang.org/x/exp/slices"
+	"golang.org/x/sys/unix"
+)
+
+// Forward is a port forwarding found by [AnalyzeForwards], together with the
+// rule it was found in, the path of jumping rules leading to it, and whether
+// the forwarding is active or dead.
+type Forward struct {
+	ForwardedPortRange
+	Rule *nufftables.Rule
+	// Path lists the rules jumping (or going) from a NAT base chain to the
+	// chain of the forwarding rule, starting with the rule in the base chain.
+	Path []*nufftables.Rule
+	// Conditions and XtConditions are the match conditions accumulated along
+	// the Path, such as Docker's “iifname != docker0” and “fib daddr type
+	// local” (or the xt “addrtype” match), which a packet must meet in order
+	// to reach the forwarding rule.
+	Conditions   []dsl.Predicate
+	XtConditions []*expr.Match
+	// Active is true if packets can reach the forwarding rule. Otherwise, the
+	// forwarding is dead: either its rule is shadowed by the earlier rule
+	// ShadowedBy, such as an unconditional “return”, or its chain is not
+	// reachable at all from any NAT base chain, with ShadowedBy being nil.
+	Active     bool
+	ShadowedBy *nufftables.Rule
+	// Weight is the share of the packets meeting the forwarding's conditions
+	// that actually reach the forwarding rule, in the range of 0..1. It is
+	// less than 1 when rules along the Path or earlier rules spread the
+	// traffic using xt “statistic” matches, such as kube-proxy does in
+	// iptables mode.
+	Weight float64
+	// group identifies the load-balancing group of forwardings with weights
+	// less than 1 that the forwarding belongs to, if any.
+	group string
+}
+
+// String returns the port forwarding information in plain textual format,
+// noting dead forwardings and the reason why they are dead.
+func (f *Forward) String() string {
+	s := f.ForwardedPortRange.String()
+	switch {
+	case f.Active:
+		return s
+	case f.ShadowedBy != nil:
+		return fmt.Sprintf("%s (dead: shadowed by rule handle %d in chain %q)",
+			s, f.ShadowedBy.Handle, chainName(f.ShadowedBy))
+	}
+	return s + " (dead: unreachable)"
+}
+
+// chainName returns the name of the chain of the specified rule, if known.
+func chainName(rule *nufftables.Rule) string {
+	if rule.Chain == nil || rule.Chain.Chain == nil {
+		return ""
+	}
+	return rule.Chain.Name
+}
+
+// ForwardedPorts returns all active port forwardings found in the specified
+// tables, sorted using [ForwardedPortOrder]; see [AnalyzeForwards] for
+// details. Port forwardings load-balanced across multiple rules are returned
+// only once, with their Endpoints listing all destinations.
+//
+// In order to restrict the scan to particular tables or table families,
+// simply pass a table map containing only these tables.
+func ForwardedPorts(tables nufftables.TableMap) []*ForwardedPortRange {
+	fps := []*ForwardedPortRange{}
+	// Forwardings of the same load-balancing group share their endpoints, so
+	// only the first forwarding of a group is returned.
+	seen := map[string]bool{}
+	for _, fwd := range AnalyzeForwards(tables) {
+		if !fwd.Active {
+			continue
+		}
+		if fwd.group != "" {
+			if seen[fwd.group] {
+				continue
+			}
+			seen[fwd.group] = true
+		}
+		fps = append(fps, &fwd.ForwardedPortRange)
+	}
+	return fps
+}
+
+// AnalyzeForwards returns all port forwardings found in the specified tables,
+// sorted using [ForwardedPortOrder], marking them as either active or dead.
+//
+// AnalyzeForwards follows the jump and goto verdicts, including verdict maps,
+// starting from the base chains of type “nat” hooked at prerouting or output
+// ([NATBaseChains]), regardless of the names and families of their tables.
+// Thus, it finds the port forwardings in “nat” tables of iptables-nft, as
+// well as in tables such as “docker”, “incus”, and “firewalld” of the inet
+// family. Along each path, AnalyzeForwards accumulates the match conditions of
+// the jumping rules.
+//
+// A port forwarding is dead if its rule is shadowed by an earlier rule in the
+// same chain (or a jumping rule is shadowed in turn) that ends evaluation,
+// such as “return”, “accept”, or another DNAT, with all the earlier rule's
+// match conditions also being required to reach the forwarding. Forwardings
+// in chains not reachable from any NAT base chain are dead too. If the same
+// forwarding rule is reachable along multiple paths, then AnalyzeForwards
+// reports it only once, preferring an active path.
+//
+// Rules with xt “statistic” matches spread the traffic across the rules of a
+// chain, such as kube-proxy in iptables mode does. AnalyzeForwards thus
+// calculates the Weight of each forwarding and groups the active forwardings
+// of the same protocol, original destination, and conditions into a single
+// load-balanced forwarding: each forwarding in such a group then lists all
+// the forwarding destinations of the group as its Endpoints.
+func AnalyzeForwards(tables nufftables.TableMap) []*Forward {
+	w := walker{
+		forwards: map[*nufftables.Rule]*Forward{},
+		visited:  map[*nufftables.Chain]bool{},
+	}
+	for _, chain := range NATBaseChains(tables) {
+		w.walk(chain, path{weight: 1}, map[*nufftables.Chain]bool{chain: true})
+	}
+	for _, chain := range sortedChains(tables) {
+		if w.visited[chain] {
+			continue
+		}
+		for idx := range chain.Rules {
+			w.record(&chain.Rules[idx], path{}, 0, nil, false)
+		}
+	}
+	slices.SortFunc(w.order, func(a, b *Forward) int {
+		return ForwardedPortOrder(&a.ForwardedPortRange, &b.ForwardedPortRange)
+	})
+	balance(w.order)
+	return w.order
+}
+
+// balance groups the active forwardings with weights less than 1 by their
+// protocol, original destination, table, and conditions, and sets the
+// endpoints of all forwardings in a group to the destinations of the group.
+func balance(forwards []*Forward) {
+	groups := map[string][]*Forward{}
+	keys := []string{}
+	for _, fwd := range forwards {
+		if !fwd.Active || fwd.Weight >= 1 || len(fwd.Endpoints) != 0 {
+			continue
+		}
+		key := fmt.Sprintf("%s %s %d-%d %s %s %s", fwd.Protocol, fwd.IP, fwd.PortMin, fwd.PortMax,
+			fwd.Family, fwd.Table, strings.Join(fwd.conditions(), ", "))
+		if _, ok := groups[key]; !ok {
+			keys = append(keys, key)
+		}
+		groups[key] = append(groups[key], fwd)
+	}
+	for _, key := range keys {
+		group := groups[key]
+		endpoints := make([]Endpoint, 0, len(group))
+		for _, fwd := range group {
+			endpoints = append(endpoints, Endpoint{
+				IP:     fwd.ForwardIP,
+				Port:   fwd.ForwardPortMin,
+				Weight: fwd.Weight,
+			})
+		}
+		for _, fwd := range group {
+			fwd.Endpoints = endpoints
+			fwd.group = key
+		}
+	}
+}
+
+// NATBaseChains returns the base chains of type “nat” hooked at prerouting or
+// output in the specified tables, that is, the base chains where destination
+// NAT happens. The chains are returned in a stable order, by table family,
+// table name, and finally chain name.
+func NATBaseChains(tables nufftables.TableMap) []*nufftables.Chain {
+	chains := []*nufftables.Chain{}
+	for _, chain := range sortedChains(tables) {
+		if isDNATBaseChain(chain) {
+			chains = append(chains, chain)
+		}
+	}
+	return chains
+}
+
+// sortedChains returns the chains of the specified tables, ordered by table
+// family, table name, and finally chain name.
+func sortedChains(tables nufftables.TableMap) []*nufftables.Chain {
+	chains := []*nufftables.Chain{}
+	for _, table := range tables {
+		for _, chain := range table.ChainsByName {
+			chains = append(chains, chain)
+		}
+	}
+	slices.SortFunc(chains, func(a, b *nufftables.Chain) int {
+		if c := int(a.Table.Family) - int(b.Table.Family); c != 0 {
+			return c
+		}
+		if c := strings.Compare(a.Table.Name, b.Table.Name); c != 0 {
+			return c
+		}
+		return strings.Compare(a.Name, b.Name)
+	})
+	return chains
+}
+
+// isDNATBaseChain returns true if the specified chain is a base chain of type
+// “nat” hooked at prerouting or output.
+func isDNATBaseChain(chain *nufftables.Chain) bool {
+	if chain.Chain == nil || chain.Table == nil || chain.Type != nftables.ChainTypeNAT || chain.Hooknum == nil {
+		return false
+	}
+	switch *chain.Hooknum {
+	case unix.NF_INET_PRE_ROUTING, unix.NF_INET_LOCAL_OUT:
+		return true
+	}
+	return false
+}
+
+// path is the path of jumping rules leading to a chain, together with the
+// match conditions accumulated along this path and the share of the packets
+// meeting these conditions that reach the chain.
+type path struct {
+	rules      []*nufftables.Rule
+	conds      []dsl.Predicate
+	xtconds    []*expr.Match
+	weight     float64
+	shadowedBy *nufftables.Rule // non-nil if the path is dead.
+}
+
+// extend returns a new path extended by the specified jumping rule with its
+// lifted form and weight.
+func (p path) extend(rule *nufftables.Rule, lifted *dsl.LiftedRule, weight float64, shadowedBy *nufftables.Rule) path {
+	return path{
+		rules:      append(p.rules[:len(p.rules):len(p.rules)], rule),
+		conds:      append(p.conds[:len(p.conds):len(p.conds)], lifted.Predicates...),
+		xtconds:    append(p.xtconds[:len(p.xtconds):len(p.xtconds)], lifted.XtMatches...),
+		weight:     weight,
+		shadowedBy: shadowedBy,
+	}
+}
+
+// walker walks the chains reachable from NAT base chains, recording the port
+// forwardings found.
+type walker struct {
+	forwards map[*nufftables.Rule]*Forward
+	order    []*Forward
+	visited  map[*nufftables.Chain]bool
+}
+
+// terminal is an earlier rule of a chain that ends the evaluation of the
+// chain, together with its lifted form.
+type terminal struct {
+	rule   *nufftables.Rule
+	lifted *dsl.LiftedRule
+}
+
+// sample is an earlier rule of a chain with xt “statistic” matches that
+// ends the evaluation of the chain or jumps to another chain, taking away its
+// share of the packets from the later rules.
+type sample struct {
+	lifted *dsl.LiftedRule // without the statistic matches.
+	rate   float64
+}
+
+// walk walks the rules of the specified chain reached along the specified
+// path, recursively walking the chains jumped (or gone) to. The stack
+// contains the chains along the path in order to break jump cycles.
+func (w *walker) walk(chain *nufftables.Chain, p path, stack map[*nufftables.Chain]bool) {
+	w.visited[chain] = true
+	terminals := []terminal{}
+	samples := []sample{}
+	for idx := range chain.Rules {
+		rule := &chain.Rules[idx]
+		lifted := dsl.Lift(rule.Expressions())
+		shadowedBy := p.shadowedBy
+		conds := append(p.conds[:len(p.conds):len(p.conds)], lifted.Predicates...)
+		xtconds := append(p.xtconds[:len(p.xtconds):len(p.xtconds)], lifted.XtMatches...)
+		if shadowedBy == nil {
+			for _, t := range terminals {
+				if implies(t.lifted, conds, xtconds) {
+					shadowedBy = t.rule
+					break
+				}
+			}
+		}
+		rate, unsampled := statistics(lifted)
+		weight := p.weight * rate
+		for _, s := range samples {
+			if implies(s.lifted, conds, xtconds) {
+				weight *= 1 - s.rate
+			}
+		}
+		w.record(rule, p, weight, shadowedBy, true)
+		targets := ruleTargets(rule)
+		for _, target := range targets {
+			if stack[target] {
+				continue
+			}
+			stack[target] = true
+			w.walk(target, p.extend(rule, lifted, weight, shadowedBy), stack)
+			delete(stack, target)
+		}
+		terminates := isTerminal(rule)
+		if terminates {
+			terminals = append(terminals, terminal{rule: rule, lifted: lifted})
+		}
+		if rate < 1 && (terminates || len(targets) != 0) {
+			samples = append(samples, sample{lifted: unsampled, rate: rate})
+		}
+	}
+}
+
+// statistics returns the share of packets matching the xt “statistic”
+// matches of the specified lifted rule, together with the lifted rule without
+// these statistic matches.
+func statistics(lifted *dsl.LiftedRule) (float64, *dsl.LiftedRule) {
+	rate := 1.0
+	unsampled := *lifted
+	unsampled.XtMatches = nil
+	for _, match := range lifted.XtMatches {
+		if m, ok := dsl.DecodeXtMatch(match).(*dsl.StatisticMatch); ok {
+			rate *= m.Rate()
+			continue
+		}
+		unsampled.XtMatches = append(unsampled.XtMatches, match)
+	}
+	return rate, &unsampled
+}
+
+// record records the port forwarding of the specified rule with the specified
+// weight, if any. If the rule has already been recorded along another path,
+// then an active forwarding replaces a dead one.
+func (w *walker) record(rule *nufftables.Rule, p path, weight float64, shadowedBy *nufftables.Rule, reachable bool) {
+	fp := ForwardedPort(*rule)
+	if fp == nil {
+		return
+	}
+	// The conditions along the path come before the rule's own conditions.
+	var pathConds ForwardedPortRange
+	for _, r := range p.rules {
+		pathConds.addConditions(r)
+	}
+	fp.Ifaces = append(pathConds.Ifaces, fp.Ifaces...)
+	fp.Sources = append(pathConds.Sources, fp.Sources...)
+	fp.AddrTypes = append(pathConds.AddrTypes, fp.AddrTypes...)
+	// The rules closest to the forwarding rule take precedence when
+	// attributing the forwarding to its managing tool.
+	for idx := len(p.rules) - 1; idx >= 0; idx-- {
+		fp.attribute(p.rules[idx])
+	}
+	fwd := &Forward{
+		ForwardedPortRange: *fp,
+		Rule:               rule,
+		Path:               p.rules,
+		Conditions:         p.conds,
+		XtConditions:       p.xtconds,
+		Active:             reachable && shadowedBy == nil,
+		ShadowedBy:         shadowedBy,
+		Weight:             weight,
+	}
+	if existing, ok := w.forwards[rule]; ok {
+		if existing.Active || !fwd.Active {
+			return
+		}
+		*existing = *fwd
+		return
+	}
+	w.forwards[rule] = fwd
+	w.order = append(w.order, fwd)
+}
+
+// ruleTargets returns the chains the specified rule jumps or goes to, either
+// directly or via a verdict map.
+func ruleTargets(rule *nufftables.Rule) []*nufftables.Chain {
+	if v := dsl.RuleVerdict(rule); v.Target != nil {
+		return []*nufftables.Chain{v.Target}
+	}
+	targets := []*nufftables.Chain{}
+	if dt := dsl.RuleDispatchTable(rule); dt != nil {
+		for _, entry := range dt.Entries {
+			if entry.Verdict != nil && entry.Verdict.Target != nil {
+				targets = append(targets, entry.Verdict.Target)
+			}
+		}
+	}
+	return targets
+}
+
+// isTerminal returns true if the specified rule ends the evaluation of its
+// chain when it matches, because of its verdict or because it is a NAT rule.
+func isTerminal(rule *nufftables.Rule) bool {
+	if dsl.RuleVerdict(rule).Terminal() {
+		return true
+	}
+	_, nat := dsl.TargetNAT(rule.Expressions())
+	return nat != nil
+}
+
+// implies returns true if all match conditions of the specified (earlier)
+// rule are also contained in the specified conditions, so that every packet
+// meeting these conditions also matches the earlier rule.
+func implies(earlier *dsl.LiftedRule, conds []dsl.Predicate, xtconds []*expr.Match) bool {
+	for idx := range earlier.Predicates {
+		if !slices.ContainsFunc(conds, func(cond dsl.Predicate) bool {
+			return samePredicate(&earlier.Predicates[idx], &cond)
+		}) {
+			return false
+		}
+	}
+	for _, match := range earlier.XtMatches {
+		if !slices.ContainsFunc(xtconds, func(cond *expr.Match) bool {
+			return cond.Name == match.Name && cond.Rev == match.Rev && reflect.DeepEqual(cond.Info, match.Info)
+		}) {
+			return false
+		}
+	}
+	return true
+}
+
+// samePredicate returns true if both predicates compare the same operand in
+// the same way.
+func samePredicate(a, b *dsl.Predicate) bool {
+	return a.Op == b.Op && a.Set == b.Set &&
+		bytes.Equal(a.Value, b.Value) && bytes.Equal(a.ValueTo, b.ValueTo) &&
+		sameOperand(&a.Operand, &b.Operand)
+}
+
+// sameOperand returns true if both operands load the same data, regardless of
+// the registers involved.
+func sameOperand(a, b *dsl.Operand) bool {
+	if !bytes.Equal(a.Mask, b.Mask) || !bytes.Equal(a.Xor, b.Xor) || !bytes.Equal(a.Data, b.Data) ||
+		len(a.Concat) != len(b.Concat) || a.Map != b.Map {
+		return false
+	}
+	for idx := range a.Concat {
+		if !sameOperand(&a.Concat[idx], &b.Concat[idx]) {
+			return false
+		}
+	}
+	switch fa := a.Field.(type) {
+	case nil:
+		return b.Field == nil
+	case *expr.Payload:
+		fb, ok := b.Field.(*expr.Payload)
+		return ok && fa.Base == fb.Base && fa.Offset == fb.Offset && fa.Len == fb.Len
+	case *expr.Meta:
+		fb, ok := b.Field.(*expr.Meta)
+		return ok && fa.Key == fb.Key
+	case *expr.Ct:
+		fb, ok := b.Field.(*expr.Ct)
+		return ok && fa.Key == fb.Key
+	}
+	return false
+}
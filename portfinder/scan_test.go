@@ -0,0 +1,264 @@
+// Copyright 2023 Harald Albrecht.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy
+// of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package portfinder
+
+import (
+	"encoding/binary"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"github.com/google/nftables/xt"
+	"github.com/thediveo/nufftables"
+	"github.com/thediveo/nufftables/dsl"
+	"golang.org/x/sys/cpu"
+	"golang.org/x/sys/unix"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+// nativeForward returns the expressions of “tcp dport <port> dnat ip to
+// <addr>:<port>”.
+func nativeForward(port uint16, addr []byte) []expr.Any {
+	return []expr.Any{
+		&expr.Meta{Key: expr.MetaKeyNFPROTO, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{unix.NFPROTO_IPV4}},
+		&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{unix.IPPROTO_TCP}},
+		&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseTransportHeader, Offset: 2, Len: 2},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{byte(port >> 8), byte(port)}},
+		&expr.Immediate{Register: 1, Data: addr},
+		&expr.Immediate{Register: 2, Data: []byte{byte(port >> 8), byte(port)}},
+		&expr.NAT{Type: expr.NATTypeDestNAT, Family: unix.NFPROTO_IPV4, RegAddrMin: 1, RegProtoMin: 2},
+	}
+}
+
+// hostUint32 returns the specified value in host byte order, as used by xt
+// match info payloads and number generator map keys.
+func hostUint32(v uint32) []byte {
+	if cpu.IsBigEndian {
+		return binary.BigEndian.AppendUint32(nil, v)
+	}
+	return binary.LittleEndian.AppendUint32(nil, v)
+}
+
+var _ = Describe("scanning tables for port forwardings", func() {
+
+	It("finds forwardings in all DNAT base chains and reachable chains", func() {
+		conn := nufftables.NewMemConn()
+		docker := &nftables.Table{Name: "docker", Family: nftables.TableFamilyINet}
+		prerouting := &nftables.Chain{Name: "prerouting", Table: docker,
+			Type: nftables.ChainTypeNAT, Hooknum: nftables.ChainHookPrerouting}
+		output := &nftables.Chain{Name: "output", Table: docker,
+			Type: nftables.ChainTypeNAT, Hooknum: nftables.ChainHookOutput}
+		forwards := &nftables.Chain{Name: "forwards", Table: docker}
+		vmapped := &nftables.Chain{Name: "vmapped", Table: docker}
+		unreachable := &nftables.Chain{Name: "unreachable", Table: docker}
+		conn.AddChain(prerouting)
+		conn.AddChain(output)
+		conn.AddChain(forwards)
+		conn.AddChain(vmapped)
+		conn.AddChain(unreachable)
+		conn.AddRule(&nftables.Rule{Table: docker, Chain: prerouting, Exprs: []expr.Any{
+			&expr.Verdict{Kind: expr.VerdictJump, Chain: "forwards"},
+		}})
+		// both base chains jump to the same chain, which must be scanned only
+		// once.
+		conn.AddRule(&nftables.Rule{Table: docker, Chain: output, Exprs: []expr.Any{
+			&expr.Verdict{Kind: expr.VerdictGoto, Chain: "forwards"},
+		}})
+		conn.AddRule(&nftables.Rule{Table: docker, Chain: forwards, Exprs: nativeForward(80, []byte{172, 17, 0, 2})})
+		Expect(conn.AddSet(&nftables.Set{Table: docker, Name: "ports", IsMap: true,
+			KeyType: nftables.TypeInetService, DataType: nftables.TypeVerdict}, []nftables.SetElement{
+			{Key: []byte{0, 81}, VerdictData: &expr.Verdict{Kind: expr.VerdictJump, Chain: "vmapped"}},
+		})).To(Succeed())
+		conn.AddRule(&nftables.Rule{Table: docker, Chain: forwards, Exprs: []expr.Any{
+			&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseTransportHeader, Offset: 2, Len: 2},
+			&expr.Lookup{SourceRegister: 1, DestRegister: unix.NFT_REG_VERDICT, IsDestRegSet: true, SetName: "ports"},
+		}})
+		conn.AddRule(&nftables.Rule{Table: docker, Chain: vmapped, Exprs: nativeForward(81, []byte{172, 17, 0, 3})})
+		conn.AddRule(&nftables.Rule{Table: docker, Chain: unreachable, Exprs: nativeForward(82, []byte{172, 17, 0, 4})})
+
+		// a filter base chain must be ignored.
+		filter := &nftables.Table{Name: "filter", Family: nftables.TableFamilyINet}
+		input := &nftables.Chain{Name: "input", Table: filter,
+			Type: nftables.ChainTypeFilter, Hooknum: nftables.ChainHookPrerouting}
+		conn.AddRule(&nftables.Rule{Table: filter, Chain: input, Exprs: nativeForward(83, []byte{172, 17, 0, 5})})
+
+		tables, err := nufftables.GetAllTables(conn)
+		Expect(err).NotTo(HaveOccurred())
+
+		chains := NATBaseChains(tables)
+		Expect(chains).To(HaveLen(2))
+		Expect(chains[0].Name).To(Equal("output"))
+		Expect(chains[1].Name).To(Equal("prerouting"))
+
+		fps := ForwardedPorts(tables)
+		Expect(fps).To(HaveLen(2))
+		Expect(fps[0].String()).To(Equal("forwarding tcp from 0.0.0.0:80 to 172.17.0.2:80 managed by docker (inet docker forwards handle 3)"))
+		Expect(fps[1].String()).To(HavePrefix("forwarding tcp from 0.0.0.0:81 to 172.17.0.3:81 managed by docker (inet docker vmapped handle "))
+
+		Expect(ForwardedPorts(nufftables.TableMap{})).To(BeEmpty())
+	})
+
+	It("accumulates conditions and tells active from dead forwardings", func() {
+		conn := nufftables.NewMemConn()
+		nat := &nftables.Table{Name: "nat", Family: nftables.TableFamilyIPv4}
+		prerouting := &nftables.Chain{Name: "PREROUTING", Table: nat,
+			Type: nftables.ChainTypeNAT, Hooknum: nftables.ChainHookPrerouting}
+		dockerChain := &nftables.Chain{Name: "DOCKER", Table: nat}
+		orphan := &nftables.Chain{Name: "ORPHAN", Table: nat}
+		conn.AddChain(prerouting)
+		conn.AddChain(dockerChain)
+		conn.AddChain(orphan)
+
+		addrtype := &expr.Match{Name: "addrtype", Rev: 1, Info: &xt.AddrTypeV1{
+			Dest: uint16(xt.AddrTypeLocal)}}
+		conn.AddRule(&nftables.Rule{Table: nat, Chain: prerouting, Exprs: []expr.Any{
+			addrtype,
+			&expr.Counter{},
+			&expr.Verdict{Kind: expr.VerdictJump, Chain: "DOCKER"},
+		}})
+		iifname := func(op expr.CmpOp) []expr.Any {
+			return []expr.Any{
+				&expr.Meta{Key: expr.MetaKeyIIFNAME, Register: 1},
+				&expr.Cmp{Op: op, Register: 1, Data: []byte("docker0\x00")},
+			}
+		}
+		conn.AddRule(&nftables.Rule{Table: nat, Chain: dockerChain, Position: 1,
+			Exprs: append(iifname(expr.CmpOpEq), &expr.Verdict{Kind: expr.VerdictReturn})})
+		conn.AddRule(&nftables.Rule{Table: nat, Chain: dockerChain, Position: 2,
+			Exprs: append(iifname(expr.CmpOpNeq), nativeForward(80, []byte{172, 17, 0, 2})...)})
+		// shadowed by the previous forwarding with less conditions.
+		conn.AddRule(&nftables.Rule{Table: nat, Chain: dockerChain, Position: 3,
+			Exprs: append(append(iifname(expr.CmpOpNeq), iifname(expr.CmpOpNeq)...),
+				nativeForward(80, []byte{172, 17, 0, 3})...)})
+		conn.AddRule(&nftables.Rule{Table: nat, Chain: dockerChain, Position: 4,
+			Exprs: []expr.Any{&expr.Verdict{Kind: expr.VerdictReturn}}})
+		conn.AddRule(&nftables.Rule{Table: nat, Chain: dockerChain, Position: 5,
+			Exprs: nativeForward(81, []byte{172, 17, 0, 4})})
+		conn.AddRule(&nftables.Rule{Table: nat, Chain: orphan,
+			Exprs: nativeForward(82, []byte{172, 17, 0, 5})})
+
+		tables, err := nufftables.GetAllTables(conn)
+		Expect(err).NotTo(HaveOccurred())
+		fwds := AnalyzeForwards(tables)
+		Expect(fwds).To(HaveLen(4))
+
+		Expect(fwds[0].Active).To(BeTrue())
+		Expect(fwds[0].ForwardIP.String()).To(Equal("172.17.0.2"))
+		Expect(fwds[0].Path).To(HaveLen(1))
+		Expect(fwds[0].Path[0].Chain.Name).To(Equal("PREROUTING"))
+		Expect(fwds[0].XtConditions).To(ConsistOf(addrtype))
+		Expect(fwds[0].Conditions).To(BeEmpty())
+		Expect(fwds[0].String()).To(Equal(`forwarding tcp from 0.0.0.0:80 to 172.17.0.2:80 ` +
+			`if iifname != "docker0", addrtype --dst-type LOCAL managed by docker (ip nat DOCKER handle 3)`))
+		Expect(fwds[0].Ifaces).To(HaveLen(1))
+		Expect(fwds[0].AddrTypes).To(ConsistOf(dsl.AddrTypeMatch{Dest: dsl.AddrTypeLocal}))
+		Expect(fwds[0].Family).To(Equal(nufftables.TableFamilyIPv4))
+		Expect(fwds[0].Table).To(Equal("nat"))
+		Expect(fwds[0].Chain).To(Equal("DOCKER"))
+		Expect(fwds[0].Handle).To(Equal(fwds[0].Rule.Handle))
+
+		Expect(fwds[1].Active).To(BeFalse())
+		Expect(fwds[1].ShadowedBy).To(BeIdenticalTo(fwds[0].Rule))
+
+		Expect(fwds[2].Active).To(BeFalse())
+		Expect(fwds[2].String()).To(MatchRegexp(
+			`^forwarding tcp from 0\.0\.0\.0:81 to 172\.17\.0\.4:81 if addrtype --dst-type LOCAL ` +
+				`managed by docker \(ip nat DOCKER handle \d+\) \(dead: shadowed by rule handle \d+ in chain "DOCKER"\)$`))
+
+		Expect(fwds[3].Active).To(BeFalse())
+		Expect(fwds[3].ShadowedBy).To(BeNil())
+		Expect(fwds[3].String()).To(HaveSuffix("(dead: unreachable)"))
+
+		Expect(ForwardedPorts(tables)).To(HaveLen(1))
+	})
+
+	It("balances forwardings spread by statistic matches", func() {
+		conn := nufftables.NewMemConn()
+		nat := &nftables.Table{Name: "nat", Family: nftables.TableFamilyIPv4}
+		prerouting := &nftables.Chain{Name: "PREROUTING", Table: nat,
+			Type: nftables.ChainTypeNAT, Hooknum: nftables.ChainHookPrerouting}
+		svc := &nftables.Chain{Name: "KUBE-SVC-WEB", Table: nat}
+		conn.AddChain(prerouting)
+		conn.AddChain(svc)
+		conn.AddRule(&nftables.Rule{Table: nat, Chain: prerouting, Exprs: []expr.Any{
+			&expr.Verdict{Kind: expr.VerdictJump, Chain: "KUBE-SVC-WEB"},
+		}})
+		// -m statistic --mode random --probability 0.5
+		statistic := func() *expr.Match {
+			info := make(xt.Unknown, 24)
+			copy(info[4:], hostUint32(0x40000000))
+			return &expr.Match{Name: "statistic", Info: &info}
+		}
+		for idx, ep := range []string{"KUBE-SEP-1", "KUBE-SEP-2", "KUBE-SEP-3"} {
+			sep := &nftables.Chain{Name: ep, Table: nat}
+			conn.AddChain(sep)
+			conn.AddRule(&nftables.Rule{Table: nat, Chain: sep,
+				Exprs: nativeForward(80, []byte{10, 0, 0, byte(idx + 1)})})
+			exprs := []expr.Any{&expr.Verdict{Kind: expr.VerdictJump, Chain: ep}}
+			if idx < 2 {
+				exprs = append([]expr.Any{statistic()}, exprs...)
+			}
+			conn.AddRule(&nftables.Rule{Table: nat, Chain: svc, Exprs: exprs})
+		}
+
+		tables, err := nufftables.GetAllTables(conn)
+		Expect(err).NotTo(HaveOccurred())
+		fwds := AnalyzeForwards(tables)
+		Expect(fwds).To(HaveLen(3))
+		Expect([]float64{fwds[0].Weight, fwds[1].Weight, fwds[2].Weight}).To(
+			HaveExactElements(0.5, 0.25, 0.25))
+		Expect(fwds[1].Endpoints).To(Equal(fwds[0].Endpoints))
+
+		fps := ForwardedPorts(tables)
+		Expect(fps).To(HaveLen(1))
+		Expect(fps[0].String()).To(MatchRegexp(
+			`^forwarding tcp from 0\.0\.0\.0:80 to 10\.0\.0\.1:80 \(50%\), 10\.0\.0\.2:80 \(25%\), ` +
+				`10\.0\.0\.3:80 \(25%\) \(ip nat KUBE-SEP-1 handle \d+\)$`))
+	})
+
+	It("returns each load-balancing group only once", func() {
+		conn := nufftables.NewMemConn()
+		nat := &nftables.Table{Name: "nat", Family: nftables.TableFamilyIPv4}
+		prerouting := &nftables.Chain{Name: "PREROUTING", Table: nat,
+			Type: nftables.ChainTypeNAT, Hooknum: nftables.ChainHookPrerouting}
+		conn.AddChain(prerouting)
+		// -m statistic --mode random --probability 0.5
+		info := make(xt.Unknown, 24)
+		copy(info[4:], hostUint32(0x40000000))
+		for _, port := range []uint16{80, 443} {
+			for idx := 0; idx < 2; idx++ {
+				exprs := nativeForward(port, []byte{10, 0, byte(port >> 8), byte(idx + 1)})
+				if idx == 0 {
+					exprs = append([]expr.Any{&expr.Match{Name: "statistic", Info: &info}}, exprs...)
+				}
+				conn.AddRule(&nftables.Rule{Table: nat, Chain: prerouting, Exprs: exprs})
+			}
+		}
+
+		tables, err := nufftables.GetAllTables(conn)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(AnalyzeForwards(tables)).To(HaveLen(4))
+		fps := ForwardedPorts(tables)
+		Expect(fps).To(HaveLen(2))
+		Expect(fps[0].String()).To(HavePrefix(
+			"forwarding tcp from 0.0.0.0:80 to 10.0.0.1:80 (50%), 10.0.0.2:80 (50%) "))
+		Expect(fps[1].String()).To(HavePrefix(
+			"forwarding tcp from 0.0.0.0:443 to 10.0.1.1:443 (50%), 10.0.1.2:443 (50%) "))
+	})
+
+})
@@ -0,0 +1,225 @@
+// Copyright 2023 Harald Albrecht.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy
+// of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package portfinder
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/google/nftables"
+	"github.com/thediveo/nufftables"
+	"github.com/thediveo/nufftables/dsl"
+	"golang.org/x/sys/unix"
+)
+
+// TrafficMatch describes the traffic matched by a redirection, an egress NAT,
+// or an exclusion in terms of interfaces, addresses, destination ports, and
+// the owners of local sockets.
+type TrafficMatch struct {
+	// Ifaces are the input and output interface conditions, such as “oifname
+	// "lo"”.
+	Ifaces []dsl.IfaceMatch
+	// Sources and Destinations are the source and destination address
+	// conditions, such as “ip daddr != 127.0.0.1”.
+	Sources      []dsl.AddrMatch
+	Destinations []dsl.AddrMatch
+	// Ports are the destination port conditions, such as “tcp dport != 15008”.
+	Ports []dsl.PortMatch
+	// Owners are the socket owner conditions of locally generated traffic,
+	// such as “-m owner --uid-owner 1337” or “meta skuid 1337”.
+	Owners []dsl.OwnerMatch
+}
+
+// String returns the conditions in textual format, separated by commas.
+func (m TrafficMatch) String() string {
+	return strings.Join(m.conditions(), ", ")
+}
+
+// conditions returns the conditions in textual format.
+func (m TrafficMatch) conditions() []string {
+	conds := []string{}
+	for idx := range m.Ifaces {
+		conds = append(conds, m.Ifaces[idx].String())
+	}
+	for idx := range m.Sources {
+		conds = append(conds, m.Sources[idx].String())
+	}
+	for idx := range m.Destinations {
+		conds = append(conds, m.Destinations[idx].String())
+	}
+	for idx := range m.Ports {
+		conds = append(conds, m.Ports[idx].String())
+	}
+	for idx := range m.Owners {
+		conds = append(conds, m.Owners[idx].String())
+	}
+	return conds
+}
+
+// prepend prepends the conditions of the specified path of jumping rules.
+func (m *TrafficMatch) prepend(path []*nufftables.Rule) {
+	var pathConds TrafficMatch
+	for _, jump := range path {
+		pathConds.add(jump)
+	}
+	m.Ifaces = append(pathConds.Ifaces, m.Ifaces...)
+	m.Sources = append(pathConds.Sources, m.Sources...)
+	m.Destinations = append(pathConds.Destinations, m.Destinations...)
+	m.Ports = append(pathConds.Ports, m.Ports...)
+	m.Owners = append(pathConds.Owners, m.Owners...)
+}
+
+// add adds the conditions of the specified rule.
+func (m *TrafficMatch) add(rule *nufftables.Rule) {
+	exprs := rule.Expressions()
+	m.Ifaces = append(m.Ifaces, dsl.IfaceMatches(exprs)...)
+	for _, match := range dsl.RuleAddrMatches(rule) {
+		if match.Direction == dsl.SourceAddr {
+			m.Sources = append(m.Sources, match)
+		} else {
+			m.Destinations = append(m.Destinations, match)
+		}
+	}
+	for _, match := range dsl.RulePortMatches(rule) {
+		if match.Direction == dsl.DestinationPort {
+			m.Ports = append(m.Ports, match)
+		}
+	}
+	m.Owners = append(m.Owners, dsl.OwnerMatches(exprs)...)
+}
+
+// Exclusion is traffic exempted from a redirection or egress NAT by an earlier
+// rule along the way to the translating rule, such as Istio's “-m owner
+// --uid-owner 1337 -j RETURN” exempting the traffic of the sidecar proxy
+// itself.
+type Exclusion struct {
+	TrafficMatch
+	// Rule is the rule ending the evaluation of its chain, such as by
+	// returning or accepting.
+	Rule *nufftables.Rule
+}
+
+// String returns the conditions of the exclusion in textual format, or the
+// chain and handle of its rule if its conditions are unknown, such as in case
+// of mark matches.
+func (e Exclusion) String() string {
+	if conds := e.conditions(); len(conds) != 0 {
+		return strings.Join(conds, ", ")
+	}
+	return fmt.Sprintf("rule %s handle %d", chainName(e.Rule), e.Rule.Handle)
+}
+
+// transportProtocols maps the transport protocol numbers to their names.
+var transportProtocols = map[uint8]string{
+	unix.IPPROTO_TCP:  "tcp",
+	unix.IPPROTO_UDP:  "udp",
+	unix.IPPROTO_SCTP: "sctp",
+}
+
+// ruleProtocol returns the name of the transport protocol matched by the
+// specified rule, or otherwise by the closest rule of the specified path
+// matching a transport protocol, such as in “-p tcp -j ISTIO_REDIRECT”. If no
+// transport protocol is matched, then the empty string is returned.
+func ruleProtocol(rule *nufftables.Rule, path []*nufftables.Rule) string {
+	if proto := transportProtocols[dsl.Lift(rule.Expressions()).L4Proto(chainFamily(rule))]; proto != "" {
+		return proto
+	}
+	for idx := len(path) - 1; idx >= 0; idx-- {
+		if proto := transportProtocols[dsl.Lift(path[idx].Expressions()).L4Proto(chainFamily(path[idx]))]; proto != "" {
+			return proto
+		}
+	}
+	return ""
+}
+
+// pathWalker walks the chains reachable from base chains, visiting each rule
+// only once together with the path of jumping rules leading to it and the
+// exclusions of earlier rules ending the evaluation of their chains.
+type pathWalker struct {
+	seen  map[*nufftables.Rule]bool
+	visit func(rule *nufftables.Rule, path []*nufftables.Rule, exclusions []Exclusion)
+}
+
+// walkFrom walks the chains reachable from the base chains of the specified
+// tables for which isBase returns true, in the order of [sortedChains].
+func walkFrom(tables nufftables.TableMap, isBase func(*nufftables.Chain) bool,
+	visit func(rule *nufftables.Rule, path []*nufftables.Rule, exclusions []Exclusion),
+) {
+	w := pathWalker{seen: map[*nufftables.Rule]bool{}, visit: visit}
+	for _, chain := range sortedChains(tables) {
+		if isBase(chain) {
+			w.walk(chain, nil, nil, map[*nufftables.Chain]bool{chain: true})
+		}
+	}
+}
+
+// walk walks the rules of the specified chain reached along the specified
+// path of jumping rules with the exclusions accumulated so far, recursively
+// walking the chains jumped (or gone) to. The stack contains the chains along
+// the path in order to break jump cycles. Rules shadowed by an earlier
+// unconditional rule ending the evaluation of the chain aren't visited.
+func (w *pathWalker) walk(chain *nufftables.Chain, path []*nufftables.Rule, exclusions []Exclusion, stack map[*nufftables.Chain]bool) {
+	for idx := range chain.Rules {
+		rule := &chain.Rules[idx]
+		if !w.seen[rule] {
+			w.seen[rule] = true
+			w.visit(rule, path, exclusions)
+		}
+		for _, target := range ruleTargets(rule) {
+			if stack[target] {
+				continue
+			}
+			stack[target] = true
+			w.walk(target,
+				append(path[:len(path):len(path)], rule),
+				exclusions[:len(exclusions):len(exclusions)],
+				stack)
+			delete(stack, target)
+		}
+		if !isTerminal(rule) {
+			continue
+		}
+		if !conditional(rule) {
+			return
+		}
+		excl := Exclusion{Rule: rule}
+		excl.add(rule)
+		exclusions = append(exclusions[:len(exclusions):len(exclusions)], excl)
+	}
+}
+
+// chainFamily returns the family of the table of the specified rule, if
+// known.
+func chainFamily(rule *nufftables.Rule) nftables.TableFamily {
+	if rule.Chain == nil || rule.Chain.Table == nil || rule.Chain.Table.Table == nil {
+		return nftables.TableFamilyUnspecified
+	}
+	return rule.Chain.Table.Family
+}
+
+// conditional returns true if the specified rule has match conditions other
+// than comments.
+func conditional(rule *nufftables.Rule) bool {
+	lifted := dsl.Lift(rule.Expressions())
+	if len(lifted.Predicates) != 0 {
+		return true
+	}
+	for _, match := range lifted.XtMatches {
+		if _, ok := dsl.DecodeXtMatch(match).(string); !ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,187 @@
+// Copyright 2023 Harald Albrecht.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy
+// of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package nufftables
+
+import (
+	"bytes"
+	"encoding/binary"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"github.com/mdlayher/netlink"
+	"golang.org/x/exp/slices"
+	"golang.org/x/sys/unix"
+)
+
+// Set wraps a [nftables.Set] (which might also be a map) together with its
+// elements. Sets reference the [Table] they are contained in.
+type Set struct {
+	*nftables.Set
+	Elements []nftables.SetElement
+	Table    *Table
+}
+
+// SetRange is an inclusive range of set element keys [From..To], in the
+// (network) byte order of the set keys.
+type SetRange struct {
+	From, To []byte
+}
+
+// SetEntry is a set element key range together with the element's data in
+// case of maps.
+type SetEntry struct {
+	SetRange
+	// Val is the element data of a map, and Verdict the element data of a
+	// verdict map.
+	Val     []byte
+	Verdict *expr.Verdict
+}
+
+// Ranges returns the keys of this set as inclusive key ranges, sorted by key.
+// For interval sets, Ranges decodes the interval start and end elements into
+// inclusive ranges; otherwise, each element key is returned as a single-key
+// range, unless the element also has an end key.
+func (s *Set) Ranges() []SetRange {
+	ranges := []SetRange{}
+	for _, entry := range s.Entries() {
+		ranges = append(ranges, entry.SetRange)
+	}
+	return ranges
+}
+
+// Entries returns the elements of this set or map as inclusive key ranges
+// together with their element data, sorted by key. See also [Set.Ranges].
+func (s *Set) Entries() []SetEntry {
+	entries := []SetEntry{}
+	if !s.Interval {
+		for _, el := range s.Elements {
+			to := el.Key
+			if el.KeyEnd != nil {
+				to = el.KeyEnd
+			}
+			entries = append(entries, SetEntry{
+				SetRange: SetRange{From: el.Key, To: to},
+				Val:      el.Val,
+				Verdict:  el.VerdictData,
+			})
+		}
+		slices.SortFunc(entries, func(a, b SetEntry) int { return bytes.Compare(a.From, b.From) })
+		return entries
+	}
+	// Interval sets consist of interval start elements, each followed by an
+	// interval end element with the first key *after* the interval. The
+	// kernel lists the elements of interval sets in reverse order, so we
+	// first need to sort them. Interval end elements with the same key as
+	// interval start elements then have to come first, as they end the
+	// preceding interval.
+	elements := append([]nftables.SetElement{}, s.Elements...)
+	slices.SortStableFunc(elements, func(a, b nftables.SetElement) int {
+		if c := bytes.Compare(a.Key, b.Key); c != 0 {
+			return c
+		}
+		switch {
+		case a.IntervalEnd == b.IntervalEnd:
+			return 0
+		case a.IntervalEnd:
+			return -1
+		}
+		return 1
+	})
+	var start *nftables.SetElement
+	entry := func(el *nftables.SetElement, to []byte) SetEntry {
+		return SetEntry{
+			SetRange: SetRange{From: el.Key, To: to},
+			Val:      el.Val,
+			Verdict:  el.VerdictData,
+		}
+	}
+	for idx := range elements {
+		el := &elements[idx]
+		if el.IntervalEnd {
+			if start != nil {
+				entries = append(entries, entry(start, decrement(el.Key)))
+				start = nil
+			}
+			continue
+		}
+		if start != nil {
+			entries = append(entries, entry(start, decrement(el.Key)))
+		}
+		start = el
+		if el.KeyEnd != nil {
+			entries = append(entries, entry(start, el.KeyEnd))
+			start = nil
+		}
+	}
+	if start != nil {
+		// an open interval reaches up to the largest possible key.
+		entries = append(entries, entry(start, bytes.Repeat([]byte{0xff}, len(start.Key))))
+	}
+	return entries
+}
+
+// decrement returns the key decremented by one, interpreting the key as an
+// unsigned big-endian integer.
+func decrement(key []byte) []byte {
+	dec := append([]byte{}, key...)
+	for idx := len(dec) - 1; idx >= 0; idx-- {
+		dec[idx]--
+		if dec[idx] != 0xff {
+			break
+		}
+	}
+	return dec
+}
+
+// isVerdictMap returns true if the specified set is a verdict map. As the
+// nftables package mistakenly sets the key type instead of the data type of
+// verdict maps read from the kernel, both types need to be checked.
+func isVerdictMap(set *nftables.Set) bool {
+	return set.IsMap &&
+		(set.DataType.GetNFTMagic() == nftables.TypeVerdict.GetNFTMagic() ||
+			set.KeyType.GetNFTMagic() == nftables.TypeVerdict.GetNFTMagic())
+}
+
+// decodeVerdicts decodes the verdicts of the specified verdict map elements
+// read from the kernel, where the nftables package leaves the verdicts in
+// their netlink attribute encoding in Val instead of decoding them into
+// VerdictData.
+func decodeVerdicts(elements []nftables.SetElement) {
+	for idx := range elements {
+		el := &elements[idx]
+		if el.VerdictData != nil || len(el.Val) == 0 {
+			continue
+		}
+		ad, err := netlink.NewAttributeDecoder(el.Val)
+		if err != nil {
+			continue
+		}
+		ad.ByteOrder = binary.BigEndian
+		verdict := &expr.Verdict{}
+		for ad.Next() {
+			switch ad.Type() {
+			case unix.NFTA_VERDICT_CODE:
+				verdict.Kind = expr.VerdictKind(int32(ad.Uint32()))
+			case unix.NFTA_VERDICT_CHAIN:
+				verdict.Chain = ad.String()
+			}
+		}
+		if ad.Err() != nil {
+			continue
+		}
+		el.VerdictData = verdict
+		el.Val = nil
+	}
+}
@@ -0,0 +1,134 @@
+// Copyright 2023 Harald Albrecht.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy
+// of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package nufftables
+
+import (
+	"encoding/binary"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"github.com/mdlayher/netlink"
+	"golang.org/x/sys/unix"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("sets", func() {
+
+	It("returns the keys of plain sets as ranges", func() {
+		set := &Set{
+			Set: &nftables.Set{},
+			Elements: []nftables.SetElement{
+				{Key: []byte{1, 187}},
+				{Key: []byte{0, 80}},
+				{Key: []byte{0, 1}, KeyEnd: []byte{0, 10}},
+			},
+		}
+		Expect(set.Ranges()).To(Equal([]SetRange{
+			{From: []byte{0, 1}, To: []byte{0, 10}},
+			{From: []byte{0, 80}, To: []byte{0, 80}},
+			{From: []byte{1, 187}, To: []byte{1, 187}},
+		}))
+	})
+
+	It("decodes interval sets listed in any order", func() {
+		set := &Set{
+			Set: &nftables.Set{Interval: true},
+			Elements: []nftables.SetElement{
+				{Key: []byte{0xff, 0x00}},
+				{Key: []byte{0x01, 0x00}, IntervalEnd: true},
+				{Key: []byte{0x00, 0x50}},
+				{Key: []byte{0x00, 0x00}, IntervalEnd: true},
+				{Key: []byte{0x00, 0xff}},
+				{Key: []byte{0x00, 0x51}, IntervalEnd: true},
+			},
+		}
+		Expect(set.Ranges()).To(Equal([]SetRange{
+			{From: []byte{0x00, 0x50}, To: []byte{0x00, 0x50}},
+			{From: []byte{0x00, 0xff}, To: []byte{0x00, 0xff}},
+			{From: []byte{0xff, 0x00}, To: []byte{0xff, 0xff}},
+		}))
+	})
+
+	It("decodes adjacent intervals", func() {
+		set := &Set{
+			Set: &nftables.Set{Interval: true},
+			Elements: []nftables.SetElement{
+				{Key: []byte{6}, IntervalEnd: true},
+				{Key: []byte{1}},
+				{Key: []byte{6}},
+				{Key: []byte{10}, IntervalEnd: true},
+			},
+		}
+		Expect(set.Ranges()).To(Equal([]SetRange{
+			{From: []byte{1}, To: []byte{5}},
+			{From: []byte{6}, To: []byte{9}},
+		}))
+	})
+
+	It("returns the element data of interval maps", func() {
+		accept := &expr.Verdict{Kind: expr.VerdictAccept}
+		set := &Set{
+			Set: &nftables.Set{Interval: true, IsMap: true},
+			Elements: []nftables.SetElement{
+				{Key: []byte{6}, IntervalEnd: true},
+				{Key: []byte{1}, VerdictData: accept},
+				{Key: []byte{10}, Val: []byte{42}},
+			},
+		}
+		Expect(set.Entries()).To(Equal([]SetEntry{
+			{SetRange: SetRange{From: []byte{1}, To: []byte{5}}, Verdict: accept},
+			{SetRange: SetRange{From: []byte{10}, To: []byte{0xff}}, Val: []byte{42}},
+		}))
+	})
+
+	It("decodes the verdicts of verdict map elements read from the kernel", func() {
+		ae := netlink.NewAttributeEncoder()
+		ae.ByteOrder = binary.BigEndian
+		ae.Int32(unix.NFTA_VERDICT_CODE, unix.NFT_JUMP)
+		ae.String(unix.NFTA_VERDICT_CHAIN, "web")
+		jump, err := ae.Encode()
+		Expect(err).NotTo(HaveOccurred())
+		ae = netlink.NewAttributeEncoder()
+		ae.ByteOrder = binary.BigEndian
+		ae.Uint32(unix.NFTA_VERDICT_CODE, uint32(expr.VerdictDrop))
+		drop, err := ae.Encode()
+		Expect(err).NotTo(HaveOccurred())
+
+		accept := &expr.Verdict{Kind: expr.VerdictAccept}
+		elements := []nftables.SetElement{
+			{Key: []byte{0, 80}, Val: jump},
+			{Key: []byte{0, 81}, Val: drop},
+			{Key: []byte{0, 82}, VerdictData: accept},
+		}
+		// the nftables package mistakenly reports verdict maps with a verdict
+		// key type.
+		Expect(isVerdictMap(&nftables.Set{IsMap: true, KeyType: nftables.TypeVerdict})).To(BeTrue())
+		Expect(isVerdictMap(&nftables.Set{IsMap: true, DataType: nftables.TypeVerdict})).To(BeTrue())
+		Expect(isVerdictMap(&nftables.Set{IsMap: true, DataType: nftables.TypeIPAddr})).To(BeFalse())
+		Expect(isVerdictMap(&nftables.Set{KeyType: nftables.TypeVerdict})).To(BeFalse())
+
+		decodeVerdicts(elements)
+		Expect(elements).To(HaveExactElements(
+			nftables.SetElement{Key: []byte{0, 80},
+				VerdictData: &expr.Verdict{Kind: expr.VerdictJump, Chain: "web"}},
+			nftables.SetElement{Key: []byte{0, 81},
+				VerdictData: &expr.Verdict{Kind: expr.VerdictDrop}},
+			nftables.SetElement{Key: []byte{0, 82}, VerdictData: accept},
+		))
+	})
+
+})
@@ -19,10 +19,12 @@ import (
 	"golang.org/x/exp/slices"
 )
 
-// Table is a [nftables.Table] together with all its named [Chain] objects.
+// Table is a [nftables.Table] together with all its named [Chain] and [Set]
+// objects.
 type Table struct {
 	*nftables.Table
 	ChainsByName map[string]*Chain
+	SetsByName   map[string]*Set // named as well as anonymous sets.
 }
 
 // TableMap indexes table names (that are always "namespaced" in a particular
@@ -59,8 +61,9 @@ func (t TableMap) TableChain(tablename string, family TableFamily, chainname str
 // GetAllTables returns the available netfilter tables as a [TableMap] using the
 // specified conn for retrieval. The [Table] objects in the returned TableMap
 // are populated with their named [Chain] objects, and these in turn contain
-// their [Rule] objects including expressions.
-func GetAllTables(conn *nftables.Conn) (TableMap, error) {
+// their [Rule] objects including expressions. The conn is typically a
+// [*nftables.Conn], but can also be an in-memory [MemConn].
+func GetAllTables(conn Conn) (TableMap, error) {
 	tables, err := conn.ListTables()
 	if err != nil {
 		return nil, err
@@ -69,10 +72,13 @@ func GetAllTables(conn *nftables.Conn) (TableMap, error) {
 	// their names together with their respective netfilter family.
 	tm := TableMap{}
 	for _, table := range tables {
-		tm[TableKey{Name: table.Name, Family: TableFamily(table.Family)}] = &Table{
+		t := &Table{
 			Table:        table,
 			ChainsByName: map[string]*Chain{},
+			SetsByName:   map[string]*Set{},
 		}
+		tm[TableKey{Name: table.Name, Family: TableFamily(table.Family)}] = t
+		_ = t.addSets(conn) // ignore sets that have gone missing.
 	}
 	// Please note that nftables only supports listing *all* chains; the
 	// particular table object a certain chain belongs to is only partially
@@ -89,7 +95,7 @@ func GetAllTables(conn *nftables.Conn) (TableMap, error) {
 
 // GetFamilyTables returns the netfiler tables for the specified netfilter
 // family only, together with all their chains and rules.
-func GetFamilyTables(conn *nftables.Conn, family TableFamily) (TableMap, error) {
+func GetFamilyTables(conn Conn, family TableFamily) (TableMap, error) {
 	chains, err := conn.ListChainsOfTableFamily(nftables.TableFamily(family))
 	if err != nil {
 		return nil, err
@@ -98,19 +104,47 @@ func GetFamilyTables(conn *nftables.Conn, family TableFamily) (TableMap, error)
 	for _, chain := range chains {
 		_ = tm.addChain(conn, chain) // ignore chains that have gone missing.
 	}
+	for _, table := range tm {
+		_ = table.addSets(conn) // ignore sets that have gone missing.
+	}
 	return tm, nil
 }
 
+// addSets fetches all sets belonging to this table, together with their
+// elements.
+func (t *Table) addSets(conn Conn) error {
+	sets, err := conn.GetSets(t.Table)
+	if err != nil {
+		return err
+	}
+	for _, set := range sets {
+		elements, err := conn.GetSetElements(set)
+		if err != nil {
+			continue // things might have changed since the discovery...
+		}
+		if isVerdictMap(set) {
+			decodeVerdicts(elements)
+		}
+		t.SetsByName[set.Name] = &Set{
+			Set:      set,
+			Elements: elements,
+			Table:    t,
+		}
+	}
+	return nil
+}
+
 // addChain adds the given [nftables.Chain] to this TableMap and then fetches
 // all rules belonging to this chain. The [Rule] objects are sorted by their
 // position.
-func (t TableMap) addChain(conn *nftables.Conn, chain *nftables.Chain) error {
+func (t TableMap) addChain(conn Conn, chain *nftables.Chain) error {
 	key := TableKey{Name: chain.Table.Name, Family: TableFamily(chain.Table.Family)}
 	table, ok := t[key]
 	if !ok {
 		table = &Table{
 			Table:        chain.Table,
 			ChainsByName: map[string]*Chain{},
+			SetsByName:   map[string]*Set{},
 		}
 		t[key] = table
 	}
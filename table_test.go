@@ -15,52 +15,114 @@
 package nufftables
 
 import (
-	"os"
-
 	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"github.com/thediveo/nufftables/nufftablestest"
 	"golang.org/x/exp/maps"
 
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
 )
 
+var ruleset = nufftablestest.Ruleset{
+	{
+		Name:   "filter",
+		Family: nftables.TableFamilyIPv4,
+		Sets: []nufftablestest.Set{
+			{
+				Name:     "ports",
+				KeyType:  nftables.TypeInetService,
+				Interval: true,
+				Elements: []nftables.SetElement{
+					{Key: []byte{0, 80}},
+					{Key: []byte{0, 81}, IntervalEnd: true},
+					{Key: []byte{0x1f, 0x40}},
+					{Key: []byte{0x1f, 0xa5}, IntervalEnd: true},
+				},
+			},
+		},
+		Chains: []nufftablestest.Chain{
+			{
+				Name:     "FORWARD",
+				Type:     nftables.ChainTypeFilter,
+				Hook:     nftables.ChainHookForward,
+				Priority: nftables.ChainPriorityFilter,
+			},
+		},
+	},
+	{
+		Name:   "nat",
+		Family: nftables.TableFamilyIPv4,
+		Chains: []nufftablestest.Chain{
+			{
+				Name:     "POSTROUTING",
+				Type:     nftables.ChainTypeNAT,
+				Hook:     nftables.ChainHookPostrouting,
+				Priority: nftables.ChainPriorityNATSource,
+				Rules: []nufftablestest.Rule{
+					{&expr.Counter{}},
+					{&expr.Verdict{Kind: expr.VerdictAccept}},
+				},
+			},
+		},
+	},
+	{
+		Name:   "filter",
+		Family: nftables.TableFamilyIPv6,
+		Chains: []nufftablestest.Chain{
+			{
+				Name:     "FORWARD",
+				Type:     nftables.ChainTypeFilter,
+				Hook:     nftables.ChainHookForward,
+				Priority: nftables.ChainPriorityFilter,
+			},
+		},
+	},
+}
+
 var _ = Describe("'nuff tables", func() {
 
 	var conn *nftables.Conn
 
 	BeforeEach(func() {
-		if os.Getuid() != 0 {
-			Skip("needs root")
-		}
-		var err error
-		conn, err = nftables.New(nftables.AsLasting())
-		Expect(err).NotTo(HaveOccurred())
-		DeferCleanup(func() {
-			conn.CloseLasting()
-		})
+		conn = nufftablestest.NewConn(ruleset)
 	})
 
 	It("gets all tables", func() {
 		tables, err := GetAllTables(conn)
 		Expect(err).NotTo(HaveOccurred())
-		Expect(tables).NotTo(BeEmpty())
+		Expect(tables).To(HaveLen(3))
 		for _, fam := range []TableFamily{TableFamilyIPv4} {
 			for _, tablename := range []string{"filter", "nat"} {
 				Expect(tables.Table(tablename, fam)).NotTo(
 					BeNil(), "missing table %q of %q", tablename, fam)
 			}
 		}
-		Expect(tables.TableChain("nat", TableFamilyIPv4, "POSTROUTING")).NotTo(BeNil())
+		Expect(tables.TableChain("nat", TableFamilyIPv4, "POSTROUTING")).To(
+			HaveField("Rules", HaveExactElements(
+				HaveField("Exprs", ConsistOf(BeAssignableToTypeOf(&expr.Counter{}))),
+				HaveField("Exprs", ConsistOf(BeAssignableToTypeOf(&expr.Verdict{}))),
+			)))
 		Expect(tables.TableChain("nat", TableFamilyIPv4, "XXX")).To(BeNil())
+		ports := tables.Table("filter", TableFamilyIPv4).SetsByName["ports"]
+		Expect(ports).NotTo(BeNil())
+		Expect(ports.Table).To(BeIdenticalTo(tables.Table("filter", TableFamilyIPv4)))
+		Expect(ports.Ranges()).To(Equal([]SetRange{
+			{From: []byte{0, 80}, To: []byte{0, 80}},
+			{From: []byte{0x1f, 0x40}, To: []byte{0x1f, 0xa4}},
+		}))
 		Expect(tables.TableChain("xxx", TableFamilyIPv4, "XXX")).To(BeNil())
 	})
 
 	It("get the tables of a specific family", func() {
 		tables, err := GetFamilyTables(conn, TableFamilyIPv4)
 		Expect(err).NotTo(HaveOccurred())
-		Expect(maps.Keys(tables)).To(
-			HaveEach(HaveField("Family", TableFamilyIPv4)))
-		Expect(tables.Table("nat", TableFamilyIPv6)).To(BeNil())
+		Expect(maps.Keys(tables)).To(ConsistOf(
+			TableKey{Name: "filter", Family: TableFamilyIPv4},
+			TableKey{Name: "nat", Family: TableFamilyIPv4},
+		))
+		Expect(tables.Table("filter", TableFamilyIPv6)).To(BeNil())
+		Expect(tables.Table("filter", TableFamilyIPv4).SetsByName).To(HaveKey("ports"))
 	})
 
 })